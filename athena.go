@@ -0,0 +1,326 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/free/sql_exporter/config"
+)
+
+const (
+	// Bounds of the (exponentially increasing) interval between checks of a running query's state.
+	athenaMinPollInterval = 100 * time.Millisecond
+	athenaMaxPollInterval = 2 * time.Second
+)
+
+func init() {
+	sql.Register("athena", athenaDriver{})
+}
+
+// athenaDriver is a minimal, query only database/sql driver for Amazon Athena, running queries via the Athena API and
+// reporting the bytes scanned by each. See OpenConnection for the DSN format.
+type athenaDriver struct{}
+
+// athenaConfig is a parsed Athena DSN.
+type athenaConfig struct {
+	aws            config.AWSConfig // region, profile and role to assume, default credential chain otherwise
+	workgroup      string           // workgroup to run queries in, `primary` if empty
+	outputLocation string           // S3 location for query results, the workgroup's if empty
+	catalog        string           // data catalog, `AwsDataCatalog` if empty
+	database       string           // database to resolve unqualified table names against, optional
+}
+
+// parseAthenaDSN parses an `athena://[region]?param=value` DSN.
+func parseAthenaDSN(dsn string) (*athenaConfig, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	c := athenaConfig{aws: config.AWSConfig{Region: u.Host}}
+	for name := range u.Query() {
+		switch value := u.Query().Get(name); name {
+		case "workgroup":
+			c.workgroup = value
+		case "output_location":
+			c.outputLocation = value
+		case "catalog":
+			c.catalog = value
+		case "database":
+			c.database = value
+		case "profile":
+			c.aws.Profile = value
+		case "role_arn":
+			c.aws.RoleARN = value
+		default:
+			return nil, fmt.Errorf("unknown parameter %q in Athena data source name", name)
+		}
+	}
+	return &c, nil
+}
+
+// Open implements driver.Driver.
+func (athenaDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := parseAthenaDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newAWSSession(&c.aws)
+	if err != nil {
+		return nil, err
+	}
+	return &athenaConn{config: c, client: athena.New(sess)}, nil
+}
+
+// athenaConn is an Athena "connection": an API client.
+type athenaConn struct {
+	config *athenaConfig
+	client *athena.Athena
+}
+
+// Prepare implements driver.Conn.
+func (c *athenaConn) Prepare(query string) (driver.Stmt, error) {
+	return &athenaStmt{conn: c, query: query}, nil
+}
+
+// Close implements driver.Conn.
+func (c *athenaConn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn.
+func (c *athenaConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("Athena driver does not support transactions")
+}
+
+// Ping implements driver.Pinger. It only checks that the workgroup is accessible, as running a query (even a trivial
+// one) takes a second or more.
+func (c *athenaConn) Ping(ctx context.Context) error {
+	workgroup := c.config.workgroup
+	if workgroup == "" {
+		workgroup = "primary"
+	}
+	_, err := c.client.GetWorkGroupWithContext(ctx, &athena.GetWorkGroupInput{WorkGroup: aws.String(workgroup)})
+	return err
+}
+
+// query runs a query and waits for it to complete, returning an iterator over its results.
+func (c *athenaConn) query(ctx context.Context, query string) (*athenaRows, error) {
+	input := &athena.StartQueryExecutionInput{QueryString: aws.String(query)}
+	if c.config.workgroup != "" {
+		input.WorkGroup = aws.String(c.config.workgroup)
+	}
+	if c.config.outputLocation != "" {
+		input.ResultConfiguration = &athena.ResultConfiguration{OutputLocation: aws.String(c.config.outputLocation)}
+	}
+	if c.config.catalog != "" || c.config.database != "" {
+		input.QueryExecutionContext = &athena.QueryExecutionContext{}
+		if c.config.catalog != "" {
+			input.QueryExecutionContext.Catalog = aws.String(c.config.catalog)
+		}
+		if c.config.database != "" {
+			input.QueryExecutionContext.Database = aws.String(c.config.database)
+		}
+	}
+	out, err := c.client.StartQueryExecutionWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	id := out.QueryExecutionId
+
+	// Wait for the query to complete, cancelling it if we're no longer interested in the results.
+	for interval := athenaMinPollInterval; ; interval *= 2 {
+		if interval > athenaMaxPollInterval {
+			interval = athenaMaxPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			go c.cancel(loggerFromContext(ctx), id)
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		out, err := c.client.GetQueryExecutionWithContext(ctx, &athena.GetQueryExecutionInput{QueryExecutionId: id})
+		if err != nil {
+			if ctx.Err() != nil {
+				go c.cancel(loggerFromContext(ctx), id)
+			}
+			return nil, err
+		}
+		qe := out.QueryExecution
+		switch aws.StringValue(qe.Status.State) {
+		case athena.QueryExecutionStateSucceeded:
+			if qe.Statistics != nil {
+				recordBytesScanned(ctx, aws.Int64Value(qe.Statistics.DataScannedInBytes))
+			}
+			// The first row of SELECT (i.e. DML) query results holds the column names.
+			skipHeader := aws.StringValue(qe.StatementType) == athena.StatementTypeDml
+			return &athenaRows{ctx: ctx, conn: c, id: id, skipHeader: skipHeader}, nil
+		case athena.QueryExecutionStateFailed, athena.QueryExecutionStateCancelled:
+			return nil, fmt.Errorf("Athena query %s %s: %s", aws.StringValue(id),
+				strings.ToLower(aws.StringValue(qe.Status.State)), aws.StringValue(qe.Status.StateChangeReason))
+		}
+	}
+}
+
+// cancel makes a best effort attempt to stop a query, logging any failure to logger.
+func (c *athenaConn) cancel(logger *slog.Logger, id *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), athenaMaxPollInterval*5)
+	defer cancel()
+	_, err := c.client.StopQueryExecutionWithContext(ctx, &athena.StopQueryExecutionInput{QueryExecutionId: id})
+	if err != nil {
+		logger.Warn("Failed to stop Athena query", "query_execution_id", aws.StringValue(id), "err", err)
+	}
+}
+
+// athenaStmt is an Athena query. Query parameters are not supported.
+type athenaStmt struct {
+	conn  *athenaConn
+	query string
+}
+
+// Close implements driver.Stmt.
+func (s *athenaStmt) Close() error {
+	return nil
+}
+
+// NumInput implements driver.Stmt.
+func (s *athenaStmt) NumInput() int {
+	return 0
+}
+
+// Exec implements driver.Stmt.
+func (s *athenaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("Athena driver does not support Exec")
+}
+
+// Query implements driver.Stmt.
+func (s *athenaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(context.Background(), s.query)
+}
+
+// QueryContext implements driver.StmtQueryContext.
+func (s *athenaStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.query(ctx, s.query)
+}
+
+// athenaRows iterates over the results of a completed query, fetching them a page at a time.
+type athenaRows struct {
+	ctx        context.Context
+	conn       *athenaConn
+	id         *string
+	skipHeader bool
+
+	columns   []*athena.ColumnInfo // nil until the first page is fetched
+	rows      []*athena.Row
+	nextToken *string
+	next      int // index of the next row in rows
+}
+
+// fetch fetches the next page of results.
+func (r *athenaRows) fetch() error {
+	out, err := r.conn.client.GetQueryResultsWithContext(r.ctx, &athena.GetQueryResultsInput{
+		QueryExecutionId: r.id,
+		NextToken:        r.nextToken,
+	})
+	if err != nil {
+		return err
+	}
+	if r.columns == nil {
+		r.columns = out.ResultSet.ResultSetMetadata.ColumnInfo
+		if r.columns == nil {
+			r.columns = []*athena.ColumnInfo{}
+		}
+		if r.skipHeader && len(out.ResultSet.Rows) > 0 {
+			out.ResultSet.Rows = out.ResultSet.Rows[1:]
+		}
+	}
+	r.rows, r.nextToken, r.next = out.ResultSet.Rows, out.NextToken, 0
+	return nil
+}
+
+// Columns implements driver.Rows.
+func (r *athenaRows) Columns() []string {
+	if r.columns == nil {
+		if err := r.fetch(); err != nil {
+			// Next will fail too, with the same error.
+			loggerFromContext(r.ctx).Warn(
+				"Failed to fetch Athena query results", "query_execution_id", aws.StringValue(r.id), "err", err)
+			return nil
+		}
+	}
+	columns := make([]string, len(r.columns))
+	for i, c := range r.columns {
+		columns[i] = aws.StringValue(c.Name)
+	}
+	return columns
+}
+
+// Close implements driver.Rows.
+func (r *athenaRows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows.
+func (r *athenaRows) Next(dest []driver.Value) error {
+	if r.columns == nil {
+		if err := r.fetch(); err != nil {
+			return err
+		}
+	}
+	for r.next >= len(r.rows) {
+		if r.nextToken == nil {
+			return io.EOF
+		}
+		if err := r.fetch(); err != nil {
+			return err
+		}
+	}
+
+	row := r.rows[r.next]
+	r.next++
+	for i, c := range r.columns {
+		if i >= len(dest) || i >= len(row.Data) {
+			break
+		}
+		v, err := athenaValue(aws.StringValue(c.Type), row.Data[i].VarCharValue)
+		if err != nil {
+			return fmt.Errorf("error converting value of column %q: %s", aws.StringValue(c.Name), err)
+		}
+		dest[i] = v
+	}
+	return nil
+}
+
+// athenaValue converts a value as returned by the Athena API (a string, for all types) to a driver.Value. DECIMAL
+// values are kept as (exact) strings, to be parsed by the caller as needed. DATE and TIMESTAMP values are converted to
+// time.Time, in UTC. Other types (including TIMESTAMP WITH TIME ZONE and complex types) are returned as strings.
+func athenaValue(typ string, v *string) (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s := *v
+	switch typ {
+	case "tinyint", "smallint", "integer", "bigint":
+		return strconv.ParseInt(s, 10, 64)
+	case "float", "real", "double":
+		return strconv.ParseFloat(s, 64)
+	case "boolean":
+		return strconv.ParseBool(s)
+	case "date":
+		return time.Parse("2006-01-02", s)
+	case "timestamp":
+		return time.Parse("2006-01-02 15:04:05.999999999", s)
+	default:
+		return s, nil
+	}
+}
@@ -0,0 +1,135 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/go-sql-driver/mysql"
+)
+
+// passwordFunc returns the password to log in with, for targets using short lived credentials such as IAM
+// authentication tokens.
+type passwordFunc func(ctx context.Context) (string, error)
+
+// setAuth sets up the spec's password or access token source, as defined by the provided authentication config.
+func (s *targetSpec) setAuth(c *config.AuthConfig) error {
+	switch c.Type {
+	case "aws_iam":
+		sess, err := newAWSSession(&c.AWSConfig)
+		if err != nil {
+			return err
+		}
+		if s.password, err = newRDSAuthTokenFunc(sess, s.dsn); err != nil {
+			return err
+		}
+	case "azure_ad":
+		if !strings.HasPrefix(s.dsn, "sqlserver://") && !strings.HasPrefix(s.dsn, "mssql://") {
+			return fmt.Errorf("azure_ad authentication is only supported by the sqlserver driver")
+		}
+		tokens := newAzureTokenSource(&c.AzureConfig, azureSQLResource)
+		s.accessToken = func(context.Context) (string, error) {
+			token, err := tokens.Token()
+			if err != nil {
+				return "", fmt.Errorf("error fetching Azure AD access token: %s", err)
+			}
+			return token.AccessToken, nil
+		}
+	default:
+		return fmt.Errorf("unsupported auth type %q", c.Type)
+	}
+	s.authKey = c.Type
+	return nil
+}
+
+// cachedPassword wraps a password generating function, reusing generated passwords for the provided duration.
+func cachedPassword(ttl time.Duration, generate func(ctx context.Context) (string, error)) passwordFunc {
+	var (
+		mu       sync.Mutex
+		password string
+		expiry   time.Time
+	)
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Now().Before(expiry) {
+			return password, nil
+		}
+		p, err := generate(ctx)
+		if err != nil {
+			return "", err
+		}
+		password, expiry = p, time.Now().Add(ttl)
+		return password, nil
+	}
+}
+
+// dsnAddressAndUser extracts the `host:port` address of the database server and the user name from a DSN, using the
+// driver's default port if none is specified.
+func dsnAddressAndUser(dsn string) (address, user string, err error) {
+	idx := strings.Index(dsn, "://")
+	if idx == -1 {
+		return "", "", fmt.Errorf("missing driver in data source name")
+	}
+	driver := dsn[:idx]
+
+	if driver == "mysql" {
+		cfg, err := mysql.ParseDSN(dsn[idx+3:])
+		if err != nil {
+			return "", "", err
+		}
+		return cfg.Addr, cfg.User, nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	address = u.Host
+	if u.Port() == "" {
+		switch driver {
+		case "postgres", "postgresql":
+			address = net.JoinHostPort(u.Hostname(), "5432")
+		case "sqlserver", "mssql":
+			address = net.JoinHostPort(u.Hostname(), "1433")
+		}
+	}
+	return address, u.User.Username(), nil
+}
+
+// withIntegratedAuth returns dsn with the driver parameters enabling the configured integrated authentication method.
+// Only applies to SQL Server data source names, others are returned unchanged.
+func withIntegratedAuth(dsn string, c *config.IntegratedAuthConfig) (string, error) {
+	if !strings.HasPrefix(dsn, "sqlserver://") && !strings.HasPrefix(dsn, "mssql://") {
+		return dsn, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	params := u.Query()
+	switch c.Method {
+	case "kerberos":
+		params.Set("authenticator", "krb5")
+		params.Set("krb5-configfile", c.Krb5Config)
+		if c.Keytab != "" {
+			params.Set("krb5-keytabfile", c.Keytab)
+			params.Set("krb5-realm", c.Realm)
+		} else {
+			params.Set("krb5-credcachefile", c.CredentialCache)
+		}
+	case "sspi":
+		params.Set("authenticator", "winsspi")
+	}
+	if c.ServerSPN != "" {
+		params.Set("ServerSPN", c.ServerSPN)
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,84 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/free/sql_exporter/config"
+)
+
+// newAWSSession returns an AWS session with the configured region and credentials, falling back to the default AWS SDK
+// credential chain for anything not explicitly configured.
+func newAWSSession(c *config.AWSConfig) (*session.Session, error) {
+	opts := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Profile:           c.Profile,
+	}
+	if c.Region != "" {
+		opts.Config.Region = aws.String(c.Region)
+	}
+	if c.AccessKey != "" {
+		opts.Config.Credentials = credentials.NewStaticCredentials(c.AccessKey, string(c.SecretKey), "")
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.RoleARN != "" {
+		sess = sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, c.RoleARN)})
+	}
+	return sess, nil
+}
+
+// rdsAuthTokenTTL is how long to reuse RDS authentication tokens for. Tokens are valid for 15 minutes, but only need
+// to be valid when a connection is established.
+const rdsAuthTokenTTL = 10 * time.Minute
+
+// newRDSAuthTokenFunc returns a passwordFunc generating RDS IAM authentication tokens for the server and user in dsn.
+func newRDSAuthTokenFunc(sess *session.Session, dsn string) (passwordFunc, error) {
+	address, user, err := dsnAddressAndUser(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		return nil, fmt.Errorf("missing user name in data source name, required for IAM authentication")
+	}
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		return nil, fmt.Errorf("no AWS region configured, required for IAM authentication")
+	}
+	return cachedPassword(rdsAuthTokenTTL, func(context.Context) (string, error) {
+		token, err := rdsutils.BuildAuthToken(address, region, user, sess.Config.Credentials)
+		if err != nil {
+			return "", fmt.Errorf("error generating RDS authentication token: %s", err)
+		}
+		return token, nil
+	}), nil
+}
+
+// awsInstanceMetadata returns the identity of the EC2 instance the exporter runs on, as label reference fields.
+func awsInstanceMetadata(ctx context.Context) (map[string]string, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := ec2metadata.New(sess).GetInstanceIdentityDocumentWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"instance_id":   doc.InstanceID,
+		"instance_type": doc.InstanceType,
+		"account_id":    doc.AccountID,
+		"region":        doc.Region,
+		"zone":          doc.AvailabilityZone,
+	}, nil
+}
@@ -0,0 +1,141 @@
+package sql_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	azureManagementResource = "https://management.azure.com/"
+	azureSQLResource        = "https://database.windows.net/"
+	// Azure Instance Metadata Service endpoint for managed identity tokens, on Azure VMs and AKS.
+	azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// newAzureTokenSource returns a token source for the given resource (e.g. `https://management.azure.com/`), using the
+// configured authentication method.
+func newAzureTokenSource(c *config.AzureConfig, resource string) oauth2.TokenSource {
+	if c.AuthenticationMethod == "ManagedIdentity" {
+		return oauth2.ReuseTokenSource(nil, &azureManagedIdentityTokenSource{resource: resource, clientID: c.ClientID})
+	}
+	cc := clientcredentials.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: string(c.ClientSecret),
+		TokenURL:     fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", url.PathEscape(c.TenantID)),
+		Scopes:       []string{strings.TrimSuffix(resource, "/") + "/.default"},
+	}
+	return cc.TokenSource(context.Background())
+}
+
+// azureManagedIdentityTokenSource is an oauth2.TokenSource fetching managed identity tokens, either from the App
+// Service/Functions identity endpoint (if present in the environment) or from the Instance Metadata Service.
+type azureManagedIdentityTokenSource struct {
+	resource string
+	clientID string
+}
+
+// Token implements oauth2.TokenSource.
+func (s *azureManagedIdentityTokenSource) Token() (*oauth2.Token, error) {
+	params := url.Values{"resource": {s.resource}}
+	if s.clientID != "" {
+		params.Set("client_id", s.clientID)
+	}
+
+	var req *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		params.Set("api-version", "2019-08-01")
+		if req, err = http.NewRequest(http.MethodGet, endpoint+"?"+params.Encode(), nil); err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		params.Set("api-version", "2018-02-01")
+		if req, err = http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+params.Encode(), nil); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching managed identity token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching managed identity token: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresOn   string `json:"expires_on"` // seconds since the epoch, as a string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("error decoding managed identity token: %s", err)
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid managed identity token expiry %q", token.ExpiresOn)
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Unix(expiresOn, 0),
+	}, nil
+}
+
+// azureIMDSInstanceURL is the Instance Metadata Service endpoint for the compute metadata of the VM.
+const azureIMDSInstanceURL = "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01"
+
+// azureInstanceMetadata returns the compute metadata of the Azure VM the exporter runs on, as label reference fields.
+func azureInstanceMetadata(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodGet, azureIMDSInstanceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var compute struct {
+		VMID           string `json:"vmId"`
+		Name           string `json:"name"`
+		VMSize         string `json:"vmSize"`
+		SubscriptionID string `json:"subscriptionId"`
+		ResourceGroup  string `json:"resourceGroupName"`
+		Location       string `json:"location"`
+		Zone           string `json:"zone"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&compute); err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"vm_id":           compute.VMID,
+		"vm_name":         compute.Name,
+		"vm_size":         compute.VMSize,
+		"subscription_id": compute.SubscriptionID,
+		"resource_group":  compute.ResourceGroup,
+		"location":        compute.Location,
+		"region":          compute.Location,
+		"zone":            compute.Zone,
+	}, nil
+}
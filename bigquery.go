@@ -0,0 +1,342 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	bigQueryAPI   = "https://bigquery.googleapis.com/bigquery/v2"
+	bigQueryScope = "https://www.googleapis.com/auth/bigquery"
+	// How long a single API call waits for a query to complete, before returning and being reissued.
+	bigQueryPollTimeout = 10 * time.Second
+)
+
+func init() {
+	sql.Register("bigquery", bigQueryDriver{})
+}
+
+// bigQueryDriver is a minimal, query only database/sql driver for BigQuery, running standard SQL queries via the
+// BigQuery REST API (`jobs.query` and `jobs.getQueryResults`). See OpenConnection for the DSN format.
+type bigQueryDriver struct{}
+
+// bigQueryConfig is a parsed BigQuery DSN.
+type bigQueryConfig struct {
+	project         string // project to run (and bill) queries in
+	location        string // location to run queries in, optional
+	dataset         string // dataset to resolve unqualified table names against, optional
+	credentialsFile string // service account key file, Application Default Credentials if empty
+	maxBytesBilled  int64  // queries billing more than this fail without being charged, no limit if zero
+}
+
+// parseBigQueryDSN parses a `bigquery://` DSN. The project is not parsed as a URL host, as domain scoped project IDs
+// (`example.com:project`) would be mistaken for a host and port.
+func parseBigQueryDSN(dsn string) (*bigQueryConfig, error) {
+	rest := strings.TrimPrefix(dsn, "bigquery://")
+	var query string
+	if idx := strings.Index(rest, "?"); idx != -1 {
+		rest, query = rest[:idx], rest[idx+1:]
+	}
+	var c bigQueryConfig
+	c.project, c.location = rest, ""
+	if idx := strings.Index(rest, "/"); idx != -1 {
+		c.project, c.location = rest[:idx], rest[idx+1:]
+	}
+	if c.project == "" {
+		return nil, fmt.Errorf("missing project in BigQuery data source name, expecting bigquery://project[/location]")
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for name := range params {
+		switch value := params.Get(name); name {
+		case "dataset":
+			c.dataset = value
+		case "credentials_file":
+			c.credentialsFile = value
+		case "max_bytes_billed":
+			if c.maxBytesBilled, err = strconv.ParseInt(value, 10, 64); err != nil || c.maxBytesBilled < 0 {
+				return nil, fmt.Errorf("invalid max_bytes_billed %q in BigQuery data source name", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown parameter %q in BigQuery data source name", name)
+		}
+	}
+	return &c, nil
+}
+
+// Open implements driver.Driver.
+func (bigQueryDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := parseBigQueryDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newGCPTokenSource(context.Background(), c.credentialsFile, bigQueryScope)
+	if err != nil {
+		return nil, err
+	}
+	tokens = oauth2.ReuseTokenSource(nil, tokens)
+	return &bigQueryConn{
+		config: c,
+		tokens: tokens,
+		client: oauth2.NewClient(context.Background(), tokens),
+	}, nil
+}
+
+// bigQueryConn is a BigQuery "connection": an authenticated API client.
+type bigQueryConn struct {
+	config *bigQueryConfig
+	tokens oauth2.TokenSource
+	client *http.Client
+}
+
+// Prepare implements driver.Conn.
+func (c *bigQueryConn) Prepare(query string) (driver.Stmt, error) {
+	return &bigQueryStmt{conn: c, query: query}, nil
+}
+
+// Close implements driver.Conn.
+func (c *bigQueryConn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn.
+func (c *bigQueryConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("BigQuery driver does not support transactions")
+}
+
+// Ping implements driver.Pinger. It only checks that an access token can be obtained, as running a query (even a
+// trivial one) takes a second or more.
+func (c *bigQueryConn) Ping(ctx context.Context) error {
+	_, err := c.tokens.Token()
+	return err
+}
+
+// bigQueryJobReference identifies a BigQuery (query) job.
+type bigQueryJobReference struct {
+	ProjectID string `json:"projectId"`
+	JobID     string `json:"jobId"`
+	Location  string `json:"location"`
+}
+
+// bigQueryField describes a result column.
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// bigQueryResponse is the response of both `jobs.query` and `jobs.getQueryResults`.
+type bigQueryResponse struct {
+	JobComplete  bool                 `json:"jobComplete"`
+	JobReference bigQueryJobReference `json:"jobReference"`
+	Schema       struct {
+		Fields []bigQueryField `json:"fields"`
+	} `json:"schema"`
+	Rows []struct {
+		F []struct {
+			V interface{} `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+	PageToken string `json:"pageToken"`
+}
+
+// query runs a query, returning its first page of results.
+func (c *bigQueryConn) query(ctx context.Context, query string) (*bigQueryRows, error) {
+	request := map[string]interface{}{
+		"query":         query,
+		"useLegacySql":  false,
+		"timeoutMs":     bigQueryPollTimeout.Milliseconds(),
+		"formatOptions": map[string]interface{}{"useInt64Timestamp": true},
+	}
+	if c.config.location != "" {
+		request["location"] = c.config.location
+	}
+	if c.config.dataset != "" {
+		request["defaultDataset"] = map[string]string{"projectId": c.config.project, "datasetId": c.config.dataset}
+	}
+	if c.config.maxBytesBilled > 0 {
+		request["maximumBytesBilled"] = strconv.FormatInt(c.config.maxBytesBilled, 10)
+	}
+	var resp bigQueryResponse
+	apiURL := fmt.Sprintf("%s/projects/%s/queries", bigQueryAPI, url.PathEscape(c.config.project))
+	if err := callJSONAPI(ctx, c.client, http.MethodPost, apiURL, request, &resp); err != nil {
+		return nil, err
+	}
+	job := resp.JobReference
+
+	// Wait for the query to complete, cancelling it if we're no longer interested in the results.
+	for !resp.JobComplete {
+		if err := c.getQueryResults(ctx, job, "", &resp); err != nil {
+			if ctx.Err() != nil {
+				go c.cancel(loggerFromContext(ctx), job)
+			}
+			return nil, err
+		}
+	}
+	return &bigQueryRows{ctx: ctx, conn: c, job: job, response: resp}, nil
+}
+
+// getQueryResults fetches the page of results of a completed job identified by pageToken, the first one if empty.
+// If the job is not complete, it waits for it up to bigQueryPollTimeout and returns no results.
+func (c *bigQueryConn) getQueryResults(
+	ctx context.Context, job bigQueryJobReference, pageToken string, resp *bigQueryResponse) error {
+	params := url.Values{
+		"timeoutMs":                       {strconv.FormatInt(bigQueryPollTimeout.Milliseconds(), 10)},
+		"formatOptions.useInt64Timestamp": {"true"},
+	}
+	if job.Location != "" {
+		params.Set("location", job.Location)
+	}
+	if pageToken != "" {
+		params.Set("pageToken", pageToken)
+	}
+	apiURL := fmt.Sprintf("%s/projects/%s/queries/%s?%s",
+		bigQueryAPI, url.PathEscape(job.ProjectID), url.PathEscape(job.JobID), params.Encode())
+	*resp = bigQueryResponse{}
+	return callJSONAPI(ctx, c.client, http.MethodGet, apiURL, nil, resp)
+}
+
+// cancel makes a best effort attempt to cancel a job, logging any failure to logger.
+func (c *bigQueryConn) cancel(logger *slog.Logger, job bigQueryJobReference) {
+	ctx, cancel := context.WithTimeout(context.Background(), bigQueryPollTimeout)
+	defer cancel()
+	apiURL := fmt.Sprintf("%s/projects/%s/jobs/%s/cancel?location=%s",
+		bigQueryAPI, url.PathEscape(job.ProjectID), url.PathEscape(job.JobID), url.QueryEscape(job.Location))
+	var resp interface{}
+	if err := callJSONAPI(ctx, c.client, http.MethodPost, apiURL, nil, &resp); err != nil {
+		logger.Warn("Failed to cancel BigQuery job", "job_id", job.JobID, "err", err)
+	}
+}
+
+// bigQueryStmt is a BigQuery query. Query parameters are not supported.
+type bigQueryStmt struct {
+	conn  *bigQueryConn
+	query string
+}
+
+// Close implements driver.Stmt.
+func (s *bigQueryStmt) Close() error {
+	return nil
+}
+
+// NumInput implements driver.Stmt.
+func (s *bigQueryStmt) NumInput() int {
+	return 0
+}
+
+// Exec implements driver.Stmt.
+func (s *bigQueryStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("BigQuery driver does not support Exec")
+}
+
+// Query implements driver.Stmt.
+func (s *bigQueryStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(context.Background(), s.query)
+}
+
+// QueryContext implements driver.StmtQueryContext.
+func (s *bigQueryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.query(ctx, s.query)
+}
+
+// bigQueryRows iterates over the results of a completed query, fetching further pages as needed.
+type bigQueryRows struct {
+	ctx      context.Context
+	conn     *bigQueryConn
+	job      bigQueryJobReference
+	response bigQueryResponse
+	next     int // index of the next row in response
+}
+
+// Columns implements driver.Rows.
+func (r *bigQueryRows) Columns() []string {
+	columns := make([]string, len(r.response.Schema.Fields))
+	for i, f := range r.response.Schema.Fields {
+		columns[i] = f.Name
+	}
+	return columns
+}
+
+// Close implements driver.Rows.
+func (r *bigQueryRows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows.
+func (r *bigQueryRows) Next(dest []driver.Value) error {
+	for r.next >= len(r.response.Rows) {
+		if r.response.PageToken == "" {
+			return io.EOF
+		}
+		// Keep the schema, it's only returned with the first page.
+		schema := r.response.Schema
+		if err := r.conn.getQueryResults(r.ctx, r.job, r.response.PageToken, &r.response); err != nil {
+			return err
+		}
+		r.response.Schema, r.next = schema, 0
+	}
+
+	row := r.response.Rows[r.next]
+	r.next++
+	for i, f := range r.response.Schema.Fields {
+		if i >= len(dest) || i >= len(row.F) {
+			break
+		}
+		v, err := bigQueryValue(f, row.F[i].V)
+		if err != nil {
+			return fmt.Errorf("error converting value of column %q: %s", f.Name, err)
+		}
+		dest[i] = v
+	}
+	return nil
+}
+
+// bigQueryValue converts a value as returned by the REST API (a string, for all scalar types) to a driver.Value.
+// NUMERIC and BIGNUMERIC values are kept as (exact) strings, to be parsed by the caller as needed. TIMESTAMP, DATE and
+// DATETIME values are converted to time.Time, in UTC. Records and arrays are returned as JSON.
+func bigQueryValue(f bigQueryField, v interface{}) (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok || f.Mode == "REPEATED" {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	}
+	switch f.Type {
+	case "INTEGER", "INT64":
+		return strconv.ParseInt(s, 10, 64)
+	case "FLOAT", "FLOAT64":
+		return strconv.ParseFloat(s, 64)
+	case "BOOLEAN", "BOOL":
+		return strconv.ParseBool(s)
+	case "TIMESTAMP":
+		// Microseconds since the epoch, as requested via formatOptions.useInt64Timestamp.
+		us, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return time.UnixMicro(us).UTC(), nil
+	case "DATE":
+		return time.Parse("2006-01-02", s)
+	case "DATETIME":
+		return time.Parse("2006-01-02T15:04:05.999999999", s)
+	default:
+		return s, nil
+	}
+}
@@ -0,0 +1,90 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// circuitBreaker tracks consecutive failed collections of a target. After threshold consecutive failures it opens for
+// cooldown, during which no connection attempts should be made. Once the cooldown expires it is half-open: a single
+// trial collection is let through and its outcome either closes the circuit or opens it for another cooldown. All
+// methods are safe to call on a nil circuitBreaker, which never opens.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+	// Whether the trial collection of the half-open circuit is in progress.
+	trial bool
+}
+
+// newCircuitBreaker returns a closed circuitBreaker with the given failure threshold and cooldown.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns nil if a collection should be attempted, i.e. if the circuit is closed or if it is half-open and no
+// trial collection is in progress, in which case the caller's collection becomes the trial. Callers allowed through
+// must record the outcome of their collection. Otherwise allow returns an error describing the state of the circuit.
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if err := cb.check(); err != nil {
+		return err
+	}
+	if cb.failures >= cb.threshold {
+		cb.trial = true
+	}
+	return nil
+}
+
+// open returns an error describing the state of the circuit if no collection should be attempted, without letting
+// the caller through as the trial collection of a half-open circuit.
+func (cb *circuitBreaker) open() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.check()
+}
+
+// check implements open. Must be called with cb.mu held.
+func (cb *circuitBreaker) check() error {
+	switch {
+	case cb.failures < cb.threshold:
+		return nil
+	case time.Now().Before(cb.until):
+		return fmt.Errorf("circuit breaker open, not connecting until %s", cb.until.Format(time.RFC3339))
+	case cb.trial:
+		return fmt.Errorf("circuit breaker half-open, waiting for a trial collection to complete")
+	}
+	return nil
+}
+
+// record records the outcome of a collection let through by allow.
+func (cb *circuitBreaker) record(success bool) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trial = false
+	if success {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.until = time.Now().Add(cb.cooldown)
+	}
+}
@@ -0,0 +1,51 @@
+package sql_exporter
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCircuitBreakerHalfOpen checks that a half-open circuit lets a single trial collection through, closing the
+// circuit if it succeeds and opening it for another cooldown otherwise.
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	cb := newCircuitBreaker(2, cooldown)
+
+	for i := 0; i < 2; i++ {
+		if err := cb.allow(); err != nil {
+			t.Fatalf("closed circuit refused collection: %s", err)
+		}
+		cb.record(false)
+	}
+	if cb.allow() == nil {
+		t.Fatal("open circuit allowed collection")
+	}
+
+	// Once half-open, a single trial is let through, whose failure opens the circuit again.
+	time.Sleep(cooldown)
+	if cb.open() != nil {
+		t.Fatal("half-open circuit reported as open")
+	}
+	if err := cb.allow(); err != nil {
+		t.Fatalf("half-open circuit refused trial collection: %s", err)
+	}
+	if cb.allow() == nil || cb.open() == nil {
+		t.Fatal("half-open circuit allowed collection during trial")
+	}
+	cb.record(false)
+	if cb.allow() == nil {
+		t.Fatal("circuit allowed collection after failed trial")
+	}
+
+	// A successful trial closes the circuit.
+	time.Sleep(cooldown)
+	if err := cb.allow(); err != nil {
+		t.Fatalf("half-open circuit refused trial collection: %s", err)
+	}
+	cb.record(true)
+	for i := 0; i < 2; i++ {
+		if err := cb.allow(); err != nil {
+			t.Fatalf("closed circuit refused collection: %s", err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	cloudSQLAdminAPI   = "https://sqladmin.googleapis.com/sql/v1beta4"
+	cloudSQLAdminScope = "https://www.googleapis.com/auth/sqlservice.admin"
+	cloudSQLLoginScope = "https://www.googleapis.com/auth/sqlservice.login"
+	// The port of the Cloud SQL server side proxy, accepting TLS connections authenticated with ephemeral certificates.
+	cloudSQLServerProxyPort = "3307"
+	// How long before expiry to refresh ephemeral certificates.
+	cloudSQLRefreshBuffer = 4 * time.Minute
+)
+
+// cloudSQLDialer dials Cloud SQL instances through their server side proxy, the way the Cloud SQL Auth Proxy and Go
+// connector do: using TLS, authenticated with an ephemeral client certificate obtained from the Cloud SQL Admin API.
+// With IAM database authentication, the certificate also carries an OAuth2 token for the database login.
+type cloudSQLDialer struct {
+	client   *http.Client
+	login    oauth2.TokenSource // for IAM database authentication, nil if not enabled
+	private  bool               // whether to connect to private instead of public IP addresses
+	key      *rsa.PrivateKey
+	keyPEM   string
+	mu       sync.Mutex
+	sessions map[string]*cloudSQLSession
+}
+
+// cloudSQLSession is the TLS configuration and address for connecting to a Cloud SQL instance, valid until expiry.
+type cloudSQLSession struct {
+	tlsConfig *tls.Config
+	address   string
+	expiry    time.Time
+}
+
+// newCloudSQLDialer returns a dialer authenticating to the Admin API with the provided token source. If login is not
+// nil, its tokens are used for IAM database authentication.
+func newCloudSQLDialer(admin, login oauth2.TokenSource, private bool) (*cloudSQLDialer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudSQLDialer{
+		client:   oauth2.NewClient(context.Background(), admin),
+		login:    login,
+		private:  private,
+		key:      key,
+		keyPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		sessions: make(map[string]*cloudSQLSession),
+	}, nil
+}
+
+// dialFunc returns a dialFunc connecting to the instance with the given connection name (`project:region:instance`),
+// regardless of the address the driver is trying to connect to.
+func (d *cloudSQLDialer) dialFunc(connectionName string) dialFunc {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		s, err := d.session(ctx, connectionName)
+		if err != nil {
+			return nil, err
+		}
+		var nd net.Dialer
+		conn, err := nd.DialContext(ctx, "tcp", net.JoinHostPort(s.address, cloudSQLServerProxyPort))
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, s.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// session returns a valid session for the given instance, refreshing it if close to expiry.
+func (d *cloudSQLDialer) session(ctx context.Context, connectionName string) (*cloudSQLSession, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, found := d.sessions[connectionName]; found && time.Until(s.expiry) > cloudSQLRefreshBuffer {
+		return s, nil
+	}
+
+	// Domain scoped projects (`example.com:project`) have a colon in the project name too, so split from the end.
+	project, instance := connectionName, ""
+	if idx := strings.LastIndex(project, ":"); idx != -1 {
+		project, instance = project[:idx], project[idx+1:]
+	}
+	if idx := strings.LastIndex(project, ":"); idx != -1 {
+		project = project[:idx]
+	} else {
+		instance = ""
+	}
+	if project == "" || instance == "" {
+		return nil, fmt.Errorf("invalid Cloud SQL instance connection name %q, expecting project:region:instance",
+			connectionName)
+	}
+
+	var settings struct {
+		ServerCACert struct {
+			Cert string `json:"cert"`
+		} `json:"serverCaCert"`
+		IPAddresses []struct {
+			Type      string `json:"type"`
+			IPAddress string `json:"ipAddress"`
+		} `json:"ipAddresses"`
+	}
+	url := fmt.Sprintf("%s/projects/%s/instances/%s/connectSettings", cloudSQLAdminAPI, project, instance)
+	if err := callJSONAPI(ctx, d.client, http.MethodGet, url, nil, &settings); err != nil {
+		return nil, err
+	}
+
+	request := map[string]string{"public_key": d.keyPEM}
+	var tokenExpiry time.Time
+	if d.login != nil {
+		token, err := d.login.Token()
+		if err != nil {
+			return nil, err
+		}
+		request["access_token"] = token.AccessToken
+		tokenExpiry = token.Expiry
+	}
+	var ephemeral struct {
+		EphemeralCert struct {
+			Cert string `json:"cert"`
+		} `json:"ephemeralCert"`
+	}
+	url = fmt.Sprintf("%s/projects/%s/instances/%s:generateEphemeralCert", cloudSQLAdminAPI, project, instance)
+	if err := callJSONAPI(ctx, d.client, http.MethodPost, url, request, &ephemeral); err != nil {
+		return nil, err
+	}
+
+	s, err := d.newSession(project+":"+instance, settings.ServerCACert.Cert, ephemeral.EphemeralCert.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up TLS for Cloud SQL instance %q: %s", connectionName, err)
+	}
+	if !tokenExpiry.IsZero() && tokenExpiry.Before(s.expiry) {
+		s.expiry = tokenExpiry
+	}
+	wantType := "PRIMARY"
+	if d.private {
+		wantType = "PRIVATE"
+	}
+	for _, ip := range settings.IPAddresses {
+		if ip.Type == wantType {
+			s.address = ip.IPAddress
+		}
+	}
+	if s.address == "" {
+		return nil, fmt.Errorf("Cloud SQL instance %q has no %s IP address", connectionName, strings.ToLower(wantType))
+	}
+
+	d.sessions[connectionName] = s
+	return s, nil
+}
+
+// newSession builds the TLS configuration for connecting to an instance with the provided server CA and client
+// certificates. Cloud SQL server certificates are issued for `project:instance` rather than a host name, so they are
+// verified explicitly.
+func (d *cloudSQLDialer) newSession(serverName, caPEM, certPEM string) (*cloudSQLSession, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid ephemeral certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, fmt.Errorf("invalid server CA certificate")
+	}
+
+	return &cloudSQLSession{
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: d.key, Leaf: cert}},
+			RootCAs:      roots,
+			MinVersion:   tls.VersionTLS12,
+			// Verified in VerifyPeerCertificate instead.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return fmt.Errorf("no server certificate")
+				}
+				server, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				opts := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+				if _, err = server.Verify(opts); err != nil {
+					return err
+				}
+				if server.Subject.CommonName != serverName {
+					return fmt.Errorf("server certificate issued for %q, expecting %q", server.Subject.CommonName, serverName)
+				}
+				return nil
+			},
+		},
+		expiry: cert.NotAfter,
+	}, nil
+}
+
+// callJSONAPI makes a JSON API call, decoding the JSON response into response.
+func callJSONAPI(ctx context.Context, client *http.Client, method, url string, request, response interface{}) error {
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// Google and Azure APIs return error details as `{"error": {"message": ...}}`.
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter"
+	"gopkg.in/yaml.v2"
+)
+
+// adminAPIPrefix is the path prefix of the admin API's target endpoints, followed by `{job}/targets[/{target}]`.
+const adminAPIPrefix = "/api/v1/jobs/"
+
+// adminAPI serves the admin API, adding and removing targets at runtime. All requests must be authenticated with a
+// bearer token. If stateFile is set, the targets added are persisted to it after every change.
+type adminAPI struct {
+	logger    *slog.Logger
+	exporter  sql_exporter.Exporter
+	token     string
+	stateFile string
+
+	// Serializes changes, so the state file is always written with the latest targets.
+	mu sync.Mutex
+}
+
+// newAdminAPI returns the admin API of exporter, reading the bearer token to authenticate requests with from tokenFile
+// and adding the targets persisted to stateFile, if it exists.
+func newAdminAPI(logger *slog.Logger, exporter sql_exporter.Exporter, tokenFile, stateFile string) (*adminAPI, error) {
+	if tokenFile == "" {
+		return nil, errors.New("the admin API requires --web.admin-api.token-file")
+	}
+	buf, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return nil, fmt.Errorf("empty admin API token file %s", tokenFile)
+	}
+
+	a := &adminAPI{logger: logger, exporter: exporter, token: token, stateFile: stateFile}
+	if stateFile == "" {
+		return a, nil
+	}
+	buf, err = ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var targets []sql_exporter.DynamicTarget
+	if err := yaml.Unmarshal(buf, &targets); err != nil {
+		return nil, fmt.Errorf("error parsing admin API state file %s: %s", stateFile, err)
+	}
+	for _, dt := range targets {
+		if err := exporter.AddTarget(dt); err != nil {
+			logger.Warn("Error adding target from state file", "job", dt.Job, "target", dt.Name, "file", stateFile,
+				"err", err)
+		}
+	}
+	logger.Info("Added targets from state file", "count", len(targets), "file", stateFile)
+	return a, nil
+}
+
+// ServeHTTP implements http.Handler, serving `{job}/targets` (GET to list the targets added to the job, POST to add
+// one) and `{job}/targets/{target}` (DELETE to remove it) under adminAPIPrefix.
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminAPIPrefix), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] != "targets" {
+		apiError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %s", r.URL.Path))
+		return
+	}
+	job := parts[0]
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		targets := []sql_exporter.DynamicTarget{}
+		for _, dt := range a.exporter.DynamicTargets() {
+			if dt.Job == job {
+				targets = append(targets, dt)
+			}
+		}
+		apiSuccess(w, targets)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		var dt sql_exporter.DynamicTarget
+		if err := json.NewDecoder(r.Body).Decode(&dt); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("error parsing request body: %s", err))
+			return
+		}
+		dt.Job = job
+		a.update(w, func() error { return a.exporter.AddTarget(dt) })
+	case len(parts) == 3 && parts[2] != "" && r.Method == http.MethodDelete:
+		a.update(w, func() error { return a.exporter.RemoveTarget(job, parts[2]) })
+	default:
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %s", r.Method, r.URL.Path))
+	}
+}
+
+// update applies a change to the exporter's targets, persists the targets to the state file and writes the response.
+func (a *adminAPI) update(w http.ResponseWriter, change func() error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := change(); err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, sql_exporter.ErrUnknownJob), errors.Is(err, sql_exporter.ErrUnknownTarget):
+			status = http.StatusNotFound
+		case errors.Is(err, sql_exporter.ErrTargetExists):
+			status = http.StatusConflict
+		}
+		apiError(w, status, err)
+		return
+	}
+	if err := a.persist(); err != nil {
+		a.logger.Error("Error persisting admin API state", "err", err)
+		apiError(w, http.StatusInternalServerError, fmt.Errorf("change applied, but not persisted: %s", err))
+		return
+	}
+	apiSuccess(w, nil)
+}
+
+// persist writes all targets added at runtime to the state file, if any. As data source names may include
+// credentials, the file is only readable by its owner.
+func (a *adminAPI) persist() error {
+	if a.stateFile == "" {
+		return nil
+	}
+	buf, err := yaml.Marshal(a.exporter.DynamicTargets())
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.stateFile), filepath.Base(a.stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.stateFile)
+}
+
+// apiSuccess writes a Prometheus API style `{"status": "success", "data": data}` JSON response.
+func apiSuccess(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Status string      `json:"status"`
+		Data   interface{} `json:"data,omitempty"`
+	}{"success", data})
+}
+
+// apiError writes a Prometheus API style `{"status": "error", "error": "..."}` JSON response with the given status.
+func apiError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}{"error", err.Error()})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+)
+
+// checkConfig implements the `check-config` command: it loads the configuration file and all collector files, resolves
+// collector references and validates all collectors and their metrics, without connecting to any database. Errors are
+// printed to stderr, prefixed by file name and line, where known.
+func checkConfig(configFile string, args []string) int {
+	flags := newCommandFlagSet("check-config", &configFile)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments to check-config: %q\n", flags.Args())
+		return 2
+	}
+
+	c, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := false
+	for _, cc := range c.Collectors {
+		if _, err := sql_exporter.NewCollector(nil, "check", cc, nil, "", ""); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: collector %q: %s\n", configFile, cc.Name, err)
+			failed = true
+		}
+	}
+	for _, j := range c.Jobs {
+		for _, err := range checkMetricNames(j) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	fmt.Printf("%s: OK, %d job(s), %d collector(s)\n", configFile, len(c.Jobs), len(c.Collectors))
+	return 0
+}
+
+// checkMetricNames returns an error for every metric name defined by more than one of the collectors applied to the
+// job's targets with a different type or help, as these could not be exposed together.
+func checkMetricNames(j *config.JobConfig) []error {
+	collectorSets := [][]*config.CollectorConfig{j.Collectors()}
+	for _, sc := range j.StaticConfigs {
+		for tname := range sc.Targets {
+			if ccs := sc.Collectors(tname); ccs != nil {
+				collectorSets = append(collectorSets, ccs)
+			}
+		}
+	}
+
+	type definition struct {
+		collector string
+		metric    *config.MetricConfig
+	}
+	var errs []error
+	reported := make(map[string]bool)
+	for _, ccs := range collectorSets {
+		defined := make(map[string]definition)
+		for _, cc := range ccs {
+			for _, mc := range cc.Metrics {
+				if mc.NameColumn != "" {
+					// Key/value mode, the metric name is only a prefix.
+					continue
+				}
+				d, found := defined[mc.Name]
+				if !found {
+					defined[mc.Name] = definition{cc.Name, mc}
+					continue
+				}
+				if d.collector == cc.Name || (d.metric.TypeString == mc.TypeString && d.metric.Help == mc.Help) {
+					continue
+				}
+				if key := d.collector + "/" + cc.Name + "/" + mc.Name; !reported[key] {
+					reported[key] = true
+					errs = append(errs, fmt.Errorf(
+						"metric %q defined with different type or help by collectors %q and %q of job %q",
+						mc.Name, d.collector, cc.Name, j.Name))
+				}
+			}
+		}
+	}
+	return errs
+}
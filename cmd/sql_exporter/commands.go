@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+)
+
+// commands are the commands supported besides running the exporter, keyed by name. Each takes the configuration file
+// and the command line arguments following the command name and returns the process exit code.
+var commands = map[string]func(configFile string, args []string) int{
+	"check-config": checkConfig,
+	"once":         collectOnce,
+	"print-config": printConfig,
+	"push":         pushMetrics,
+	"test":         testCollector,
+	"test-rules":   testRules,
+}
+
+// newCommandFlagSet returns a flag set for the named command, accepting `--config.file` (overriding configFile) in
+// addition to the command's own flags.
+func newCommandFlagSet(name string, configFile *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("sql_exporter "+name, flag.ExitOnError)
+	flags.StringVar(configFile, "config.file", *configFile, "SQL Exporter configuration file name.")
+	return flags
+}
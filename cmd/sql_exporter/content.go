@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 
 	"github.com/free/sql_exporter"
 )
@@ -25,6 +26,11 @@ const (
           .navbar-header { font-size: 18px; }
           body > * { margin: 15px; padding: 0; }
           pre { padding: 10px; font-size: 13px; background-color: #f5f5f5; border: 1px solid #ccc; }
+          table { border-collapse: collapse; }
+          th, td { padding: 4px 10px; border: 1px solid #ccc; text-align: left; vertical-align: top; }
+          th { background-color: #f5f5f5; }
+          .up { color: #3c763d; }
+          .down { color: #a94442; }
           h1, h2 { font-weight: 500; }
           a { color: #337ab7; }
           a:hover, a:focus { color: #23527c; }
@@ -34,6 +40,7 @@ const (
         <div class="navbar">
           <div class="navbar-header"><a href="/">Prometheus SQL Exporter</a></div>
           <div><a href="{{ .MetricsPath }}">Metrics</a></div>
+          <div><a href="/targets">Targets</a></div>
           <div><a href="/config">Configuration</a></div>
           <div><a href="/debug/pprof">Profiling</a></div>
           <div><a href="{{ .DocsUrl }}">Help</a></div>
@@ -53,6 +60,50 @@ const (
       <pre>{{ .Config }}</pre>
     {{- end }}
 
+    {{ define "state" -}}
+      {{ if . }}<span class="up">up</span>{{ else }}<span class="down">down</span>{{ end }}
+    {{- end }}
+
+    {{ define "content.targets" -}}
+      <h2>Targets</h2>
+      <table>
+        <tr>
+          <th>Job</th><th>Target</th><th>State</th><th>Last scrape</th><th>Duration</th><th>Connections</th>
+          <th>Collectors</th><th>Error</th>
+        </tr>
+        {{- range .Targets }}
+        <tr>
+          <td>{{ .Job }}</td>
+          <td>{{ .Name }}</td>
+          {{- if .LastScrape }}
+          <td>{{ template "state" .Up }}</td>
+          <td>{{ .LastScrape.Format "2006-01-02 15:04:05 MST" }}</td>
+          <td>{{ printf "%.3fs" .LastScrapeDuration }}</td>
+          {{- else }}
+          <td>unknown</td><td></td><td></td>
+          {{- end }}
+          <td>
+            {{- with .ConnectionPool }}{{ .Open }} open ({{ .InUse }} in use, {{ .Idle }} idle)
+              {{- if .WaitCount }}, waited {{ .WaitCount }} time(s)
+              {{- printf " for %.3fs" .WaitDurationSeconds }}{{ end }}
+            {{- end -}}
+          </td>
+          <td>
+            {{- range .Collectors }}
+            <div>{{ .Name }}:
+              {{- if eq .LastScrapeDuration 0.0 }} not run{{ else }} {{ template "state" .Up }},
+              {{- printf " %.3fs" .LastScrapeDuration }}{{ end }}
+              {{- with .LastErrorTime }}, last failed {{ .Format "2006-01-02 15:04:05 MST" }}{{ end }}
+              {{- with .LastError }}<br><small>{{ . }}</small>{{ end }}</div>
+            {{- end }}
+          </td>
+          <td>{{ .LastError }}</td>
+        </tr>
+        {{- end }}
+      </table>
+      <p>Also available as JSON at <a href="/api/v1/targets">/api/v1/targets</a>.</p>
+    {{- end }}
+
     {{ define "content.error" -}}
       <h2>Error</h2>
       <pre>{{ .Err }}</pre>
@@ -67,15 +118,19 @@ type tdata struct {
 	// `/config` only
 	Config string
 
+	// `/targets` only
+	Targets []sql_exporter.TargetStatus
+
 	// `/error` only
 	Err error
 }
 
 var (
-	allTemplates   = template.Must(template.New("").Parse(templates))
-	homeTemplate   = pageTemplate("home")
-	configTemplate = pageTemplate("config")
-	errorTemplate  = pageTemplate("error")
+	allTemplates    = template.Must(template.New("").Parse(templates))
+	homeTemplate    = pageTemplate("home")
+	configTemplate  = pageTemplate("config")
+	targetsTemplate = pageTemplate("targets")
+	errorTemplate   = pageTemplate("error")
 )
 
 func pageTemplate(name string) *template.Template {
@@ -93,20 +148,71 @@ func HomeHandlerFunc(metricsPath string) func(http.ResponseWriter, *http.Request
 	}
 }
 
-// ConfigHandlerFunc is the HTTP handler for the `/config` page. It outputs the configuration marshaled in YAML format.
+// ConfigHandlerFunc is the HTTP handler for the `/config` page. It outputs the effective configuration, with secrets
+// redacted, as an HTML page or, if requested via the `format` query parameter (`yaml` or `json`) or the Accept header,
+// as raw YAML or JSON.
 func ConfigHandlerFunc(metricsPath string, exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		config, err := exporter.Config().YAML()
+		format := configFormat(r)
+		if format == "" {
+			msg := fmt.Sprintf("Unsupported format %q, expecting yaml, json or html", r.URL.Query().Get("format"))
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		var (
+			config []byte
+			err    error
+		)
+		if format == "json" {
+			config, err = exporter.Config().JSON()
+		} else {
+			config, err = exporter.Config().YAML()
+		}
 		if err != nil {
-			handleError(err, metricsPath, w, r)
+			HandleError(err, metricsPath, w, r)
 			return
 		}
-		configTemplate.Execute(w, &tdata{
-			MetricsPath: metricsPath,
-			DocsUrl:     docsUrl,
-			Config:      string(config),
-		})
+
+		switch format {
+		case "yaml":
+			w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+			w.Write(config)
+		case "json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write(config)
+		default:
+			configTemplate.Execute(w, &tdata{
+				MetricsPath: metricsPath,
+				DocsUrl:     docsUrl,
+				Config:      string(config),
+			})
+		}
+	}
+}
+
+// configFormat returns the format to serve the configuration in, as requested by r: `yaml`, `json` or `html`; empty
+// for an unsupported `format` query parameter. The query parameter takes precedence over the Accept header, which only
+// selects YAML or JSON if preferred to HTML (i.e. listed first).
+func configFormat(r *http.Request) string {
+	switch format := r.URL.Query().Get("format"); format {
+	case "yaml", "json", "html":
+		return format
+	case "":
+	default:
+		return ""
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		switch mediaType {
+		case "application/json":
+			return "json"
+		case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+			return "yaml"
+		case "text/html", "*/*":
+			return "html"
+		}
 	}
+	return "html"
 }
 
 // HandleError is an error handler that other handlers defer to in case of error. It is important to not have written
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// graphiteInvalidChars matches the characters replaced with underscores in Graphite metric path components.
+var graphiteInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// graphiteSink is a sink sending metrics to Graphite (e.g. carbon-cache or carbon-relay) over TCP, using the plaintext
+// protocol. The path of each sample is made up of the prefix (if any), the values of the path labels (in order), the
+// metric name and, unless sent as Graphite tags, the names and values of all other labels, ordered by name.
+type graphiteSink struct {
+	address    string
+	prefix     string
+	pathLabels []string
+	tags       bool
+}
+
+// newGraphiteSink returns a graphiteSink sending to address (host:port). pathLabels is a comma separated list of the
+// labels whose values to insert into paths before the metric name. If tags is true, other labels are sent as Graphite
+// tags rather than appended to the path.
+func newGraphiteSink(address, prefix, pathLabels string, tags bool) *graphiteSink {
+	s := &graphiteSink{address: address, prefix: strings.Trim(prefix, "."), tags: tags}
+	for _, l := range strings.Split(pathLabels, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			s.pathLabels = append(s.pathLabels, l)
+		}
+	}
+	return s
+}
+
+// push implements sink.
+func (s *graphiteSink) push(ctx context.Context, mfs []*dto.MetricFamily) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	now := time.Now()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = time.UnixMilli(m.GetTimestampMs())
+			}
+			for _, sample := range graphiteSamples(mf.GetName(), mf.GetType(), m) {
+				fmt.Fprintf(w, "%s %s %d\n", s.path(sample.name, sample.labels),
+					strconv.FormatFloat(sample.value, 'g', -1, 64), ts.Unix())
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// close implements sink.
+func (s *graphiteSink) close(context.Context) error {
+	return nil
+}
+
+// path returns the Graphite path (and tags, if enabled) of the sample of the named metric with the given labels.
+func (s *graphiteSink) path(name string, labels map[string]string) string {
+	var components []string
+	if s.prefix != "" {
+		components = append(components, s.prefix)
+	}
+	for _, l := range s.pathLabels {
+		if v, found := labels[l]; found {
+			components = append(components, graphiteInvalidChars.ReplaceAllString(v, "_"))
+			delete(labels, l)
+		}
+	}
+	components = append(components, graphiteInvalidChars.ReplaceAllString(name, "_"))
+
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	if s.tags {
+		path := strings.Join(components, ".")
+		for _, l := range names {
+			// Tag values may not be empty or contain semicolons or tildes.
+			if v := strings.NewReplacer(";", "_", "~", "_").Replace(labels[l]); v != "" {
+				path += ";" + l + "=" + v
+			}
+		}
+		return path
+	}
+	for _, l := range names {
+		components = append(components, l, graphiteInvalidChars.ReplaceAllString(labels[l], "_"))
+	}
+	return strings.Join(components, ".")
+}
+
+// graphiteSample is a single sample, with its labels by name.
+type graphiteSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// graphiteSamples returns the samples of m, a metric of the named family of the given type: a single one for counters,
+// gauges and untyped metrics; `_bucket` (by `le` label), `_sum` and `_count` samples for histograms. Summaries (which
+// SQL Exporter never produces) are not supported.
+func graphiteSamples(name string, typ dto.MetricType, m *dto.Metric) []graphiteSample {
+	labels := func() map[string]string {
+		l := make(map[string]string, len(m.Label)+1)
+		for _, lp := range m.Label {
+			l[lp.GetName()] = lp.GetValue()
+		}
+		return l
+	}
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return []graphiteSample{{name, labels(), m.GetCounter().GetValue()}}
+	case dto.MetricType_GAUGE:
+		return []graphiteSample{{name, labels(), m.GetGauge().GetValue()}}
+	case dto.MetricType_UNTYPED:
+		return []graphiteSample{{name, labels(), m.GetUntyped().GetValue()}}
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		samples := make([]graphiteSample, 0, len(h.Bucket)+3)
+		infSeen := false
+		for _, b := range h.Bucket {
+			l := labels()
+			l["le"] = strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)
+			infSeen = infSeen || math.IsInf(b.GetUpperBound(), +1)
+			samples = append(samples, graphiteSample{name + "_bucket", l, float64(b.GetCumulativeCount())})
+		}
+		if !infSeen {
+			l := labels()
+			l["le"] = "+Inf"
+			samples = append(samples, graphiteSample{name + "_bucket", l, float64(h.GetSampleCount())})
+		}
+		return append(samples,
+			graphiteSample{name + "_sum", labels(), h.GetSampleSum()},
+			graphiteSample{name + "_count", labels(), float64(h.GetSampleCount())})
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/free/sql_exporter"
+)
+
+// Readiness criteria, as accepted by --web.ready-when.
+const (
+	// The configuration was loaded, i.e. always, once the exporter is serving.
+	readyWhenConfigLoaded = "config-loaded"
+	// At least one target was scraped (or collected in the background), successfully or not.
+	readyWhenScraped = "scraped"
+	// The latest scrape of at least one target could connect to its database.
+	readyWhenTargetUp = "target-up"
+)
+
+// checkReadyWhen returns an error if readyWhen is not one of the supported readiness criteria.
+func checkReadyWhen(readyWhen string) error {
+	switch readyWhen {
+	case readyWhenConfigLoaded, readyWhenScraped, readyWhenTargetUp:
+		return nil
+	}
+	return fmt.Errorf("unsupported readiness criterion %q, expecting %s, %s or %s",
+		readyWhen, readyWhenConfigLoaded, readyWhenScraped, readyWhenTargetUp)
+}
+
+// defaultHealthCheckTimeout is how long deep health checks wait for databases to respond, unless overridden.
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// HealthyHandlerFunc is the HTTP handler for `/-/healthy` (and the older `/healthz`), always OK while the process is
+// able to serve requests.
+//
+// With a `deep=1` URL parameter, it instead pings the databases of all targets (or of the `job` and/or `target` URL
+// parameters only), waiting up to `timeout` (5s by default) for them to respond, and reports the outcome for each
+// target as JSON, with a 503 Service Unavailable status code if any of them is down.
+func HealthyHandlerFunc(exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if deep := params.Get("deep"); deep == "" || deep == "0" || deep == "false" {
+			http.Error(w, "OK", http.StatusOK)
+			return
+		}
+
+		timeout := defaultHealthCheckTimeout
+		if t := params.Get("timeout"); t != "" {
+			var err error
+			if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+				apiError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", t))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		targets, err := exporter.CheckHealth(ctx, params.Get("job"), params.Get("target"))
+		switch {
+		case errors.Is(err, sql_exporter.ErrUnknownJob), errors.Is(err, sql_exporter.ErrUnknownTarget):
+			apiError(w, http.StatusNotFound, err)
+			return
+		case err != nil:
+			apiError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		status, code := "healthy", http.StatusOK
+		for _, th := range targets {
+			if !th.Up {
+				status, code = "unhealthy", http.StatusServiceUnavailable
+			}
+		}
+		if targets == nil {
+			targets = []sql_exporter.TargetHealth{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Status  string                      `json:"status"`
+			Targets []sql_exporter.TargetHealth `json:"targets"`
+		}{status, targets})
+	}
+}
+
+// ReadyHandlerFunc is the HTTP handler for `/-/ready`, OK if the exporter meets the readiness criterion readyWhen and
+// 503 Service Unavailable otherwise.
+func ReadyHandlerFunc(exporter sql_exporter.Exporter, readyWhen string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readyWhen == readyWhenConfigLoaded {
+			http.Error(w, "OK", http.StatusOK)
+			return
+		}
+		for _, ts := range exporter.Targets() {
+			if readyWhen == readyWhenScraped && ts.LastScrape != nil || readyWhen == readyWhenTargetUp && ts.Up {
+				http.Error(w, "OK", http.StatusOK)
+				return
+			}
+		}
+		if readyWhen == readyWhenScraped {
+			http.Error(w, "Not ready: no target scraped yet", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "Not ready: no target up", http.StatusServiceUnavailable)
+		}
+	}
+}
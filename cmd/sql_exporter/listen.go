@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixSocketPrefix is the prefix of listen addresses denoting a Unix domain socket path, e.g. `unix:///run/sql.sock`.
+const unixSocketPrefix = "unix://"
+
+// listen returns a listener for address: a Unix domain socket if address is prefixed with `unix://`, a TCP address
+// otherwise. A stale socket file left behind by a previous run is removed.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixSocketPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixSocketPrefix)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// systemdListener returns the first socket passed by systemd socket activation, via the LISTEN_PID and LISTEN_FDS
+// environment variables (see sd_listen_fds(3)). The variables are unset, so child processes don't inherit them.
+func systemdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_PID not set to this process)")
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS=%q)", os.Getenv("LISTEN_FDS"))
+	}
+	// Passed file descriptors start at 3, right after stdin, stdout and stderr.
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+// newLogger returns a logger writing to w in the given format (logfmt or json), dropping messages below the given level
+// (debug, info, warn or error), and the logLevel controlling it.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, *logLevel, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid --log.level %q, expecting one of debug, info, warn or error", level)
+	}
+	ll := &logLevel{base: l}
+	ll.level.Set(l)
+	opts := &slog.HandlerOptions{Level: &ll.level}
+	switch format {
+	case logFormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), ll, nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), ll, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid --log.format %q, expecting %s or %s", format, logFormatLogfmt, logFormatJSON)
+	}
+}
+
+// logLevel is the log level of a logger, which may be changed at runtime, either permanently or temporarily (reverting
+// to the previous permanent level after a while).
+type logLevel struct {
+	level slog.LevelVar
+
+	// mu protects base (the level to revert to), revert (the timer reverting a temporary level, nil if none) and until
+	// (when the timer fires).
+	mu     sync.Mutex
+	base   slog.Level
+	revert *time.Timer
+	until  time.Time
+}
+
+// set changes the log level. If d is positive, the change is temporary: the level reverts after d.
+func (l *logLevel) set(level slog.Level, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopRevert()
+	l.level.Set(level)
+	if d <= 0 {
+		l.base = level
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// Another change may have happened just as the timer fired.
+		if l.revert == t {
+			l.revert = nil
+			l.level.Set(l.base)
+		}
+	})
+	l.revert, l.until = t, time.Now().Add(d)
+}
+
+// toggleDebug switches the log level to debug, or back to the permanent level if debug already (to info if that is
+// debug too), and returns the new level. The change doesn't expire.
+func (l *logLevel) toggleDebug() slog.Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopRevert()
+	switch {
+	case l.level.Level() > slog.LevelDebug:
+		l.level.Set(slog.LevelDebug)
+	case l.base > slog.LevelDebug:
+		l.level.Set(l.base)
+	default:
+		l.level.Set(slog.LevelInfo)
+	}
+	return l.level.Level()
+}
+
+// stopRevert cancels reverting a temporary level, if any. The caller must hold mu.
+func (l *logLevel) stopRevert() {
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+}
+
+// String returns the current log level and, if temporary, the level it reverts to and when.
+func (l *logLevel) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.revert != nil {
+		return fmt.Sprintf("%s (reverting to %s in %s)", l.level.Level(), l.base, time.Until(l.until).Round(time.Second))
+	}
+	return l.level.Level().String()
+}
+
+// LogLevelHandlerFunc is the HTTP handler for `/-/loglevel`. GET requests return the current log level. PUT requests
+// change it to the `level` parameter (debug, info, warn or error) permanently or, if a `duration` parameter is
+// provided, for that long only (e.g. `level=debug&duration=10m`, after which the previous level is restored).
+func LogLevelHandlerFunc(logger *slog.Logger, ll *logLevel) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid level %q, expecting one of debug, info, warn or error",
+					r.FormValue("level")), http.StatusBadRequest)
+				return
+			}
+			var d time.Duration
+			if s := r.FormValue("duration"); s != "" {
+				var err error
+				if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+					http.Error(w, fmt.Sprintf("Invalid duration %q", s), http.StatusBadRequest)
+					return
+				}
+			}
+			ll.set(level, d)
+			logger.Info("Log level changed", "level", level, "duration", d)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Only GET or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, ll)
+	}
+}
+
+// kitLogger adapts a slog logger to the go-kit log.Logger interface (as used by exporter-toolkit), logging at the
+// level of the "level" key, if any, with the "msg" key as message.
+type kitLogger struct {
+	logger *slog.Logger
+}
+
+// Log implements go-kit's log.Logger.
+func (k kitLogger) Log(keyvals ...interface{}) error {
+	level, msg := slog.LevelInfo, ""
+	attrs := make([]interface{}, 0, len(keyvals))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch key := fmt.Sprint(keyvals[i]); key {
+		case "level":
+			level.UnmarshalText([]byte(fmt.Sprint(keyvals[i+1])))
+		case "msg":
+			msg = fmt.Sprint(keyvals[i+1])
+		default:
+			attrs = append(attrs, key, keyvals[i+1])
+		}
+	}
+	k.logger.Log(context.Background(), level, msg, attrs...)
+	return nil
+}
+
+// promhttpLogger adapts a slog logger to the promhttp.Logger interface, logging every message as an error.
+type promhttpLogger struct {
+	logger *slog.Logger
+}
+
+// Println implements promhttp.Logger.
+func (p promhttpLogger) Println(args ...interface{}) {
+	p.logger.Error(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
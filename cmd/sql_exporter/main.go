@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/free/sql_exporter"
-	log "github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
 	_ "net/http/pprof"
 )
 
@@ -26,17 +33,75 @@ func main() {
 	}
 
 	var (
-		showVersion   = flag.Bool("version", false, "Print version information.")
-		listenAddress = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		configFile    = flag.String("config.file", "sql_exporter.yml", "SQL Exporter configuration file name.")
+		showVersion       = flag.Bool("version", false, "Print version information.")
+		enableOpenMetrics = flag.Bool("web.enable-openmetrics", false, "Expose metrics in the OpenMetrics format, "+
+			"if requested by the scraper, e.g. for exemplars. Counters not named `*_total` get the suffix appended.")
+		listenAddress = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and "+
+			"telemetry, either host:port or unix:///path/to/socket.")
+		systemdSocket = flag.Bool("web.systemd-socket", false,
+			"Use the socket passed by systemd socket activation instead of the listen address.")
+		metricsPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		selfMetricsPath = flag.String("web.self-telemetry-path", "", "Path under which to expose the exporter's own "+
+			"metrics only, leaving them out of the metrics path. If a self-telemetry listen address is set, defaults "+
+			"to /metrics on that address.")
+		selfListenAddress = flag.String("web.self-telemetry-listen-address", "",
+			"Address to expose the exporter's own metrics on, leaving them out of the metrics path.")
+		configFile      = flag.String("config.file", "sql_exporter.yml", "SQL Exporter configuration file name.")
+		enableLifecycle = flag.Bool("web.enable-lifecycle", false,
+			"Enable configuration reload and log level changes via HTTP requests.")
+		enableAdminAPI = flag.Bool("web.enable-admin-api", false, "Enable the API adding and removing targets at runtime.")
+		adminTokenFile = flag.String("web.admin-api.token-file", "",
+			"File containing the bearer token the admin API requires. Required if the admin API is enabled.")
+		adminStateFile = flag.String("web.admin-api.state-file", "",
+			"File to persist the targets added via the admin API to, restoring them on startup.")
+		webConfigFile = flag.String("web.config.file", "", "Path to configuration file that can enable TLS or authentication.")
+		dryRun        = flag.Bool("dry-run", false, "Check the configuration and exit, same as the check-config command.")
+		recordDir     = flag.String("query.record-dir", "", "Directory to record the results of all queries to.")
+		metricChanCap = flag.Int("query.metric-channel-capacity", 1000, "Number of metrics buffered between queries "+
+			"and the exporter, per channel.")
+		replayDir = flag.String("query.replay-dir", "",
+			"Directory to replay recorded query results from, instead of connecting to databases.")
+		once      = flag.Bool("once", false, "Collect metrics once, print them and exit, same as the once command.")
+		readyWhen = flag.String("web.ready-when", readyWhenConfigLoaded, "When to report the exporter as ready at "+
+			"/-/ready: once the configuration is loaded (config-loaded), once any target was scraped (scraped) or while "+
+			"any target is up (target-up).")
+		shutdownTimeout = flag.Duration("web.shutdown-timeout", 30*time.Second,
+			"How long to wait for in-flight scrapes to complete on SIGTERM or SIGINT, before canceling them.")
+		logLevel = flag.String("log.level", "info", "Only log messages with the given severity or above: debug, info, "+
+			"warn or error.")
+		logFormat  = flag.String("log.format", logFormatLogfmt, "Output format of log messages: logfmt or json.")
+		logQueries = flag.Bool("log.queries", false, "Log every query executed, with its target, collector, duration, "+
+			"rows returned and error, if any.")
+		slowQueryThreshold = flag.Duration("log.slow-query-threshold", 0,
+			"Always log queries taking longer than this, as warnings. Zero disables slow query logging.")
+		queryLogFile    = flag.String("log.query-file", "", "File to append logged queries to, instead of the main log.")
+		tracingEndpoint = flag.String("tracing.endpoint", "", "OTLP over HTTP endpoint (host:port) to export spans of "+
+			"scrapes and queries to. Tracing is disabled if empty.")
+		tracingInsecure = flag.Bool("tracing.insecure", false, "Export spans over plain HTTP rather than HTTPS.")
+		samplingRatio   = flag.Float64("tracing.sampling-ratio", 1, "Ratio of scrapes to trace, between 0 and 1.")
+		maxStatementLen = flag.Int("tracing.max-statement-length", 0,
+			"Truncate the query text attached to query spans to this many bytes. Zero means no truncation.")
+		pushInterval = flag.Duration("push.interval", time.Minute,
+			"How often to collect metrics and push them to the configured push destinations (e.g. --pushgateway.url).")
+		otlpEndpoint = flag.String("otlp.endpoint", "", "OpenTelemetry collector endpoint (host:port) to push metrics "+
+			"to via OTLP, in addition to exposing them for scraping.")
+		otlpProtocol = flag.String("otlp.protocol", otlpProtocolGRPC, "Protocol to push metrics via OTLP with: grpc or "+
+			"http.")
+		otlpInsecure   = flag.Bool("otlp.insecure", false, "Push metrics via OTLP without TLS.")
+		pushgatewayURL = flag.String("pushgateway.url", "", "URL of a Pushgateway to push metrics to, in addition to "+
+			"exposing them for scraping.")
+		pushgatewayGrouping = labelsFlag{}
+		graphiteAddress     = flag.String("graphite.address", "", "Address (host:port) of a Graphite server to push "+
+			"metrics to over TCP using the plaintext protocol, in addition to exposing them for scraping.")
+		graphitePrefix     = flag.String("graphite.prefix", "", "Prefix of the paths of metrics pushed to Graphite.")
+		graphitePathLabels = flag.String("graphite.path-labels", "job,instance", "Comma separated labels whose values "+
+			"make up the paths of metrics pushed to Graphite, in order, before the metric name.")
+		graphiteTags = flag.Bool("graphite.tags", false, "Push the labels not in --graphite.path-labels to Graphite as "+
+			"tags, rather than appending their names and values to the path.")
 	)
+	flag.Var(pushgatewayGrouping, "pushgateway.grouping-label", "Grouping label to push metrics to the Pushgateway "+
+		"with, besides the job, as name=value. May be repeated.")
 
-	// Override --alsologtostderr default value.
-	if alsoLogToStderr := flag.Lookup("alsologtostderr"); alsoLogToStderr != nil {
-		alsoLogToStderr.DefValue = "true"
-		alsoLogToStderr.Value.Set("true")
-	}
 	// Override the config.file default with the CONFIG environment variable, if set. If the flag is explicitly set, it
 	// will end up overriding either.
 	if envConfigFile := os.Getenv("CONFIG"); envConfigFile != "" {
@@ -49,35 +114,273 @@ func main() {
 		os.Exit(0)
 	}
 
-	log.Infof("Starting SQL exporter %s %s", version.Info(), version.BuildContext())
+	logger, level, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// Anything not logging to a logger of its own (e.g. database drivers, commands) logs to the default logger.
+	slog.SetDefault(logger)
 
-	exporter, err := sql_exporter.NewExporter(*configFile, prometheus.DefaultGatherer)
+	if err := checkReadyWhen(*readyWhen); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *selfMetricsPath != "" && *selfMetricsPath == *metricsPath {
+		fmt.Fprintln(os.Stderr, "--web.self-telemetry-path must differ from --web.telemetry-path")
+		os.Exit(2)
+	}
+	if *logQueries || *slowQueryThreshold > 0 {
+		queryLogger := logger
+		if *queryLogFile != "" {
+			f, err := os.OpenFile(*queryLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			// Unlike the main log, the query log is not subject to --log.level.
+			queryLogger, _, _ = newLogger(f, "info", *logFormat)
+		}
+		sql_exporter.LogQueries(queryLogger, *logQueries, *slowQueryThreshold)
+	}
+	if *recordDir != "" && *replayDir != "" {
+		fmt.Fprintln(os.Stderr, "Only one of --query.record-dir and --query.replay-dir may be specified")
+		os.Exit(2)
+	}
+	if *metricChanCap < 0 {
+		fmt.Fprintf(os.Stderr, "Negative --query.metric-channel-capacity: %d\n", *metricChanCap)
+		os.Exit(2)
+	}
+	sql_exporter.SetMetricChannelCapacity(*metricChanCap)
+	if *recordDir != "" {
+		sql_exporter.RecordQueries(*recordDir)
+	} else if *replayDir != "" {
+		sql_exporter.ReplayQueries(*replayDir)
+	}
+
+	// Run a command instead of the exporter, if one was specified, e.g. `sql_exporter check-config`.
+	command, args := flag.Arg(0), flag.Args()
+	if command != "" {
+		args = args[1:]
+	} else if *dryRun {
+		command = "check-config"
+	} else if *once {
+		command = "once"
+	}
+	if command != "" {
+		run, found := commands[command]
+		if !found {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", command)
+			os.Exit(2)
+		}
+		os.Exit(run(*configFile, args))
+	}
+
+	logger.Info("Starting SQL exporter", "version", version.Info(), "build_context", version.BuildContext())
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if *tracingEndpoint != "" {
+		shutdownTracing, err = setupTracing(logger, *tracingEndpoint, *tracingInsecure, *samplingRatio)
+		if err != nil {
+			logger.Error("Error setting up tracing", "err", err)
+			os.Exit(1)
+		}
+		sql_exporter.TruncateTracedStatements(*maxStatementLen)
+	}
+
+	exporter, err := sql_exporter.NewExporter(logger, *configFile, prometheus.DefaultGatherer)
 	if err != nil {
-		log.Fatalf("Error starting exporter: %s", err)
+		logger.Error("Error starting exporter", "err", err)
+		os.Exit(1)
+	}
+
+	// Push metrics to any configured push destinations, besides exposing them for scraping.
+	var sinks []sink
+	if *otlpEndpoint != "" {
+		s, err := newOTLPSink(exporter, *otlpProtocol, *otlpEndpoint, *otlpInsecure)
+		if err != nil {
+			logger.Error("Error setting up OTLP metrics export", "err", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if *pushgatewayURL != "" {
+		sinks = append(sinks, newPushgatewaySink(*pushgatewayURL, pushgatewayGrouping))
+	}
+	if *graphiteAddress != "" {
+		sinks = append(sinks, newGraphiteSink(*graphiteAddress, *graphitePrefix, *graphitePathLabels, *graphiteTags))
+	}
+	sinksCtx, stopSinks := context.WithCancel(context.Background())
+	for _, s := range sinks {
+		go runSink(sinksCtx, logger, exporter, *pushInterval, s)
 	}
 
+	// Reload the configuration on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(logger, exporter)
+		}
+	}()
+	// Toggle debug logging on SIGUSR1.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			logger.Info("Log level changed", "level", level.toggleDebug())
+		}
+	}()
+
 	// Setup and start webserver.
 	opts := promhttp.HandlerOpts{
-		ErrorLog:      LogFunc(log.Error),
-		ErrorHandling: promhttp.ContinueOnError,
+		ErrorLog:          promhttpLogger{logger},
+		ErrorHandling:     promhttp.ContinueOnError,
+		EnableOpenMetrics: *enableOpenMetrics,
 	}
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
+	http.HandleFunc("/-/healthy", HealthyHandlerFunc(exporter))
+	http.HandleFunc("/-/ready", ReadyHandlerFunc(exporter, *readyWhen))
+	// Deprecated, kept for compatibility with existing liveness probes.
+	http.HandleFunc("/healthz", HealthyHandlerFunc(exporter))
 	http.HandleFunc("/", HomeHandlerFunc(*metricsPath))
 	http.HandleFunc("/config", ConfigHandlerFunc(*metricsPath, exporter))
+	http.HandleFunc("/targets", TargetsHandlerFunc(*metricsPath, exporter))
+	http.HandleFunc("/api/v1/targets", TargetsAPIHandlerFunc(exporter))
+	if *enableLifecycle {
+		http.HandleFunc("/-/reload", reloadHandlerFunc(logger, exporter))
+		http.HandleFunc("/-/loglevel", LogLevelHandlerFunc(logger, level))
+	}
+	if *enableAdminAPI {
+		adminAPI, err := newAdminAPI(logger, exporter, *adminTokenFile, *adminStateFile)
+		if err != nil {
+			logger.Error("Error starting admin API", "err", err)
+			os.Exit(1)
+		}
+		http.Handle(adminAPIPrefix, adminAPI)
+	}
 
-	// Expose metrics merged from exporter and the default gatherer.
-	margingGatherer := prometheus.Gatherers{exporter, prometheus.DefaultGatherer}
-	http.Handle(*metricsPath, promhttp.HandlerFor(margingGatherer, opts))
+	// Expose metrics merged from exporter and the default gatherer, unless the latter's are exposed separately.
+	separateSelf := *selfMetricsPath != "" || *selfListenAddress != ""
+	http.HandleFunc(*metricsPath, MetricsHandlerFunc(exporter, !separateSelf, opts))
+	if *selfMetricsPath != "" {
+		http.Handle(*selfMetricsPath, SelfMetricsHandler(opts))
+	}
+	// Expose each job's metrics on its own path, under the metrics path.
+	if jobsPath := strings.TrimSuffix(*metricsPath, "/") + "/"; jobsPath != "/" {
+		http.HandleFunc(jobsPath, JobMetricsHandlerFunc(exporter, jobsPath, opts))
+	}
+	// Expose metrics from a single, dynamically specified target.
+	http.HandleFunc("/probe", ProbeHandlerFunc(exporter, opts))
+	// Expose all targets in Prometheus HTTP service discovery format.
+	http.HandleFunc("/sd", SDHandlerFunc(exporter, *metricsPath, strings.TrimSuffix(*metricsPath, "/")+"/"))
 
-	log.Infof("Listening on %s", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	servers := []*http.Server{{Addr: *listenAddress}}
+	// Expose the metrics of jobs with a listen address on their own port too. Changes require a restart.
+	for _, jc := range exporter.Config().Jobs {
+		if jc.ListenAddress != "" {
+			servers = append(servers, jobMetricsServer(jc.ListenAddress, exporter, jc.Name, *metricsPath, opts))
+		}
+	}
+	if *selfListenAddress != "" {
+		path := *selfMetricsPath
+		if path == "" {
+			path = "/metrics"
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, SelfMetricsHandler(opts))
+		servers = append(servers, &http.Server{Addr: *selfListenAddress, Handler: mux})
+	}
+	listeners := make([]net.Listener, len(servers))
+	for i, server := range servers {
+		var err error
+		if i == 0 && *systemdSocket {
+			listeners[i], err = systemdListener()
+		} else {
+			listeners[i], err = listen(server.Addr)
+		}
+		if err != nil {
+			logger.Error("Error listening", "address", server.Addr, "err", err)
+			os.Exit(1)
+		}
+		logger.Info("Listening", "address", listeners[i].Addr().String())
+	}
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(l net.Listener, server *http.Server) {
+			errs <- web.Serve(l, server, *webConfigFile, kitLogger{logger})
+		}(listeners[i], server)
+	}
+
+	// Shut down gracefully on SIGTERM or SIGINT: stop accepting connections, let in-flight scrapes complete (up to the
+	// shutdown timeout), then close all database handles.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		logger.Error("Error serving HTTP", "err", err)
+		os.Exit(1)
+	case sig := <-term:
+		logger.Info("Shutting down", "signal", sig.String())
+	}
+	signal.Stop(term)
+
+	stopSinks()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("Error shutting down HTTP server", "address", server.Addr, "err", err)
+		}
+	}
+	if err := exporter.Shutdown(ctx); err != nil {
+		logger.Warn("Canceled in-flight scrapes", "timeout", *shutdownTimeout, "err", err)
+	}
+	for _, s := range sinks {
+		if err := s.close(ctx); err != nil {
+			logger.Warn("Error flushing pushed metrics", "err", err)
+		}
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Warn("Error flushing spans", "err", err)
+	}
+	logger.Info("Shut down")
 }
 
-// LogFunc is an adapter to allow the use of any function as a promhttp.Logger. If f is a function, LogFunc(f) is a
-// promhttp.Logger that calls f.
-type LogFunc func(args ...interface{})
+// jobMetricsServer returns an HTTP server serving the metrics of the named job on the metrics path of a dedicated
+// listen address.
+func jobMetricsServer(listenAddress string, exporter sql_exporter.Exporter, job, metricsPath string,
+	opts promhttp.HandlerOpts) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		serveJobMetrics(exporter, job, opts, w, r)
+	})
+	return &http.Server{Addr: listenAddress, Handler: mux}
+}
 
-// Println implements promhttp.Logger.
-func (log LogFunc) Println(args ...interface{}) {
-	log(args)
+// reloadConfig reloads the exporter configuration, logging the outcome. On failure the previous configuration is kept.
+func reloadConfig(logger *slog.Logger, exporter sql_exporter.Exporter) error {
+	logger.Info("Reloading configuration")
+	if err := exporter.Reload(); err != nil {
+		logger.Error("Error reloading configuration, keeping previous one", "err", err)
+		return err
+	}
+	logger.Info("Configuration successfully reloaded")
+	return nil
+}
+
+// reloadHandlerFunc is the HTTP handler for `/-/reload`. It triggers a configuration reload on POST or PUT requests and
+// responds with a 500 status code if the new configuration could not be loaded.
+func reloadHandlerFunc(logger *slog.Logger, exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(logger, exporter); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reload configuration: %s", err), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "OK", http.StatusOK)
+	}
 }
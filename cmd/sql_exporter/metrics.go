@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandlerFunc is the HTTP handler for the metrics endpoint. It exposes the metrics collected by the exporter,
+// merged with those of the default gatherer (the exporter's own metrics) if withSelf is true. If any `collect[]` URL
+// parameters are specified, only the named collectors are run and the default gatherer's metrics are left out.
+func MetricsHandlerFunc(
+	exporter sql_exporter.Exporter, withSelf bool, opts promhttp.HandlerOpts) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collectors, err := collectParams(exporter, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var gatherer prometheus.Gatherer
+		if len(collectors) == 0 && withSelf {
+			gatherer = prometheus.Gatherers{exporter, prometheus.DefaultGatherer}
+		} else {
+			gatherer = sql_exporter.WithCollectors(exporter, collectors)
+		}
+		promhttp.HandlerFor(gatherer, opts).ServeHTTP(w, r)
+	}
+}
+
+// SelfMetricsHandler returns the HTTP handler for the self-telemetry endpoint, exposing only the exporter's own
+// metrics (process, Go runtime and query statistics), without scraping any databases.
+func SelfMetricsHandler(opts promhttp.HandlerOpts) http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, opts)
+}
+
+// JobMetricsHandlerFunc is the HTTP handler for the per-job metrics endpoints, `<jobsPath><job>` (e.g.
+// `/metrics/<job>`). Each exposes the metrics collected from a single job's targets, so jobs may be scraped
+// independently, or only from the one named by the `target` URL parameter, if specified. `collect[]` URL parameters
+// are supported, same as for the metrics endpoint.
+func JobMetricsHandlerFunc(
+	exporter sql_exporter.Exporter, jobsPath string, opts promhttp.HandlerOpts) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveJobMetrics(exporter, strings.TrimPrefix(r.URL.Path, jobsPath), opts, w, r)
+	}
+}
+
+// serveJobMetrics serves the metrics collected from the named job's targets.
+func serveJobMetrics(
+	exporter sql_exporter.Exporter, job string, opts promhttp.HandlerOpts, w http.ResponseWriter, r *http.Request) {
+	if !hasJob(exporter.Config(), job) {
+		http.Error(w, fmt.Sprintf("unknown job %q", job), http.StatusNotFound)
+		return
+	}
+	collectors, err := collectParams(exporter, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gatherer := exporter.JobGatherer(job)
+	if target := r.URL.Query().Get("target"); target != "" {
+		gatherer = exporter.TargetGatherer(job, target)
+	}
+	gatherer = sql_exporter.WithCollectors(gatherer, collectors)
+	promhttp.HandlerFor(gatherer, opts).ServeHTTP(w, r)
+}
+
+// hasJob returns true if the configuration defines the named job.
+func hasJob(c *config.Config, name string) bool {
+	for _, jc := range c.Jobs {
+		if jc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collectParams returns the collector names specified via `collect[]` URL parameters, checking that they are defined.
+func collectParams(exporter sql_exporter.Exporter, r *http.Request) ([]string, error) {
+	collectors := r.URL.Query()["collect[]"]
+	config := exporter.Config()
+	for _, name := range collectors {
+		if config.Collector(name) == nil {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+	}
+	return collectors, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/free/sql_exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// collectOnce implements the `once` command: it collects metrics from all targets (or only those of the named job)
+// once and writes them in text exposition format to stdout or a file (e.g. for node_exporter's textfile collector).
+// The exit code is non-zero if any target was down.
+func collectOnce(configFile string, args []string) int {
+	flags := newCommandFlagSet("once", &configFile)
+	output := flags.String("output", "-", "File to write the metrics to, replacing it atomically, or - for stdout.")
+	job := flags.String("job", "", "Name of the job to collect metrics from. Defaults to all jobs.")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments to once: %q\n", flags.Args())
+		return 2
+	}
+
+	exporter, err := sql_exporter.NewExporter(nil, configFile, prometheus.NewRegistry())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var g prometheus.Gatherer = exporter
+	if *job != "" {
+		if !hasJob(exporter.Config(), *job) {
+			fmt.Fprintf(os.Stderr, "Unknown job %q\n", *job)
+			return 2
+		}
+		g = exporter.JobGatherer(*job)
+	}
+	mfs, gatherErr := g.Gather()
+	if gatherErr != nil {
+		fmt.Fprintln(os.Stderr, gatherErr)
+	}
+	down := 0
+	for _, ts := range exporter.Targets() {
+		if ts.LastScrape != nil && !ts.Up && (*job == "" || ts.Job == *job) {
+			down++
+		}
+	}
+	exporter.Shutdown(context.Background())
+
+	sort.Slice(mfs, func(i, k int) bool { return mfs[i].GetName() < mfs[k].GetName() })
+	write := func(w io.Writer) error {
+		for _, mf := range mfs {
+			if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if *output == "-" {
+		err = write(os.Stdout)
+	} else {
+		err = writeFileAtomically(*output, write)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if down > 0 {
+		fmt.Fprintf(os.Stderr, "%d target(s) down\n", down)
+		return 1
+	}
+	return 0
+}
+
+// writeFileAtomically writes file via write, to a temporary file in the same directory first, then renamed to file,
+// so readers never see a partially written file.
+func writeFileAtomically(file string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Temporary files are only readable by their owner, the output is meant to be read by other processes too.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/free/sql_exporter"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http"
+)
+
+// otlpScope is the instrumentation scope of all metrics exported via OTLP.
+var otlpScope = instrumentation.Scope{Name: "github.com/free/sql_exporter", Version: version.Version}
+
+// otlpSink is a sink exporting metrics via OTLP to an OpenTelemetry collector. The metrics of each target are exported
+// with a resource of their own, derived from the target's labels: `job` as `service.name`, `instance` as
+// `service.instance.id` and any other target labels as is. The remaining labels become data point attributes.
+type otlpSink struct {
+	exporter sql_exporter.Exporter
+	exp      sdkmetric.Exporter
+	// Start time of all cumulative metrics, as the exporter doesn't know when targets were first scraped.
+	start time.Time
+}
+
+// newOTLPSink returns an otlpSink exporting the metrics collected by exporter via OTLP over gRPC or HTTP (per protocol)
+// to endpoint (host:port).
+func newOTLPSink(exporter sql_exporter.Exporter, protocol, endpoint string, insecure bool) (*otlpSink, error) {
+	var (
+		exp sdkmetric.Exporter
+		err error
+	)
+	// Neither fails on an unreachable endpoint, they keep retrying in the background.
+	switch protocol {
+	case otlpProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(endpoint)}
+		if insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		exp, err = otlpmetricgrpc.New(context.Background(), opts...)
+	case otlpProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(endpoint)}
+		if insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		exp, err = otlpmetrichttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("invalid --otlp.protocol %q, expecting %s or %s", protocol, otlpProtocolGRPC,
+			otlpProtocolHTTP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &otlpSink{exporter: exporter, exp: exp, start: time.Now()}, nil
+}
+
+// otlpTarget identifies the target metrics were collected from, by job and instance label.
+type otlpTarget struct {
+	job, instance string
+}
+
+// otlpResourceMetrics groups the metrics of a target (or those not collected from a known target).
+type otlpResourceMetrics struct {
+	// The target's labels, nil if not a known target.
+	labels  map[string]string
+	metrics []metricdata.Metrics
+	// Index of each metric family in metrics, by name.
+	index map[string]int
+}
+
+// push implements sink.
+func (s *otlpSink) push(ctx context.Context, mfs []*dto.MetricFamily) error {
+	targetLabels := make(map[otlpTarget]map[string]string)
+	for _, ts := range s.exporter.Targets() {
+		targetLabels[otlpTarget{ts.Labels["job"], ts.Labels["instance"]}] = ts.Labels
+	}
+
+	var (
+		now    = time.Now()
+		order  []otlpTarget
+		groups = make(map[otlpTarget]*otlpResourceMetrics)
+	)
+	for _, mf := range mfs {
+		if mf.GetType() == dto.MetricType_SUMMARY {
+			continue
+		}
+		for _, m := range mf.Metric {
+			key := otlpTarget{}
+			for _, lp := range m.Label {
+				switch lp.GetName() {
+				case "job":
+					key.job = lp.GetValue()
+				case "instance":
+					key.instance = lp.GetValue()
+				}
+			}
+			tl, found := targetLabels[key]
+			if !found {
+				key = otlpTarget{}
+			}
+			g := groups[key]
+			if g == nil {
+				g = &otlpResourceMetrics{labels: tl, index: make(map[string]int)}
+				groups[key] = g
+				order = append(order, key)
+			}
+
+			// Labels identifying the target are resource attributes, all others are data point attributes.
+			attrs := make([]attribute.KeyValue, 0, len(m.Label))
+			for _, lp := range m.Label {
+				if v, isTargetLabel := tl[lp.GetName()]; !isTargetLabel || v != lp.GetValue() {
+					attrs = append(attrs, attribute.String(lp.GetName(), lp.GetValue()))
+				}
+			}
+			ts := now
+			if m.TimestampMs != nil {
+				ts = time.UnixMilli(m.GetTimestampMs())
+			}
+			i, found := g.index[mf.GetName()]
+			if !found {
+				i = len(g.metrics)
+				g.index[mf.GetName()] = i
+				g.metrics = append(g.metrics, metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp()})
+			}
+			appendDataPoint(&g.metrics[i], mf.GetType(), m, attribute.NewSet(attrs...), s.start, ts)
+		}
+	}
+
+	var errs []error
+	for _, key := range order {
+		g := groups[key]
+		rm := &metricdata.ResourceMetrics{
+			Resource:     otlpResource(g.labels),
+			ScopeMetrics: []metricdata.ScopeMetrics{{Scope: otlpScope, Metrics: g.metrics}},
+		}
+		if err := s.exp.Export(ctx, rm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// close implements sink.
+func (s *otlpSink) close(ctx context.Context) error {
+	return s.exp.Shutdown(ctx)
+}
+
+// otlpResource returns the resource of a target with the given labels, the exporter itself if nil.
+func otlpResource(labels map[string]string) *resource.Resource {
+	if labels == nil {
+		return resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("sql_exporter"))
+	}
+	attrs := make([]attribute.KeyValue, 0, len(labels))
+	for name, value := range labels {
+		switch name {
+		case "job":
+			attrs = append(attrs, semconv.ServiceName(value))
+		case "instance":
+			attrs = append(attrs, semconv.ServiceInstanceID(value))
+		default:
+			attrs = append(attrs, attribute.String(name, value))
+		}
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
+// appendDataPoint appends a data point converted from m to md, as a monotonic cumulative sum for counters, a histogram
+// for histograms and a gauge for gauges and untyped metrics. Summaries (which SQL Exporter never produces) are not
+// supported.
+func appendDataPoint(
+	md *metricdata.Metrics, typ dto.MetricType, m *dto.Metric, attrs attribute.Set, start, ts time.Time) {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		sum, _ := md.Data.(metricdata.Sum[float64])
+		sum.Temporality, sum.IsMonotonic = metricdata.CumulativeTemporality, true
+		sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+			Attributes: attrs, StartTime: start, Time: ts, Value: m.GetCounter().GetValue(),
+		})
+		md.Data = sum
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		value := m.GetGauge().GetValue()
+		if typ == dto.MetricType_UNTYPED {
+			value = m.GetUntyped().GetValue()
+		}
+		gauge, _ := md.Data.(metricdata.Gauge[float64])
+		gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+			Attributes: attrs, Time: ts, Value: value,
+		})
+		md.Data = gauge
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		dp := metricdata.HistogramDataPoint[float64]{
+			Attributes: attrs, StartTime: start, Time: ts, Count: h.GetSampleCount(), Sum: h.GetSampleSum(),
+		}
+		// Prometheus bucket counts are cumulative, OTLP ones aren't. The +Inf bucket is implicit.
+		var cumulative uint64
+		for _, b := range h.Bucket {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				continue
+			}
+			dp.Bounds = append(dp.Bounds, b.GetUpperBound())
+			dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount()-cumulative)
+			cumulative = b.GetCumulativeCount()
+		}
+		dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-cumulative)
+		hist, _ := md.Data.(metricdata.Histogram[float64])
+		hist.Temporality = metricdata.CumulativeTemporality
+		hist.DataPoints = append(hist.DataPoints, dp)
+		md.Data = hist
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// printConfig implements the `print-config` command: it prints the effective configuration to stdout, as loaded by the
+// exporter. That is with defaults filled in, collector files, bundled collectors and collectors extending others
+// resolved, the collectors applied to targets overriding their job's listed and secrets redacted.
+func printConfig(configFile string, args []string) int {
+	flags := newCommandFlagSet("print-config", &configFile)
+	format := flags.String("format", "yaml", "Output format, one of yaml or json.")
+	flags.Parse(args)
+	if flags.NArg() > 0 || (*format != "yaml" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "Usage: sql_exporter print-config [--format=yaml|json]")
+		return 2
+	}
+
+	c, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var buf []byte
+	if *format == "json" {
+		buf, err = c.JSON()
+		buf = append(buf, '\n')
+	} else {
+		buf, err = c.YAML()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(buf)
+	return 0
+}
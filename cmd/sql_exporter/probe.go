@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/free/sql_exporter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ProbeHandlerFunc is the HTTP handler for the `/probe` endpoint. It collects metrics from the single target specified
+// by the `target` URL parameter (either a target name or, if allowed by the job's probe_dsns, a data source name),
+// created on the fly from the job named by the optional `job` parameter. An optional comma separated list of
+// `collectors` overrides the job's collectors. Any `collect[]` parameters further restrict the collectors to run.
+func ProbeHandlerFunc(
+	exporter sql_exporter.Exporter, opts promhttp.HandlerOpts) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		target := params.Get("target")
+		if target == "" {
+			http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		var collectors []string
+		if cs := params.Get("collectors"); cs != "" {
+			collectors = strings.Split(cs, ",")
+		}
+		collect, err := collectParams(exporter, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		gatherer, err := exporter.Probe(params.Get("job"), target, collectors)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		promhttp.HandlerFor(sql_exporter.WithCollectors(gatherer, collect), opts).ServeHTTP(w, r)
+	}
+}
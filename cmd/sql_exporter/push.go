@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sink is a destination the metrics collected by the exporter are pushed to periodically, for systems that don't
+// scrape Prometheus exporters.
+type sink interface {
+	// push sends the collected metric families to the destination.
+	push(ctx context.Context, mfs []*dto.MetricFamily) error
+	// close flushes any pending metrics and releases the sink's resources.
+	close(ctx context.Context) error
+}
+
+// runSink gathers metrics from g every interval and pushes them to s, until ctx is canceled. Gathering errors (e.g. a
+// target being down) are logged and whatever metrics were gathered are pushed regardless. Pushes time out after
+// interval.
+func runSink(ctx context.Context, logger *slog.Logger, g prometheus.Gatherer, interval time.Duration, s sink) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		mfs, err := g.Gather()
+		if err != nil {
+			logger.Warn("Error gathering metrics", "err", err)
+		}
+		if len(mfs) == 0 {
+			continue
+		}
+		pushCtx, cancel := context.WithTimeout(ctx, interval)
+		if err := s.push(pushCtx, mfs); err != nil {
+			logger.Error("Error pushing metrics", "err", err)
+		}
+		cancel()
+	}
+}
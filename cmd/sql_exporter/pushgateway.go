@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/free/sql_exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// labelsFlag is a repeatable `name=value` command line flag, collecting label values by name.
+type labelsFlag map[string]string
+
+// String implements flag.Value.
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for name, value := range l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value.
+func (l labelsFlag) Set(s string) error {
+	name, value, found := strings.Cut(s, "=")
+	if !found || !model.LabelName(name).IsValid() {
+		return fmt.Errorf("expecting name=value, got %q", s)
+	}
+	if name == "job" || name == "instance" {
+		return fmt.Errorf("reserved label %q", name)
+	}
+	l[name] = value
+	return nil
+}
+
+// pushgatewaySink is a sink pushing metrics to a Pushgateway. The metrics of each job are pushed to a group of their
+// own, with the job name and the configured grouping labels as grouping key, replacing the group's previous metrics.
+type pushgatewaySink struct {
+	url      string
+	grouping map[string]string
+	client   *http.Client
+}
+
+// newPushgatewaySink returns a pushgatewaySink pushing to the Pushgateway at pushURL (http://host:port, optionally
+// followed by a path prefix; the scheme may be omitted), with the given extra grouping labels.
+func newPushgatewaySink(pushURL string, grouping map[string]string) *pushgatewaySink {
+	if !strings.Contains(pushURL, "://") {
+		pushURL = "http://" + pushURL
+	}
+	return &pushgatewaySink{url: strings.TrimSuffix(pushURL, "/"), grouping: grouping, client: &http.Client{}}
+}
+
+// push implements sink.
+func (s *pushgatewaySink) push(ctx context.Context, mfs []*dto.MetricFamily) error {
+	// Split the metric families by job, keeping the order of metric families.
+	var jobs []string
+	byJob := make(map[string][]*dto.MetricFamily)
+	for _, mf := range mfs {
+		metrics := make(map[string][]*dto.Metric)
+		for _, m := range mf.Metric {
+			job := "sql_exporter"
+			for _, lp := range m.Label {
+				if lp.GetName() == "job" {
+					job = lp.GetValue()
+				}
+			}
+			if _, found := byJob[job]; !found {
+				byJob[job] = nil
+				jobs = append(jobs, job)
+			}
+			metrics[job] = append(metrics[job], m)
+		}
+		for job, ms := range metrics {
+			byJob[job] = append(byJob[job], &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: ms})
+		}
+	}
+
+	var errs []error
+	for _, job := range jobs {
+		if err := s.pushGroup(ctx, job, byJob[job]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pushGroup replaces the metrics of the named job's group with mfs.
+func (s *pushgatewaySink) pushGroup(ctx context.Context, job string, mfs []*dto.MetricFamily) error {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	path := "/metrics/job" + groupingKeyComponent(job)
+	names := make([]string, 0, len(s.grouping))
+	for name := range s.grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += "/" + name + groupingKeyComponent(s.grouping[name])
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// Ignore any error reading the body, it's only used for the error message.
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d pushing to %s: %s", resp.StatusCode, s.url+path,
+			strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// close implements sink.
+func (s *pushgatewaySink) close(context.Context) error {
+	return nil
+}
+
+// groupingKeyComponent returns the URL path component (including the leading slash) encoding a grouping label value,
+// base64 encoded if empty or containing slashes, as supported by the Pushgateway.
+func groupingKeyComponent(value string) string {
+	switch {
+	case value == "":
+		return "@base64/="
+	case strings.Contains(value, "/"):
+		return "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	default:
+		return "/" + url.PathEscape(value)
+	}
+}
+
+// pushMetrics implements the `push` command: it collects metrics from all targets (or only those of the named job)
+// once, pushes them to a Pushgateway and exits, with a non-zero exit code if the push failed.
+func pushMetrics(configFile string, args []string) int {
+	flags := newCommandFlagSet("push", &configFile)
+	pushURL := flags.String("pushgateway.url", "", "URL of the Pushgateway to push metrics to.")
+	grouping := labelsFlag{}
+	flags.Var(grouping, "pushgateway.grouping-label", "Grouping label to push metrics with, besides the job, as "+
+		"name=value. May be repeated.")
+	job := flags.String("job", "", "Name of the job to collect metrics from. Defaults to all jobs.")
+	timeout := flags.Duration("timeout", time.Minute, "How long to wait for the push to complete.")
+	flags.Parse(args)
+	if *pushURL == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: sql_exporter push --pushgateway.url=<url> [--pushgateway.grouping-label="+
+			"<name=value> ...] [--job=<name>]")
+		return 2
+	}
+
+	exporter, err := sql_exporter.NewExporter(nil, configFile, prometheus.NewRegistry())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	defer exporter.Shutdown(ctx)
+
+	var g prometheus.Gatherer = exporter
+	if *job != "" {
+		if !hasJob(exporter.Config(), *job) {
+			fmt.Fprintf(os.Stderr, "Unknown job %q\n", *job)
+			return 2
+		}
+		g = exporter.JobGatherer(*job)
+	}
+	mfs, err := g.Gather()
+	if err != nil {
+		// Push whatever was collected regardless, including the `up` metrics of targets that are down.
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err := newPushgatewaySink(*pushURL, grouping).push(ctx, mfs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
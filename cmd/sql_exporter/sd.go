@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/free/sql_exporter"
+)
+
+// sdTargetGroup is a target group in Prometheus HTTP service discovery format.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// SDHandlerFunc is the HTTP handler for the `/sd` endpoint, returning one target group per target of every job (defined
+// by the configuration, discovered or added at runtime), in Prometheus HTTP service discovery format. Each points
+// Prometheus at the per-job metrics path (or `/probe`, if there is none) of the target's job, restricted to the target
+// via the `target` URL parameter, and carries the target's labels (`job` and `instance` included).
+//
+// The exporter address is the one the request was sent to, or the job's own listen address, if it has one.
+func SDHandlerFunc(
+	exporter sql_exporter.Exporter, metricsPath, jobsPath string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		addresses := make(map[string]string)
+		for _, jc := range exporter.Config().Jobs {
+			if jc.ListenAddress == "" {
+				continue
+			}
+			jobHost, port, err := net.SplitHostPort(jc.ListenAddress)
+			if err != nil {
+				continue
+			}
+			if ip := net.ParseIP(jobHost); jobHost == "" || ip != nil && ip.IsUnspecified() {
+				jobHost = host
+			}
+			addresses[jc.Name] = net.JoinHostPort(jobHost, port)
+		}
+
+		groups := []sdTargetGroup{}
+		for _, ts := range exporter.Targets() {
+			labels := make(map[string]string, len(ts.Labels)+3)
+			for name, value := range ts.Labels {
+				labels[name] = value
+			}
+			labels["__param_target"] = ts.Name
+			address, found := addresses[ts.Job]
+			switch {
+			case found:
+				labels["__metrics_path__"] = metricsPath
+			case jobsPath != "/":
+				address = r.Host
+				labels["__metrics_path__"] = jobsPath + ts.Job
+			default:
+				address = r.Host
+				labels["__metrics_path__"] = "/probe"
+				labels["__param_job"] = ts.Job
+			}
+			groups = append(groups, sdTargetGroup{Targets: []string{address}, Labels: labels})
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(groups)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/free/sql_exporter"
+)
+
+// TargetsHandlerFunc is the HTTP handler for the `/targets` page, listing all jobs' targets with their status.
+func TargetsHandlerFunc(metricsPath string, exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetsTemplate.Execute(w, &tdata{
+			MetricsPath: metricsPath,
+			DocsUrl:     docsUrl,
+			Targets:     exporter.Targets(),
+		})
+	}
+}
+
+// TargetsAPIHandlerFunc is the HTTP handler for the `/api/v1/targets` endpoint, returning the status of all jobs'
+// targets in JSON format, in a Prometheus API style `{"status": "success", "data": [...]}` envelope.
+func TargetsAPIHandlerFunc(exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targets := exporter.Targets()
+		if targets == nil {
+			targets = []sql_exporter.TargetStatus{}
+		}
+		apiSuccess(w, targets)
+	}
+}
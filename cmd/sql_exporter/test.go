@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// testCollector implements the `test` command: it runs a collector (or all of a target's collectors) once against a
+// target, printing the collected samples in text exposition format to stdout and the time taken by each query to
+// stderr.
+func testCollector(configFile string, args []string) int {
+	flags := newCommandFlagSet("test", &configFile)
+	target := flags.String("target", "",
+		"Name of the target to collect from (or data source name, if allowed by the job's probe_dsns).")
+	collector := flags.String("collector", "", "Name of the collector to run. Defaults to the target's collectors.")
+	job := flags.String("job", "", "Name of the job to create the target from. Defaults to the target's job.")
+	flags.Parse(args)
+	if *target == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: sql_exporter test --target=<name|dsn> [--collector=<name>] [--job=<name>]")
+		return 2
+	}
+
+	c, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var collectors []string
+	if *collector != "" {
+		collectors = []string{*collector}
+	}
+	probe, err := sql_exporter.NewProbe(nil, c, *job, *target, collectors)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	mfs, gatherErr := probe.Gather()
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, mf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	printQueryTimings()
+	if gatherErr != nil {
+		fmt.Fprintln(os.Stderr, gatherErr)
+		return 1
+	}
+	return 0
+}
+
+// printQueryTimings prints the duration and number of rows returned of every query run so far to stderr.
+func printQueryTimings() {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	type timing struct {
+		duration time.Duration
+		rows     float64
+	}
+	timings := make(map[string]*timing)
+	for _, mf := range mfs {
+		if mf.GetName() != "sql_exporter_query_duration_seconds" && mf.GetName() != "sql_exporter_query_rows_returned" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			query := fmt.Sprintf("collector=%q, query=%q", labelValue(m, "collector"), labelValue(m, "query"))
+			t, found := timings[query]
+			if !found {
+				t = &timing{}
+				timings[query] = t
+			}
+			if h := m.GetHistogram(); h != nil {
+				t.duration = time.Duration(h.GetSampleSum() * float64(time.Second))
+			} else {
+				t.rows = m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	queries := make([]string, 0, len(timings))
+	for query := range timings {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+	for _, query := range queries {
+		t := timings[query]
+		fmt.Fprintf(os.Stderr, "# %s: %s, %g row(s)\n", query, t.duration.Round(time.Microsecond), t.rows)
+	}
+}
+
+// labelValue returns the value of the named label of m, empty if m has no such label.
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v2"
+)
+
+// ruleTestFile is a collector unit test file, as run by the `test-rules` command.
+type ruleTestFile struct {
+	// Configuration file defining the collectors under test, relative to the test file. Defaults to --config.file.
+	ConfigFile string      `yaml:"config_file,omitempty"`
+	Tests      []*ruleTest `yaml:"tests"`
+}
+
+// ruleTest runs a collector against query fixtures and compares the collected metrics to the expected ones.
+type ruleTest struct {
+	Name      string            `yaml:"name"`
+	Collector string            `yaml:"collector"`
+	Labels    map[string]string `yaml:"labels,omitempty"` // target labels, applied to all metrics
+	Fixtures  []*queryFixture   `yaml:"fixtures"`
+	// Expected metrics, in text exposition format. HELP and TYPE lines are optional, sample order is irrelevant.
+	ExpectedMetrics string `yaml:"expected_metrics"`
+	// Substrings of the expected collection errors, if any.
+	ExpectedErrors []string `yaml:"expected_errors,omitempty"`
+}
+
+// queryFixture is the result returned by a query: a single result set, multiple result sets or an error.
+type queryFixture struct {
+	// Query name, metric name (for metrics defining their own query) or query text (e.g. of a `when` query).
+	Query            string `yaml:"query"`
+	resultSetFixture `yaml:",inline"`
+	ResultSets       []*resultSetFixture `yaml:"result_sets,omitempty"`
+	Error            string              `yaml:"error,omitempty"`
+}
+
+// resultSetFixture is a query result set, either listing columns and rows or read from a CSV file with a header row.
+type resultSetFixture struct {
+	Columns []string        `yaml:"columns,omitempty"`
+	Rows    [][]interface{} `yaml:"rows,omitempty"`
+	// CSV file, relative to the test file. `NULL` cells are NULL.
+	CSVFile string `yaml:"csv_file,omitempty"`
+}
+
+// testRules implements the `test-rules` command: it runs the collector unit tests defined by the test files given as
+// arguments, against mock databases returning fixtures instead of query results.
+func testRules(configFile string, args []string) int {
+	flags := newCommandFlagSet("test-rules", &configFile)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: sql_exporter test-rules <test file>...")
+		return 2
+	}
+
+	failed := false
+	for _, file := range flags.Args() {
+		fmt.Printf("Unit testing: %s\n", file)
+		if err := runRuleTestFile(file, configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "  FAILED:\n%s\n", err)
+			failed = true
+			continue
+		}
+		fmt.Println("  SUCCESS")
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runRuleTestFile runs the tests in file, returning an error describing all failed tests, if any.
+func runRuleTestFile(file, configFile string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var tf ruleTestFile
+	if err := yaml.UnmarshalStrict(buf, &tf); err != nil {
+		return fmt.Errorf("    error parsing %s: %s", file, err)
+	}
+	dir := filepath.Dir(file)
+	if tf.ConfigFile != "" {
+		configFile = tf.ConfigFile
+		if !filepath.IsAbs(configFile) {
+			configFile = filepath.Join(dir, configFile)
+		}
+	}
+	c, err := config.Load(configFile)
+	if err != nil {
+		return fmt.Errorf("    %s", err)
+	}
+
+	var failures []string
+	for i, t := range tf.Tests {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := t.run(c, dir); err != nil {
+			msg := strings.Replace(err.Error(), "\n", "\n      ", -1)
+			failures = append(failures, fmt.Sprintf("    test %s:\n      %s", name, msg))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// run runs the test against the collectors of c, with fixture files relative to dir.
+func (t *ruleTest) run(c *config.Config, dir string) error {
+	cc := c.Collector(t.Collector)
+	if cc == nil {
+		return fmt.Errorf("unknown collector %q", t.Collector)
+	}
+	fixtures := make(map[string]*sql_exporter.Fixture, len(t.Fixtures))
+	for _, qf := range t.Fixtures {
+		f, err := qf.fixture(dir)
+		if err != nil {
+			return err
+		}
+		fixtures[qf.Query] = f
+	}
+	expected, err := parseSamples(t.ExpectedMetrics)
+	if err != nil {
+		return fmt.Errorf("error parsing expected_metrics: %s", err)
+	}
+
+	mfs, collectErr := sql_exporter.CollectFixtures(cc, t.Labels, fixtures)
+	var problems []string
+	var errs []error
+	if me, ok := collectErr.(prometheus.MultiError); ok {
+		errs = me
+	} else if collectErr != nil {
+		errs = []error{collectErr}
+	}
+	for _, err := range errs {
+		if !containsAny(err.Error(), t.ExpectedErrors) {
+			problems = append(problems, fmt.Sprintf("unexpected error: %s", err))
+		}
+	}
+	for _, expectedErr := range t.ExpectedErrors {
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), expectedErr)
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("missing error: %s", expectedErr))
+		}
+	}
+
+	var text bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&text, mf); err != nil {
+			return err
+		}
+	}
+	actual, err := parseSamples(text.String())
+	if err != nil {
+		return err
+	}
+	for _, s := range expected {
+		if !contains(actual, s) {
+			problems = append(problems, fmt.Sprintf("missing sample: %s", s))
+		}
+	}
+	for _, s := range actual {
+		if !contains(expected, s) {
+			problems = append(problems, fmt.Sprintf("unexpected sample: %s", s))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// fixture returns the sql_exporter.Fixture defined by qf, with CSV files relative to dir.
+func (qf *queryFixture) fixture(dir string) (*sql_exporter.Fixture, error) {
+	if qf.Query == "" {
+		return nil, fmt.Errorf("fixture without query")
+	}
+	if qf.Error != "" {
+		return &sql_exporter.Fixture{Err: fmt.Errorf("%s", qf.Error)}, nil
+	}
+	resultSets := qf.ResultSets
+	if len(resultSets) == 0 {
+		resultSets = []*resultSetFixture{&qf.resultSetFixture}
+	}
+	f := &sql_exporter.Fixture{}
+	for _, rsf := range resultSets {
+		rs, err := rsf.resultSet(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s for fixture of query %q", err, qf.Query)
+		}
+		f.ResultSets = append(f.ResultSets, rs)
+	}
+	return f, nil
+}
+
+// resultSet returns the result set defined by rsf, with CSV files relative to dir.
+func (rsf *resultSetFixture) resultSet(dir string) (sql_exporter.FixtureResultSet, error) {
+	if rsf.CSVFile == "" {
+		if len(rsf.Columns) == 0 {
+			return sql_exporter.FixtureResultSet{}, fmt.Errorf("no columns or csv_file defined")
+		}
+		return sql_exporter.FixtureResultSet{Columns: rsf.Columns, Rows: rsf.Rows}, nil
+	}
+	if len(rsf.Columns) > 0 || len(rsf.Rows) > 0 {
+		return sql_exporter.FixtureResultSet{}, fmt.Errorf("csv_file and columns or rows defined")
+	}
+
+	file := rsf.CSVFile
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return sql_exporter.FixtureResultSet{}, err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return sql_exporter.FixtureResultSet{}, fmt.Errorf("error reading %s: %s", file, err)
+	}
+	if len(records) == 0 {
+		return sql_exporter.FixtureResultSet{}, fmt.Errorf("no header row in %s", file)
+	}
+	rs := sql_exporter.FixtureResultSet{Columns: records[0]}
+	for _, record := range records[1:] {
+		row := make([]interface{}, len(record))
+		for i, cell := range record {
+			if cell != "NULL" {
+				row[i] = cell
+			}
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+	return rs, nil
+}
+
+// parseSamples parses metrics in text exposition format into a sorted list of samples, each formatted as the metric
+// name, sorted labels, value and timestamp (if any). Histograms are expanded into their bucket, sum and count samples.
+func parseSamples(text string) ([]string, error) {
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	var samples []string
+	for name, mf := range mfs {
+		for _, m := range mf.Metric {
+			if h := m.GetHistogram(); h != nil && mf.GetType() == dto.MetricType_HISTOGRAM {
+				for _, b := range h.Bucket {
+					labels := bucketLabels(m.Label, formatFloat(b.GetUpperBound()))
+					samples = append(samples, formatSample(name+"_bucket", labels, float64(b.GetCumulativeCount()), m))
+				}
+				if !hasInfBucket(h) {
+					labels := bucketLabels(m.Label, "+Inf")
+					samples = append(samples, formatSample(name+"_bucket", labels, float64(h.GetSampleCount()), m))
+				}
+				samples = append(samples, formatSample(name+"_sum", m.Label, h.GetSampleSum(), m))
+				samples = append(samples, formatSample(name+"_count", m.Label, float64(h.GetSampleCount()), m))
+				continue
+			}
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				value = m.GetUntyped().GetValue()
+			default:
+				return nil, fmt.Errorf("unsupported type %s of metric %s", mf.GetType(), name)
+			}
+			samples = append(samples, formatSample(name, m.Label, value, m))
+		}
+	}
+	sort.Strings(samples)
+	return samples, nil
+}
+
+// formatSample formats a sample with the given name, labels and value and the timestamp of m, if any.
+func formatSample(name string, labels []*dto.LabelPair, value float64, m *dto.Metric) string {
+	pairs := make([]string, 0, len(labels))
+	for _, lp := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+	}
+	sort.Strings(pairs)
+	s := fmt.Sprintf("%s{%s} %s", name, strings.Join(pairs, ","), formatFloat(value))
+	if m.TimestampMs != nil {
+		s += " " + strconv.FormatInt(m.GetTimestampMs(), 10)
+	}
+	return s
+}
+
+// formatFloat formats f like the text exposition format does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// bucketLabels returns a copy of labels, plus the `le` label of a histogram bucket with the given upper bound.
+func bucketLabels(labels []*dto.LabelPair, le string) []*dto.LabelPair {
+	return append(append(make([]*dto.LabelPair, 0, len(labels)+1), labels...),
+		&dto.LabelPair{Name: proto.String("le"), Value: proto.String(le)})
+}
+
+// hasInfBucket returns true if the histogram has an explicit +Inf bucket.
+func hasInfBucket(h *dto.Histogram) bool {
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if the sorted list of samples contains s.
+func contains(samples []string, s string) bool {
+	i := sort.SearchStrings(samples, s)
+	return i < len(samples) && samples[i] == s
+}
+
+// containsAny returns true if s contains any of the substrings.
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/prometheus/common/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// setupTracing makes the exporter export spans of scrapes, targets, collectors and queries via OTLP over HTTP to
+// endpoint (host:port), sampling the given ratio of scrapes. Export errors are logged to logger. It returns a function
+// flushing any pending spans and shutting down the span exporter.
+func setupTracing(logger *slog.Logger, endpoint string, insecure bool, samplingRatio float64) (
+	func(context.Context) error, error) {
+	if samplingRatio < 0 || samplingRatio > 1 {
+		return nil, fmt.Errorf("invalid --tracing.sampling-ratio %g, expecting a value between 0 and 1", samplingRatio)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	// Only fails on invalid options, spans are exported in the background.
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("sql_exporter"),
+			semconv.ServiceVersion(version.Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("Error exporting spans", "err", err)
+	}))
+	return tp.Shutdown, nil
+}
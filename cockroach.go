@@ -0,0 +1,66 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// cockroachFollowerReadsOption is the startup option enabling follower reads for all read-only transactions.
+const cockroachFollowerReadsOption = "-c default_transaction_use_follower_reads=on"
+
+// isPostgresDSN returns true if dsn is for the PostgreSQL driver, the one used to connect to CockroachDB.
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// isCockroachDB returns true if the server conn is connected to is CockroachDB rather than PostgreSQL.
+func isCockroachDB(ctx context.Context, conn *sql.DB) (bool, error) {
+	var version string
+	if err := conn.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+		return false, err
+	}
+	return strings.Contains(version, "CockroachDB"), nil
+}
+
+// isSerializationFailure returns true if err is a serialization failure, which CockroachDB returns whenever a
+// transaction conflicts with another and must be retried by the client.
+func isSerializationFailure(err error) bool {
+	e, ok := errors.Cause(err).(*pq.Error)
+	return ok && e.Code == "40001"
+}
+
+// withFollowerReads returns the PostgreSQL driver DSN with follower reads enabled, via the `options` parameter.
+func withFollowerReads(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	options := params.Get("options")
+	if options != "" {
+		options += " "
+	}
+	params.Set("options", options+cockroachFollowerReadsOption)
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// serializationRetriesKey is the context key under which the number of retries of serialization failures is stored.
+type serializationRetriesKey struct{}
+
+// withSerializationRetries returns a copy of ctx that makes collectors retry queries failing with serialization errors
+// up to the given number of times.
+func withSerializationRetries(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, serializationRetriesKey{}, retries)
+}
+
+// serializationRetriesFromContext returns the number of retries of serialization failures, zero if not set.
+func serializationRetriesFromContext(ctx context.Context) int {
+	retries, _ := ctx.Value(serializationRetriesKey{}).(int)
+	return retries
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/free/sql_exporter/config"
-	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Collector is a self-contained group of SQL queries and metric families to collect from a specific database. It is
@@ -16,6 +20,22 @@ import (
 type Collector interface {
 	// Collect is the equivalent of prometheus.Collector.Collect() but takes a context to run in and a database to run on.
 	Collect(context.Context, *sql.DB, chan<- Metric)
+	// Name returns the collector name, as configured.
+	Name() string
+}
+
+// backgroundCollector is implemented by Collectors doing work in the background, which must be stopped (and waited
+// for) before the database they collect from is closed.
+type backgroundCollector interface {
+	// stop cancels any background work and waits for it to complete.
+	stop()
+}
+
+// stopCollector stops the background work of c, if any.
+func stopCollector(c Collector) {
+	if bc, ok := c.(backgroundCollector); ok {
+		bc.stop()
+	}
 }
 
 // collector implements Collector. It wraps a collection of queries, metrics and the database to collect them from.
@@ -23,22 +43,41 @@ type collector struct {
 	config     *config.CollectorConfig
 	queries    []*Query
 	logContext string
+	logger     *slog.Logger
+
+	// Descriptors of the derived metrics, indexed like config.DerivedMetrics.
+	derivedDescs []MetricDesc
 }
 
-// NewCollector returns a new Collector with the given configuration and database. The metrics it creates will all have
-// the provided const labels applied.
-func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair) (Collector, error) {
+// NewCollector returns a new Collector with the given configuration. The database to run its queries on is provided
+// on every Collect() call, so it may be any *sql.DB (e.g. one owned by an application embedding the exporter), with
+// queries prepared on every handle they run on. The metrics it creates will all have the provided const labels
+// applied. The job and target names are only used to label query execution metrics.
+func NewCollector(logger *slog.Logger, logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair,
+	jobName, targetName string) (Collector, error) {
 	logContext = fmt.Sprintf("%s, collector=%q", logContext, cc.Name)
+	logger = orDefaultLogger(logger).With("collector", cc.Name)
+	if cc.Plugin != nil {
+		return newPluginCollector(logger, logContext, cc, constLabels)
+	}
 
 	// Maps each query to the list of metric families it populates.
 	queryMFs := make(map[*config.QueryConfig][]*MetricFamily, len(cc.Metrics))
 
 	// Instantiate metric families.
 	for _, mc := range cc.Metrics {
-		mf, err := NewMetricFamily(logContext, mc, constLabels)
+		mf, err := NewMetricFamily(logger, logContext, mc, constLabels)
 		if err != nil {
 			return nil, err
 		}
+		metricLabels := prometheus.Labels{"job": jobName, "target": targetName, "collector": cc.Name, "metric": mc.Name}
+		if mc.CounterResets != "" {
+			mf.counters = newCounterTracker(mc.CounterResets, counterResets.With(metricLabels))
+		}
+		if mc.MaxSeries > 0 || len(mc.AllowedLabelValues()) > 0 || len(mc.DeniedLabelValues()) > 0 {
+			mf.limits = newSeriesLimiter(
+				mf.logger, mc.AllowedLabelValues(), mc.DeniedLabelValues(), mc.MaxSeries, metricLabels)
+		}
 		mfs, found := queryMFs[mc.Query()]
 		if !found {
 			mfs = make([]*MetricFamily, 0, 2)
@@ -47,22 +86,42 @@ func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*
 	}
 
 	// Instantiate queries.
+	queryLabels := prometheus.Labels{"job": jobName, "target": targetName, "collector": cc.Name}
+	targetLabels := make(map[string]string, len(constLabels))
+	for _, lp := range constLabels {
+		targetLabels[lp.GetName()] = lp.GetValue()
+	}
 	queries := make([]*Query, 0, len(cc.Metrics))
 	for qc, mfs := range queryMFs {
-		q, err := NewQuery(logContext, qc, mfs...)
+		q, err := NewQuery(logger, logContext, qc, queryLabels, mfs...)
 		if err != nil {
 			return nil, err
 		}
+		if err := q.bindParameters(targetLabels); err != nil {
+			return nil, err
+		}
 		queries = append(queries, q)
 	}
 
+	derivedDescs := make([]MetricDesc, 0, len(cc.DerivedMetrics))
+	for _, dm := range cc.DerivedMetrics {
+		derivedDescs = append(derivedDescs, NewAutomaticMetricDesc(
+			fmt.Sprintf("%s, metric=%q", logContext, dm.Name), dm.Name, dm.Help, dm.ValueType(), nil))
+	}
+
 	c := collector{
-		config:     cc,
-		queries:    queries,
-		logContext: logContext,
+		config:       cc,
+		queries:      queries,
+		logContext:   logContext,
+		logger:       logger,
+		derivedDescs: derivedDescs,
+	}
+	if c.config.CacheTTL > 0 {
+		logger.Debug("Non-zero cache_ttl, creating revalidating collector", "cache_ttl", c.config.CacheTTL)
+		return newRevalidatingCollector(&c, constLabels), nil
 	}
 	if c.config.MinInterval > 0 {
-		log.V(2).Infof("[%s] Non-zero min_interval (%s), creating cached collector.", logContext, c.config.MinInterval)
+		logger.Debug("Non-zero min_interval, creating cached collector", "min_interval", c.config.MinInterval)
 		return newCachingCollector(&c), nil
 	}
 	return &c, nil
@@ -70,36 +129,218 @@ func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*
 
 // Collect implements Collector.
 func (c *collector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	// The collector timeout (if any) only applies if tighter than the scrape deadline, as would any query timeout.
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.config.Timeout))
+		defer cancel()
+	}
+
+	if len(c.config.DerivedMetrics) == 0 {
+		c.runQueries(ctx, conn, ch)
+		return
+	}
+
+	// Record the metrics referenced by derived metrics on their way through.
+	samples := newDerivedSamples(c.config.DerivedMetrics)
+	queryCh := make(chan Metric, capMetricChan)
+	done := make(chan struct{})
+	go func() {
+		for metric := range queryCh {
+			samples.record(metric)
+			ch <- metric
+		}
+		close(done)
+	}()
+	c.runQueries(ctx, conn, queryCh)
+	close(queryCh)
+	<-done
+	c.collectDerived(samples, ch)
+}
+
+// runQueries runs all the collector's queries in sequence, for as long as the context is not done.
+func (c *collector) runQueries(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
 	for _, q := range c.queries {
 		if ctx.Err() != nil {
 			ch <- NewInvalidMetric(c.logContext, ctx.Err())
 			return
 		}
-		rows, err := q.Run(ctx, conn)
-		if err != nil {
-			// TODO: increment an error counter
-			ch <- NewInvalidMetric(fmt.Sprintf("[%s] error running query", c.logContext), err)
-			continue
+		c.runQuery(ctx, conn, q, ch)
+	}
+}
+
+// runQuery executes a single query and collects the metrics populated from its results, recording the query duration,
+// number of rows returned and errors along the way.
+func (c *collector) runQuery(ctx context.Context, conn *sql.DB, q *Query, ch chan<- Metric) {
+	if q.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(q.config.Timeout))
+		defer cancel()
+	}
+
+	if err := queryLimiter.acquire(ctx); err != nil {
+		q.metrics.recordError(err)
+		ch <- NewInvalidMetric(fmt.Sprintf("[%s] error waiting to run query", c.logContext), err)
+		return
+	}
+	defer queryLimiter.release()
+
+	q.resetSeriesLimits()
+	if enabled, err := q.Enabled(ctx, conn); err != nil {
+		q.metrics.recordError(err)
+		ch <- NewInvalidMetric(fmt.Sprintf("[%s] error running query", c.logContext), err)
+		return
+	} else if !enabled {
+		return
+	}
+
+	rq := queryRecorderFromContext(ctx).query(c.config.Name, q.config.Name)
+	defer rq.done()
+	ctx, span := tracer.Start(ctx, "query", trace.WithAttributes(attribute.String("sql_exporter.query", q.config.Name)))
+	queryStart := time.Now()
+	rows, outputs, err := c.runWithRetries(ctx, conn, q)
+	if err != nil {
+		endSpan(span, err)
+		logQuery(q, time.Since(queryStart), 0, err)
+		rq.fail(err)
+		q.metrics.recordError(err)
+		ch <- NewInvalidMetric(fmt.Sprintf("[%s] error running query", c.logContext), err)
+		return
+	}
+
+	run := &queryRun{}
+	rowCount := 0
+	if rows != nil {
+		rowCount = c.collectResultSets(q, rows, run, rq, ch)
+	}
+	// Output parameters are only populated once all result sets have been read.
+	if len(q.output.metricFamilies) > 0 {
+		if row, err := q.scanOutputs(outputs); err != nil {
+			run.markIncomplete()
+			q.metrics.recordError(err)
+			ch <- NewInvalidMetric(fmt.Sprintf("[%s] error scanning output parameters", c.logContext), err)
+		} else {
+			for _, mf := range q.output.metricFamilies {
+				mf.collectRow(row, run, ch)
+			}
 		}
-		defer rows.Close()
+	}
+	q.flush(run, ch)
+
+	duration := time.Since(queryStart)
+	q.metrics.duration.Observe(duration.Seconds())
+	q.metrics.rows.Set(float64(rowCount))
+	q.logger.Debug("Query completed", "rows", rowCount, "duration", duration)
+	logQuery(q, duration, rowCount, nil)
+	span.SetAttributes(attribute.Int("sql_exporter.rows", rowCount))
+	span.End()
+}
+
+// collectResultSets collects the metrics populated from the query's result sets (recording them to rq, if not nil),
+// row by row, as part of run, then closes rows. Rows beyond the query's max_rows (or else the collector's), if set, are
+// skipped without being scanned and only counted. It returns the number of rows collected.
+func (c *collector) collectResultSets(
+	q *Query, rows *sql.Rows, run *queryRun, rq *recordedQuery, ch chan<- Metric) int {
+	defer rows.Close()
+
+	maxRows := q.config.MaxRows
+	if maxRows == 0 {
+		maxRows = c.config.MaxRows
+	}
 
+	var err error
+	rowCount, truncated := 0, 0
+	for resultSet := 0; resultSet < q.ResultSets(); resultSet++ {
+		if resultSet > 0 && !rows.NextResultSet() {
+			if rows.Err() == nil {
+				err = fmt.Errorf("[%s] query returned %d result set(s), expecting %d", q.logContext, resultSet, q.ResultSets())
+				run.markIncomplete()
+				q.metrics.recordError(err)
+				ch <- NewInvalidMetric(c.logContext, err)
+			}
+			break
+		}
+		rq.resultSet()
+		metricFamilies := q.MetricFamilies(resultSet)
 		for rows.Next() {
-			row, err := q.ScanRow(rows)
+			if maxRows > 0 && rowCount >= maxRows {
+				// Skip the row without scanning it, only counting it.
+				truncated++
+				continue
+			}
+			rowCount++
+			if len(metricFamilies) == 0 {
+				// Result set not used by any metric, skip it.
+				rq.row(nil)
+				continue
+			}
+			row, err := q.ScanRow(rows, resultSet)
 			if err != nil {
+				run.markIncomplete()
+				q.metrics.recordError(err)
 				ch <- NewInvalidMetric(fmt.Sprintf("[%s] error scanning row", c.logContext), err)
 				continue
 			}
-			for _, mf := range q.metricFamilies {
-				mf.Collect(row, ch)
+			rq.row(row)
+			for _, mf := range metricFamilies {
+				mf.collectRow(row, run, ch)
 			}
 		}
-		rows.Close()
-		if err = rows.Err(); err != nil {
-			ch <- NewInvalidMetric(c.logContext, err)
+	}
+	rows.Close()
+	if truncated > 0 {
+		run.markIncomplete()
+		q.metrics.rowsTruncated.Add(float64(truncated))
+		q.logger.Warn("Query returned more than max_rows rows, discarded the rest", "max_rows", maxRows,
+			"discarded", truncated)
+	}
+	if err = rows.Err(); err != nil {
+		run.markIncomplete()
+		q.metrics.recordError(err)
+		ch <- NewInvalidMetric(c.logContext, err)
+	}
+	return rowCount
+}
+
+// runWithRetries runs the query, retrying up to the configured number of times with exponential backoff for as long as
+// it fails with transient errors and there is enough time left before the context deadline. Only the execution of the
+// query is retried, errors while processing its results are not, as some metrics may have already been collected.
+// Serialization failures on CockroachDB targets are retried at least as many times as the target requests via ctx.
+func (c *collector) runWithRetries(
+	ctx context.Context, conn *sql.DB, q *Query) (*sql.Rows, map[string]interface{}, error) {
+	backoff := time.Duration(c.config.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		rows, outputs, err := q.run(ctx, conn)
+		if err == nil || !isTransientError(err) {
+			return rows, outputs, err
+		}
+		retries := c.config.Retries
+		if n := serializationRetriesFromContext(ctx); n > retries && isSerializationFailure(err) {
+			retries = n
 		}
+		if attempt >= retries {
+			return rows, outputs, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return nil, nil, err
+		}
+
+		q.metrics.recordError(err)
+		q.logger.Debug("Transient error running query, retrying", "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, nil, err
+		}
+		backoff *= 2
 	}
 }
 
+// Name implements Collector.
+func (c *collector) Name() string {
+	return c.config.Name
+}
+
 // newCachingCollector returns a new Collector wrapping the provided raw Collector.
 func newCachingCollector(rawColl *collector) Collector {
 	cc := &cachingCollector{
@@ -124,6 +365,11 @@ type cachingCollector struct {
 	cache []Metric
 }
 
+// Name implements Collector.
+func (cc *cachingCollector) Name() string {
+	return cc.rawColl.Name()
+}
+
 // Collect implements Collector.
 func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
 	if ctx.Err() != nil {
@@ -137,8 +383,7 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 		// Have the lock.
 		if age := collTime.Sub(cacheTime); age > cc.minInterval {
 			// Cache contents are older than minInterval, collect fresh metrics, cache them and pipe them through.
-			log.V(2).Infof("[%s] collecting fresh metrics: min_interval=%.3fs cache_age=%.3fs",
-				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds())
+			cc.rawColl.logger.Debug("Collecting fresh metrics", "min_interval", cc.minInterval, "cache_age", age)
 			cacheChan := make(chan Metric, capMetricChan)
 			cc.cache = make([]Metric, 0, len(cc.cache))
 			go func() {
@@ -151,8 +396,7 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 			}
 			cacheTime = collTime
 		} else {
-			log.V(2).Infof("[%s] returning cached metrics: min_interval=%.3fs cache_age=%.3fs",
-				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds())
+			cc.rawColl.logger.Debug("Returning cached metrics", "min_interval", cc.minInterval, "cache_age", age)
 			for _, metric := range cc.cache {
 				ch <- metric
 			}
@@ -166,3 +410,136 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 		ch <- NewInvalidMetric(cc.rawColl.logContext, ctx.Err())
 	}
 }
+
+// newRevalidatingCollector returns a new Collector wrapping the provided raw Collector, exporting the age of the cached
+// metrics with the provided const labels.
+func newRevalidatingCollector(rawColl *collector, constLabels []*dto.LabelPair) Collector {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &revalidatingCollector{
+		rawColl: rawColl,
+		ttl:     time.Duration(rawColl.config.CacheTTL),
+		cacheAgeDesc: NewAutomaticMetricDesc(rawColl.logContext, collectorCacheAgeName, collectorCacheAgeHelp,
+			prometheus.GaugeValue, constLabels, "collector"),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Collector serving the metrics of its latest collection right away, and collecting fresh metrics in the background
+// once they are older than the TTL (stale-while-revalidate). Only used when cache_ttl is non-zero, instead of
+// cachingCollector.
+type revalidatingCollector struct {
+	// Underlying collector, which is being cached.
+	rawColl *collector
+	// Convenience copy of rawColl.config.CacheTTL.
+	ttl time.Duration
+	// Descriptor of the cache age metric.
+	cacheAgeDesc MetricDesc
+	// Canceled by stop(), along with any background collection.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Tracks background collections, for stop() to wait for.
+	background sync.WaitGroup
+
+	// Protects the fields below.
+	mu sync.Mutex
+	// Metrics of the latest complete collection and when it started, zero if there was none yet.
+	cache     []Metric
+	cacheTime time.Time
+	// Closed once the collection in progress (in the background or filling the cache), if any, completes.
+	refreshed chan struct{}
+}
+
+// Name implements Collector.
+func (rc *revalidatingCollector) Name() string {
+	return rc.rawColl.Name()
+}
+
+// Collect implements Collector.
+func (rc *revalidatingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	rc.mu.Lock()
+	for rc.cacheTime.IsZero() {
+		if rc.refreshed == nil {
+			// Nothing to serve yet, collect (and cache) fresh metrics.
+			rc.refreshed = make(chan struct{})
+			rc.mu.Unlock()
+			rc.refresh(ctx, conn, ch)
+			ch <- NewMetric(rc.cacheAgeDesc, 0, rc.Name())
+			return
+		}
+		// Another scrape is filling the cache, serve its metrics once it's done.
+		refreshed := rc.refreshed
+		rc.mu.Unlock()
+		select {
+		case <-refreshed:
+		case <-ctx.Done():
+			ch <- NewInvalidMetric(rc.rawColl.logContext, ctx.Err())
+			return
+		}
+		rc.mu.Lock()
+	}
+	cache, cacheTime := rc.cache, rc.cacheTime
+	age := time.Since(cacheTime)
+	if age > rc.ttl && rc.refreshed == nil && rc.ctx.Err() == nil {
+		rc.refreshed = make(chan struct{})
+		// Refresh with the scrape's context values (and time budget), canceled by stop() rather than along with the
+		// scrape.
+		var (
+			bgCtx  = context.WithoutCancel(ctx)
+			cancel context.CancelFunc
+		)
+		if deadline, ok := ctx.Deadline(); ok {
+			bgCtx, cancel = context.WithDeadline(bgCtx, deadline)
+		} else {
+			bgCtx, cancel = context.WithCancel(bgCtx)
+		}
+		stopCancel := context.AfterFunc(rc.ctx, cancel)
+		rc.rawColl.logger.Debug("Cached metrics expired, collecting fresh metrics in the background",
+			"cache_ttl", rc.ttl, "cache_age", age)
+		rc.background.Add(1)
+		go func() {
+			defer rc.background.Done()
+			defer stopCancel()
+			defer cancel()
+			rc.refresh(bgCtx, conn, nil)
+		}()
+	}
+	rc.mu.Unlock()
+
+	for _, metric := range cache {
+		ch <- metric
+	}
+	ch <- NewMetric(rc.cacheAgeDesc, age.Seconds(), rc.Name())
+}
+
+// refresh collects fresh metrics, passing them through to ch (if not nil), then replaces the cached metrics with them.
+func (rc *revalidatingCollector) refresh(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	collTime := time.Now()
+	collCh := make(chan Metric, capMetricChan)
+	go func() {
+		rc.rawColl.Collect(ctx, conn, collCh)
+		close(collCh)
+	}()
+	var metrics []Metric
+	for metric := range collCh {
+		metrics = append(metrics, metric)
+		if ch != nil {
+			ch <- metric
+		}
+	}
+
+	rc.mu.Lock()
+	rc.cache, rc.cacheTime = metrics, collTime
+	close(rc.refreshed)
+	rc.refreshed = nil
+	rc.mu.Unlock()
+}
+
+// stop implements backgroundCollector.
+func (rc *revalidatingCollector) stop() {
+	rc.mu.Lock()
+	// Canceled while holding the lock, so no background collection may start once waiting for them.
+	rc.cancel()
+	rc.mu.Unlock()
+	rc.background.Wait()
+}
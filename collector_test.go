@@ -0,0 +1,198 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collectionQuery records a row in table `collections`, returning it.
+const collectionQuery = "INSERT INTO collections (n) VALUES (1) RETURNING n AS v"
+
+// newTestCollector returns a collector with the given settings (in YAML, e.g. `cache_ttl: 1h`) running the given
+// query, and a SQLite database with a `collections` table, limited to a single connection.
+func newTestCollector(t *testing.T, settings, query string) (Collector, *sql.DB) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	c, err := config.Parse([]byte(fmt.Sprintf(`
+jobs:
+  - job_name: test
+    collectors: [test]
+    static_configs:
+      - targets:
+          db: 'sqlite://%s'
+collectors:
+  - collector_name: test
+    %s
+    metrics:
+      - metric_name: collections
+        type: gauge
+        help: 'Collections.'
+        values: [v]
+        query: %s
+`, path, settings, query)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, err := NewCollector(nil, "test", c.Collectors[0], nil, "test", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE collections (n INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	return coll, db
+}
+
+// collections returns the number of collections run on db.
+func collections(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM collections").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// collect runs a collection of c on db, returning the metrics collected.
+func collect(ctx context.Context, c Collector, db *sql.DB) []Metric {
+	ch := make(chan Metric, capMetricChan)
+	go func() {
+		c.Collect(ctx, db, ch)
+		close(ch)
+	}()
+	var metrics []Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// TestRevalidatingCollectorSingleFill checks that concurrent scrapes of a revalidating collector with nothing cached
+// yet run a single collection between them.
+func TestRevalidatingCollectorSingleFill(t *testing.T) {
+	c, db := newTestCollector(t, "cache_ttl: 1h", collectionQuery)
+	ctx := context.Background()
+
+	// Hold the only connection, so the scrapes pile up.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The collection plus the cache age.
+			if metrics := collect(ctx, c, db); len(metrics) != 2 {
+				t.Errorf("got %d metrics, want 2", len(metrics))
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	wg.Wait()
+
+	if n := collections(t, db); n != 1 {
+		t.Errorf("ran %d collections, want 1", n)
+	}
+}
+
+// TestRevalidatingCollectorStop checks that stopping a revalidating collector cancels its background collection and
+// waits for it, and that no further background collections are started.
+func TestRevalidatingCollectorStop(t *testing.T) {
+	c, db := newTestCollector(t, "cache_ttl: 1ms", collectionQuery)
+	ctx := context.Background()
+	collect(ctx, c, db)
+	time.Sleep(10 * time.Millisecond)
+
+	// Hold the only connection, so the background collection blocks.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	collect(ctx, c, db)
+
+	stopped := make(chan struct{})
+	go func() {
+		c.(backgroundCollector).stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop() did not cancel the background collection")
+	}
+	conn.Close()
+
+	collect(ctx, c, db)
+	c.(backgroundCollector).stop()
+	if n := collections(t, db); n != 1 {
+		t.Errorf("ran %d collections, want 1", n)
+	}
+}
+
+// TestCollectorMaxRows checks that rows beyond max_rows are discarded and counted.
+func TestCollectorMaxRows(t *testing.T) {
+	c, db := newTestCollector(t, "max_rows: 2",
+		"WITH RECURSIVE r(v) AS (SELECT 1 UNION ALL SELECT v + 1 FROM r WHERE v < 5) SELECT v FROM r")
+	// The counter is shared by all collectors with the same job, target, collector and query names.
+	truncated := func() float64 {
+		var m dto.Metric
+		if err := c.(*collector).queries[0].metrics.rowsTruncated.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := truncated()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if metrics := collect(ctx, c, db); len(metrics) != 2 {
+			t.Errorf("got %d metrics, want 2", len(metrics))
+		}
+	}
+	// 3 rows discarded by each of 3 executions.
+	if got := truncated() - before; got != 9 {
+		t.Errorf("counted %g truncated rows, want 9", got)
+	}
+}
+
+// TestCollectorMultipleHandles checks that a collector may run on different database handles.
+func TestCollectorMultipleHandles(t *testing.T) {
+	c, db := newTestCollector(t, "", collectionQuery)
+	other, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "other.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.Exec("CREATE TABLE collections (n INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, conn := range []*sql.DB{db, other, db} {
+		if metrics := collect(ctx, c, conn); len(metrics) != 1 {
+			t.Errorf("got %d metrics, want 1", len(metrics))
+		}
+	}
+	if n, m := collections(t, db), collections(t, other); n != 2 || m != 1 {
+		t.Errorf("ran %d and %d collections, want 2 and 1", n, m)
+	}
+}
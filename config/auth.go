@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// AuthConfig defines how a target obtains short lived credentials to log in with, in place of the password in its
+// data source name. May be specified as just the authentication type, e.g. `auth: aws_iam`.
+type AuthConfig struct {
+	Type string `yaml:"type"` // `aws_iam` or `azure_ad`
+	// Region and credentials used to generate RDS authentication tokens, for `aws_iam`.
+	AWSConfig `yaml:",inline"`
+	// Managed identity or service principal used to fetch access tokens, for `azure_ad`.
+	AzureConfig `yaml:",inline"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for AuthConfig.
+func (c *AuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Type); err != nil {
+		type plain AuthConfig
+		if err := unmarshal((*plain)(c)); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch c.Type {
+	case "aws_iam":
+		err = c.AWSConfig.validate("auth")
+	case "azure_ad":
+		err = c.AzureConfig.validate("auth")
+	default:
+		return fmt.Errorf("invalid auth type %q, expecting `aws_iam` or `azure_ad`", c.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	return checkOverflow(c.XXX, "auth")
+}
+
+// IntegratedAuthConfig defines Kerberos or Windows (SSPI) integrated authentication, for SQL Server targets. The user
+// to log in as (if any) is taken from the data source name.
+type IntegratedAuthConfig struct {
+	Method string `yaml:"method"` // `kerberos` or `sspi` (Windows only, as the user the exporter runs as)
+	// Kerberos only: the Kerberos configuration and either a keytab (plus realm) or a credential cache to log in with.
+	Krb5Config      string `yaml:"krb5_config,omitempty"` // default `/etc/krb5.conf`
+	Keytab          string `yaml:"keytab,omitempty"`
+	Realm           string `yaml:"realm,omitempty"`
+	CredentialCache string `yaml:"credential_cache,omitempty"`
+	// Service principal name of the servers, default `MSSQLSvc/<host>:<port>`.
+	ServerSPN string `yaml:"server_spn,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for IntegratedAuthConfig.
+func (c *IntegratedAuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain IntegratedAuthConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Method {
+	case "kerberos":
+		if c.Krb5Config == "" {
+			c.Krb5Config = "/etc/krb5.conf"
+		}
+		if (c.Keytab == "") == (c.CredentialCache == "") {
+			return fmt.Errorf("exactly one of keytab and credential_cache is required for kerberos integrated_auth")
+		}
+		if c.Keytab != "" && c.Realm == "" {
+			return fmt.Errorf("realm is required with keytab for kerberos integrated_auth")
+		}
+	case "sspi":
+		if runtime.GOOS != "windows" {
+			return fmt.Errorf("sspi integrated_auth is only supported on Windows")
+		}
+		if c.Krb5Config != "" || c.Keytab != "" || c.Realm != "" || c.CredentialCache != "" {
+			return fmt.Errorf("krb5_config, keytab, realm and credential_cache only apply to kerberos integrated_auth")
+		}
+	default:
+		return fmt.Errorf("invalid integrated_auth method %q, expecting `kerberos` or `sspi`", c.Method)
+	}
+
+	return checkOverflow(c.XXX, "integrated_auth")
+}
@@ -0,0 +1,21 @@
+package config
+
+import "fmt"
+
+// AWSConfig defines the region and credentials used to access AWS APIs. Credentials not explicitly configured are
+// looked up the usual AWS SDK way: environment variables, shared credentials file, web identity, ECS or EC2 role.
+type AWSConfig struct {
+	Region    string `yaml:"region,omitempty"`     // AWS region, default from the environment
+	AccessKey string `yaml:"access_key,omitempty"` // static credentials, must be paired with secret_key
+	SecretKey Secret `yaml:"secret_key,omitempty"`
+	Profile   string `yaml:"profile,omitempty"`  // shared credentials/config file profile
+	RoleARN   string `yaml:"role_arn,omitempty"` // role to assume, if any
+}
+
+// validate checks that static credentials are either fully defined or not at all.
+func (c *AWSConfig) validate(ctx string) error {
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return fmt.Errorf("access_key and secret_key must be defined together in %s", ctx)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package config
+
+import "fmt"
+
+// AzureConfig defines how to authenticate to Azure AD (Entra ID): either as a service principal, with OAuth client
+// credentials, or using the managed identity of the host the exporter runs on.
+type AzureConfig struct {
+	// `OAuth` (the default) or `ManagedIdentity`.
+	AuthenticationMethod string `yaml:"authentication_method,omitempty"`
+	TenantID             string `yaml:"tenant_id,omitempty"` // OAuth only
+	// OAuth: the service principal's client ID. ManagedIdentity: optional, selects a user assigned identity.
+	ClientID     string `yaml:"client_id,omitempty"`
+	ClientSecret Secret `yaml:"client_secret,omitempty"` // OAuth only
+}
+
+// validate checks that the fields required by the authentication method are set.
+func (c *AzureConfig) validate(ctx string) error {
+	switch c.AuthenticationMethod {
+	case "":
+		c.AuthenticationMethod = "OAuth"
+		fallthrough
+	case "OAuth":
+		if c.TenantID == "" || c.ClientID == "" || c.ClientSecret == "" {
+			return fmt.Errorf("tenant_id, client_id and client_secret are required for OAuth authentication in %s", ctx)
+		}
+	case "ManagedIdentity":
+	default:
+		return fmt.Errorf("invalid authentication_method %q in %s, expecting `OAuth` or `ManagedIdentity`",
+			c.AuthenticationMethod, ctx)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// bundledCollectors are compiled-in collector definitions, keyed by collector name. They are available to all jobs
+// (and for collectors to extend) by name, unless the configuration defines a collector with the same name.
+var bundledCollectors = map[string]string{
+	"postgres_standard": postgresStandard,
+	"mysql_standard":    mysqlStandard,
+	"mssql_standard":    mssqlStandard,
+}
+
+// addBundledCollectors adds the bundled collectors referenced by jobs, targets or other collectors, but not defined by
+// the configuration, to the configuration's collectors.
+func (c *Config) addBundledCollectors() error {
+	defined := make(map[string]bool, len(c.Collectors))
+	refs := make([]string, 0, len(c.Collectors))
+	for _, coll := range c.Collectors {
+		defined[coll.Name] = true
+		refs = append(refs, coll.Extends)
+	}
+	for _, j := range c.Jobs {
+		refs = append(refs, j.CollectorRefs...)
+		for _, sc := range j.StaticConfigs {
+			for _, o := range sc.overrides {
+				refs = append(refs, o.CollectorRefs...)
+				refs = append(refs, o.ExtraCollectorRefs...)
+			}
+		}
+	}
+
+	for _, name := range refs {
+		text, found := bundledCollectors[name]
+		if !found || defined[name] {
+			continue
+		}
+		coll := &CollectorConfig{}
+		if err := yaml.Unmarshal([]byte(text), coll); err != nil {
+			return fmt.Errorf("error parsing bundled collector %q: %s", name, err)
+		}
+		c.Collectors = append(c.Collectors, coll)
+		defined[name] = true
+	}
+	return nil
+}
+
+// postgresStandard collects PostgreSQL connections, locks, replication, database size and buffer cache statistics.
+const postgresStandard = `
+collector_name: postgres_standard
+metrics:
+  - metric_name: pg_connections
+    type: gauge
+    help: 'Number of server processes, per database and state.'
+    key_labels: [datname, state]
+    values: [connections]
+    null_label: none
+    query: |
+      SELECT datname, state, count(*) AS connections
+      FROM pg_stat_activity
+      WHERE backend_type = 'client backend'
+      GROUP BY datname, state
+  - metric_name: pg_max_connections
+    type: gauge
+    help: 'Maximum number of concurrent connections to the server.'
+    values: [max_connections]
+    query: SELECT current_setting('max_connections')::float AS max_connections
+  - metric_name: pg_locks
+    type: gauge
+    help: 'Number of locks held or awaited, per database, lock mode and whether granted.'
+    key_labels: [datname, mode, granted]
+    values: [locks]
+    null_label: none
+    query: |
+      SELECT d.datname, l.mode, l.granted::text AS granted, count(*) AS locks
+      FROM pg_locks l
+      LEFT JOIN pg_database d ON d.oid = l.database
+      GROUP BY d.datname, l.mode, l.granted
+  - metric_name: pg_in_recovery
+    type: gauge
+    help: 'Whether the server is a standby (1) or a primary (0).'
+    values: [in_recovery]
+    query_ref: pg_replication
+  - metric_name: pg_replication_lag_seconds
+    type: gauge
+    help: 'Time since the last transaction replayed on a standby. 0 on primaries.'
+    values: [lag]
+    query_ref: pg_replication
+  - metric_name: pg_replicas
+    type: gauge
+    help: 'Number of connected WAL sender processes (standbys or backup clients).'
+    values: [replicas]
+    query: SELECT count(*) AS replicas FROM pg_stat_replication
+  - metric_name: pg_database_size_bytes
+    type: gauge
+    help: 'Disk space used by the database.'
+    key_labels: [datname]
+    values: [size]
+    query: SELECT datname, pg_database_size(datname)::float AS size FROM pg_database WHERE datallowconn
+  - metric_name: pg_transactions_total
+    type: counter
+    help: 'Number of transactions committed or rolled back, per database.'
+    key_labels: [datname]
+    value_label: result
+    values: [commit, rollback]
+    query_ref: pg_stat_database
+  - metric_name: pg_blocks_total
+    type: counter
+    help: 'Number of disk blocks found in the buffer cache (hit) or read from disk or the OS cache (read).'
+    key_labels: [datname]
+    value_label: source
+    values: [hit, read]
+    query_ref: pg_stat_database
+  - metric_name: pg_deadlocks_total
+    type: counter
+    help: 'Number of deadlocks detected, per database.'
+    key_labels: [datname]
+    values: [deadlocks]
+    query_ref: pg_stat_database
+  - metric_name: pg_bgwriter_buffers_total
+    type: counter
+    help: 'Number of buffers written by the background writer (clean) or allocated (alloc).'
+    value_label: kind
+    values: [clean, alloc]
+    query: SELECT buffers_clean AS clean, buffers_alloc AS alloc FROM pg_stat_bgwriter
+queries:
+  - query_name: pg_replication
+    query: |
+      SELECT
+        pg_is_in_recovery()::int AS in_recovery,
+        CASE WHEN pg_is_in_recovery()
+          THEN coalesce(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0)
+          ELSE 0
+        END AS lag
+  - query_name: pg_stat_database
+    query: |
+      SELECT datname, xact_commit AS commit, xact_rollback AS rollback, blks_hit AS hit, blks_read AS read, deadlocks
+      FROM pg_stat_database
+      WHERE datname IS NOT NULL
+`
+
+// mysqlStandard collects MySQL connections, InnoDB lock, row and buffer pool statistics and replication status.
+const mysqlStandard = `
+collector_name: mysql_standard
+metrics:
+  - metric_name: mysql_global_status
+    type: gauge
+    help: 'MySQL server status variable.'
+    name_column: name
+    values: [value]
+    query: |
+      SELECT lower(VARIABLE_NAME) AS name, VARIABLE_VALUE AS value
+      FROM performance_schema.global_status
+      WHERE VARIABLE_NAME IN ('Threads_connected', 'Threads_running', 'Innodb_row_lock_current_waits',
+        'Innodb_buffer_pool_pages_data', 'Innodb_buffer_pool_pages_dirty', 'Innodb_buffer_pool_pages_free',
+        'Innodb_buffer_pool_pages_total', 'Uptime')
+  - metric_name: mysql_global_counters
+    type: counter
+    help: 'MySQL server status counter, since server start.'
+    name_column: name
+    values: [value]
+    query: |
+      SELECT concat(lower(VARIABLE_NAME), '_total') AS name, VARIABLE_VALUE AS value
+      FROM performance_schema.global_status
+      WHERE VARIABLE_NAME IN ('Connections', 'Aborted_connects', 'Aborted_clients', 'Queries', 'Slow_queries',
+        'Innodb_row_lock_waits', 'Innodb_row_lock_time', 'Innodb_deadlocks', 'Innodb_buffer_pool_read_requests',
+        'Innodb_buffer_pool_reads', 'Bytes_received', 'Bytes_sent')
+  - metric_name: mysql_max_connections
+    type: gauge
+    help: 'Maximum number of simultaneous client connections.'
+    values: [max_connections]
+    query: SELECT @@max_connections AS max_connections
+  - metric_name: mysql_replication_running
+    type: gauge
+    help: 'Whether the replication receiver (I/O) and applier (SQL) threads are running, per channel.'
+    key_labels: [channel]
+    value_label: thread
+    values: [receiver, applier]
+    query: |
+      SELECT c.CHANNEL_NAME AS channel, c.SERVICE_STATE = 'ON' AS receiver, a.SERVICE_STATE = 'ON' AS applier
+      FROM performance_schema.replication_connection_status c
+      JOIN performance_schema.replication_applier_status a ON a.CHANNEL_NAME = c.CHANNEL_NAME
+`
+
+// mssqlStandard collects SQL Server connections, locks, buffer manager statistics and availability group replica
+// queues.
+const mssqlStandard = `
+collector_name: mssql_standard
+metrics:
+  - metric_name: mssql_connections
+    type: gauge
+    help: 'Number of user sessions, per database.'
+    key_labels: [db]
+    values: [connections]
+    null_label: none
+    query: |
+      SELECT DB_NAME(database_id) AS db, COUNT(*) AS connections
+      FROM sys.dm_exec_sessions
+      WHERE is_user_process = 1
+      GROUP BY database_id
+  - metric_name: mssql_deadlocks_total
+    type: counter
+    help: 'Number of lock requests that resulted in a deadlock, since server start.'
+    values: [cntr_value]
+    query: |
+      SELECT cntr_value FROM sys.dm_os_performance_counters
+      WHERE object_name LIKE '%:Locks%' AND counter_name = 'Number of Deadlocks/sec' AND instance_name = '_Total'
+  - metric_name: mssql_lock_waits_total
+    type: counter
+    help: 'Number of lock requests that required the caller to wait, since server start.'
+    values: [cntr_value]
+    query: |
+      SELECT cntr_value FROM sys.dm_os_performance_counters
+      WHERE object_name LIKE '%:Locks%' AND counter_name = 'Lock Waits/sec' AND instance_name = '_Total'
+  - metric_name: mssql_blocked_sessions
+    type: gauge
+    help: 'Number of requests currently blocked by another session.'
+    values: [blocked]
+    query: SELECT COUNT(*) AS blocked FROM sys.dm_exec_requests WHERE blocking_session_id <> 0
+  - metric_name: mssql_page_life_expectancy_seconds
+    type: gauge
+    help: 'Number of seconds a page is expected to stay in the buffer pool.'
+    values: [cntr_value]
+    query: |
+      SELECT cntr_value FROM sys.dm_os_performance_counters
+      WHERE object_name LIKE '%:Buffer Manager%' AND counter_name = 'Page life expectancy'
+  - metric_name: mssql_buffer_cache_hit_ratio
+    type: gauge
+    help: 'Ratio of pages found in the buffer pool without having to read from disk.'
+    values: [ratio]
+    query: |
+      SELECT CAST(r.cntr_value AS float) / NULLIF(b.cntr_value, 0) AS ratio
+      FROM sys.dm_os_performance_counters r
+      JOIN sys.dm_os_performance_counters b ON b.object_name = r.object_name
+      WHERE r.object_name LIKE '%:Buffer Manager%' AND r.counter_name = 'Buffer cache hit ratio'
+        AND b.counter_name = 'Buffer cache hit ratio base'
+    null_value: nan
+  - metric_name: mssql_hadr_queue_bytes
+    type: gauge
+    help: 'Size of the availability group log send and redo queues, per replica and database.'
+    key_labels: [replica, db]
+    value_label: queue
+    values: [log_send, redo]
+    null_value: zero
+    query_ref: mssql_hadr_queues
+queries:
+  - query_name: mssql_hadr_queues
+    query: |
+      SELECT ar.replica_server_name AS replica, DB_NAME(drs.database_id) AS db,
+        drs.log_send_queue_size * 1024.0 AS log_send, drs.redo_queue_size * 1024.0 AS redo
+      FROM sys.dm_hadr_database_replica_states drs
+      JOIN sys.availability_replicas ar ON ar.replica_id = drs.replica_id
+    # Only on instances with Always On availability groups enabled.
+    when: SELECT CAST(SERVERPROPERTY('IsHadrEnabled') AS int)
+`
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// collectorFileTimeout bounds the fetching of a remote collector file.
+const collectorFileTimeout = 30 * time.Second
+
+// sha256RE matches hex encoded SHA-256 checksums.
+var sha256RE = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// CollectorFileConfig is an entry of collector_files: either a glob pattern matching local files or the URL of a
+// remote file, each file defining one collector. Entries may be specified as a string (a path or an http(s) URL) or as
+// a mapping.
+type CollectorFileConfig struct {
+	Path string `yaml:"path,omitempty"` // glob pattern, relative to the configuration file's directory
+	URL  string `yaml:"url,omitempty"`  // `http://` or `https://` URL
+	// Remote files only: the expected (hex encoded) SHA-256 checksum of the file, if set.
+	SHA256 string `yaml:"sha256,omitempty"`
+	// Remote files only: how often to check the file for changes, reloading the configuration if it changed.
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+
+	pattern    string   // Path, resolved against the configuration file's directory
+	checksum   string   // checksum of the remote file contents in use
+	fetchErr   error    // error fetching the remote file, if a cached copy is in use
+	collectors []string // names of the collectors defined by the file(s)
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CollectorFileConfig.
+func (f *CollectorFileConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+			f.URL = s
+		} else {
+			f.Path = s
+		}
+	} else {
+		type plain CollectorFileConfig
+		if err := unmarshal((*plain)(f)); err != nil {
+			return err
+		}
+	}
+
+	if (f.Path == "") == (f.URL == "") {
+		return fmt.Errorf("collector_files entry must define exactly one of path and url")
+	}
+	if f.Path != "" {
+		if f.SHA256 != "" || f.RefreshInterval != 0 {
+			return fmt.Errorf("sha256 and refresh_interval are only allowed for collector_files urls, not %q", f.Path)
+		}
+	} else {
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			return fmt.Errorf("invalid collector_files url %q: %s", f.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid collector_files url %q, expecting an http or https url", f.URL)
+		}
+		if f.SHA256 != "" && !sha256RE.MatchString(f.SHA256) {
+			return fmt.Errorf("invalid sha256 %q for collector_files url %q", f.SHA256, f.URL)
+		}
+		f.SHA256 = strings.ToLower(f.SHA256)
+	}
+	return checkOverflow(f.XXX, "collector_files entry")
+}
+
+// MarshalYAML implements the yaml.Marshaler interface for CollectorFileConfig. It redacts any password in the URL and
+// lists the names of the collectors defined by the file(s), which are included with all other collectors.
+func (f *CollectorFileConfig) MarshalYAML() (interface{}, error) {
+	type plain CollectorFileConfig
+	redacted := struct {
+		plain      `yaml:",inline"`
+		Collectors []string `yaml:"collectors,omitempty"`
+	}{plain(*f), f.collectors}
+	if u, err := url.Parse(f.URL); err == nil {
+		redacted.URL = u.Redacted()
+	}
+	return &redacted, nil
+}
+
+// Pattern returns the glob pattern of local collector files, resolved against the configuration file's directory.
+// Empty for remote files.
+func (f *CollectorFileConfig) Pattern() string {
+	return f.pattern
+}
+
+// FetchError returns the error fetching the remote collector file, if its last good copy was used instead. Nil for
+// local files.
+func (f *CollectorFileConfig) FetchError() error {
+	return f.fetchErr
+}
+
+// Changed fetches the remote collector file and returns true if its contents differ from the ones in use.
+func (f *CollectorFileConfig) Changed(ctx context.Context) (bool, error) {
+	buf, err := f.download(ctx)
+	if err != nil {
+		return false, err
+	}
+	return checksum(buf) != f.checksum, nil
+}
+
+// read returns the contents of the collector files defined by the entry, keyed by file path or URL. Relative paths are
+// resolved against baseDir, remote files are cached in cacheDir.
+func (f *CollectorFileConfig) read(baseDir, cacheDir string) (map[string][]byte, error) {
+	if f.URL != "" {
+		buf, err := f.fetch(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{f.URL: buf}, nil
+	}
+
+	f.pattern = f.Path
+	if !filepath.IsAbs(f.pattern) {
+		f.pattern = filepath.Join(baseDir, f.pattern)
+	}
+	files, err := filepath.Glob(f.pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collector_files pattern %q: %s", f.pattern, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match collector_files pattern %q", f.pattern)
+	}
+	contents := make(map[string][]byte, len(files))
+	for _, file := range files {
+		if contents[file], err = ioutil.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("error reading collector file: %s", err)
+		}
+	}
+	return contents, nil
+}
+
+// fetch downloads the remote collector file and caches it in cacheDir. If downloading fails, it falls back to the
+// last good copy cached in cacheDir, if any.
+func (f *CollectorFileConfig) fetch(cacheDir string) ([]byte, error) {
+	cacheFile := filepath.Join(cacheDir, "collector-"+checksum([]byte(f.URL))+".yml")
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectorFileTimeout)
+	defer cancel()
+	buf, err := f.download(ctx)
+	if err == nil {
+		f.checksum = checksum(buf)
+		if err := writeFileAtomic(cacheFile, buf); err != nil {
+			f.fetchErr = fmt.Errorf("error caching collector file %s: %s", f.URL, err)
+		}
+		return buf, nil
+	}
+
+	cached, cacheErr := ioutil.ReadFile(cacheFile)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%s, no cached copy", err)
+	}
+	if f.SHA256 != "" && checksum(cached) != f.SHA256 {
+		return nil, fmt.Errorf("%s, cached copy %q does not match sha256", err, cacheFile)
+	}
+	f.checksum = checksum(cached)
+	f.fetchErr = fmt.Errorf("%s, using cached copy %q", err, cacheFile)
+	return cached, nil
+}
+
+// download fetches the remote collector file, checking it against the configured checksum, if any.
+func (f *CollectorFileConfig) download(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching collector file %s: %s", f.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching collector file %s: %s", f.URL, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching collector file %s: %s", f.URL, err)
+	}
+	if f.SHA256 != "" && checksum(buf) != f.SHA256 {
+		return nil, fmt.Errorf("collector file %s does not match sha256 %s", f.URL, f.SHA256)
+	}
+	return buf, nil
+}
+
+// checksum returns the hex encoded SHA-256 checksum of buf.
+func checksum(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic writes buf to file via a temporary file, so that readers never see a partially written file.
+func writeFileAtomic(file string, buf []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// loadCollectorFiles reads the collectors defined by collector_files entries, then resolves all collector references.
+// Relative paths are resolved against baseDir.
+func (c *Config) loadCollectorFiles(baseDir string) error {
+	if len(c.CollectorFiles) == 0 {
+		return nil
+	}
+	cacheDir := c.Globals.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "sql_exporter")
+	} else if !filepath.IsAbs(cacheDir) {
+		cacheDir = filepath.Join(baseDir, cacheDir)
+	}
+
+	for _, f := range c.CollectorFiles {
+		contents, err := f.read(baseDir, cacheDir)
+		if err != nil {
+			return err
+		}
+		f.collectors = nil
+		for name, buf := range contents {
+			coll := &CollectorConfig{}
+			if err := yaml.Unmarshal(buf, coll); err != nil {
+				return locateError(name, buf, "collectors[]", err)
+			}
+			c.Collectors = append(c.Collectors, coll)
+			f.collectors = append(f.collectors, coll.Name)
+		}
+		sort.Strings(f.collectors)
+	}
+	return c.resolveCollectorRefs()
+}
@@ -1,27 +1,62 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
-// Load attempts to parse the given config file and return a Config object.
+// Load attempts to parse the given config file and return a Config object. Errors found in the configuration (or
+// collector) files are returned as *Error, with the line they were found on, if known.
 func Load(configFile string) (*Config, error) {
-	f := Config{}
-
 	buf, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return &f, err
+		return &Config{}, err
 	}
+	return parse(configFile, filepath.Dir(configFile), buf)
+}
 
-	err = yaml.Unmarshal(buf, &f)
-	return &f, err
+// Parse parses a configuration from buf, like Load does with the contents of a file, resolving relative paths (e.g. of
+// collector files) against dir. It is meant for applications embedding the exporter, with configurations that don't
+// come from a file.
+func Parse(buf []byte, dir string) (*Config, error) {
+	return parse("config", dir, buf)
+}
+
+// parse parses the configuration in buf, read from file, resolving relative paths against dir.
+func parse(file, dir string, buf []byte) (*Config, error) {
+	f := Config{}
+	err := yaml.Unmarshal(buf, &f)
+	if err != nil {
+		return &f, locateError(file, buf, "", err)
+	}
+	if err = f.loadCollectorFiles(dir); err != nil {
+		return &f, locateError(file, buf, "", err)
+	}
+
+	f.setDirectory(dir)
+	if err = f.loadDSNFiles(dir); err != nil {
+		return &f, locateError(file, buf, "", err)
+	}
+	if err = f.loadQueryFiles(dir); err != nil {
+		return &f, locateError(file, buf, "", err)
+	}
+	return &f, nil
 }
 
 //
@@ -33,6 +68,8 @@ type Config struct {
 	Globals    GlobalConfig       `yaml:"global"`
 	Jobs       []*JobConfig       `yaml:"jobs"`
 	Collectors []*CollectorConfig `yaml:"collectors"`
+	// Local files (or glob patterns) and remote URLs of files each defining one collector.
+	CollectorFiles []*CollectorFileConfig `yaml:"collector_files,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -40,6 +77,8 @@ type Config struct {
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface for Config.
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Apply the global defaults even if there is no `global` section.
+	c.Globals = DefaultGlobalConfig
 	type plain Config
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
@@ -48,19 +87,58 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if len(c.Jobs) == 0 {
 		return fmt.Errorf("no jobs defined")
 	}
+	jobNames := make(map[string]bool, len(c.Jobs))
+	listenAddresses := make(map[string]string)
+	for _, j := range c.Jobs {
+		if jobNames[j.Name] {
+			return fmt.Errorf("duplicate job name: %s", j.Name)
+		}
+		jobNames[j.Name] = true
+		if j.ListenAddress == "" {
+			continue
+		}
+		if other, found := listenAddresses[j.ListenAddress]; found {
+			return fmt.Errorf("listen_address %q of job %q already used by job %q", j.ListenAddress, j.Name, other)
+		}
+		listenAddresses[j.ListenAddress] = j.Name
+	}
+	if err := checkOverflow(c.XXX, "config"); err != nil {
+		return err
+	}
+
+	// Collectors read from files are only resolved once the files are read, by loadCollectorFiles.
+	if len(c.CollectorFiles) > 0 {
+		return nil
+	}
+	return c.resolveCollectorRefs()
+}
+
+// resolveCollectorRefs adds any referenced bundled collectors, resolves the base collectors of collectors extending
+// another and populates collector references for all jobs and targets.
+func (c *Config) resolveCollectorRefs() error {
+	if err := c.addBundledCollectors(); err != nil {
+		return err
+	}
 
 	// Populate collector references for all jobs
 	colls := make(map[string]*CollectorConfig)
 	for _, coll := range c.Collectors {
-		// Set the min interval to the global default if not explicitly set.
-		if coll.MinInterval < 0 {
-			coll.MinInterval = c.Globals.MinInterval
-		}
 		if _, found := colls[coll.Name]; found {
 			return fmt.Errorf("duplicate collector name: %s", coll.Name)
 		}
 		colls[coll.Name] = coll
 	}
+	for _, coll := range c.Collectors {
+		if err := coll.resolveExtends(colls, nil); err != nil {
+			return err
+		}
+	}
+	for _, coll := range c.Collectors {
+		// Set the min interval to the global default if not explicitly set.
+		if coll.MinInterval < 0 {
+			coll.MinInterval = c.Globals.MinInterval
+		}
+	}
 	for _, j := range c.Jobs {
 		j.collectors = make([]*CollectorConfig, 0, len(j.CollectorRefs))
 		for _, cname := range j.CollectorRefs {
@@ -70,9 +148,80 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			}
 			j.collectors = append(j.collectors, coll)
 		}
+		for _, sc := range j.StaticConfigs {
+			if err := sc.resolveCollectors(j, colls); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	return checkOverflow(c.XXX, "config")
+// setDirectory resolves relative file paths (e.g. TLS certificates) against dir.
+func (c *Config) setDirectory(dir string) {
+	for _, j := range c.Jobs {
+		for _, k := range j.KubernetesSDConfigs {
+			k.HTTPClient.SetDirectory(dir)
+		}
+		for _, g := range j.GCPCloudSQLSDConfigs {
+			g.CredentialsFile = config_util.JoinDir(dir, g.CredentialsFile)
+		}
+		for _, c := range j.ConsulSDConfigs {
+			c.HTTPClient.SetDirectory(dir)
+		}
+		for _, sc := range j.StaticConfigs {
+			for _, t := range sc.tlsConfigs {
+				t.setDirectory(dir)
+			}
+			for _, t := range sc.sshTunnels {
+				t.setDirectory(dir)
+			}
+		}
+		if ia := j.IntegratedAuth; ia != nil {
+			ia.Krb5Config = config_util.JoinDir(dir, ia.Krb5Config)
+			ia.Keytab = config_util.JoinDir(dir, ia.Keytab)
+			ia.CredentialCache = config_util.JoinDir(dir, ia.CredentialCache)
+		}
+	}
+	for _, coll := range c.Collectors {
+		if coll.Plugin != nil {
+			coll.Plugin.Path = config_util.JoinDir(dir, coll.Plugin.Path)
+		}
+	}
+}
+
+// loadDSNFiles reads the data source names of all targets defined via `data_source_name_file`. Relative paths are
+// resolved against baseDir.
+func (c *Config) loadDSNFiles(baseDir string) error {
+	for _, j := range c.Jobs {
+		for _, sc := range j.StaticConfigs {
+			if err := sc.loadDSNFiles(baseDir); err != nil {
+				return fmt.Errorf("%s for job %q", err, j.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// loadQueryFiles reads the queries of all collectors defined via `query_file` or `query_files`. Relative paths are
+// resolved against baseDir.
+func (c *Config) loadQueryFiles(baseDir string) error {
+	for _, coll := range c.Collectors {
+		if err := coll.loadQueryFiles(baseDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collector returns the collector with the given name, or nil if not found.
+func (c *Config) Collector(name string) *CollectorConfig {
+	for _, coll := range c.Collectors {
+		if coll.Name == name {
+			return coll
+		}
+	}
+	return nil
 }
 
 // YAML marshals the config into YAML format.
@@ -80,10 +229,36 @@ func (c *Config) YAML() ([]byte, error) {
 	return yaml.Marshal(c)
 }
 
+// JSON marshals the config into (indented) JSON format, with the same structure and field names as YAML.
+func (c *Config) JSON() ([]byte, error) {
+	buf, err := c.YAML()
+	if err != nil {
+		return nil, err
+	}
+	// Unlike v2, v3 decodes mappings with string keys into map[string]interface{}, which encoding/json supports.
+	var v interface{}
+	if err := yamlv3.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// DefaultGlobalConfig is the global configuration used if not overridden.
+var DefaultGlobalConfig = GlobalConfig{
+	// Default to running the queries on every scrape.
+	MinInterval: model.Duration(0),
+	// Default to 9 seconds, since Prometheus has a 10 second scrape timeout default.
+	ScrapeTimeout: model.Duration(9 * time.Second),
+}
+
 // GlobalConfig contains globally applicable defaults.
 type GlobalConfig struct {
 	MinInterval   model.Duration `yaml:"min_interval"`   // minimum interval between query executions, default is 0
 	ScrapeTimeout model.Duration `yaml:"scrape_timeout"` // per-scrape timeout, global
+	// If non-zero, the maximum number of queries run simultaneously, across all jobs, targets and collectors.
+	MaxConcurrentQueries int `yaml:"max_concurrent_queries,omitempty"`
+	// Directory to cache remote collector files in, the `sql_exporter` subdirectory of the temp directory by default.
+	CacheDir string `yaml:"cache_dir,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -91,15 +266,14 @@ type GlobalConfig struct {
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface for GlobalConfig.
 func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	// Default to running the queries on every scrape.
-	g.MinInterval = model.Duration(0)
-	// Default to 9 seconds, since Prometheus has a 10 second scrape timeout default.
-	g.ScrapeTimeout = model.Duration(9 * time.Second)
-
+	*g = DefaultGlobalConfig
 	type plain GlobalConfig
 	if err := unmarshal((*plain)(g)); err != nil {
 		return err
 	}
+	if g.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("negative max_concurrent_queries")
+	}
 
 	return checkOverflow(g.XXX, "global")
 }
@@ -110,9 +284,46 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // JobConfig defines a set of collectors to be executed on a set of targets.
 type JobConfig struct {
-	Name          string          `yaml:"job_name"`       // name of this job
-	CollectorRefs []string        `yaml:"collectors"`     // names of collectors to apply to all targets in this job
-	StaticConfigs []*StaticConfig `yaml:"static_configs"` // collections of statically defined targets
+	Name          string          `yaml:"job_name"`                 // name of this job
+	CollectorRefs []string        `yaml:"collectors"`               // names of collectors to apply to the job's targets
+	StaticConfigs []*StaticConfig `yaml:"static_configs,omitempty"` // collections of statically defined targets
+	SQLSDConfigs  []*SQLSDConfig  `yaml:"sql_sd_configs,omitempty"` // catalog database queries listing targets
+	// Kubernetes pods or services to create targets from.
+	KubernetesSDConfigs []*KubernetesSDConfig `yaml:"kubernetes_sd_configs,omitempty"`
+	// AWS RDS instances or Aurora clusters to create targets from.
+	AWSRDSSDConfigs []*AWSRDSSDConfig `yaml:"aws_rds_sd_configs,omitempty"`
+	// GCP Cloud SQL instances to create targets from.
+	GCPCloudSQLSDConfigs []*GCPCloudSQLSDConfig `yaml:"gcp_cloudsql_sd_configs,omitempty"`
+	// Azure SQL databases or managed instances to create targets from.
+	AzureSDConfigs []*AzureSDConfig `yaml:"azure_sd_configs,omitempty"`
+	// Consul service instances to create targets from.
+	ConsulSDConfigs []*ConsulSDConfig `yaml:"consul_sd_configs,omitempty"`
+	// If non-zero, collect in the background at this interval instead of on every scrape.
+	Interval model.Duration `yaml:"interval,omitempty"`
+	// If non-zero, delay every background collection by a random duration of up to this much.
+	IntervalJitter model.Duration `yaml:"interval_jitter,omitempty"`
+	// If true, spread the background collections of the job's targets evenly over the interval.
+	IntervalSpread bool `yaml:"interval_spread,omitempty"`
+	// If non-zero, overrides the global scrape timeout when the job is scraped on its own (or probed).
+	ScrapeTimeout model.Duration `yaml:"scrape_timeout,omitempty"`
+	// If set, additionally expose the job's metrics (only) on their own port, e.g. `:9238`.
+	ListenAddress string `yaml:"listen_address,omitempty"`
+	// If non-zero, the maximum number of collectors run simultaneously against any one target.
+	MaxParallelCollectors int `yaml:"max_parallel_collectors,omitempty"`
+	// If set, stop connecting to targets for a while after repeated failures.
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	// If set, allow probing data source names (as opposed to target names) matching it via the `/probe` endpoint.
+	ProbeDSNs *ProbeDSNsConfig `yaml:"probe_dsns,omitempty"`
+	// If set, log in to the job's SQL Server targets using Kerberos or Windows integrated authentication.
+	IntegratedAuth *IntegratedAuthConfig `yaml:"integrated_auth,omitempty"`
+	// CockroachDB specific settings, for the job's CockroachDB targets.
+	CockroachDB *CockroachDBConfig `yaml:"cockroachdb,omitempty"`
+	// Values of the `${name}` query parameters, for all the job's targets. Targets may override them.
+	Params map[string]string `yaml:"params,omitempty"`
+	// Variables available to query templates, as `{{ .Vars.name }}`.
+	Vars map[string]string `yaml:"vars,omitempty"`
+	// Rules applied to the name and labels of all metrics collected by the job, e.g. to drop or rename them.
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
 
 	collectors []*CollectorConfig // resolved collector references
 
@@ -125,6 +336,16 @@ func (j *JobConfig) Collectors() []*CollectorConfig {
 	return j.collectors
 }
 
+// HasTarget returns true if the job statically defines a target with the given name.
+func (j *JobConfig) HasTarget(name string) bool {
+	for _, sc := range j.StaticConfigs {
+		if _, found := sc.Targets[name]; found {
+			return true
+		}
+	}
+	return false
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for JobConfig.
 func (j *JobConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain JobConfig
@@ -148,14 +369,155 @@ func (j *JobConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			}
 		}
 	}
-
-	if len(j.StaticConfigs) == 0 {
-		return fmt.Errorf("no targets defined for job %q", j.Name)
+	if err := checkParams(j.Params, "job", j.Name); err != nil {
+		return err
+	}
+	if j.ScrapeTimeout < 0 {
+		return fmt.Errorf("negative scrape_timeout for job %q", j.Name)
+	}
+	if j.MaxParallelCollectors < 0 {
+		return fmt.Errorf("negative max_parallel_collectors for job %q", j.Name)
+	}
+	if j.Interval <= 0 && (j.IntervalJitter != 0 || j.IntervalSpread) {
+		return fmt.Errorf("interval_jitter and interval_spread require an interval for job %q", j.Name)
+	}
+	if j.IntervalJitter < 0 {
+		return fmt.Errorf("negative interval_jitter for job %q", j.Name)
+	}
+	if j.Interval > 0 && j.IntervalJitter >= j.Interval {
+		return fmt.Errorf("interval_jitter must be shorter than interval for job %q", j.Name)
 	}
 
 	return checkOverflow(j.XXX, "job")
 }
 
+// CircuitBreakerConfig defines when to stop connecting to a failing target and for how long.
+type CircuitBreakerConfig struct {
+	FailureThreshold int            `yaml:"failure_threshold"` // consecutive failed scrapes that open the circuit
+	Cooldown         model.Duration `yaml:"cooldown"`          // how long the circuit stays open
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CircuitBreakerConfig.
+func (c *CircuitBreakerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Default to opening the circuit for a minute after 3 consecutive failures.
+	c.FailureThreshold = 3
+	c.Cooldown = model.Duration(time.Minute)
+
+	type plain CircuitBreakerConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.FailureThreshold <= 0 {
+		return fmt.Errorf("circuit_breaker.failure_threshold must be positive, got %d", c.FailureThreshold)
+	}
+	if c.Cooldown <= 0 {
+		return fmt.Errorf("circuit_breaker.cooldown must be positive, got %s", c.Cooldown)
+	}
+
+	return checkOverflow(c.XXX, "circuit_breaker")
+}
+
+// ProbeDSNsConfig defines which data source names may be probed (i.e. connected to on request) via the `/probe`
+// endpoint, as templated by a job. Without it, only the job's statically defined targets may be probed, by name.
+type ProbeDSNsConfig struct {
+	Drivers []string `yaml:"drivers"` // drivers (i.e. DSN schemes) allowed, e.g. `sqlserver`
+	Hosts   []string `yaml:"hosts"`   // patterns of the hosts allowed, e.g. `*.db.example.com`, as per path.Match
+	// Names of the data source name parameters allowed, e.g. `sslmode`. Parameters may redirect connections or make
+	// drivers read local files (e.g. PostgreSQL's `host` or MySQL's `allowAllFiles`), so none are allowed by default.
+	Params []string `yaml:"params,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ProbeDSNsConfig.
+func (c *ProbeDSNsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ProbeDSNsConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if len(c.Drivers) == 0 {
+		return fmt.Errorf("no drivers defined for probe_dsns")
+	}
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("no hosts defined for probe_dsns")
+	}
+	for _, pattern := range c.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid probe_dsns host pattern %q: %s", pattern, err)
+		}
+	}
+
+	return checkOverflow(c.XXX, "probe_dsns")
+}
+
+// Allows returns true if a data source name using driver, pointing to host and with the named parameters may be
+// probed. Data source names with no host (e.g. SQLite files or Unix sockets) are never allowed.
+func (c *ProbeDSNsConfig) Allows(driver, host string, params []string) bool {
+	if host == "" || !containsString(c.Drivers, driver) {
+		return false
+	}
+	for _, param := range params {
+		if !containsString(c.Params, param) {
+			return false
+		}
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range c.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString returns true if s is one of values.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultSerializationRetries is how many times queries failing with serialization errors are retried on CockroachDB
+// targets (detected automatically), unless configured otherwise.
+const DefaultSerializationRetries = 3
+
+// CockroachDBConfig defines CockroachDB specific settings.
+type CockroachDBConfig struct {
+	// Number of times to retry queries failing with serialization errors (SQLSTATE 40001), if higher than the
+	// collector's `retries`.
+	SerializationRetries int `yaml:"serialization_retries"`
+	// Whether to run queries against the closest replica, as of a few seconds ago, with follower reads.
+	FollowerReads bool `yaml:"follower_reads,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CockroachDBConfig.
+func (c *CockroachDBConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.SerializationRetries = DefaultSerializationRetries
+
+	type plain CockroachDBConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.SerializationRetries < 0 {
+		return fmt.Errorf("cockroachdb.serialization_retries must not be negative, got %d", c.SerializationRetries)
+	}
+
+	return checkOverflow(c.XXX, "cockroachdb")
+}
+
 // checkLabelCollisions checks for label collisions between StaticConfig labels and Metric labels.
 func (j *JobConfig) checkLabelCollisions() error {
 	sclabels := make(map[string]interface{})
@@ -184,49 +546,340 @@ type StaticConfig struct {
 	Targets map[string]string `yaml:"targets"`          // map of target names to data source names
 	Labels  map[string]string `yaml:"labels,omitempty"` // labels to apply to all metrics collected from the targets
 
+	dsnFiles    map[string]string            // map of target names to data source name files, for targets defined that way
+	dataSources map[string]*DataSourceConfig // map of target names to data source configs, for targets defined that way
+	auths       map[string]*AuthConfig       // map of target names to authentication configs, for targets defining one
+	tlsConfigs  map[string]*TLSConfig        // map of target names to TLS configs, for targets defining one
+	sshTunnels  map[string]*SSHTunnelConfig  // map of target names to SSH tunnel configs, for targets defining one
+	proxyURLs   map[string]*config_util.URL  // map of target names to proxy URLs, for targets defining one
+	params      map[string]map[string]string // map of target names to query parameter values, for targets defining any
+	// Map of target names to targets' collector overrides and the resulting collectors, for targets defining any.
+	overrides  map[string]*targetSpec
+	collectors map[string][]*CollectorConfig
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface for StaticConfig.
 func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain StaticConfig
-	if err := unmarshal((*plain)(s)); err != nil {
+	var raw struct {
+		Targets map[string]*targetSpec `yaml:"targets"`
+		Labels  map[string]string      `yaml:"labels,omitempty"`
+		XXX     map[string]interface{} `yaml:",inline"`
+	}
+	if err := unmarshal(&raw); err != nil {
 		return err
 	}
+	s.Labels = raw.Labels
+	s.XXX = raw.XXX
 
 	// Check for empty/duplicate target names/data source names
-	tnames := make(map[string]interface{})
+	s.Targets = make(map[string]string, len(raw.Targets))
 	dsns := make(map[string]interface{})
-	for tname, dsn := range s.Targets {
+	for tname, spec := range raw.Targets {
 		if tname == "" {
-			return fmt.Errorf("empty target name in static config %+v", s)
+			return fmt.Errorf("empty target name in static config")
 		}
-		if _, ok := tnames[tname]; ok {
-			return fmt.Errorf("duplicate target name %q in static_config %+v", tname, s)
+		if spec == nil || (spec.DSN == "" && spec.DSNFile == "" && spec.DataSource == nil) {
+			return fmt.Errorf("empty data source name for target %q in static config", tname)
 		}
-		tnames[tname] = nil
-		if dsn == "" {
-			return fmt.Errorf("empty data source name in static config %+v", s)
+		if spec.Auth != nil {
+			if s.auths == nil {
+				s.auths = make(map[string]*AuthConfig)
+			}
+			s.auths[tname] = spec.Auth
 		}
-		if _, ok := dsns[dsn]; ok {
-			return fmt.Errorf("duplicate data source name %q in static_config %+v", tname, s)
+		if spec.TLS != nil {
+			if s.tlsConfigs == nil {
+				s.tlsConfigs = make(map[string]*TLSConfig)
+			}
+			s.tlsConfigs[tname] = spec.TLS
+		}
+		if spec.SSHTunnel != nil {
+			if s.sshTunnels == nil {
+				s.sshTunnels = make(map[string]*SSHTunnelConfig)
+			}
+			s.sshTunnels[tname] = spec.SSHTunnel
 		}
-		dsns[dsn] = nil
+		if spec.ProxyURL != nil {
+			if s.proxyURLs == nil {
+				s.proxyURLs = make(map[string]*config_util.URL)
+			}
+			s.proxyURLs[tname] = spec.ProxyURL
+		}
+		if len(spec.Params) > 0 {
+			if err := checkParams(spec.Params, "target", tname); err != nil {
+				return err
+			}
+			if s.params == nil {
+				s.params = make(map[string]map[string]string)
+			}
+			s.params[tname] = spec.Params
+		}
+		if spec.CollectorRefs != nil || len(spec.ExtraCollectorRefs) > 0 || len(spec.ExcludeCollectorRefs) > 0 {
+			if s.overrides == nil {
+				s.overrides = make(map[string]*targetSpec)
+			}
+			s.overrides[tname] = spec
+		}
+		if spec.DSNFile != "" {
+			if s.dsnFiles == nil {
+				s.dsnFiles = make(map[string]string)
+			}
+			s.dsnFiles[tname] = spec.DSNFile
+			continue
+		}
+		if spec.DataSource != nil {
+			if s.dataSources == nil {
+				s.dataSources = make(map[string]*DataSourceConfig)
+			}
+			s.dataSources[tname] = spec.DataSource
+			// Assembled again once any password_file is read.
+			spec.DSN, _ = spec.DataSource.DSN(nil)
+		}
+		if _, ok := dsns[spec.DSN]; ok {
+			return fmt.Errorf("duplicate data source name for target %q in static_config", tname)
+		}
+		dsns[spec.DSN] = nil
+		s.Targets[tname] = spec.DSN
 	}
 
 	return checkOverflow(s.XXX, "static_config")
 }
 
+// loadDSNFiles reads the data source names of all targets defined via `data_source_name_file` and the passwords of
+// all data sources defined via `password_file`. Relative paths are resolved against baseDir.
+func (s *StaticConfig) loadDSNFiles(baseDir string) error {
+	for tname, ds := range s.dataSources {
+		if ds.PasswordFile == "" {
+			continue
+		}
+		if err := ds.loadPasswordFile(baseDir); err != nil {
+			return fmt.Errorf("%s for target %q", err, tname)
+		}
+		dsn, err := ds.DSN(nil)
+		if err != nil {
+			return fmt.Errorf("%s for target %q", err, tname)
+		}
+		s.Targets[tname] = dsn
+	}
+	for tname, file := range s.dsnFiles {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading data_source_name_file for target %q: %s", tname, err)
+		}
+		dsn := strings.TrimSpace(string(buf))
+		if dsn == "" {
+			return fmt.Errorf("empty data_source_name_file %q for target %q", file, tname)
+		}
+		s.Targets[tname] = dsn
+	}
+	return nil
+}
+
+// resolveCollectors resolves the collector overrides of the config's targets against the job's collectors and the
+// collectors defined by the configuration.
+func (s *StaticConfig) resolveCollectors(j *JobConfig, colls map[string]*CollectorConfig) error {
+	for tname, o := range s.overrides {
+		refs := o.CollectorRefs
+		if refs == nil {
+			jobRefs := make(map[string]bool, len(j.CollectorRefs))
+			for _, cname := range j.CollectorRefs {
+				jobRefs[cname] = true
+			}
+			excluded := make(map[string]bool, len(o.ExcludeCollectorRefs))
+			for _, cname := range o.ExcludeCollectorRefs {
+				if !jobRefs[cname] {
+					return fmt.Errorf("collector %q excluded by target %q is not referenced by job %q", cname, tname, j.Name)
+				}
+				excluded[cname] = true
+			}
+			refs = make([]string, 0, len(j.CollectorRefs)+len(o.ExtraCollectorRefs))
+			for _, cname := range j.CollectorRefs {
+				if !excluded[cname] {
+					refs = append(refs, cname)
+				}
+			}
+			for _, cname := range o.ExtraCollectorRefs {
+				if jobRefs[cname] {
+					return fmt.Errorf("extra collector %q of target %q is already referenced by job %q", cname, tname, j.Name)
+				}
+				refs = append(refs, cname)
+			}
+		}
+		if len(refs) == 0 {
+			return fmt.Errorf("no collectors left for target %q of job %q", tname, j.Name)
+		}
+
+		collectors := make([]*CollectorConfig, 0, len(refs))
+		for _, cname := range refs {
+			coll, found := colls[cname]
+			if !found {
+				return fmt.Errorf("unknown collector %q referenced by target %q of job %q", cname, tname, j.Name)
+			}
+			collectors = append(collectors, coll)
+		}
+		if s.collectors == nil {
+			s.collectors = make(map[string][]*CollectorConfig)
+		}
+		s.collectors[tname] = collectors
+	}
+	return nil
+}
+
+// Collectors returns the collectors to apply to the named target, nil if it doesn't override the job's collectors.
+func (s *StaticConfig) Collectors(tname string) []*CollectorConfig {
+	return s.collectors[tname]
+}
+
+// DataSource returns the data source config of the named target, nil if it's defined by a data source name.
+func (s *StaticConfig) DataSource(tname string) *DataSourceConfig {
+	return s.dataSources[tname]
+}
+
+// Auth returns the authentication config of the named target, nil if it doesn't define one.
+func (s *StaticConfig) Auth(tname string) *AuthConfig {
+	return s.auths[tname]
+}
+
+// TLS returns the TLS config of the named target, nil if it doesn't define one.
+func (s *StaticConfig) TLS(tname string) *TLSConfig {
+	return s.tlsConfigs[tname]
+}
+
+// SSHTunnel returns the SSH tunnel config of the named target, nil if it doesn't define one.
+func (s *StaticConfig) SSHTunnel(tname string) *SSHTunnelConfig {
+	return s.sshTunnels[tname]
+}
+
+// ProxyURL returns the proxy URL of the named target, nil if it doesn't define one.
+func (s *StaticConfig) ProxyURL(tname string) *url.URL {
+	if u := s.proxyURLs[tname]; u != nil {
+		return u.URL
+	}
+	return nil
+}
+
+// Params returns the query parameter values defined by the named target, nil if it doesn't define any.
+func (s *StaticConfig) Params(tname string) map[string]string {
+	return s.params[tname]
+}
+
 // MarshalYAML implements the yaml.Marshaler interface for StaticConfig. It replaces DSNs with placeholders as they
-// may contain credentials.
+// may contain credentials and lists the collectors applied to targets overriding the job's, once resolved.
 func (s *StaticConfig) MarshalYAML() (interface{}, error) {
-	result := *s
-	result.Targets = make(map[string]string, len(s.Targets))
+	targets := make(map[string]interface{}, len(s.Targets))
 	for tname := range s.Targets {
-		result.Targets[tname] = "<secret>"
+		spec := &targetSpec{
+			DSNFile:    s.dsnFiles[tname],
+			DataSource: s.dataSources[tname],
+			Auth:       s.auths[tname],
+			TLS:        s.tlsConfigs[tname],
+			SSHTunnel:  s.sshTunnels[tname],
+			Params:     s.params[tname],
+		}
+		for _, cc := range s.collectors[tname] {
+			spec.CollectorRefs = append(spec.CollectorRefs, cc.Name)
+		}
+		if u := s.proxyURLs[tname]; u != nil {
+			// The proxy URL may contain credentials too.
+			redacted, _ := url.Parse(u.Redacted())
+			spec.ProxyURL = &config_util.URL{URL: redacted}
+		}
+		switch {
+		case spec.DSNFile == "" && spec.DataSource == nil && spec.Auth == nil && spec.TLS == nil &&
+			spec.SSHTunnel == nil && spec.ProxyURL == nil && spec.Params == nil && s.overrides[tname] == nil:
+			targets[tname] = "<secret>"
+		case spec.DSNFile == "" && spec.DataSource == nil:
+			spec.DSN = "<secret>"
+			fallthrough
+		default:
+			targets[tname] = spec
+		}
+	}
+	return struct {
+		Targets map[string]interface{} `yaml:"targets"`
+		Labels  map[string]string      `yaml:"labels,omitempty"`
+	}{targets, s.Labels}, nil
+}
+
+// targetSpec is the data source name of a target, specified either inline, as a string, or as a mapping with one of
+// `data_source_name`, `data_source_name_file` (referencing a file to read the data source name from) or `data_source`
+// (defining the data source field by field) and optional `auth`, `tls`, `params`, collector overrides and either
+// `ssh_tunnel` or `proxy_url` keys.
+type targetSpec struct {
+	DSN        string            `yaml:"data_source_name,omitempty"`
+	DSNFile    string            `yaml:"data_source_name_file,omitempty"`
+	DataSource *DataSourceConfig `yaml:"data_source,omitempty"`
+	Auth       *AuthConfig       `yaml:"auth,omitempty"`
+	TLS        *TLSConfig        `yaml:"tls,omitempty"`
+	SSHTunnel  *SSHTunnelConfig  `yaml:"ssh_tunnel,omitempty"`
+	ProxyURL   *config_util.URL  `yaml:"proxy_url,omitempty"` // `socks5://`, `socks5h://` or `http://` (CONNECT)
+	Params     map[string]string `yaml:"params,omitempty"`    // query parameter values, overriding the job's
+	// Names of collectors to apply instead of the job's, or to apply in addition to or exclude from the job's.
+	CollectorRefs        []string `yaml:"collectors,omitempty"`
+	ExtraCollectorRefs   []string `yaml:"extra_collectors,omitempty"`
+	ExcludeCollectorRefs []string `yaml:"exclude_collectors,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for targetSpec.
+func (t *targetSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&t.DSN); err == nil {
+		return nil
+	}
+
+	type plain targetSpec
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+	defined := 0
+	for _, set := range []bool{t.DSN != "", t.DSNFile != "", t.DataSource != nil} {
+		if set {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return fmt.Errorf("target must define exactly one of data_source_name, data_source_name_file and data_source")
+	}
+	if t.CollectorRefs != nil {
+		if len(t.CollectorRefs) == 0 {
+			return fmt.Errorf("empty collectors list for target")
+		}
+		if len(t.ExtraCollectorRefs) > 0 || len(t.ExcludeCollectorRefs) > 0 {
+			return fmt.Errorf("target must not define both collectors and extra_collectors or exclude_collectors")
+		}
+	}
+	for _, refs := range [][]string{t.CollectorRefs, t.ExtraCollectorRefs, t.ExcludeCollectorRefs} {
+		for i, ci := range refs {
+			for _, cj := range refs[i+1:] {
+				if ci == cj {
+					return fmt.Errorf("duplicate collector reference %q by target", ci)
+				}
+			}
+		}
+	}
+	if t.ProxyURL != nil {
+		if t.SSHTunnel != nil {
+			return fmt.Errorf("target must not define both ssh_tunnel and proxy_url")
+		}
+		switch t.ProxyURL.Scheme {
+		case "socks5", "socks5h", "http", "https":
+		default:
+			return fmt.Errorf("unsupported proxy_url scheme %q, must be one of socks5, socks5h, http and https",
+				t.ProxyURL.Scheme)
+		}
+		if t.ProxyURL.Host == "" {
+			return fmt.Errorf("missing host in proxy_url %q", t.ProxyURL.Redacted())
+		}
 	}
-	return result, nil
+	return checkOverflow(t.XXX, "target")
 }
 
 //
@@ -235,10 +888,30 @@ func (s *StaticConfig) MarshalYAML() (interface{}, error) {
 
 // CollectorConfig defines a set of metrics and how they are collected.
 type CollectorConfig struct {
-	Name        string          `yaml:"collector_name"`         // name of this collector
-	MinInterval model.Duration  `yaml:"min_interval,omitempty"` // minimum interval between query executions
-	Metrics     []*MetricConfig `yaml:"metrics"`                // metrics/queries defined by this collector
-	Queries     []*QueryConfig  `yaml:"queries,omitempty"`      // named queries defined by this collector
+	Name         string          `yaml:"collector_name"`          // name of this collector
+	MinInterval  model.Duration  `yaml:"min_interval,omitempty"`  // minimum interval between query executions
+	Timeout      model.Duration  `yaml:"timeout,omitempty"`       // maximum time to spend running all queries
+	Retries      int             `yaml:"retries,omitempty"`       // number of retries of queries failing transiently
+	RetryBackoff model.Duration  `yaml:"retry_backoff,omitempty"` // delay before the first retry, doubled every retry
+	MaxRows      int             `yaml:"max_rows,omitempty"`      // default max_rows of the collector's queries
+	Metrics      []*MetricConfig `yaml:"metrics"`                 // metrics/queries defined by this collector
+	Queries      []*QueryConfig  `yaml:"queries,omitempty"`       // named queries defined by this collector
+	// If non-zero, serve cached metrics immediately, collecting fresh ones in the background once older than this.
+	CacheTTL model.Duration `yaml:"cache_ttl,omitempty"`
+	// Named SQL fragments, included into the collector's query templates via `{{ template "name" . }}`.
+	Snippets map[string]string `yaml:"snippets,omitempty"`
+	// Glob patterns of SQL files, each defining a named query (named after the file, minus the extension).
+	QueryFiles []string `yaml:"query_files,omitempty"`
+	// Metrics computed from the collector's other metrics, once all its queries have run.
+	DerivedMetrics []*DerivedMetricConfig `yaml:"derived_metrics,omitempty"`
+	// Name of a collector to inherit settings, snippets, queries, metrics and derived metrics from. The collector's
+	// own override the inherited ones with the same name.
+	Extends string `yaml:"extends,omitempty"`
+	// Go plugin implementing the collector, instead of metrics and queries.
+	Plugin *PluginConfig `yaml:"plugin,omitempty"`
+
+	snippets *template.Template // Snippets, parsed
+	extended bool               // whether the base collector (if any) was merged in
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -254,11 +927,172 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return err
 	}
 
+	if c.Timeout < 0 {
+		return fmt.Errorf("negative timeout for collector %q", c.Name)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("negative retries for collector %q", c.Name)
+	}
+	if c.RetryBackoff < 0 {
+		return fmt.Errorf("negative retry_backoff for collector %q", c.Name)
+	}
+	if c.MaxRows < 0 {
+		return fmt.Errorf("negative max_rows for collector %q", c.Name)
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("negative cache_ttl for collector %q", c.Name)
+	}
+	if err := checkOverflow(c.XXX, "collector"); err != nil {
+		return err
+	}
+
+	// Collectors extending another are only set up once merged with their base collector, by resolveExtends.
+	if c.Extends != "" {
+		return nil
+	}
+	return c.setup()
+}
+
+// setup applies defaults to the collector, then parses and resolves its snippets, queries and derived metrics.
+func (c *CollectorConfig) setup() error {
+	if c.Plugin != nil {
+		if len(c.Metrics) > 0 || len(c.Queries) > 0 || len(c.QueryFiles) > 0 || len(c.DerivedMetrics) > 0 {
+			return fmt.Errorf("collector %q defines both a plugin and metrics or queries", c.Name)
+		}
+		return nil
+	}
 	if len(c.Metrics) == 0 {
 		return fmt.Errorf("no metrics defined for collector %q", c.Name)
 	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = model.Duration(100 * time.Millisecond)
+	}
 
-	// Set metric.query for all metrics: resolve query references (if any) and generate QueryConfigs for literal queries.
+	// Parse snippets into a template set, to be extended with each query template.
+	if len(c.Snippets) > 0 {
+		c.snippets = template.New("")
+		for name, text := range c.Snippets {
+			if _, err := c.snippets.New(name).Parse(text); err != nil {
+				return fmt.Errorf("invalid snippet %q in collector %q: %s", name, c.Name, err)
+			}
+		}
+	}
+
+	if err := c.checkDerivedMetrics(); err != nil {
+		return err
+	}
+
+	// Queries read from files are only resolved once the files are read, by loadQueryFiles.
+	if !c.hasQueryFiles() {
+		return c.resolveQueries()
+	}
+	return nil
+}
+
+// PluginConfig defines a collector implemented by a Go plugin, for metrics that cannot be collected with plain SQL
+// queries. See sql_exporter.CollectorPluginFunc for the function the plugin must export.
+type PluginConfig struct {
+	Path   string            `yaml:"path"`             // path of the plugin (shared object) file
+	Params map[string]string `yaml:"params,omitempty"` // parameters passed to the plugin, as is
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for PluginConfig.
+func (p *PluginConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PluginConfig
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+
+	if p.Path == "" {
+		return fmt.Errorf("missing path for plugin")
+	}
+	return checkOverflow(p.XXX, "plugin")
+}
+
+// hasQueryFiles returns true if any of the collector's queries are read from files.
+func (c *CollectorConfig) hasQueryFiles() bool {
+	if len(c.QueryFiles) > 0 {
+		return true
+	}
+	for _, query := range c.Queries {
+		if query.QueryFile != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadQueryFiles reads the queries defined via `query_file` and the ones matching `query_files` patterns, then
+// resolves the collector's queries. Relative paths are resolved against baseDir.
+func (c *CollectorConfig) loadQueryFiles(baseDir string) error {
+	if !c.hasQueryFiles() {
+		return nil
+	}
+	for _, query := range c.Queries {
+		if query.QueryFile == "" {
+			continue
+		}
+		text, err := readQueryFile(baseDir, query.QueryFile)
+		if err != nil {
+			return fmt.Errorf("%s for query %q of collector %q", err, query.Name, c.Name)
+		}
+		query.Query = text
+	}
+
+	names := make(map[string]bool, len(c.Queries))
+	for _, query := range c.Queries {
+		names[query.Name] = true
+	}
+	for _, pattern := range c.QueryFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid query_files pattern %q in collector %q: %s", pattern, c.Name, err)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no files match query_files pattern %q in collector %q", pattern, c.Name)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			if names[name] {
+				return fmt.Errorf("duplicate query name %q (from file %q) in collector %q", name, file, c.Name)
+			}
+			names[name] = true
+			text, err := readQueryFile("", file)
+			if err != nil {
+				return fmt.Errorf("%s in collector %q", err, c.Name)
+			}
+			c.Queries = append(c.Queries, &QueryConfig{Name: name, Query: text, QueryFile: file})
+		}
+	}
+
+	return c.resolveQueries()
+}
+
+// readQueryFile reads a query from a file, resolving relative paths against baseDir.
+func readQueryFile(baseDir, file string) (string, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(baseDir, file)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading query file: %s", err)
+	}
+	text := strings.TrimSpace(string(buf))
+	if text == "" {
+		return "", fmt.Errorf("empty query file %q", file)
+	}
+	return text, nil
+}
+
+// resolveQueries sets metric.query for all metrics: it resolves query references (if any), generates QueryConfigs for
+// literal queries and parses query templates.
+func (c *CollectorConfig) resolveQueries() error {
 	queries := make(map[string]*QueryConfig, len(c.Queries))
 	for _, query := range c.Queries {
 		queries[query.Name] = query
@@ -269,18 +1103,27 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 			if !found {
 				return fmt.Errorf("unresolved query_ref %q in metric %q of collector %q", metric.QueryRef, metric.Name, c.Name)
 			}
+			if metric.OutputParameters && !query.hasOutputParameters() {
+				return fmt.Errorf("metric %q of collector %q is populated from output parameters, but query %q has none",
+					metric.Name, c.Name, query.Name)
+			}
 			metric.query = query
 			query.metrics = append(query.metrics, metric)
 		} else {
+			if metric.OutputParameters {
+				return fmt.Errorf("output_parameters is not allowed for metric %q with a literal query", metric.Name)
+			}
 			// For literal queries generate a QueryConfig with a name based off collector and metric name.
 			metric.query = &QueryConfig{
 				Name:  fmt.Sprintf("%s.[literal]", metric.Name),
 				Query: metric.QueryLiteral,
 			}
 		}
+		if err := metric.query.parseTemplate(c.snippets); err != nil {
+			return fmt.Errorf("%s in collector %q", err, c.Name)
+		}
 	}
-
-	return checkOverflow(c.XXX, "collector")
+	return nil
 }
 
 // MetricConfig defines a Prometheus metric, the SQL query to populate it and the mapping of columns to metric
@@ -294,9 +1137,77 @@ type MetricConfig struct {
 	Values       []string `yaml:"values"`                // expose each of these columns as a value, keyed by column name
 	QueryLiteral string   `yaml:"query,omitempty"`       // a literal query
 	QueryRef     string   `yaml:"query_ref,omitempty"`   // references a query in the query map
-
-	valueType prometheus.ValueType // TypeString converted to prometheus.ValueType
-	query     *QueryConfig         // QueryConfig resolved from QueryRef or generated from Query
+	ResultSet    int      `yaml:"result_set,omitempty"`  // populate from this result set (0 based), for multiple ones
+	// Populate from the output parameters of the (stored procedure) query, rather than from a result set.
+	OutputParameters bool `yaml:"output_parameters,omitempty"`
+	// Key/value mode: generate one metric per row, named after the metric name plus the (sanitized) value of this
+	// column, with the value taken from the single value column.
+	NameColumn string `yaml:"name_column,omitempty"`
+
+	// Sample timestamps: taken from this column (a timestamp or seconds since the epoch), rather than the scrape time.
+	// Rows with timestamps older than max_age (if set) are dropped.
+	TimestampColumn string         `yaml:"timestamp_column,omitempty"`
+	MaxAge          model.Duration `yaml:"max_age,omitempty"`
+
+	// JSON expansion: maps field names, usable as key label, value (or other) columns, to JSONPath-style expressions
+	// selecting them from the JSON document in `json_column`, e.g. `{role: $.replication.role}`.
+	JSONColumn string            `yaml:"json_column,omitempty"`
+	JSONFields map[string]string `yaml:"json_fields,omitempty"`
+
+	// Conversion of (typically string) value columns: `bool`, `duration` (to seconds), `size` (to bytes) or `timestamp`
+	// (to seconds since the epoch). If not set, values must be numeric, boolean or timestamp columns.
+	ValueFormat string `yaml:"value_format,omitempty"`
+	// Label value filters: series are only exported if their label values match the regular expressions in
+	// `label_allow` and don't match those in `label_deny`, keyed by label name. At most `max_series` series are
+	// exported per collection, if set.
+	LabelAllow map[string]string `yaml:"label_allow,omitempty"`
+	LabelDeny  map[string]string `yaml:"label_deny,omitempty"`
+	MaxSeries  int               `yaml:"max_series,omitempty"`
+
+	// Counter only: handling of decreases (e.g. on database restart), `clamp` (add the value before every decrease to
+	// the values after it) or `reset` (export as is); both count them in sql_exporter_counter_resets_total. Off if not
+	// set.
+	CounterResets string `yaml:"counter_resets,omitempty"`
+	// Optional arithmetic expression of `value`, applied to (non-NULL) values before export, e.g. `value * 1e-3`.
+	Transform string `yaml:"transform,omitempty"`
+	// NULL handling: `null_value` is one of `drop` (the row), `zero`, `nan` or a numeric constant to substitute for
+	// NULL values; `null_label` is substituted for NULL label values. If not set, NULLs are reported as errors.
+	NullValue string `yaml:"null_value,omitempty"`
+	NullLabel string `yaml:"null_label,omitempty"`
+
+	// Stateset only: one series per state, labeled with the state under value_label (or the metric name), with a
+	// value of 1 for the state matching the state column and 0 for all others.
+	StateColumn string   `yaml:"state_column,omitempty"`
+	States      []string `yaml:"states,omitempty"`
+
+	// Histogram only: maps cumulative bucket count columns to their upper bounds.
+	Buckets     map[string]float64 `yaml:"buckets,omitempty"`
+	SumColumn   string             `yaml:"sum_column,omitempty"`   // histogram only: sum of observations column
+	CountColumn string             `yaml:"count_column,omitempty"` // histogram only: count of observations column
+	// Histogram only: whether to also expose the bucket columns as a native histogram, approximating each bucket by
+	// the native bucket its upper bound falls in.
+	NativeHistogram bool `yaml:"native_histogram,omitempty"`
+	// Histogram only, instead of the above: a native histogram of the values of this column (one observation per row,
+	// grouped by key labels).
+	ObservationColumn string `yaml:"observation_column,omitempty"`
+	// Native histograms only: bucket boundaries grow by a factor of at most this much.
+	NativeHistogramBucketFactor float64 `yaml:"native_histogram_bucket_factor,omitempty"`
+
+	// Counter and histogram only: columns (e.g. a trace or query ID) attached to samples as OpenMetrics exemplar labels,
+	// with the exemplar value taken from `exemplar_value` (the counter value by default, required for histograms).
+	ExemplarLabels []string `yaml:"exemplar_labels,omitempty"`
+	ExemplarValue  string   `yaml:"exemplar_value,omitempty"`
+
+	valueType prometheus.ValueType      // TypeString converted to prometheus.ValueType
+	histogram bool                      // whether TypeString is "histogram"
+	info      bool                      // whether TypeString is "info"
+	stateset  bool                      // whether TypeString is "stateset"
+	nullValue float64                   // NullValue converted to float64, if not "drop"
+	jsonPaths map[string]JSONPath       // JSONFields, parsed
+	transform Transform                 // Transform, compiled
+	allow     map[string]*regexp.Regexp // LabelAllow, anchored and compiled
+	deny      map[string]*regexp.Regexp // LabelDeny, anchored and compiled
+	query     *QueryConfig              // QueryConfig resolved from QueryRef or generated from Query
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -307,6 +1218,78 @@ func (m *MetricConfig) ValueType() prometheus.ValueType {
 	return m.valueType
 }
 
+// Histogram returns true if the metric is a histogram, populated from bucket, sum and count columns.
+func (m *MetricConfig) Histogram() bool {
+	return m.histogram
+}
+
+// Native returns true if the metric is a native histogram, populated from an observation column or from bucket
+// columns with native_histogram set.
+func (m *MetricConfig) Native() bool {
+	return m.histogram && (m.NativeHistogram || m.ObservationColumn != "")
+}
+
+// NullValueDrop is the null_value policy dropping rows with NULL values.
+const NullValueDrop = "drop"
+
+// Supported counter_resets values.
+const (
+	CounterResetsClamp = "clamp"
+	CounterResetsReset = "reset"
+)
+
+// Supported value_format values.
+const (
+	ValueFormatBool      = "bool"
+	ValueFormatDuration  = "duration"
+	ValueFormatSize      = "size"
+	ValueFormatTimestamp = "timestamp"
+)
+
+// NullReplacement returns the value to substitute for NULL values, as per the null_value policy. Only meaningful if
+// NullValue is set and not NullValueDrop.
+func (m *MetricConfig) NullReplacement() float64 {
+	return m.nullValue
+}
+
+// JSONPaths returns the parsed paths of the fields to expand from the JSON column, keyed by field name.
+func (m *MetricConfig) JSONPaths() map[string]JSONPath {
+	return m.jsonPaths
+}
+
+// AllowedLabelValues returns the label_allow regular expressions, anchored and compiled, keyed by label name.
+func (m *MetricConfig) AllowedLabelValues() map[string]*regexp.Regexp {
+	return m.allow
+}
+
+// DeniedLabelValues returns the label_deny regular expressions, anchored and compiled, keyed by label name.
+func (m *MetricConfig) DeniedLabelValues() map[string]*regexp.Regexp {
+	return m.deny
+}
+
+// ValueTransform returns the compiled value transformation expression, nil if none.
+func (m *MetricConfig) ValueTransform() Transform {
+	return m.transform
+}
+
+// Info returns true if the metric is an info metric, with all columns mapped to labels and a constant value of 1.
+func (m *MetricConfig) Info() bool {
+	return m.info
+}
+
+// Stateset returns true if the metric is a stateset, with one 0/1 series per declared state.
+func (m *MetricConfig) Stateset() bool {
+	return m.stateset
+}
+
+// StateLabel returns the name of the label holding the state, for stateset metrics.
+func (m *MetricConfig) StateLabel() string {
+	if m.ValueLabel != "" {
+		return m.ValueLabel
+	}
+	return m.Name
+}
+
 // Query returns the query defined (as a literal) or referenced by the metric.
 func (m *MetricConfig) Query() *QueryConfig {
 	return m.query
@@ -332,16 +1315,92 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if (m.QueryLiteral == "") == (m.QueryRef == "") {
 		return fmt.Errorf("exactly one of query and query_ref should be specified for metric %q", m.Name)
 	}
+	if m.ResultSet < 0 {
+		return fmt.Errorf("negative result_set for metric %q", m.Name)
+	}
+	if m.OutputParameters && m.ResultSet != 0 {
+		return fmt.Errorf("result_set is not allowed for metric %q populated from output parameters", m.Name)
+	}
 
 	switch strings.ToLower(m.TypeString) {
 	case "counter":
 		m.valueType = prometheus.CounterValue
 	case "gauge":
 		m.valueType = prometheus.GaugeValue
+	case "histogram":
+		m.valueType = prometheus.UntypedValue
+		m.histogram = true
+	case "info":
+		m.valueType = prometheus.GaugeValue
+		m.info = true
+	case "stateset":
+		m.valueType = prometheus.GaugeValue
+		m.stateset = true
 	default:
 		return fmt.Errorf("unsupported metric type: %s", m.TypeString)
 	}
 
+	if err := m.checkJSONFields(); err != nil {
+		return err
+	}
+	if m.MaxSeries < 0 {
+		return fmt.Errorf("negative max_series for metric %q", m.Name)
+	}
+	var err error
+	if m.allow, err = compileLabelFilters(m.LabelAllow); err != nil {
+		return fmt.Errorf("%s in label_allow of metric %q", err, m.Name)
+	}
+	if m.deny, err = compileLabelFilters(m.LabelDeny); err != nil {
+		return fmt.Errorf("%s in label_deny of metric %q", err, m.Name)
+	}
+	switch m.CounterResets {
+	case "":
+	case CounterResetsClamp, CounterResetsReset:
+		if m.valueType != prometheus.CounterValue {
+			return fmt.Errorf("counter_resets is only allowed for counter metric %q", m.Name)
+		}
+	default:
+		return fmt.Errorf("unsupported counter_resets %q for metric %q, expecting clamp or reset", m.CounterResets, m.Name)
+	}
+	if m.MaxAge != 0 && m.TimestampColumn == "" {
+		return fmt.Errorf("max_age is only allowed with timestamp_column for metric %q", m.Name)
+	}
+
+	switch m.ValueFormat {
+	case "", ValueFormatBool, ValueFormatDuration, ValueFormatSize, ValueFormatTimestamp:
+	default:
+		return fmt.Errorf("unsupported value_format %q for metric %q", m.ValueFormat, m.Name)
+	}
+	if m.ValueFormat != "" && (m.histogram || m.info || m.stateset) {
+		return fmt.Errorf("value_format is not allowed for %s metric %q", m.TypeString, m.Name)
+	}
+	if m.Transform != "" {
+		if m.histogram || m.info || m.stateset {
+			return fmt.Errorf("transform is not allowed for %s metric %q", m.TypeString, m.Name)
+		}
+		t, err := parseTransform(m.Transform)
+		if err != nil {
+			return fmt.Errorf("%s for metric %q", err, m.Name)
+		}
+		m.transform = t
+	}
+
+	switch strings.ToLower(m.NullValue) {
+	case "", NullValueDrop:
+		m.NullValue = strings.ToLower(m.NullValue)
+	case "zero":
+		m.nullValue = 0
+	case "nan":
+		m.nullValue = math.NaN()
+	default:
+		f, err := strconv.ParseFloat(m.NullValue, 64)
+		if err != nil {
+			return fmt.Errorf("invalid null_value %q for metric %q, expecting drop, zero, nan or a number",
+				m.NullValue, m.Name)
+		}
+		m.nullValue = f
+	}
+
 	// Check for duplicate key labels
 	for i, li := range m.KeyLabels {
 		checkLabel(li, "metric", m.Name)
@@ -355,10 +1414,47 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 	}
 
+	if !m.stateset && (m.StateColumn != "" || len(m.States) > 0) {
+		return fmt.Errorf("state_column and states are only allowed for stateset metric %q", m.Name)
+	}
+	if err := m.checkExemplar(); err != nil {
+		return err
+	}
+	if m.histogram {
+		if err := m.checkHistogram(); err != nil {
+			return err
+		}
+		return checkOverflow(m.XXX, "metric")
+	}
+	if len(m.Buckets) > 0 || m.SumColumn != "" || m.CountColumn != "" || m.NativeHistogram ||
+		m.ObservationColumn != "" || m.NativeHistogramBucketFactor != 0 {
+		return fmt.Errorf("buckets, sum_column, count_column, native_histogram, observation_column and "+
+			"native_histogram_bucket_factor are only allowed for histogram metric %q", m.Name)
+	}
+	if m.info {
+		if len(m.Values) > 0 || m.ValueLabel != "" || m.NameColumn != "" {
+			return fmt.Errorf("values, value_label and name_column are not allowed for info metric %q", m.Name)
+		}
+		if len(m.KeyLabels) == 0 {
+			return fmt.Errorf("no key_labels defined for info metric %q", m.Name)
+		}
+		return checkOverflow(m.XXX, "metric")
+	}
+	if m.stateset {
+		if err := m.checkStateset(); err != nil {
+			return err
+		}
+		return checkOverflow(m.XXX, "metric")
+	}
+
 	if len(m.Values) == 0 {
 		return fmt.Errorf("no values defined for metric %q", m.Name)
 	}
 
+	if m.NameColumn != "" {
+		return m.checkNameColumn()
+	}
+
 	if len(m.Values) > 1 {
 		// Multiple value columns but no value label to identify them
 		if m.ValueLabel == "" {
@@ -370,12 +1466,161 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(m.XXX, "metric")
 }
 
+// DefaultNativeHistogramBucketFactor is the native histogram bucket factor used if not configured, for about 8
+// buckets per power of 2.
+const DefaultNativeHistogramBucketFactor = 1.1
+
+// checkHistogram validates the bucket, sum and count column mappings (or observation column) of a histogram metric.
+func (m *MetricConfig) checkHistogram() error {
+	if len(m.Values) > 0 || m.ValueLabel != "" || m.NameColumn != "" {
+		return fmt.Errorf("values, value_label and name_column are not allowed for histogram metric %q", m.Name)
+	}
+	if m.Native() {
+		if m.NativeHistogramBucketFactor == 0 {
+			m.NativeHistogramBucketFactor = DefaultNativeHistogramBucketFactor
+		}
+		if m.NativeHistogramBucketFactor <= 1 {
+			return fmt.Errorf("native_histogram_bucket_factor must be greater than 1 for histogram metric %q", m.Name)
+		}
+	} else if m.NativeHistogramBucketFactor != 0 {
+		return fmt.Errorf("native_histogram_bucket_factor is only allowed for native histogram metric %q", m.Name)
+	}
+	if m.ObservationColumn != "" {
+		if len(m.Buckets) > 0 || m.SumColumn != "" || m.CountColumn != "" {
+			return fmt.Errorf("buckets, sum_column and count_column are not allowed with observation_column for "+
+				"histogram metric %q", m.Name)
+		}
+		if m.TimestampColumn != "" || len(m.ExemplarLabels) > 0 {
+			return fmt.Errorf("timestamp_column and exemplar_labels are not allowed with observation_column for "+
+				"histogram metric %q", m.Name)
+		}
+		return nil
+	}
+	if len(m.Buckets) == 0 {
+		return fmt.Errorf("no buckets defined for histogram metric %q", m.Name)
+	}
+	if m.SumColumn == "" || m.CountColumn == "" {
+		return fmt.Errorf("sum_column and count_column must be defined for histogram metric %q", m.Name)
+	}
+
+	bounds := make(map[float64]string, len(m.Buckets))
+	for column, bound := range m.Buckets {
+		if other, found := bounds[bound]; found {
+			return fmt.Errorf("duplicate bucket upper bound %g (columns %q and %q) for histogram metric %q",
+				bound, other, column, m.Name)
+		}
+		bounds[bound] = column
+	}
+	return nil
+}
+
+// checkExemplar validates the exemplar label and value columns of a metric, if any.
+func (m *MetricConfig) checkExemplar() error {
+	if len(m.ExemplarLabels) == 0 {
+		if m.ExemplarValue != "" {
+			return fmt.Errorf("exemplar_value is only allowed with exemplar_labels for metric %q", m.Name)
+		}
+		return nil
+	}
+	if m.valueType != prometheus.CounterValue && !m.histogram {
+		return fmt.Errorf("exemplar_labels are only allowed for counter and histogram metrics, not %q", m.Name)
+	}
+	if m.histogram && m.ExemplarValue == "" {
+		return fmt.Errorf("exemplar_value must be defined with exemplar_labels for histogram metric %q", m.Name)
+	}
+	for i, li := range m.ExemplarLabels {
+		if !model.LabelName(li).IsValid() {
+			return fmt.Errorf("invalid exemplar label %q for metric %q", li, m.Name)
+		}
+		for _, lj := range m.ExemplarLabels[i+1:] {
+			if li == lj {
+				return fmt.Errorf("duplicate exemplar label %q for metric %q", li, m.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// compileLabelFilters compiles label value filters, anchoring the regular expressions at both ends.
+func compileLabelFilters(filters map[string]string) (map[string]*regexp.Regexp, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	compiled := make(map[string]*regexp.Regexp, len(filters))
+	for label, expr := range filters {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q for label %q: %s", expr, label, err)
+		}
+		compiled[label] = re
+	}
+	return compiled, nil
+}
+
+// checkStateset validates the state column and states of a stateset metric.
+func (m *MetricConfig) checkStateset() error {
+	if len(m.Values) > 0 || m.NameColumn != "" {
+		return fmt.Errorf("values and name_column are not allowed for stateset metric %q", m.Name)
+	}
+	if m.StateColumn == "" {
+		return fmt.Errorf("no state_column defined for stateset metric %q", m.Name)
+	}
+	if len(m.States) == 0 {
+		return fmt.Errorf("no states defined for stateset metric %q", m.Name)
+	}
+	for i, si := range m.States {
+		for _, sj := range m.States[i+1:] {
+			if si == sj {
+				return fmt.Errorf("duplicate state %q for stateset metric %q", si, m.Name)
+			}
+		}
+	}
+	for _, l := range m.KeyLabels {
+		if l == m.StateColumn {
+			return fmt.Errorf("state_column %q also used as key label for stateset metric %q", l, m.Name)
+		}
+		if l == m.StateLabel() {
+			return fmt.Errorf("duplicate label %q (key label and state label) for stateset metric %q", l, m.Name)
+		}
+	}
+	return checkLabel(m.StateLabel(), "state label for metric", m.Name)
+}
+
+// checkNameColumn validates a key/value mode metric, generating metric names from a column.
+func (m *MetricConfig) checkNameColumn() error {
+	if len(m.Values) > 1 || m.ValueLabel != "" {
+		return fmt.Errorf("exactly one value and no value_label allowed for metric %q with name_column", m.Name)
+	}
+	if m.NameColumn == m.Values[0] {
+		return fmt.Errorf("name_column %q also used as value for metric %q", m.NameColumn, m.Name)
+	}
+	for _, l := range m.KeyLabels {
+		if l == m.NameColumn {
+			return fmt.Errorf("name_column %q also used as key label for metric %q", m.NameColumn, m.Name)
+		}
+	}
+	return checkOverflow(m.XXX, "metric")
+}
+
 // QueryConfig defines a named query, to be referenced by one or multiple metrics.
 type QueryConfig struct {
-	Name  string `yaml:"query_name"` // the query name, to be referenced via `query_ref`
-	Query string `yaml:"query"`      // the named query
-
-	metrics []*MetricConfig // metrics referencing this query
+	Name      string         `yaml:"query_name"`           // the query name, to be referenced via `query_ref`
+	Query     string         `yaml:"query,omitempty"`      // the named query, or
+	QueryFile string         `yaml:"query_file,omitempty"` // a file to read the query from, or
+	Procedure string         `yaml:"procedure,omitempty"`  // the stored procedure to call
+	Timeout   model.Duration `yaml:"timeout,omitempty"`    // maximum time to spend running the query
+	// If non-zero, the maximum number of rows (across all result sets) to collect metrics from. Any further rows are
+	// skipped without being scanned, so runaway queries cannot cause unbounded memory use.
+	MaxRows int `yaml:"max_rows,omitempty"`
+	// Optional feature detection query: the query only runs on targets where it returns a row with a true (or
+	// non-zero) first column. Run once per target.
+	When string `yaml:"when,omitempty"`
+
+	// Stored procedure parameters, in the order declared by the procedure.
+	Parameters []*ParameterConfig `yaml:"parameters,omitempty"`
+
+	metrics  []*MetricConfig    // metrics referencing this query
+	template *template.Template // Query parsed as a Go template, nil if it contains no actions
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -392,8 +1637,30 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if q.Name == "" {
 		return fmt.Errorf("missing name for query %+v", q)
 	}
-	if q.Query == "" {
-		return fmt.Errorf("missing query literal for query %q", q.Name)
+	defined := 0
+	for _, set := range []bool{q.Query != "", q.QueryFile != "", q.Procedure != ""} {
+		if set {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return fmt.Errorf("exactly one of query, query_file and procedure should be specified for query %q", q.Name)
+	}
+	if q.MaxRows < 0 {
+		return fmt.Errorf("negative max_rows for query %q", q.Name)
+	}
+	if len(q.Parameters) > 0 && q.Procedure == "" {
+		return fmt.Errorf("parameters are only allowed for stored procedure query %q", q.Name)
+	}
+	names := make(map[string]bool, len(q.Parameters))
+	for _, p := range q.Parameters {
+		if names[p.Name] {
+			return fmt.Errorf("duplicate parameter %q for query %q", p.Name, q.Name)
+		}
+		names[p.Name] = true
+	}
+	if q.Timeout < 0 {
+		return fmt.Errorf("negative timeout for query %q", q.Name)
 	}
 
 	q.metrics = make([]*MetricConfig, 0, 2)
@@ -401,6 +1668,60 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(q.XXX, "metric")
 }
 
+// Template returns the query parsed as a Go template, to be rendered with target specific data before execution, or
+// nil if the query contains no template actions.
+func (q *QueryConfig) Template() *template.Template {
+	return q.template
+}
+
+// parseTemplate parses the query as a Go template, if it contains any actions, along with the provided snippets (if
+// any). Missing map keys (e.g. referencing a label the target doesn't have) are errors when rendering.
+func (q *QueryConfig) parseTemplate(snippets *template.Template) error {
+	if q.template != nil || !strings.Contains(q.Query, "{{") {
+		return nil
+	}
+	tmpl := template.New(q.Name)
+	if snippets != nil {
+		if snippets.Lookup(q.Name) != nil {
+			return fmt.Errorf("query %q has the same name as a snippet", q.Name)
+		}
+		clone, err := snippets.Clone()
+		if err != nil {
+			return err
+		}
+		tmpl = clone.New(q.Name)
+	}
+	tmpl, err := tmpl.Option("missingkey=error").Parse(q.Query)
+	if err != nil {
+		return fmt.Errorf("invalid template for query %q: %s", q.Name, err)
+	}
+	q.template = tmpl
+	return nil
+}
+
+// hasOutputParameters returns true if the query is a stored procedure call with output parameters.
+func (q *QueryConfig) hasOutputParameters() bool {
+	for _, p := range q.Parameters {
+		if p.Output {
+			return true
+		}
+	}
+	return false
+}
+
+// paramNameRE matches valid query and stored procedure parameter names, usable as is in SQL statements.
+var paramNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkParams checks that all query parameter names are valid.
+func checkParams(params map[string]string, ctx ...string) error {
+	for name := range params {
+		if !paramNameRE.MatchString(name) {
+			return fmt.Errorf("invalid query parameter name %q in %s", name, strings.Join(ctx, " "))
+		}
+	}
+	return nil
+}
+
 func checkLabel(label string, ctx ...string) error {
 	if label == "" {
 		return fmt.Errorf("empty label defined in %s", strings.Join(ctx, " "))
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dataSourceDefaultPorts maps the drivers supported by data source configs to their default ports.
+var dataSourceDefaultPorts = map[string]int{
+	"postgres":   5432,
+	"mysql":      3306,
+	"sqlserver":  1433,
+	"clickhouse": 9000,
+	"trino":      8080,
+}
+
+// DataSourceConfig defines a target's data source field by field, as an alternative to a data source name. Fields are
+// assembled into a driver specific data source name, escaped as needed.
+type DataSourceConfig struct {
+	Driver       string `yaml:"driver"`                  // `postgres`, `mysql`, `sqlserver`, `clickhouse` or `trino`
+	Host         string `yaml:"host"`                    // host name or IP address
+	Port         int    `yaml:"port,omitempty"`          // defaults to the driver's default port
+	Database     string `yaml:"database,omitempty"`      // database (Trino catalog) to connect to, driver default if empty
+	User         string `yaml:"user,omitempty"`          // user name to log in as
+	Password     Secret `yaml:"password,omitempty"`      // password to log in with, or
+	PasswordFile string `yaml:"password_file,omitempty"` // file to read the password from
+	// Whether to require (true) or disable (false) TLS, left to the driver default if not set.
+	TLS     *bool             `yaml:"tls,omitempty"`
+	Options map[string]string `yaml:"options,omitempty"` // other driver specific data source name parameters
+
+	password string // read from PasswordFile
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for DataSourceConfig.
+func (d *DataSourceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DataSourceConfig
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+
+	if _, found := dataSourceDefaultPorts[d.Driver]; !found {
+		return fmt.Errorf(
+			"invalid driver %q for data_source, expecting `postgres`, `mysql`, `sqlserver`, `clickhouse` or `trino`",
+			d.Driver)
+	}
+	if d.Host == "" {
+		return fmt.Errorf("missing host for data_source")
+	}
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("invalid port %d for data_source", d.Port)
+	}
+	if d.Password != "" && d.PasswordFile != "" {
+		return fmt.Errorf("at most one of password and password_file may be defined for data_source")
+	}
+	for name := range d.Options {
+		if name == "" {
+			return fmt.Errorf("empty option name for data_source")
+		}
+	}
+
+	return checkOverflow(d.XXX, "data_source")
+}
+
+// MarshalYAML implements the yaml.Marshaler interface for DataSourceConfig. It replaces the values of options that
+// look like passwords with placeholders, same as Password.
+func (d *DataSourceConfig) MarshalYAML() (interface{}, error) {
+	type plain DataSourceConfig
+	redacted := plain(*d)
+	if len(d.Options) > 0 {
+		redacted.Options = make(map[string]string, len(d.Options))
+		for name, value := range d.Options {
+			if dsnPasswordParamRE.MatchString(name + "=") {
+				value = "<secret>"
+			}
+			redacted.Options[name] = value
+		}
+	}
+	return &redacted, nil
+}
+
+// loadPasswordFile reads the password from PasswordFile, if defined. Relative paths are resolved against baseDir.
+func (d *DataSourceConfig) loadPasswordFile(baseDir string) error {
+	if d.PasswordFile == "" {
+		return nil
+	}
+	file := d.PasswordFile
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(baseDir, file)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading password_file: %s", err)
+	}
+	d.password = strings.TrimSpace(string(buf))
+	return nil
+}
+
+// DSN assembles the driver specific data source name. If resolve is not nil, it is applied to all string fields and
+// option values first, e.g. to replace secret references with the secrets' values.
+func (d *DataSourceConfig) DSN(resolve func(string) (string, error)) (string, error) {
+	if resolve == nil {
+		resolve = func(s string) (string, error) { return s, nil }
+	}
+	host, database, user, password := d.Host, d.Database, d.User, string(d.Password)
+	if d.PasswordFile != "" {
+		password = d.password
+	}
+	for _, f := range []*string{&host, &database, &user, &password} {
+		var err error
+		if *f, err = resolve(*f); err != nil {
+			return "", err
+		}
+	}
+
+	params := url.Values{}
+	for name, value := range d.Options {
+		value, err := resolve(value)
+		if err != nil {
+			return "", err
+		}
+		params.Set(name, value)
+	}
+
+	port := d.Port
+	if port == 0 {
+		port = dataSourceDefaultPorts[d.Driver]
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	var userinfo *url.Userinfo
+	if user != "" || password != "" {
+		userinfo = url.UserPassword(user, password)
+	}
+
+	switch d.Driver {
+	case "postgres":
+		if d.TLS != nil {
+			params.Set("sslmode", map[bool]string{true: "require", false: "disable"}[*d.TLS])
+		}
+		u := url.URL{Scheme: "postgres", User: userinfo, Host: address, Path: "/" + database}
+		u.RawQuery = params.Encode()
+		return u.String(), nil
+
+	case "sqlserver":
+		if database != "" {
+			params.Set("database", database)
+		}
+		if d.TLS != nil {
+			params.Set("encrypt", map[bool]string{true: "true", false: "disable"}[*d.TLS])
+		}
+		u := url.URL{Scheme: "sqlserver", User: userinfo, Host: address}
+		u.RawQuery = params.Encode()
+		return u.String(), nil
+
+	case "clickhouse":
+		if user != "" {
+			params.Set("username", user)
+		}
+		if password != "" {
+			params.Set("password", password)
+		}
+		if database != "" {
+			params.Set("database", database)
+		}
+		if d.TLS != nil {
+			params.Set("secure", strconv.FormatBool(*d.TLS))
+		}
+		u := url.URL{Scheme: "clickhouse", Host: address}
+		u.RawQuery = params.Encode()
+		return u.String(), nil
+
+	case "trino":
+		// The schema, if any, is one of the options.
+		if database != "" {
+			params.Set("catalog", database)
+		}
+		if d.TLS != nil {
+			params.Set("ssl", strconv.FormatBool(*d.TLS))
+		}
+		u := url.URL{Scheme: "trino", User: userinfo, Host: address}
+		u.RawQuery = params.Encode()
+		return u.String(), nil
+
+	case "mysql":
+		// MySQL DSNs are not URLs: user, password and database name are used verbatim (the password may contain any
+		// character, as the address follows the last `@`), only parameter values are unescaped.
+		if d.TLS != nil {
+			params.Set("tls", strconv.FormatBool(*d.TLS))
+		}
+		var dsn strings.Builder
+		dsn.WriteString("mysql://")
+		if user != "" || password != "" {
+			dsn.WriteString(user)
+			if password != "" {
+				dsn.WriteString(":" + password)
+			}
+			dsn.WriteString("@")
+		}
+		dsn.WriteString("tcp(" + address + ")/" + database)
+		if len(params) > 0 {
+			dsn.WriteString("?" + params.Encode())
+		}
+		return dsn.String(), nil
+	}
+	return "", fmt.Errorf("unsupported driver %q", d.Driver)
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DerivedMetricConfig defines a metric computed from other metrics of the same collector, via an arithmetic expression
+// of their names, e.g. `hits / (hits + misses)`. One series is computed for every label set present in all the
+// referenced metrics.
+type DerivedMetricConfig struct {
+	Name       string `yaml:"metric_name"` // the Prometheus metric name
+	TypeString string `yaml:"type"`        // the Prometheus metric type
+	Help       string `yaml:"help"`        // the Prometheus metric help text
+	Expr       string `yaml:"expr"`        // the expression computing the metric value
+
+	valueType  prometheus.ValueType // TypeString converted to prometheus.ValueType
+	expression *Expression          // Expr, compiled
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// ValueType returns the metric type, converted to a prometheus.ValueType.
+func (d *DerivedMetricConfig) ValueType() prometheus.ValueType {
+	return d.valueType
+}
+
+// Expression returns the compiled expression.
+func (d *DerivedMetricConfig) Expression() *Expression {
+	return d.expression
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for DerivedMetricConfig.
+func (d *DerivedMetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DerivedMetricConfig
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+
+	if d.Name == "" {
+		return fmt.Errorf("missing name for derived metric %+v", d)
+	}
+	if d.Help == "" {
+		return fmt.Errorf("missing help for derived metric %q", d.Name)
+	}
+	switch strings.ToLower(d.TypeString) {
+	case "counter":
+		d.valueType = prometheus.CounterValue
+	case "gauge":
+		d.valueType = prometheus.GaugeValue
+	default:
+		return fmt.Errorf("unsupported type %q for derived metric %q", d.TypeString, d.Name)
+	}
+	e, err := parseExpression(d.Expr)
+	if err != nil {
+		return fmt.Errorf("invalid expr %q for derived metric %q: %s", d.Expr, d.Name, err)
+	}
+	d.expression = e
+
+	return checkOverflow(d.XXX, "derived metric")
+}
+
+// checkDerivedMetrics checks that the collector's derived metrics only reference gauge or counter metrics (or
+// previously defined derived metrics) of the collector, by name.
+func (c *CollectorConfig) checkDerivedMetrics() error {
+	names := make(map[string]bool, len(c.Metrics)+len(c.DerivedMetrics))
+	for _, m := range c.Metrics {
+		if !m.histogram && !m.stateset && m.NameColumn == "" {
+			names[m.Name] = true
+		}
+	}
+	for _, d := range c.DerivedMetrics {
+		for _, v := range d.expression.Variables() {
+			if !names[v] {
+				return fmt.Errorf("derived metric %q references unknown (or non gauge/counter) metric %q in collector %q",
+					d.Name, v, c.Name)
+			}
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate metric name %q for derived metric in collector %q", d.Name, c.Name)
+		}
+		names[d.Name] = true
+	}
+	return nil
+}
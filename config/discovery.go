@@ -0,0 +1,347 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"text/template"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+)
+
+// Secret is a string that is replaced by a placeholder when marshaled, as it may contain credentials.
+type Secret string
+
+// MarshalYAML implements the yaml.Marshaler interface for Secret.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return "<secret>", nil
+}
+
+// DSNTemplate is a data source name template. When marshaled, any passwords it includes (in URL user info or as
+// `password` or `pwd` parameters) are redacted.
+type DSNTemplate string
+
+var (
+	// dsnUserInfoPasswordRE matches the password in the user info of a URL (template).
+	dsnUserInfoPasswordRE = regexp.MustCompile(`(://[^:/@\s]*):[^/@\s]*@`)
+	// dsnPasswordParamRE matches password parameters, as used by e.g. ODBC and key/value DSNs.
+	dsnPasswordParamRE = regexp.MustCompile(`(?i)\b(password|pwd)=[^&;\s]*`)
+)
+
+// MarshalYAML implements the yaml.Marshaler interface for DSNTemplate.
+func (t DSNTemplate) MarshalYAML() (interface{}, error) {
+	return redactDSN(string(t)), nil
+}
+
+// redactDSN replaces the passwords included in a data source name (or template) with `xxxxx`.
+func redactDSN(dsn string) string {
+	dsn = dsnUserInfoPasswordRE.ReplaceAllString(dsn, "$1:xxxxx@")
+	return dsnPasswordParamRE.ReplaceAllString(dsn, "$1=xxxxx")
+}
+
+// defaultRefreshInterval is the default interval between target discovery refreshes.
+const defaultRefreshInterval = model.Duration(5 * time.Minute)
+
+// SQLSDConfig defines a query against a catalog database, returning one row per target of a job.
+type SQLSDConfig struct {
+	DSN             Secret         `yaml:"data_source_name"`           // the catalog database to query
+	Query           string         `yaml:"query"`                      // returns one row per target
+	NameColumn      string         `yaml:"name_column,omitempty"`      // column holding target names, default `name`
+	DSNColumn       string         `yaml:"dsn_column,omitempty"`       // column holding target DSNs, default `dsn`
+	LabelColumns    []string       `yaml:"label_columns,omitempty"`    // columns to apply as labels to the targets
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"` // how often to re-run the query, default 5m
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for SQLSDConfig.
+func (c *SQLSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.NameColumn = "name"
+	c.DSNColumn = "dsn"
+	c.RefreshInterval = defaultRefreshInterval
+
+	type plain SQLSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.DSN == "" {
+		return fmt.Errorf("missing data_source_name for sql_sd_config")
+	}
+	if c.Query == "" {
+		return fmt.Errorf("missing query for sql_sd_config")
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive for sql_sd_config")
+	}
+	for _, l := range c.LabelColumns {
+		if err := checkLabel(l, "sql_sd_config"); err != nil {
+			return err
+		}
+	}
+
+	return checkOverflow(c.XXX, "sql_sd_config")
+}
+
+// KubernetesSDConfig defines the discovery of targets from Kubernetes pods or services.
+type KubernetesSDConfig struct {
+	Role          string   `yaml:"role"`                     // `pod` or `service`
+	Namespaces    []string `yaml:"namespaces,omitempty"`     // namespaces to look in, all namespaces if empty
+	LabelSelector string   `yaml:"label_selector,omitempty"` // e.g. `app=postgres,tier!=dev`
+	// Annotation holding the DSN template of a pod/service, default `sql-exporter.io/dsn`.
+	DSNAnnotation string `yaml:"dsn_annotation,omitempty"`
+	// DSN template for pods/services without a DSN annotation. If empty, such pods/services are ignored.
+	DSNTemplate DSNTemplate `yaml:"dsn_template,omitempty"`
+	// Kubernetes API server URL. If empty, the exporter is assumed to run inside the cluster.
+	APIServer       config_util.URL              `yaml:"api_server,omitempty"`
+	HTTPClient      config_util.HTTPClientConfig `yaml:",inline"`
+	RefreshInterval model.Duration               `yaml:"refresh_interval,omitempty"` // default 5m
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for KubernetesSDConfig.
+func (c *KubernetesSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.DSNAnnotation = "sql-exporter.io/dsn"
+	c.HTTPClient = config_util.DefaultHTTPClientConfig
+	c.RefreshInterval = defaultRefreshInterval
+
+	type plain KubernetesSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Role {
+	case "pod", "service":
+	default:
+		return fmt.Errorf("invalid role %q for kubernetes_sd_config, expecting `pod` or `service`", c.Role)
+	}
+	if err := checkTemplate(string(c.DSNTemplate), "dsn_template", "kubernetes_sd_config"); err != nil {
+		return err
+	}
+	if err := c.HTTPClient.Validate(); err != nil {
+		return fmt.Errorf("%s in kubernetes_sd_config", err)
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive for kubernetes_sd_config")
+	}
+
+	return checkOverflow(c.XXX, "kubernetes_sd_config")
+}
+
+// checkTemplate checks that text, if not empty, is a valid Go template.
+func checkTemplate(text, field, ctx string) error {
+	if text == "" {
+		return nil
+	}
+	if _, err := template.New(field).Parse(text); err != nil {
+		return fmt.Errorf("invalid %s in %s: %s", field, ctx, err)
+	}
+	return nil
+}
+
+// AWSRDSSDConfig defines the discovery of targets from AWS RDS database instances or Aurora clusters.
+type AWSRDSSDConfig struct {
+	AWSConfig `yaml:",inline"`
+	Role      string            `yaml:"role,omitempty"`    // `instance` (the default) or `cluster`
+	Engines   []string          `yaml:"engines,omitempty"` // only discover these engines (e.g. `postgres`), if set
+	Tags      map[string]string `yaml:"tags,omitempty"`    // only discover instances/clusters with these tags
+	// DSN template, with access to the instance/cluster .Name, .Address, .Port and .Labels (tags).
+	DSNTemplate DSNTemplate `yaml:"dsn_template"`
+	// Whether to log in using RDS IAM database authentication tokens rather than the DSN password.
+	IAMAuth         bool           `yaml:"iam_auth,omitempty"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"` // default 5m
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for AWSRDSSDConfig.
+func (c *AWSRDSSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.Role = "instance"
+	c.RefreshInterval = defaultRefreshInterval
+
+	type plain AWSRDSSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Role {
+	case "instance", "cluster":
+	default:
+		return fmt.Errorf("invalid role %q for aws_rds_sd_config, expecting `instance` or `cluster`", c.Role)
+	}
+	if c.DSNTemplate == "" {
+		return fmt.Errorf("missing dsn_template for aws_rds_sd_config")
+	}
+	if err := checkTemplate(string(c.DSNTemplate), "dsn_template", "aws_rds_sd_config"); err != nil {
+		return err
+	}
+	if err := c.AWSConfig.validate("aws_rds_sd_config"); err != nil {
+		return err
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive for aws_rds_sd_config")
+	}
+
+	return checkOverflow(c.XXX, "aws_rds_sd_config")
+}
+
+// GCPCloudSQLSDConfig defines the discovery of targets from GCP Cloud SQL instances.
+type GCPCloudSQLSDConfig struct {
+	Project string            `yaml:"project"`          // the project to list instances of
+	Labels  map[string]string `yaml:"labels,omitempty"` // only discover instances with these user labels
+	// DSN template, with access to the instance .Name, .Address, .Port and .Labels.
+	DSNTemplate DSNTemplate `yaml:"dsn_template"`
+	// Whether to connect to private rather than public IP addresses.
+	PrivateIP bool `yaml:"private_ip,omitempty"`
+	// Whether to connect through the Cloud SQL server side proxy, with automatic TLS, instead of directly.
+	UseConnector bool `yaml:"use_connector,omitempty"`
+	// Whether to log in using IAM database authentication. Requires use_connector.
+	IAMAuth bool `yaml:"iam_auth,omitempty"`
+	// Service account key file, if not using Application Default Credentials.
+	CredentialsFile string         `yaml:"credentials_file,omitempty"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"` // default 5m
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for GCPCloudSQLSDConfig.
+func (c *GCPCloudSQLSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.RefreshInterval = defaultRefreshInterval
+
+	type plain GCPCloudSQLSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Project == "" {
+		return fmt.Errorf("missing project for gcp_cloudsql_sd_config")
+	}
+	if c.DSNTemplate == "" {
+		return fmt.Errorf("missing dsn_template for gcp_cloudsql_sd_config")
+	}
+	if err := checkTemplate(string(c.DSNTemplate), "dsn_template", "gcp_cloudsql_sd_config"); err != nil {
+		return err
+	}
+	if c.IAMAuth && !c.UseConnector {
+		return fmt.Errorf("iam_auth requires use_connector in gcp_cloudsql_sd_config")
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive for gcp_cloudsql_sd_config")
+	}
+
+	return checkOverflow(c.XXX, "gcp_cloudsql_sd_config")
+}
+
+// AzureSDConfig defines the discovery of targets from Azure SQL databases or managed instances, via Azure Resource
+// Graph.
+type AzureSDConfig struct {
+	AzureConfig   `yaml:",inline"`
+	Subscriptions []string          `yaml:"subscriptions"`  // subscription IDs to look in
+	Role          string            `yaml:"role,omitempty"` // `database` (the default) or `managed_instance`
+	Tags          map[string]string `yaml:"tags,omitempty"` // only discover resources with these tags
+	// DSN template, with access to the database/instance .Name, .Address, .Port, .Labels (tags) and .Meta
+	// (`resource_group`, `region`, `resource_id` and, for databases, `server`).
+	DSNTemplate     DSNTemplate    `yaml:"dsn_template"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"` // default 5m
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for AzureSDConfig.
+func (c *AzureSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.Role = "database"
+	c.RefreshInterval = defaultRefreshInterval
+
+	type plain AzureSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if len(c.Subscriptions) == 0 {
+		return fmt.Errorf("no subscriptions defined for azure_sd_config")
+	}
+	switch c.Role {
+	case "database", "managed_instance":
+	default:
+		return fmt.Errorf("invalid role %q for azure_sd_config, expecting `database` or `managed_instance`", c.Role)
+	}
+	if c.DSNTemplate == "" {
+		return fmt.Errorf("missing dsn_template for azure_sd_config")
+	}
+	if err := checkTemplate(string(c.DSNTemplate), "dsn_template", "azure_sd_config"); err != nil {
+		return err
+	}
+	if err := c.AzureConfig.validate("azure_sd_config"); err != nil {
+		return err
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive for azure_sd_config")
+	}
+
+	return checkOverflow(c.XXX, "azure_sd_config")
+}
+
+// ConsulSDConfig defines the discovery of targets from Consul service instances.
+type ConsulSDConfig struct {
+	Server     string   `yaml:"server,omitempty"`     // Consul agent address, default `localhost:8500`
+	Scheme     string   `yaml:"scheme,omitempty"`     // `http` (the default) or `https`
+	Token      Secret   `yaml:"token,omitempty"`      // ACL token
+	Datacenter string   `yaml:"datacenter,omitempty"` // defaults to the agent's datacenter
+	Services   []string `yaml:"services,omitempty"`   // services to discover, all services if empty
+	Tags       []string `yaml:"tags,omitempty"`       // only discover service instances with all of these tags
+	// Whether to only discover service instances passing all their health checks.
+	PassingOnly bool `yaml:"passing_only,omitempty"`
+	// DSN template, with access to the service .Name, .Address, .Port, .Labels (service metadata) and .Meta (`node`,
+	// `datacenter`, `service_id` and comma separated `tags`).
+	DSNTemplate     DSNTemplate                  `yaml:"dsn_template"`
+	HTTPClient      config_util.HTTPClientConfig `yaml:",inline"`
+	RefreshInterval model.Duration               `yaml:"refresh_interval,omitempty"` // default 30s
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ConsulSDConfig.
+func (c *ConsulSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.Server = "localhost:8500"
+	c.Scheme = "http"
+	c.HTTPClient = config_util.DefaultHTTPClientConfig
+	// Consul membership changes frequently and queries are cheap, so refresh more often than the other mechanisms.
+	c.RefreshInterval = model.Duration(30 * time.Second)
+
+	type plain ConsulSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q for consul_sd_config, expecting `http` or `https`", c.Scheme)
+	}
+	if c.DSNTemplate == "" {
+		return fmt.Errorf("missing dsn_template for consul_sd_config")
+	}
+	if err := checkTemplate(string(c.DSNTemplate), "dsn_template", "consul_sd_config"); err != nil {
+		return err
+	}
+	if c.Token != "" && c.HTTPClient.Authorization != nil {
+		return fmt.Errorf("at most one of token and authorization may be configured in consul_sd_config")
+	}
+	if err := c.HTTPClient.Validate(); err != nil {
+		return fmt.Errorf("%s in consul_sd_config", err)
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive for consul_sd_config")
+	}
+
+	return checkOverflow(c.XXX, "consul_sd_config")
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Error is an error found in a configuration (or collector) file, with the line it was found on, if known.
+type Error struct {
+	File string
+	Line int // 1-based, 0 if unknown
+	Err  error
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Err)
+}
+
+// yamlLineRE matches YAML syntax errors, e.g. `yaml: line 3: mapping values are not allowed in this context`.
+var yamlLineRE = regexp.MustCompile(`(?s)^yaml: line (\d+): (.*)$`)
+
+// yamlTypeErrorLineRE matches the individual errors of a yaml.TypeError, e.g. `line 3: cannot unmarshal ...`.
+var yamlTypeErrorLineRE = regexp.MustCompile(`(?s)^line (\d+): (.*)$`)
+
+// quotedRE matches double quoted strings, e.g. names quoted via `%q` in error messages.
+var quotedRE = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// elementTypes maps the paths of configuration elements to functions returning a new value of the respective type.
+// `[]` stands for any item of a sequence, `{}` for any value of a mapping.
+var elementTypes = map[string]func() interface{}{
+	"global":                              func() interface{} { return &GlobalConfig{} },
+	"jobs[]":                              func() interface{} { return &JobConfig{} },
+	"jobs[].static_configs[]":             func() interface{} { return &StaticConfig{} },
+	"jobs[].static_configs[].targets{}":   func() interface{} { return &targetSpec{} },
+	"jobs[].sql_sd_configs[]":             func() interface{} { return &SQLSDConfig{} },
+	"jobs[].kubernetes_sd_configs[]":      func() interface{} { return &KubernetesSDConfig{} },
+	"jobs[].aws_rds_sd_configs[]":         func() interface{} { return &AWSRDSSDConfig{} },
+	"jobs[].gcp_cloudsql_sd_configs[]":    func() interface{} { return &GCPCloudSQLSDConfig{} },
+	"jobs[].azure_sd_configs[]":           func() interface{} { return &AzureSDConfig{} },
+	"jobs[].consul_sd_configs[]":          func() interface{} { return &ConsulSDConfig{} },
+	"jobs[].circuit_breaker":              func() interface{} { return &CircuitBreakerConfig{} },
+	"jobs[].probe_dsns":                   func() interface{} { return &ProbeDSNsConfig{} },
+	"jobs[].integrated_auth":              func() interface{} { return &IntegratedAuthConfig{} },
+	"jobs[].cockroachdb":                  func() interface{} { return &CockroachDBConfig{} },
+	"jobs[].metric_relabel_configs[]":     func() interface{} { return &RelabelConfig{} },
+	"collectors[]":                        func() interface{} { return &CollectorConfig{} },
+	"collectors[].metrics[]":              func() interface{} { return &MetricConfig{} },
+	"collectors[].queries[]":              func() interface{} { return &QueryConfig{} },
+	"collectors[].queries[].parameters[]": func() interface{} { return &ParameterConfig{} },
+	"collectors[].derived_metrics[]":      func() interface{} { return &DerivedMetricConfig{} },
+	"collectors[].plugin":                 func() interface{} { return &PluginConfig{} },
+	"collector_files[]":                   func() interface{} { return &CollectorFileConfig{} },
+}
+
+// locateError returns err as an *Error found in file, with buf the file contents and root the path of the document
+// root (empty for configuration files). Unless err is already an *Error, it determines the line from YAML errors, by
+// finding the innermost element which fails to parse on its own with an error contained in err, or else by finding
+// the first value quoted in the error message.
+func locateError(file string, buf []byte, root string, err error) error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	if m := yamlLineRE.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &Error{File: file, Line: line, Err: fmt.Errorf("%s", m[2])}
+	}
+	if te, ok := err.(*yaml.TypeError); ok && len(te.Errors) > 0 {
+		if m := yamlTypeErrorLineRE.FindStringSubmatch(te.Errors[0]); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			if len(te.Errors) == 1 {
+				err = fmt.Errorf("%s", m[2])
+			}
+			return &Error{File: file, Line: line, Err: err}
+		}
+	}
+
+	var doc yamlv3.Node
+	if yamlv3.Unmarshal(buf, &doc) != nil || len(doc.Content) == 0 {
+		return &Error{File: file, Err: err}
+	}
+	line := locateElement(doc.Content[0], root, err.Error())
+	if line == 0 {
+		for _, quoted := range quotedRE.FindAllString(err.Error(), -1) {
+			if value, uerr := strconv.Unquote(quoted); uerr == nil {
+				if line = locateValue(doc.Content[0], value); line > 0 {
+					break
+				}
+			}
+		}
+	}
+	return &Error{File: file, Line: line, Err: err}
+}
+
+// locateElement returns the line of the innermost element under n (the node at path) which fails to parse on its own
+// with an error contained in msg, 0 if none does.
+func locateElement(n *yamlv3.Node, path, msg string) int {
+	switch n.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i].Value, n.Content[i+1]
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if line := locateElement(value, childPath, msg); line > 0 {
+				return line
+			}
+			if _, found := elementTypes[path+"{}"]; found {
+				if line := locateElement(value, path+"{}", msg); line > 0 {
+					return line
+				}
+			}
+		}
+	case yamlv3.SequenceNode:
+		for _, item := range n.Content {
+			if line := locateElement(item, path+"[]", msg); line > 0 {
+				return line
+			}
+		}
+	}
+
+	newElement, found := elementTypes[path]
+	if !found {
+		return 0
+	}
+	buf, err := yamlv3.Marshal(n)
+	if err != nil {
+		return 0
+	}
+	if err = yaml.Unmarshal(buf, newElement()); err != nil && strings.Contains(msg, err.Error()) {
+		return n.Line
+	}
+	return 0
+}
+
+// locateValue returns the line of the first scalar under n equal to value, 0 if there is none.
+func locateValue(n *yamlv3.Node, value string) int {
+	if n.Kind == yamlv3.ScalarNode && n.Value == value {
+		return n.Line
+	}
+	for _, child := range n.Content {
+		if line := locateValue(child, value); line > 0 {
+			return line
+		}
+	}
+	return 0
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode"
+)
+
+// Transform is a compiled value transformation expression, mapping a scanned value to the exported one.
+type Transform func(value float64) float64
+
+// evalFunc evaluates a compiled expression, given the values of its variables.
+type evalFunc func(vars map[string]float64) float64
+
+// Expression is a compiled arithmetic expression of named variables.
+type Expression struct {
+	eval      evalFunc
+	variables []string
+}
+
+// Eval evaluates the expression, given the values of all its variables.
+func (e *Expression) Eval(vars map[string]float64) float64 {
+	return e.eval(vars)
+}
+
+// Variables returns the names of the variables referenced by the expression, without duplicates.
+func (e *Expression) Variables() []string {
+	return e.variables
+}
+
+// exprFuncs are the functions available to expressions, keyed by name.
+var exprFuncs = map[string]struct {
+	arity int
+	f     func(args []float64) float64
+}{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"ln":    {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+}
+
+// parseTransform compiles an arithmetic expression of the scanned `value`, e.g. `value * 1e-3`, `1 - value` or
+// `abs(value)`.
+func parseTransform(expr string) (Transform, error) {
+	e, err := parseExpression(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transform %q: %s", expr, err)
+	}
+	for _, v := range e.variables {
+		if v != "value" {
+			return nil, fmt.Errorf("invalid transform %q: unknown identifier %q", expr, v)
+		}
+	}
+	return func(value float64) float64 {
+		return e.eval(map[string]float64{"value": value})
+	}, nil
+}
+
+// parseExpression compiles an arithmetic expression. Supported are numeric literals, variables, the `+`, `-`, `*`,
+// `/` and `%` operators, parentheses and the functions in exprFuncs. Expressions can do nothing but compute a
+// number, so they are safe to evaluate.
+func parseExpression(expr string) (*Expression, error) {
+	p := &exprParser{expr: expr, variables: make(map[string]bool)}
+	eval, err := p.parseSum()
+	if err == nil && p.peek() != 0 {
+		err = fmt.Errorf("unexpected %q at position %d", p.expr[p.pos:], p.pos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	variables := make([]string, 0, len(p.variables))
+	for v := range p.variables {
+		variables = append(variables, v)
+	}
+	sort.Strings(variables)
+	return &Expression{eval: eval, variables: variables}, nil
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions.
+type exprParser struct {
+	expr      string
+	pos       int
+	variables map[string]bool
+}
+
+// peek skips whitespace and returns the next character, 0 at the end of the expression.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.expr) && unicode.IsSpace(rune(p.expr[p.pos])) {
+		p.pos++
+	}
+	if p.pos == len(p.expr) {
+		return 0
+	}
+	return p.expr[p.pos]
+}
+
+// parseSum parses a sequence of terms separated by `+` or `-`.
+func (p *exprParser) parseSum() (evalFunc, error) {
+	left, err := p.parseProduct()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var right evalFunc
+		if right, err = p.parseProduct(); err == nil {
+			left = binaryExpr(op, left, right)
+		}
+	}
+	return left, err
+}
+
+// parseProduct parses a sequence of factors separated by `*`, `/` or `%`.
+func (p *exprParser) parseProduct() (evalFunc, error) {
+	left, err := p.parseFactor()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		p.pos++
+		var right evalFunc
+		if right, err = p.parseFactor(); err == nil {
+			left = binaryExpr(op, left, right)
+		}
+	}
+	return left, err
+}
+
+// binaryExpr combines two expressions with an arithmetic operator.
+func binaryExpr(op byte, left, right evalFunc) evalFunc {
+	switch op {
+	case '+':
+		return func(v map[string]float64) float64 { return left(v) + right(v) }
+	case '-':
+		return func(v map[string]float64) float64 { return left(v) - right(v) }
+	case '*':
+		return func(v map[string]float64) float64 { return left(v) * right(v) }
+	case '/':
+		return func(v map[string]float64) float64 { return left(v) / right(v) }
+	default:
+		return func(v map[string]float64) float64 { return math.Mod(left(v), right(v)) }
+	}
+}
+
+// parseFactor parses a negation, number, variable, function call or parenthesized expression.
+func (p *exprParser) parseFactor() (evalFunc, error) {
+	c := p.peek()
+	switch {
+	case c == '-':
+		p.pos++
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return func(v map[string]float64) float64 { return -operand(v) }, nil
+
+	case c == '(':
+		p.pos++
+		t, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return t, nil
+
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.expr) && (p.expr[p.pos] == '.' || (p.expr[p.pos] >= '0' && p.expr[p.pos] <= '9')) {
+			p.pos++
+		}
+		// Exponent, e.g. `1e-3`.
+		if p.pos < len(p.expr) && (p.expr[p.pos] == 'e' || p.expr[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.expr) && (p.expr[p.pos] == '+' || p.expr[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.expr) && p.expr[p.pos] >= '0' && p.expr[p.pos] <= '9' {
+				p.pos++
+			}
+		}
+		f, err := strconv.ParseFloat(p.expr[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.expr[start:p.pos])
+		}
+		return func(map[string]float64) float64 { return f }, nil
+
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.expr) && (p.expr[p.pos] == '_' || unicode.IsLetter(rune(p.expr[p.pos])) ||
+			unicode.IsDigit(rune(p.expr[p.pos]))) {
+			p.pos++
+		}
+		name := p.expr[start:p.pos]
+		if p.peek() == '(' {
+			return p.parseCall(name)
+		}
+		p.variables[name] = true
+		return func(v map[string]float64) float64 { return v[name] }, nil
+
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+}
+
+// parseCall parses the parenthesized arguments of a call to the named function.
+func (p *exprParser) parseCall(name string) (evalFunc, error) {
+	fn, found := exprFuncs[name]
+	if !found {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	p.pos++
+	args := make([]evalFunc, 0, fn.arity)
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing ) at position %d", p.pos)
+	}
+	p.pos++
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf("%s() takes %d argument(s), got %d", name, fn.arity, len(args))
+	}
+	return func(v map[string]float64) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(v)
+		}
+		return fn.f(values)
+	}, nil
+}
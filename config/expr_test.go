@@ -0,0 +1,58 @@
+package config
+
+import (
+	"math"
+	"testing"
+)
+
+// TestParseTransform checks the evaluation of transform expressions, including operator precedence and functions.
+func TestParseTransform(t *testing.T) {
+	tests := []struct {
+		expr        string
+		value, want float64
+	}{
+		{"value", 42, 42},
+		{"value * 1e-3", 2500, 2.5},
+		{"1 - value", 0.25, 0.75},
+		{"-value", 3, -3},
+		{"2 + value * 3", 4, 14},
+		{"(2 + value) * 3", 4, 18},
+		{"value / 4 - 1", 10, 1.5},
+		{"value % 7", 23, 2},
+		{"abs(value)", -5, 5},
+		{"round(value * 100) / 100", 1.23456, 1.23},
+		{"pow(value, 2)", 3, 9},
+		{"max(min(value, 10), 0)", 12, 10},
+		{"log10(value)", 1000, 3},
+	}
+	for _, test := range tests {
+		transform, err := parseTransform(test.expr)
+		if err != nil {
+			t.Errorf("parseTransform(%q): %s", test.expr, err)
+			continue
+		}
+		if got := transform(test.value); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s with value = %g: got %g, want %g", test.expr, test.value, got, test.want)
+		}
+	}
+}
+
+// TestParseTransformErrors checks that invalid transform expressions are rejected.
+func TestParseTransformErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"value +",
+		"value value",
+		"(value",
+		"foo",
+		"foo(value)",
+		"abs value",
+		"abs(value, 2)",
+		"pow(value)",
+		"value & 1",
+	} {
+		if _, err := parseTransform(expr); err == nil {
+			t.Errorf("parseTransform(%q) succeeded, want error", expr)
+		}
+	}
+}
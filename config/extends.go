@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resolveExtends merges the collector's base collector (resolving its own base first, if any) into it, then sets it
+// up. chain holds the names of the collectors extending this one, to detect cycles.
+func (c *CollectorConfig) resolveExtends(colls map[string]*CollectorConfig, chain []string) error {
+	if c.Extends == "" || c.extended {
+		return nil
+	}
+	chain = append(chain, c.Name)
+	for _, name := range chain {
+		if name == c.Extends {
+			return fmt.Errorf("cyclic extends between collectors: %s -> %s", strings.Join(chain, " -> "), c.Extends)
+		}
+	}
+	base, found := colls[c.Extends]
+	if !found {
+		return fmt.Errorf("unknown collector %q extended by collector %q", c.Extends, c.Name)
+	}
+	if err := base.resolveExtends(colls, chain); err != nil {
+		return err
+	}
+
+	c.inherit(base)
+	c.extended = true
+	return c.setup()
+}
+
+// inherit merges the settings, snippets, queries, metrics and derived metrics of base into c. The ones c defines
+// take precedence: settings if non-zero, everything else by name. Inherited queries and metrics are copied, as they
+// get resolved against c's own.
+func (c *CollectorConfig) inherit(base *CollectorConfig) {
+	if c.MinInterval < 0 {
+		c.MinInterval = base.MinInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = base.Timeout
+	}
+	if c.Retries == 0 {
+		c.Retries = base.Retries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = base.RetryBackoff
+	}
+	if c.MaxRows == 0 {
+		c.MaxRows = base.MaxRows
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = base.CacheTTL
+	}
+	if c.Plugin == nil {
+		c.Plugin = base.Plugin
+	}
+
+	if len(base.Snippets) > 0 {
+		snippets := make(map[string]string, len(base.Snippets)+len(c.Snippets))
+		for name, text := range base.Snippets {
+			snippets[name] = text
+		}
+		for name, text := range c.Snippets {
+			snippets[name] = text
+		}
+		c.Snippets = snippets
+	}
+
+	patterns := make(map[string]bool, len(c.QueryFiles))
+	for _, pattern := range c.QueryFiles {
+		patterns[pattern] = true
+	}
+	for _, pattern := range base.QueryFiles {
+		if !patterns[pattern] {
+			c.QueryFiles = append(c.QueryFiles, pattern)
+		}
+	}
+
+	queries := make([]*QueryConfig, 0, len(base.Queries)+len(c.Queries))
+	overridden := make(map[string]bool, len(c.Queries))
+	for _, q := range c.Queries {
+		overridden[q.Name] = true
+	}
+	// Queries matching base's query_files patterns are not read yet, c reads them itself along with its own.
+	for _, q := range base.Queries {
+		if !overridden[q.Name] {
+			inherited := *q
+			inherited.metrics, inherited.template = nil, nil
+			queries = append(queries, &inherited)
+		}
+	}
+	c.Queries = append(queries, c.Queries...)
+
+	metrics := make([]*MetricConfig, 0, len(base.Metrics)+len(c.Metrics))
+	own := make(map[string]*MetricConfig, len(c.Metrics))
+	for _, m := range c.Metrics {
+		own[m.Name] = m
+	}
+	for _, m := range base.Metrics {
+		if override, found := own[m.Name]; found {
+			metrics = append(metrics, override)
+			delete(own, m.Name)
+			continue
+		}
+		inherited := *m
+		inherited.query = nil
+		metrics = append(metrics, &inherited)
+	}
+	for _, m := range c.Metrics {
+		if _, found := own[m.Name]; found {
+			metrics = append(metrics, m)
+		}
+	}
+	c.Metrics = metrics
+
+	derived := make([]*DerivedMetricConfig, 0, len(base.DerivedMetrics)+len(c.DerivedMetrics))
+	ownDerived := make(map[string]bool, len(c.DerivedMetrics))
+	for _, d := range c.DerivedMetrics {
+		ownDerived[d.Name] = true
+	}
+	for _, d := range base.DerivedMetrics {
+		if !ownDerived[d.Name] {
+			derived = append(derived, d)
+		}
+	}
+	c.DerivedMetrics = append(derived, c.DerivedMetrics...)
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPath is a parsed JSONPath-style expression selecting a single field of a JSON document, e.g. `$.replication.role`
+// or `$.members[0]['last heartbeat']`. Its elements are either object member names (string) or array indices (int).
+type JSONPath []interface{}
+
+// parseJSONPath parses a JSONPath-style expression: an optional leading `$`, followed by any number of `.name`,
+// `['name']` (or `["name"]`) and `[index]` elements.
+func parseJSONPath(expr string) (JSONPath, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(expr), "$")
+	path := JSONPath{}
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			name := s[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("empty member name in JSON path %q", expr)
+			}
+			path = append(path, name)
+			s = s[end+1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in JSON path %q", expr)
+			}
+			elem := s[1:end]
+			if len(elem) >= 2 && (elem[0] == '\'' || elem[0] == '"') && elem[len(elem)-1] == elem[0] {
+				path = append(path, elem[1:len(elem)-1])
+			} else if i, err := strconv.Atoi(elem); err == nil && i >= 0 {
+				path = append(path, i)
+			} else {
+				return nil, fmt.Errorf("invalid element [%s] in JSON path %q", elem, expr)
+			}
+			s = s[end+1:]
+		default:
+			if len(path) > 0 || strings.HasPrefix(strings.TrimSpace(expr), "$") {
+				return nil, fmt.Errorf("unexpected %q in JSON path %q", s, expr)
+			}
+			// Allow a leading bare member name, e.g. `replication.role`.
+			s = "." + s
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty JSON path %q", expr)
+	}
+	return path, nil
+}
+
+// checkJSONFields validates and parses the JSON field paths of a metric.
+func (m *MetricConfig) checkJSONFields() error {
+	if (m.JSONColumn == "") != (len(m.JSONFields) == 0) {
+		return fmt.Errorf("json_column and json_fields must be defined together for metric %q", m.Name)
+	}
+	m.jsonPaths = make(map[string]JSONPath, len(m.JSONFields))
+	for field, expr := range m.JSONFields {
+		if field == m.JSONColumn {
+			return fmt.Errorf("json field %q has the same name as json_column for metric %q", field, m.Name)
+		}
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			return fmt.Errorf("%s for json field %q of metric %q", err, field, m.Name)
+		}
+		m.jsonPaths[field] = path
+	}
+	return nil
+}
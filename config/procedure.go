@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ParameterConfig defines a stored procedure parameter: either an input parameter, with a literal value or a value
+// taken from a target label, or an output parameter.
+type ParameterConfig struct {
+	Name   string `yaml:"name"`             // the parameter name, as declared by the procedure
+	Type   string `yaml:"type,omitempty"`   // `string` (the default), `int`, `float` or `bool`
+	Value  string `yaml:"value,omitempty"`  // input parameter value, or
+	Label  string `yaml:"label,omitempty"`  // target label to take the input parameter value from
+	Output bool   `yaml:"output,omitempty"` // whether this is an output parameter
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ParameterConfig.
+func (p *ParameterConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ParameterConfig
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+
+	if !paramNameRE.MatchString(p.Name) {
+		return fmt.Errorf("invalid procedure parameter name %q", p.Name)
+	}
+	switch p.Type {
+	case "":
+		p.Type = "string"
+	case "string", "int", "float", "bool":
+	default:
+		return fmt.Errorf("unsupported type %q for procedure parameter %q", p.Type, p.Name)
+	}
+	if p.Output {
+		if p.Value != "" || p.Label != "" {
+			return fmt.Errorf("value and label are not allowed for output parameter %q", p.Name)
+		}
+	} else {
+		if p.Value != "" && p.Label != "" {
+			return fmt.Errorf("at most one of value and label may be defined for procedure parameter %q", p.Name)
+		}
+		if p.Label == "" {
+			if _, err := p.Convert(p.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return checkOverflow(p.XXX, "procedure parameter")
+}
+
+// Convert converts an input value for the parameter from a string to the parameter's type: string, int64, float64 or
+// bool.
+func (p *ParameterConfig) Convert(value string) (interface{}, error) {
+	var (
+		v   interface{}
+		err error
+	)
+	switch p.Type {
+	case "int":
+		v, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		v, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		v, err = strconv.ParseBool(value)
+	default:
+		v = value
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q for procedure parameter %q", p.Type, value, p.Name)
+	}
+	return v, nil
+}
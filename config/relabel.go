@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Supported relabeling actions.
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+// RelabelConfig is a Prometheus metric_relabel_configs style rule, applied to the name (as the `__name__` label) and
+// labels of collected metrics.
+type RelabelConfig struct {
+	// Labels whose values are concatenated, using separator, and matched against regex.
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	// Label to write the (expanded) replacement to, for the replace action.
+	TargetLabel string `yaml:"target_label,omitempty"`
+	Replacement string `yaml:"replacement,omitempty"`
+	// One of replace (the default), keep, drop, labelmap, labeldrop and labelkeep.
+	Action string `yaml:"action,omitempty"`
+
+	regex *regexp.Regexp // Regex, anchored and compiled
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// Regexp returns the rule's compiled regular expression, anchored at both ends.
+func (r *RelabelConfig) Regexp() *regexp.Regexp {
+	return r.regex
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for RelabelConfig.
+func (r *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Same defaults as Prometheus.
+	*r = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	type plain RelabelConfig
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex %q: %s", r.Regex, err)
+	}
+	r.regex = regex
+
+	switch r.Action {
+	case RelabelReplace:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("target_label is required for relabel action %q", r.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("source_labels are required for relabel action %q", r.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		if len(r.SourceLabels) > 0 || r.TargetLabel != "" {
+			return fmt.Errorf("source_labels and target_label are not allowed for relabel action %q", r.Action)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %q", r.Action)
+	}
+
+	return checkOverflow(r.XXX, "metric_relabel_configs")
+}
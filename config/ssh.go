@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	config_util "github.com/prometheus/common/config"
+)
+
+// SSHTunnelConfig defines an SSH server (bastion host) through which a target's database connections are dialed.
+type SSHTunnelConfig struct {
+	Host       string `yaml:"host"`                  // SSH server, as `host[:port]`, port defaults to 22
+	User       string `yaml:"user"`                  // user name to log in as
+	KeyFile    string `yaml:"key_file,omitempty"`    // (unencrypted) private key to authenticate with, or
+	Password   Secret `yaml:"password,omitempty"`    // password to authenticate with
+	KnownHosts string `yaml:"known_hosts,omitempty"` // known_hosts file to verify the SSH server's host key against
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for SSHTunnelConfig.
+func (c *SSHTunnelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SSHTunnelConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Host == "" || c.User == "" {
+		return fmt.Errorf("host and user must be defined in ssh_tunnel config")
+	}
+	if _, _, err := net.SplitHostPort(c.Host); err != nil {
+		c.Host = net.JoinHostPort(c.Host, "22")
+	}
+	if (c.KeyFile == "") == (c.Password == "") {
+		return fmt.Errorf("exactly one of key_file and password must be defined in ssh_tunnel config")
+	}
+	if c.KnownHosts == "" {
+		return fmt.Errorf("known_hosts must be defined in ssh_tunnel config")
+	}
+
+	return checkOverflow(c.XXX, "ssh_tunnel config")
+}
+
+// setDirectory joins any relative file paths with dir.
+func (c *SSHTunnelConfig) setDirectory(dir string) {
+	c.KeyFile = config_util.JoinDir(dir, c.KeyFile)
+	c.KnownHosts = config_util.JoinDir(dir, c.KnownHosts)
+}
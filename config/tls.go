@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+
+	config_util "github.com/prometheus/common/config"
+)
+
+// TLSConfig defines how a target secures its database connections with TLS. It is translated into the equivalent
+// driver specific settings, not all of which are supported by all drivers.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`              // CA certificate(s) to verify the server with
+	CertFile           string `yaml:"cert_file,omitempty"`            // client certificate, paired with key_file
+	KeyFile            string `yaml:"key_file,omitempty"`             // client private key
+	ServerName         string `yaml:"server_name,omitempty"`          // server name to verify, if not the host name
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"` // encrypt, but don't verify the server
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for TLSConfig.
+func (c *TLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TLSConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be defined together in tls config")
+	}
+	if c.InsecureSkipVerify && (c.CAFile != "" || c.ServerName != "") {
+		return fmt.Errorf("ca_file and server_name have no effect with insecure_skip_verify in tls config")
+	}
+
+	return checkOverflow(c.XXX, "tls config")
+}
+
+// setDirectory joins any relative file paths with dir.
+func (c *TLSConfig) setDirectory(dir string) {
+	c.CAFile = config_util.JoinDir(dir, c.CAFile)
+	c.CertFile = config_util.JoinDir(dir, c.CertFile)
+	c.KeyFile = config_util.JoinDir(dir, c.KeyFile)
+}
@@ -0,0 +1,109 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// connections is the process wide registry of database handles, shared by all targets (across all jobs and config
+// reloads) with the same data source name.
+var connections = connectionRegistry{conns: make(map[string]*sharedConnection)}
+
+// connectionRegistry deduplicates database handles by normalized data source name, reference counting them so a
+// handle is only closed once the last target using it is closed.
+type connectionRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*sharedConnection
+}
+
+// sharedConnection is a database handle along with the number of targets using it.
+type sharedConnection struct {
+	conn *sql.DB
+	refs int
+}
+
+// acquire returns the database handle for the given data source name, opening it if no other target is using it. If
+// any hooks are set, a new handle applying them is returned, without sharing. Every successful call must be paired
+// with a call to release.
+func (r *connectionRegistry) acquire(ctx context.Context, logger *slog.Logger, dsn string, hooks connectHooks) (
+	*sql.DB, error) {
+	if !hooks.isZero() {
+		return openConnection(ctx, logger, dsn, hooks)
+	}
+	key := normalizeDSN(dsn)
+
+	r.mu.Lock()
+	conn := r.reuse(logger, key)
+	r.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	// Opening a handle may take a while (e.g. fetching secrets or setting up a tunnel), so it's done without the lock.
+	// A concurrent call for the same data source name may beat us to it, in which case its handle is used.
+	opened, err := OpenConnection(ctx, logger, dsn)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	if conn := r.reuse(logger, key); conn != nil {
+		r.mu.Unlock()
+		if err := opened.Close(); err != nil {
+			logger.Warn("Error closing redundant database handle", "err", err)
+		}
+		return conn, nil
+	}
+	r.conns[key] = &sharedConnection{conn: opened, refs: 1}
+	r.mu.Unlock()
+	return opened, nil
+}
+
+// reuse returns the registered database handle for the given key with an extra reference to it, nil if there is none.
+// Must be called with r.mu held.
+func (r *connectionRegistry) reuse(logger *slog.Logger, key string) *sql.DB {
+	sc, found := r.conns[key]
+	if !found {
+		return nil
+	}
+	sc.refs++
+	logger.Debug("Reusing database handle", "shared_by_targets", sc.refs)
+	return sc.conn
+}
+
+// release drops a reference to the provided database handle, closing it if it was the last one (or not shared).
+func (r *connectionRegistry) release(conn *sql.DB) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, sc := range r.conns {
+		if sc.conn != conn {
+			continue
+		}
+		sc.refs--
+		if sc.refs > 0 {
+			return nil
+		}
+		delete(r.conns, key)
+		break
+	}
+	return conn.Close()
+}
+
+// normalizeDSN returns a canonical form of a URL data source name, with lowercase scheme and host and sorted
+// parameters, so that equivalent data source names map to the same database handle. Data source names that cannot be
+// parsed as URLs (e.g. MySQL's `tcp(host:port)` addresses) are only trimmed of whitespace.
+func normalizeDSN(dsn string) string {
+	dsn = strings.TrimSpace(dsn)
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" || u.Opaque != "" {
+		return dsn
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	// url.Values.Encode() sorts parameters by key.
+	u.RawQuery = u.Query().Encode()
+	return u.String()
+}
@@ -0,0 +1,58 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+)
+
+// TestConnectionRegistryConcurrentAcquire checks that concurrent calls acquiring the same data source name end up
+// sharing a single database handle, closed once all of them release it. Meant to be run with -race.
+func TestConnectionRegistryConcurrentAcquire(t *testing.T) {
+	// Database handles are opened lazily, so there need not be a database listening.
+	dsn := "postgres://127.0.0.1:1/test"
+	ctx := context.Background()
+
+	const n = 10
+	conns := make([]*sql.DB, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := connections.acquire(ctx, orDefaultLogger(nil), dsn, connectHooks{})
+			if err != nil {
+				t.Error(err)
+			}
+			conns[i] = conn
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for _, conn := range conns[1:] {
+		if conn != conns[0] {
+			t.Fatal("concurrent calls acquired different database handles")
+		}
+	}
+	connections.mu.Lock()
+	refs := connections.conns[normalizeDSN(dsn)].refs
+	connections.mu.Unlock()
+	if refs != n {
+		t.Errorf("database handle has %d references, want %d", refs, n)
+	}
+
+	for _, conn := range conns {
+		if err := connections.release(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	if _, found := connections.conns[normalizeDSN(dsn)]; found {
+		t.Error("database handle still registered after releasing all references")
+	}
+}
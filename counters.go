@@ -0,0 +1,89 @@
+package sql_exporter
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var counterResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_counter_resets_total",
+	Help: "Total number of decreases (e.g. due to database restarts) of counter metrics tracking resets.",
+}, []string{"job", "target", "collector", "metric"})
+
+func init() {
+	prometheus.MustRegister(counterResets)
+}
+
+// counterTracker tracks the previous values of a counter metric family's series, to detect and handle decreases.
+type counterTracker struct {
+	mode   string
+	resets prometheus.Counter
+
+	mu sync.Mutex
+	// Tracked series, keyed by metric name and label values.
+	series map[string]*counterSeries
+	// Incremented by every sweep, series not tracked since the previous one are forgotten.
+	generation uint64
+}
+
+// counterSeries is the state of a counter series tracked by counterTracker.
+type counterSeries struct {
+	// Previously scanned value.
+	scanned float64
+	// Clamp mode only: sum of the values scanned before every decrease, added to the scanned values.
+	offset float64
+	// Generation the series was last tracked in.
+	generation uint64
+}
+
+// newCounterTracker returns a counterTracker handling resets as per mode (see config.CounterResetsClamp and
+// config.CounterResetsReset), counting them with the provided counter.
+func newCounterTracker(mode string, resets prometheus.Counter) *counterTracker {
+	return &counterTracker{
+		mode:   mode,
+		resets: resets,
+		series: make(map[string]*counterSeries),
+	}
+}
+
+// track records the value of a counter metric, adjusting it in place as needed. Decreases are counted as resets and,
+// in clamp mode, the value scanned before each of them is added to the values exported from then on, so the exported
+// counter keeps increasing.
+func (t *counterTracker) track(metric *constMetric) {
+	parts := make([]string, 0, len(metric.labelPairs)+1)
+	parts = append(parts, metric.desc.Name())
+	for _, lp := range metric.labelPairs {
+		parts = append(parts, lp.GetValue())
+	}
+	key := strings.Join(parts, "\xff")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, found := t.series[key]
+	if !found {
+		s = &counterSeries{}
+		t.series[key] = s
+	} else if metric.val < s.scanned {
+		t.resets.Inc()
+		if t.mode == config.CounterResetsClamp {
+			s.offset += s.scanned
+		}
+	}
+	s.scanned, s.generation = metric.val, t.generation
+	metric.val += s.offset
+}
+
+// sweep forgets the series not tracked since the previous sweep, at the end of a collection.
+func (t *counterTracker) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, s := range t.series {
+		if s.generation != t.generation {
+			delete(t.series, key)
+		}
+	}
+	t.generation++
+}
@@ -0,0 +1,129 @@
+package sql_exporter
+
+import (
+	"testing"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// trackCollection runs a collection of the given series (keyed by label value) through t, returning the exported
+// values.
+func trackCollection(t *counterTracker, desc MetricDesc, values map[string]float64) map[string]float64 {
+	exported := make(map[string]float64, len(values))
+	for label, value := range values {
+		m := NewMetric(desc, value, label).(*constMetric)
+		t.track(m)
+		exported[label] = m.val
+	}
+	t.sweep()
+	return exported
+}
+
+// TestCounterTracker checks that decreases are counted as resets in both modes, and offset in clamp mode.
+func TestCounterTracker(t *testing.T) {
+	desc := NewAutomaticMetricDesc("test", "test_total", "Test.", prometheus.CounterValue, nil, "series")
+	for _, tc := range []struct {
+		mode string
+		want []float64
+	}{
+		{config.CounterResetsClamp, []float64{10, 20, 25, 28, 31, 40}},
+		{config.CounterResetsReset, []float64{10, 20, 5, 8, 3, 12}},
+	} {
+		resets := prometheus.NewCounter(prometheus.CounterOpts{Name: "resets_total", Help: "Resets."})
+		tracker := newCounterTracker(tc.mode, resets)
+		// Reset, increment, reset again, increment.
+		for i, value := range []float64{10, 20, 5, 8, 3, 12} {
+			if got := trackCollection(tracker, desc, map[string]float64{"a": value})["a"]; got != tc.want[i] {
+				t.Errorf("%s: collection %d exported %g, want %g", tc.mode, i, got, tc.want[i])
+			}
+		}
+
+		var m dto.Metric
+		if err := resets.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetCounter().GetValue(); got != 2 {
+			t.Errorf("%s: counted %g resets, want 2", tc.mode, got)
+		}
+	}
+}
+
+// TestCounterTrackerEviction checks that series missing from a collection are forgotten, along with their offsets.
+func TestCounterTrackerEviction(t *testing.T) {
+	desc := NewAutomaticMetricDesc("test", "test_total", "Test.", prometheus.CounterValue, nil, "series")
+	resets := prometheus.NewCounter(prometheus.CounterOpts{Name: "resets_total", Help: "Resets."})
+	tracker := newCounterTracker(config.CounterResetsClamp, resets)
+
+	trackCollection(tracker, desc, map[string]float64{"a": 10, "b": 10})
+	trackCollection(tracker, desc, map[string]float64{"a": 5, "b": 20})
+	if len(tracker.series) != 2 {
+		t.Fatalf("tracking %d series, want 2", len(tracker.series))
+	}
+	// Series a is forgotten (along with its offset) once missing from a collection.
+	trackCollection(tracker, desc, map[string]float64{"b": 30})
+	if len(tracker.series) != 1 {
+		t.Fatalf("tracking %d series after one went missing, want 1", len(tracker.series))
+	}
+	if got := trackCollection(tracker, desc, map[string]float64{"a": 1, "b": 40}); got["a"] != 1 || got["b"] != 40 {
+		t.Errorf("exported %v, want a=1, b=40", got)
+	}
+}
+
+func TestCounterTrackerPartialCollection(t *testing.T) {
+	c, err := config.Parse([]byte(`
+jobs:
+  - job_name: test
+    collectors: [test]
+    static_configs:
+      - targets:
+          db: 'sqlite://test.db'
+collectors:
+  - collector_name: test
+    metrics:
+      - metric_name: test_total
+        type: counter
+        help: 'Test.'
+        key_labels: [series]
+        values: [v]
+        counter_resets: clamp
+        query: SELECT 1
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, err := NewMetricFamily(nil, "test", c.Collectors[0].Metrics[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resets := prometheus.NewCounter(prometheus.CounterOpts{Name: "resets_total", Help: "Resets."})
+	mf.counters = newCounterTracker(config.CounterResetsClamp, resets)
+
+	// collectRun collects a single row into a new query run, returning the exported value, if any.
+	collectRun := func(v interface{}) (value float64, ok bool) {
+		run := &queryRun{}
+		ch := make(chan Metric, 2)
+		mf.collectRow(map[string]interface{}{"series": "a", "v": v}, run, ch)
+		mf.flush(run, ch)
+		close(ch)
+		for m := range ch {
+			if cm, isConst := m.(*constMetric); isConst {
+				value, ok = cm.val, true
+			}
+		}
+		return value, ok
+	}
+
+	collectRun(10.0)
+	if got, _ := collectRun(5.0); got != 15 {
+		t.Fatalf("exported %g after a reset, want 15", got)
+	}
+	// A NULL value fails the row, the series is not collected but must not be forgotten.
+	if _, ok := collectRun(nil); ok {
+		t.Fatal("exported a value for a NULL row")
+	}
+	if got, _ := collectRun(6.0); got != 16 {
+		t.Errorf("exported %g after a partial collection, want 16", got)
+	}
+}
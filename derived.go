@@ -0,0 +1,95 @@
+package sql_exporter
+
+import (
+	"strings"
+
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// derivedSamples records the samples of the metrics referenced by a collector's derived metrics, grouped by label set.
+type derivedSamples struct {
+	// Names of the metrics referenced by derived metrics.
+	names map[string]bool
+	// Series keyed by label set, in the order first seen.
+	series map[string]*derivedSeries
+	keys   []string
+}
+
+// derivedSeries holds the values of the metrics sharing a label set.
+type derivedSeries struct {
+	labels []*dto.LabelPair
+	values map[string]float64
+}
+
+// newDerivedSamples returns a derivedSamples recording the metrics referenced by the given derived metrics.
+func newDerivedSamples(dms []*config.DerivedMetricConfig) *derivedSamples {
+	names := make(map[string]bool)
+	for _, dm := range dms {
+		for _, v := range dm.Expression().Variables() {
+			names[v] = true
+		}
+	}
+	return &derivedSamples{
+		names:  names,
+		series: make(map[string]*derivedSeries),
+	}
+}
+
+// record records the value of metric, if it is referenced by a derived metric.
+func (s *derivedSamples) record(metric Metric) {
+	desc := metric.Desc()
+	if desc == nil || !s.names[desc.Name()] {
+		return
+	}
+	out := &dto.Metric{}
+	if err := metric.Write(out); err != nil {
+		return
+	}
+	var value float64
+	switch {
+	case out.Gauge != nil:
+		value = out.Gauge.GetValue()
+	case out.Counter != nil:
+		value = out.Counter.GetValue()
+	default:
+		return
+	}
+
+	parts := make([]string, 0, len(out.Label))
+	for _, lp := range out.Label {
+		parts = append(parts, lp.GetName()+"="+lp.GetValue())
+	}
+	key := strings.Join(parts, "\xff")
+	series, found := s.series[key]
+	if !found {
+		series = &derivedSeries{labels: out.Label, values: make(map[string]float64)}
+		s.series[key] = series
+		s.keys = append(s.keys, key)
+	}
+	series.values[desc.Name()] = value
+}
+
+// collectDerived computes the collector's derived metrics from the recorded samples, one per label set for which all
+// referenced metrics were collected. Derived metrics may reference previously defined ones.
+func (c *collector) collectDerived(samples *derivedSamples, ch chan<- Metric) {
+	for i, dm := range c.config.DerivedMetrics {
+		expr := dm.Expression()
+		for _, key := range samples.keys {
+			series := samples.series[key]
+			complete := true
+			for _, v := range expr.Variables() {
+				if _, found := series.values[v]; !found {
+					complete = false
+					break
+				}
+			}
+			if !complete {
+				continue
+			}
+			value := expr.Eval(series.values)
+			series.values[dm.Name] = value
+			ch <- &constMetric{desc: c.derivedDescs[i], val: value, labelPairs: series.labels}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+	go_ora "github.com/sijms/go-ora/v2"
+)
+
+// dialFunc dials a database server in place of the driver's own dialing, e.g. to connect through a tunnel or proxy.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// connectHooks customize how a target connects to its database. The zero value uses the driver's defaults.
+type connectHooks struct {
+	dial     dialFunc     // optional, dials the database in place of the driver
+	password passwordFunc // optional, supplies the password for every new connection, overriding the DSN's
+	// Optional, supplies access tokens for federated authentication (e.g. Azure AD), MS SQL Server only.
+	accessToken passwordFunc
+}
+
+// isZero returns true if no hooks are set.
+func (h connectHooks) isZero() bool {
+	return h.dial == nil && h.password == nil && h.accessToken == nil
+}
+
+// mysqlDialSeq generates unique network names for registering MySQL dial functions.
+var mysqlDialSeq uint64
+
+// newConnector returns a driver.Connector for the given driver and (adjusted) DSN, applying the provided hooks. Only
+// the PostgreSQL, MySQL, MS SQL Server and Oracle drivers support hooks.
+func newConnector(driverName, dsn string, hooks connectHooks) (driver.Connector, error) {
+	newBase, err := connectorFunc(driverName, dsn, hooks)
+	if err != nil {
+		return nil, err
+	}
+	base, err := newBase(nil)
+	if err != nil {
+		return nil, err
+	}
+	if hooks.password == nil {
+		return base, nil
+	}
+	return &passwordConnector{newConnector: newBase, password: hooks.password, driver: base.Driver()}, nil
+}
+
+// connectorFunc returns a function creating driver.Connectors for the given driver and (adjusted) DSN, applying the
+// dial and access token hooks and overriding the DSN password with the function argument, if not nil.
+func connectorFunc(driverName, dsn string, hooks connectHooks) (
+	func(password *string) (driver.Connector, error), error) {
+	dial := hooks.dial
+	if hooks.accessToken != nil && driverName != "sqlserver" && driverName != "mssql" {
+		return nil, fmt.Errorf("driver %q does not support access token authentication", driverName)
+	}
+
+	switch driverName {
+	case "postgres", "postgresql":
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return func(password *string) (driver.Connector, error) {
+			c, err := pq.NewConnector(withURLPassword(u, password))
+			if err != nil {
+				return nil, err
+			}
+			if dial != nil {
+				c.Dialer(pqDialer(dial))
+			}
+			return c, nil
+		}, nil
+
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		if dial != nil {
+			// The MySQL driver looks up dial functions by network name, with no way to unregister them. Every
+			// registration is tiny, so there is no harm in leaking them when targets are closed.
+			network := fmt.Sprintf("sql_exporter_%d", atomic.AddUint64(&mysqlDialSeq, 1))
+			mysql.RegisterDialContext(network, func(ctx context.Context, addr string) (net.Conn, error) {
+				return dial(ctx, "tcp", addr)
+			})
+			cfg.Net = network
+		}
+		return func(password *string) (driver.Connector, error) {
+			cfg := cfg.Clone()
+			if password != nil {
+				cfg.Passwd = *password
+				// Authentication tokens must be sent as is, the server can't verify them against a hash.
+				cfg.AllowCleartextPasswords = true
+			}
+			return mysql.NewConnector(cfg)
+		}, nil
+
+	case "sqlserver", "mssql":
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return func(password *string) (driver.Connector, error) {
+			var c *mssql.Connector
+			if hooks.accessToken != nil {
+				// The driver doesn't pass the connection's context to the token provider.
+				tc, err := mssql.NewAccessTokenConnector(withURLPassword(u, password), func() (string, error) {
+					return hooks.accessToken(context.Background())
+				})
+				if err != nil {
+					return nil, err
+				}
+				c = tc.(*mssql.Connector)
+			} else if c, err = mssql.NewConnector(withURLPassword(u, password)); err != nil {
+				return nil, err
+			}
+			if dial != nil {
+				c.Dialer = mssqlDialer(dial)
+			}
+			return c, nil
+		}, nil
+
+	case "oracle":
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return func(password *string) (driver.Connector, error) {
+			c := go_ora.NewConnector(withURLPassword(u, password)).(*go_ora.OracleConnector)
+			if dial != nil {
+				c.Dialer(oracleDialer(dial))
+			}
+			return c, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("driver %q does not support custom dialing or authentication", driverName)
+}
+
+// withURLPassword returns u as a string, with its password replaced by password, if not nil.
+func withURLPassword(u *url.URL, password *string) string {
+	if password == nil {
+		return u.String()
+	}
+	v := *u
+	v.User = url.UserPassword(u.User.Username(), *password)
+	return v.String()
+}
+
+// passwordConnector is a driver.Connector that obtains a fresh password for every new connection.
+type passwordConnector struct {
+	newConnector func(password *string) (driver.Connector, error)
+	password     passwordFunc
+	driver       driver.Driver
+}
+
+// Connect implements driver.Connector.
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.password(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := c.newConnector(&password)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// Driver implements driver.Connector.
+func (c *passwordConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// pqDialer adapts a dialFunc to the pq.Dialer and pq.DialerContext interfaces.
+type pqDialer dialFunc
+
+// Dial implements pq.Dialer.
+func (d pqDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+// DialTimeout implements pq.Dialer.
+func (d pqDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d(ctx, network, address)
+}
+
+// DialContext implements pq.DialerContext.
+func (d pqDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// mssqlDialer adapts a dialFunc to the mssql.Dialer interface.
+type mssqlDialer dialFunc
+
+// DialContext implements mssql.Dialer.
+func (d mssqlDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// oracleDialer adapts a dialFunc to the go-ora configurations.DialerContext interface.
+type oracleDialer dialFunc
+
+// DialContext implements configurations.DialerContext.
+func (d oracleDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
@@ -0,0 +1,156 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// initialDiscoveryTimeout bounds the first, synchronous discovery run of a job, so that an unreachable discovery
+// source doesn't block startup or reloads indefinitely.
+const initialDiscoveryTimeout = 10 * time.Second
+
+// targetSpec describes a target to be created by a job: its name, data source name and extra labels.
+type targetSpec struct {
+	name   string
+	dsn    string
+	labels map[string]string
+
+	// Optional, dials the database in place of the driver. dialKey uniquely identifies the dialer, as functions cannot
+	// be compared.
+	dial    dialFunc
+	dialKey string
+	// Optional, supply short lived passwords or access tokens. authKey uniquely identifies their source.
+	password    passwordFunc
+	accessToken passwordFunc
+	authKey     string
+	// Optional, TLS settings to apply to the DSN.
+	tls *config.TLSConfig
+	// Optional, query parameter values overriding the job's.
+	params map[string]string
+	// Optional, collectors to apply instead of the job's.
+	collectors []*config.CollectorConfig
+}
+
+// equal returns true if s and o would result in identical targets.
+func (s targetSpec) equal(o targetSpec) bool {
+	if s.name != o.name || s.dsn != o.dsn || s.dialKey != o.dialKey || s.authKey != o.authKey || s.tls != o.tls {
+		return false
+	}
+	if len(s.collectors) != len(o.collectors) {
+		return false
+	}
+	for i := range s.collectors {
+		if s.collectors[i] != o.collectors[i] {
+			return false
+		}
+	}
+	return equalMaps(s.labels, o.labels) && equalMaps(s.params, o.params)
+}
+
+// equalMaps returns true if a and b hold the same keys and values.
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if ov, found := b[k]; !found || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the target name followed by its sorted labels, for logging purposes (the DSN may hold credentials).
+func (s targetSpec) String() string {
+	labels := make([]string, 0, len(s.labels))
+	for name, value := range s.labels {
+		labels = append(labels, name+"="+value)
+	}
+	sort.Strings(labels)
+	return s.name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// discoverer is a source of targets for a job, e.g. a catalog database. Discoverers holding resources (such as
+// database handles) may implement io.Closer, in which case they get closed along with their job.
+type discoverer interface {
+	// discover returns the current set of targets.
+	discover(ctx context.Context) ([]targetSpec, error)
+}
+
+// discovery pairs a discoverer with its refresh interval.
+type discovery struct {
+	discoverer
+	refreshInterval time.Duration
+}
+
+// newDiscoveries returns the discoveries configured for a job, logging to the job's logger.
+func newDiscoveries(logger *slog.Logger, logContext string, jc *config.JobConfig) ([]discovery, error) {
+	var ds []discovery
+	for _, c := range jc.SQLSDConfigs {
+		ds = append(ds, discovery{newSQLDiscoverer(logger, logContext, c), time.Duration(c.RefreshInterval)})
+	}
+	for _, c := range jc.KubernetesSDConfigs {
+		d, err := newKubernetesDiscoverer(logger, logContext, c)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, discovery{d, time.Duration(c.RefreshInterval)})
+	}
+	for _, c := range jc.AWSRDSSDConfigs {
+		d, err := newAWSRDSDiscoverer(logger, logContext, c)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, discovery{d, time.Duration(c.RefreshInterval)})
+	}
+	for _, c := range jc.GCPCloudSQLSDConfigs {
+		d, err := newGCPCloudSQLDiscoverer(logger, logContext, c)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, discovery{d, time.Duration(c.RefreshInterval)})
+	}
+	for _, c := range jc.AzureSDConfigs {
+		ds = append(ds, discovery{newAzureDiscoverer(logger, logContext, c), time.Duration(c.RefreshInterval)})
+	}
+	for _, c := range jc.ConsulSDConfigs {
+		d, err := newConsulDiscoverer(logger, logContext, c)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, discovery{d, time.Duration(c.RefreshInterval)})
+	}
+	return ds, nil
+}
+
+// dsnTemplateData is the data available to the DSN templates of discovered targets. Not all fields are populated by
+// all discovery mechanisms.
+type dsnTemplateData struct {
+	Name        string            // name of the discovered resource, e.g. pod, service or database instance
+	Namespace   string            // namespace of the discovered resource, if any
+	Address     string            // host name or IP address to connect to
+	Port        int               // port to connect to, if known
+	Labels      map[string]string // labels or tags of the discovered resource
+	Annotations map[string]string // annotations of the discovered resource
+	Meta        map[string]string // other provider specific metadata, e.g. Azure resource group and region
+}
+
+// executeDSNTemplate executes the provided DSN template on data.
+func executeDSNTemplate(text string, data *dsnTemplateData) (string, error) {
+	tmpl, err := template.New("dsn").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,122 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/free/sql_exporter/config"
+)
+
+// awsRDSDiscoverer discovers targets from AWS RDS database instances or Aurora clusters.
+type awsRDSDiscoverer struct {
+	config     *config.AWSRDSSDConfig
+	logContext string
+	logger     *slog.Logger
+	client     *rds.RDS
+	session    *session.Session
+}
+
+// newAWSRDSDiscoverer returns a discoverer listing the RDS instances or clusters matching the configured filters.
+func newAWSRDSDiscoverer(logger *slog.Logger, logContext string, c *config.AWSRDSSDConfig) (*awsRDSDiscoverer, error) {
+	logContext = fmt.Sprintf("%s, aws_rds_sd", logContext)
+	sess, err := newAWSSession(&c.AWSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+	return &awsRDSDiscoverer{
+		config:     c,
+		logContext: logContext,
+		logger:     logger.With("discovery", "aws_rds_sd"),
+		client:     rds.New(sess),
+		session:    sess,
+	}, nil
+}
+
+// discover implements discoverer.
+func (d *awsRDSDiscoverer) discover(ctx context.Context) ([]targetSpec, error) {
+	var filters []*rds.Filter
+	if len(d.config.Engines) > 0 {
+		filters = append(filters, &rds.Filter{Name: aws.String("engine"), Values: aws.StringSlice(d.config.Engines)})
+	}
+
+	var (
+		specs []targetSpec
+		err   error
+	)
+	if d.config.Role == "cluster" {
+		input := &rds.DescribeDBClustersInput{Filters: filters}
+		err = d.client.DescribeDBClustersPagesWithContext(ctx, input, func(out *rds.DescribeDBClustersOutput, _ bool) bool {
+			for _, c := range out.DBClusters {
+				if c.Endpoint == nil || !d.available(aws.StringValue(c.Status)) {
+					continue
+				}
+				specs = d.appendSpec(specs, aws.StringValue(c.DBClusterIdentifier), aws.StringValue(c.Endpoint),
+					int(aws.Int64Value(c.Port)), c.TagList)
+			}
+			return true
+		})
+	} else {
+		input := &rds.DescribeDBInstancesInput{Filters: filters}
+		err = d.client.DescribeDBInstancesPagesWithContext(ctx, input, func(out *rds.DescribeDBInstancesOutput, _ bool) bool {
+			for _, i := range out.DBInstances {
+				if i.Endpoint == nil || !d.available(aws.StringValue(i.DBInstanceStatus)) {
+					continue
+				}
+				specs = d.appendSpec(specs, aws.StringValue(i.DBInstanceIdentifier), aws.StringValue(i.Endpoint.Address),
+					int(aws.Int64Value(i.Endpoint.Port)), i.TagList)
+			}
+			return true
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[%s] error listing RDS %ss: %s", d.logContext, d.config.Role, err)
+	}
+	return specs, nil
+}
+
+// available returns false for instances/clusters that cannot be connected to because of their status.
+func (d *awsRDSDiscoverer) available(status string) bool {
+	switch status {
+	case "creating", "deleting", "stopped", "stopping", "starting", "failed", "inaccessible-encryption-credentials":
+		return false
+	}
+	return true
+}
+
+// appendSpec appends the target spec for an instance/cluster to specs, provided its tags match the configured ones.
+func (d *awsRDSDiscoverer) appendSpec(
+	specs []targetSpec, name, address string, port int, tagList []*rds.Tag) []targetSpec {
+	tags := make(map[string]string, len(tagList))
+	for _, t := range tagList {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for k, v := range d.config.Tags {
+		if tags[k] != v {
+			return specs
+		}
+	}
+
+	dsn, err := executeDSNTemplate(string(d.config.DSNTemplate), &dsnTemplateData{
+		Name:    name,
+		Address: address,
+		Port:    port,
+		Labels:  tags,
+	})
+	if err != nil {
+		d.logger.Warn("Error building data source name", "role", d.config.Role, "name", name, "err", err)
+		return specs
+	}
+	spec := targetSpec{name: name, dsn: dsn}
+	if d.config.IAMAuth {
+		if spec.password, err = newRDSAuthTokenFunc(d.session, dsn); err != nil {
+			d.logger.Warn("Error setting up IAM authentication", "role", d.config.Role, "name", name, "err", err)
+			return specs
+		}
+		spec.authKey = "aws_iam"
+	}
+	return append(specs, spec)
+}
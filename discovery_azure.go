@@ -0,0 +1,141 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/free/sql_exporter/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	azureResourceGraphURL = "https://management.azure.com/providers/Microsoft.ResourceGraph/resources" +
+		"?api-version=2021-03-01"
+
+	// Resource Graph queries listing Azure SQL databases (except for system databases) and managed instances, with
+	// the fully qualified domain names to connect to.
+	azureDatabasesQuery = `Resources
+| where type =~ 'microsoft.sql/servers/databases' and name != 'master'
+| extend serverId = tolower(tostring(split(id, '/databases/')[0]))
+| join kind=inner (
+    Resources
+    | where type =~ 'microsoft.sql/servers'
+    | project serverId = tolower(id), server = name, fqdn = tostring(properties.fullyQualifiedDomainName)
+  ) on serverId
+| project id, name, resourceGroup, location, tags, server, fqdn`
+	azureManagedInstancesQuery = `Resources
+| where type =~ 'microsoft.sql/managedinstances'
+| project id, name, resourceGroup, location, tags, server = '', fqdn = tostring(properties.fullyQualifiedDomainName)`
+)
+
+// azureDiscoverer discovers targets from Azure SQL databases or managed instances, via Azure Resource Graph.
+type azureDiscoverer struct {
+	config     *config.AzureSDConfig
+	logContext string
+	logger     *slog.Logger
+	client     *http.Client
+}
+
+// newAzureDiscoverer returns a discoverer listing the Azure SQL databases or managed instances of the configured
+// subscriptions.
+func newAzureDiscoverer(logger *slog.Logger, logContext string, c *config.AzureSDConfig) *azureDiscoverer {
+	return &azureDiscoverer{
+		config:     c,
+		logContext: fmt.Sprintf("%s, azure_sd", logContext),
+		logger:     logger.With("discovery", "azure_sd"),
+		client:     oauth2.NewClient(context.Background(), newAzureTokenSource(&c.AzureConfig, azureManagementResource)),
+	}
+}
+
+// azureResource is a row returned by the Resource Graph queries above.
+type azureResource struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	ResourceGroup string            `json:"resourceGroup"`
+	Location      string            `json:"location"`
+	Tags          map[string]string `json:"tags"`
+	Server        string            `json:"server"`
+	FQDN          string            `json:"fqdn"`
+}
+
+// discover implements discoverer.
+func (d *azureDiscoverer) discover(ctx context.Context) ([]targetSpec, error) {
+	query := azureDatabasesQuery
+	if d.config.Role == "managed_instance" {
+		query = azureManagedInstancesQuery
+	}
+
+	var (
+		specs     []targetSpec
+		skipToken string
+	)
+	for {
+		request := map[string]interface{}{
+			"subscriptions": d.config.Subscriptions,
+			"query":         query,
+			"options":       map[string]interface{}{"resultFormat": "objectArray"},
+		}
+		if skipToken != "" {
+			request["options"].(map[string]interface{})["$skipToken"] = skipToken
+		}
+		var response struct {
+			Data      []azureResource `json:"data"`
+			SkipToken string          `json:"$skipToken"`
+		}
+		if err := callJSONAPI(ctx, d.client, http.MethodPost, azureResourceGraphURL, request, &response); err != nil {
+			return nil, fmt.Errorf("[%s] error querying Azure Resource Graph: %s", d.logContext, err)
+		}
+		for _, r := range response.Data {
+			if spec, ok := d.targetSpec(r); ok {
+				specs = append(specs, spec)
+			}
+		}
+		if skipToken = response.SkipToken; skipToken == "" {
+			return specs, nil
+		}
+	}
+}
+
+// targetSpec builds the target spec for a database or managed instance. Returns false if it doesn't match the
+// configured tags or has no domain name to connect to.
+func (d *azureDiscoverer) targetSpec(r azureResource) (targetSpec, bool) {
+	for k, v := range d.config.Tags {
+		if r.Tags[k] != v {
+			return targetSpec{}, false
+		}
+	}
+	if r.FQDN == "" {
+		return targetSpec{}, false
+	}
+
+	meta := map[string]string{
+		"resource_group": r.ResourceGroup,
+		"region":         r.Location,
+		"resource_id":    r.ID,
+	}
+	name := r.Name
+	if r.Server != "" {
+		meta["server"] = r.Server
+		name = r.Server + "/" + r.Name
+	}
+	dsn, err := executeDSNTemplate(string(d.config.DSNTemplate), &dsnTemplateData{
+		Name:    r.Name,
+		Address: r.FQDN,
+		Port:    1433,
+		Labels:  r.Tags,
+		Meta:    meta,
+	})
+	if err != nil {
+		d.logger.Warn("Error building data source name", "name", name, "err", err)
+		return targetSpec{}, false
+	}
+
+	labels := map[string]string{
+		"resource_group":    r.ResourceGroup,
+		"region":            r.Location,
+		"azure_resource_id": r.ID,
+	}
+	return targetSpec{name: name, dsn: dsn, labels: labels}, true
+}
@@ -0,0 +1,176 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/free/sql_exporter/config"
+	config_util "github.com/prometheus/common/config"
+)
+
+// consulDiscoverer discovers targets from Consul service instances, by polling the Consul HTTP API.
+type consulDiscoverer struct {
+	config     *config.ConsulSDConfig
+	logContext string
+	logger     *slog.Logger
+	server     string
+	client     *http.Client
+}
+
+// newConsulDiscoverer returns a discoverer listing the instances of the configured Consul services.
+func newConsulDiscoverer(logger *slog.Logger, logContext string, c *config.ConsulSDConfig) (*consulDiscoverer, error) {
+	logContext = fmt.Sprintf("%s, consul_sd", logContext)
+
+	httpConfig := c.HTTPClient
+	if c.Token != "" {
+		// Consul accepts ACL tokens as bearer tokens.
+		httpConfig.Authorization = &config_util.Authorization{Type: "Bearer", Credentials: config_util.Secret(c.Token)}
+	}
+	client, err := config_util.NewClientFromConfig(httpConfig, "consul_sd")
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+	return &consulDiscoverer{
+		config:     c,
+		logContext: logContext,
+		logger:     logger.With("discovery", "consul_sd"),
+		server:     c.Scheme + "://" + c.Server,
+		client:     client,
+	}, nil
+}
+
+// consulServiceEntry is the subset of a Consul health service entry that's relevant for target discovery.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string `json:"Node"`
+		Address    string `json:"Address"`
+		Datacenter string `json:"Datacenter"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+// discover implements discoverer.
+func (d *consulDiscoverer) discover(ctx context.Context) ([]targetSpec, error) {
+	services := d.config.Services
+	if len(services) == 0 {
+		var err error
+		if services, err = d.listServices(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var specs []targetSpec
+	for _, service := range services {
+		params := d.params()
+		if d.config.PassingOnly {
+			params.Set("passing", "true")
+		}
+		var entries []consulServiceEntry
+		u := d.server + "/v1/health/service/" + url.PathEscape(service) + "?" + params.Encode()
+		if err := callJSONAPI(ctx, d.client, http.MethodGet, u, nil, &entries); err != nil {
+			return nil, fmt.Errorf("[%s] error listing instances of service %s: %s", d.logContext, service, err)
+		}
+		for _, e := range entries {
+			if !hasAllTags(e.Service.Tags, d.config.Tags) {
+				continue
+			}
+			spec, err := d.targetSpec(e)
+			if err != nil {
+				d.logger.Warn("Skipping discovered target", "err", err)
+				continue
+			}
+			specs = append(specs, spec)
+		}
+	}
+	return specs, nil
+}
+
+// listServices returns the names of all services registered in the catalog having the configured tags.
+func (d *consulDiscoverer) listServices(ctx context.Context) ([]string, error) {
+	var catalog map[string][]string
+	if err := callJSONAPI(ctx, d.client, http.MethodGet, d.server+"/v1/catalog/services?"+d.params().Encode(), nil,
+		&catalog); err != nil {
+		return nil, fmt.Errorf("[%s] error listing services: %s", d.logContext, err)
+	}
+	services := make([]string, 0, len(catalog))
+	for name, tags := range catalog {
+		// Catalog tags are the union of the tags of all instances, so this only rules out services with no matching
+		// instances. Instances get filtered individually.
+		if name != "consul" && hasAllTags(tags, d.config.Tags) {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// params returns the query parameters common to all Consul API requests.
+func (d *consulDiscoverer) params() url.Values {
+	params := url.Values{}
+	if d.config.Datacenter != "" {
+		params.Set("dc", d.config.Datacenter)
+	}
+	return params
+}
+
+// targetSpec builds the target spec for a Consul service instance.
+func (d *consulDiscoverer) targetSpec(e consulServiceEntry) (targetSpec, error) {
+	address := e.Service.Address
+	if address == "" {
+		// Service instances registered without an address use the address of their node.
+		address = e.Node.Address
+	}
+	dsn, err := executeDSNTemplate(string(d.config.DSNTemplate), &dsnTemplateData{
+		Name:    e.Service.Service,
+		Address: address,
+		Port:    e.Service.Port,
+		Labels:  e.Service.Meta,
+		Meta: map[string]string{
+			"node":       e.Node.Node,
+			"datacenter": e.Node.Datacenter,
+			"service_id": e.Service.ID,
+			"tags":       strings.Join(e.Service.Tags, ","),
+		},
+	})
+	if err != nil {
+		return targetSpec{}, fmt.Errorf("[%s] error building data source name for service %s on node %s: %s",
+			d.logContext, e.Service.ID, e.Node.Node, err)
+	}
+	return targetSpec{
+		name: e.Node.Node + "/" + e.Service.ID,
+		dsn:  dsn,
+		labels: map[string]string{
+			"service": e.Service.Service,
+			"node":    e.Node.Node,
+		},
+	}, nil
+}
+
+// hasAllTags returns true if tags includes all of required.
+func hasAllTags(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, t := range tags {
+			if t == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
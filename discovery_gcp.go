@@ -0,0 +1,149 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/free/sql_exporter/config"
+	"golang.org/x/oauth2"
+)
+
+// gcpCloudSQLDiscoverer discovers targets from GCP Cloud SQL instances, optionally connecting to them through the
+// Cloud SQL server side proxy.
+type gcpCloudSQLDiscoverer struct {
+	config     *config.GCPCloudSQLSDConfig
+	logContext string
+	logger     *slog.Logger
+	client     *http.Client
+	dialer     *cloudSQLDialer // nil unless use_connector is set
+}
+
+// newGCPCloudSQLDiscoverer returns a discoverer listing the Cloud SQL instances of the configured project.
+func newGCPCloudSQLDiscoverer(
+	logger *slog.Logger, logContext string, c *config.GCPCloudSQLSDConfig) (*gcpCloudSQLDiscoverer, error) {
+	logContext = fmt.Sprintf("%s, gcp_cloudsql_sd", logContext)
+	ctx := context.Background()
+
+	admin, err := newGCPTokenSource(ctx, c.CredentialsFile, cloudSQLAdminScope)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+	d := gcpCloudSQLDiscoverer{
+		config:     c,
+		logContext: logContext,
+		logger:     logger.With("discovery", "gcp_cloudsql_sd"),
+		client:     oauth2.NewClient(ctx, admin),
+	}
+	if c.UseConnector {
+		var login oauth2.TokenSource
+		if c.IAMAuth {
+			if login, err = newGCPTokenSource(ctx, c.CredentialsFile, cloudSQLLoginScope); err != nil {
+				return nil, fmt.Errorf("[%s] %s", logContext, err)
+			}
+		}
+		if d.dialer, err = newCloudSQLDialer(admin, login, c.PrivateIP); err != nil {
+			return nil, fmt.Errorf("[%s] %s", logContext, err)
+		}
+	}
+	return &d, nil
+}
+
+// cloudSQLInstance is the subset of a Cloud SQL instance resource that's relevant for target discovery.
+type cloudSQLInstance struct {
+	Name            string `json:"name"`
+	ConnectionName  string `json:"connectionName"`
+	DatabaseVersion string `json:"databaseVersion"`
+	State           string `json:"state"`
+	IPAddresses     []struct {
+		Type      string `json:"type"`
+		IPAddress string `json:"ipAddress"`
+	} `json:"ipAddresses"`
+	Settings struct {
+		UserLabels map[string]string `json:"userLabels"`
+	} `json:"settings"`
+}
+
+// discover implements discoverer.
+func (d *gcpCloudSQLDiscoverer) discover(ctx context.Context) ([]targetSpec, error) {
+	var (
+		specs     []targetSpec
+		pageToken string
+	)
+	for {
+		u := fmt.Sprintf("%s/projects/%s/instances", cloudSQLAdminAPI, url.PathEscape(d.config.Project))
+		if pageToken != "" {
+			u += "?" + url.Values{"pageToken": {pageToken}}.Encode()
+		}
+		var page struct {
+			Items         []cloudSQLInstance `json:"items"`
+			NextPageToken string             `json:"nextPageToken"`
+		}
+		if err := callJSONAPI(ctx, d.client, http.MethodGet, u, nil, &page); err != nil {
+			return nil, fmt.Errorf("[%s] error listing Cloud SQL instances: %s", d.logContext, err)
+		}
+		for _, i := range page.Items {
+			if spec, ok := d.targetSpec(i); ok {
+				specs = append(specs, spec)
+			}
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			return specs, nil
+		}
+	}
+}
+
+// targetSpec builds the target spec for an instance. Returns false if the instance is not running, doesn't match the
+// configured labels or has no IP address of the configured type.
+func (d *gcpCloudSQLDiscoverer) targetSpec(i cloudSQLInstance) (targetSpec, bool) {
+	if i.State != "RUNNABLE" {
+		return targetSpec{}, false
+	}
+	for k, v := range d.config.Labels {
+		if i.Settings.UserLabels[k] != v {
+			return targetSpec{}, false
+		}
+	}
+
+	data := dsnTemplateData{
+		Name:   i.Name,
+		Labels: i.Settings.UserLabels,
+	}
+	wantType := "PRIMARY"
+	if d.config.PrivateIP {
+		wantType = "PRIVATE"
+	}
+	for _, ip := range i.IPAddresses {
+		if ip.Type == wantType {
+			data.Address = ip.IPAddress
+		}
+	}
+	if data.Address == "" {
+		d.logger.Debug("Skipping Cloud SQL instance with no IP address of the configured type", "instance", i.Name,
+			"ip_type", wantType)
+		return targetSpec{}, false
+	}
+	switch {
+	case strings.HasPrefix(i.DatabaseVersion, "POSTGRES"):
+		data.Port = 5432
+	case strings.HasPrefix(i.DatabaseVersion, "MYSQL"):
+		data.Port = 3306
+	case strings.HasPrefix(i.DatabaseVersion, "SQLSERVER"):
+		data.Port = 1433
+	}
+
+	dsn, err := executeDSNTemplate(string(d.config.DSNTemplate), &data)
+	if err != nil {
+		d.logger.Warn("Error building data source name", "instance", i.Name, "err", err)
+		return targetSpec{}, false
+	}
+	spec := targetSpec{name: i.Name, dsn: dsn}
+	if d.dialer != nil {
+		spec.dial = d.dialer.dialFunc(i.ConnectionName)
+		spec.dialKey = "cloudsql:" + i.ConnectionName
+	}
+	return spec, true
+}
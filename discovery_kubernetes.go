@@ -0,0 +1,210 @@
+package sql_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/free/sql_exporter/config"
+	config_util "github.com/prometheus/common/config"
+)
+
+const (
+	// Where the service account credentials are mounted inside Kubernetes pods.
+	kubernetesServiceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubernetesServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// kubernetesDiscoverer discovers targets from Kubernetes pods or services, by polling the Kubernetes API.
+type kubernetesDiscoverer struct {
+	config     *config.KubernetesSDConfig
+	logContext string
+	logger     *slog.Logger
+	server     string
+	client     *http.Client
+}
+
+// newKubernetesDiscoverer returns a discoverer listing the configured pods or services. If no API server is
+// configured, the in-cluster API server and service account credentials are used.
+func newKubernetesDiscoverer(
+	logger *slog.Logger, logContext string, c *config.KubernetesSDConfig) (*kubernetesDiscoverer, error) {
+	logContext = fmt.Sprintf("%s, kubernetes_sd", logContext)
+
+	httpConfig := c.HTTPClient
+	var server string
+	if c.APIServer.URL != nil {
+		server = c.APIServer.String()
+	} else {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("[%s] no api_server configured and not running in a Kubernetes cluster", logContext)
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+		if httpConfig.Authorization == nil && httpConfig.BasicAuth == nil && httpConfig.OAuth2 == nil {
+			httpConfig.Authorization = &config_util.Authorization{
+				Type:            "Bearer",
+				CredentialsFile: kubernetesServiceAccountToken,
+			}
+		}
+		if httpConfig.TLSConfig.CAFile == "" {
+			httpConfig.TLSConfig.CAFile = kubernetesServiceAccountCA
+		}
+	}
+
+	client, err := config_util.NewClientFromConfig(httpConfig, "kubernetes_sd")
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+	return &kubernetesDiscoverer{
+		config:     c,
+		logContext: logContext,
+		logger:     logger.With("discovery", "kubernetes_sd"),
+		server:     server,
+		client:     client,
+	}, nil
+}
+
+// kubernetesObject is the subset of a Kubernetes pod or service that's relevant for target discovery.
+type kubernetesObject struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		// Pods only.
+		Containers []struct {
+			Ports []struct {
+				ContainerPort int `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+		// Services only.
+		Ports []struct {
+			Port int `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+	Status struct {
+		// Pods only.
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// discover implements discoverer.
+func (d *kubernetesDiscoverer) discover(ctx context.Context) ([]targetSpec, error) {
+	namespaces := d.config.Namespaces
+	if len(namespaces) == 0 {
+		// List across all namespaces.
+		namespaces = []string{""}
+	}
+
+	var specs []targetSpec
+	for _, ns := range namespaces {
+		objects, err := d.list(ctx, ns)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			spec, ok, err := d.targetSpec(o)
+			if err != nil {
+				d.logger.Warn("Skipping discovered target", "err", err)
+				continue
+			}
+			if ok {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	return specs, nil
+}
+
+// list returns the pods or services matching the label selector in the given namespace (all namespaces if empty).
+func (d *kubernetesDiscoverer) list(ctx context.Context, namespace string) ([]kubernetesObject, error) {
+	resource := d.config.Role + "s"
+	path := "/api/v1/" + resource
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/" + resource
+	}
+	u := d.server + path
+	if d.config.LabelSelector != "" {
+		u += "?" + url.Values{"labelSelector": {d.config.LabelSelector}}.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] error listing %s: %s", d.logContext, resource, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[%s] error listing %s: %s", d.logContext, resource, resp.Status)
+	}
+
+	var list struct {
+		Items []kubernetesObject `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("[%s] error decoding %s: %s", d.logContext, resource, err)
+	}
+	return list.Items, nil
+}
+
+// targetSpec builds the target spec for a pod or service. Returns false if the object has no DSN template (neither
+// annotated nor configured) or is a pod that's not running.
+func (d *kubernetesDiscoverer) targetSpec(o kubernetesObject) (targetSpec, bool, error) {
+	text, found := o.Metadata.Annotations[d.config.DSNAnnotation]
+	if !found {
+		text = string(d.config.DSNTemplate)
+	}
+	if text == "" {
+		return targetSpec{}, false, nil
+	}
+
+	data := dsnTemplateData{
+		Name:        o.Metadata.Name,
+		Namespace:   o.Metadata.Namespace,
+		Labels:      o.Metadata.Labels,
+		Annotations: o.Metadata.Annotations,
+	}
+	switch d.config.Role {
+	case "pod":
+		if o.Status.Phase != "Running" || o.Status.PodIP == "" {
+			return targetSpec{}, false, nil
+		}
+		data.Address = o.Status.PodIP
+		for _, c := range o.Spec.Containers {
+			if len(c.Ports) > 0 {
+				data.Port = c.Ports[0].ContainerPort
+				break
+			}
+		}
+	case "service":
+		data.Address = fmt.Sprintf("%s.%s.svc", o.Metadata.Name, o.Metadata.Namespace)
+		if len(o.Spec.Ports) > 0 {
+			data.Port = o.Spec.Ports[0].Port
+		}
+	}
+
+	dsn, err := executeDSNTemplate(text, &data)
+	if err != nil {
+		return targetSpec{}, false, fmt.Errorf("[%s] error building data source name for %s %s/%s: %s",
+			d.logContext, d.config.Role, o.Metadata.Namespace, o.Metadata.Name, err)
+	}
+	return targetSpec{
+		name: o.Metadata.Namespace + "/" + o.Metadata.Name,
+		dsn:  dsn,
+		labels: map[string]string{
+			"namespace":   o.Metadata.Namespace,
+			d.config.Role: o.Metadata.Name,
+		},
+	}, true, nil
+}
@@ -0,0 +1,113 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// sqlDiscoverer discovers targets by querying a catalog database.
+type sqlDiscoverer struct {
+	config     *config.SQLSDConfig
+	logContext string
+	logger     *slog.Logger
+
+	// Protects conn, which is lazily opened on the first discovery.
+	mu   sync.Mutex
+	conn *sql.DB
+}
+
+// newSQLDiscoverer returns a discoverer running the configured query against a catalog database.
+func newSQLDiscoverer(logger *slog.Logger, logContext string, c *config.SQLSDConfig) *sqlDiscoverer {
+	return &sqlDiscoverer{
+		config:     c,
+		logContext: fmt.Sprintf("%s, sql_sd", logContext),
+		logger:     logger.With("discovery", "sql_sd"),
+	}
+}
+
+// discover implements discoverer.
+func (d *sqlDiscoverer) discover(ctx context.Context) ([]targetSpec, error) {
+	dsn := string(d.config.DSN)
+
+	d.mu.Lock()
+	if d.conn == nil {
+		resolved, err := resolveSecrets(ctx, dsn)
+		if err != nil {
+			d.mu.Unlock()
+			return nil, fmt.Errorf("[%s] %s", d.logContext, err)
+		}
+		conn, err := connections.acquire(ctx, d.logger, resolved, connectHooks{})
+		if err != nil {
+			d.mu.Unlock()
+			return nil, redactError(err, resolved)
+		}
+		d.conn = conn
+	}
+	conn := d.conn
+	d.mu.Unlock()
+
+	rows, err := conn.QueryContext(ctx, d.config.Query)
+	if err != nil {
+		return nil, redactError(err, dsn)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]int, len(columns))
+	for i, column := range columns {
+		indexes[column] = i
+	}
+	for _, column := range append([]string{d.config.NameColumn, d.config.DSNColumn}, d.config.LabelColumns...) {
+		if _, found := indexes[column]; !found {
+			return nil, fmt.Errorf("[%s] column %q missing from query result", d.logContext, column)
+		}
+	}
+
+	var specs []targetSpec
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		spec := targetSpec{
+			name: values[indexes[d.config.NameColumn]].String,
+			dsn:  values[indexes[d.config.DSNColumn]].String,
+		}
+		if spec.name == "" || spec.dsn == "" {
+			return nil, fmt.Errorf("[%s] empty target name or data source name returned by query", d.logContext)
+		}
+		if len(d.config.LabelColumns) > 0 {
+			spec.labels = make(map[string]string, len(d.config.LabelColumns))
+			for _, column := range d.config.LabelColumns {
+				spec.labels[column] = values[indexes[column]].String
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, rows.Err()
+}
+
+// Close releases the catalog database handle, if any.
+func (d *sqlDiscoverer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return nil
+	}
+	conn := d.conn
+	d.conn = nil
+	return connections.release(conn)
+}
@@ -0,0 +1,8 @@
+//go:build db2
+// +build db2
+
+package sql_exporter
+
+// The Db2 driver requires cgo and the IBM Db2 CLI driver (`clidriver`) to build and run, so it's only built in with
+// the `db2` build tag, e.g. `go build -tags db2`.
+import _ "github.com/ibmdb/go_ibm_db" // register the Db2 driver
@@ -0,0 +1,8 @@
+//go:build odbc
+// +build odbc
+
+package sql_exporter
+
+// The ODBC driver requires cgo and unixODBC (or the Windows ODBC driver manager) to build and run, so it's only built
+// in with the `odbc` build tag, e.g. `go build -tags odbc`.
+import _ "github.com/alexbrainman/odbc" // register the ODBC driver
@@ -0,0 +1,164 @@
+package sql_exporter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+var (
+	// ErrUnknownJob is returned when adding a target to a job not defined by the configuration.
+	ErrUnknownJob = errors.New("unknown job")
+	// ErrUnknownTarget is returned when removing a target that was not added at runtime.
+	ErrUnknownTarget = errors.New("unknown target")
+	// ErrTargetExists is returned when adding a target named like one defined by the configuration or discovered.
+	ErrTargetExists = errors.New("target already exists")
+)
+
+// DynamicTarget is a target added to a job at runtime, via Exporter.AddTarget(), rather than defined by the
+// configuration. The job's collectors are applied to it.
+type DynamicTarget struct {
+	Job  string `yaml:"job" json:"job"`
+	Name string `yaml:"target" json:"target"`
+	DSN  string `yaml:"data_source_name" json:"data_source_name"`
+	// Labels to apply to all metrics collected from the target, besides `job` and `instance`.
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// validate checks that the target has a name, a data source name and valid labels.
+func (dt *DynamicTarget) validate() error {
+	if dt.Name == "" {
+		return fmt.Errorf("missing target name")
+	}
+	if !strings.Contains(dt.DSN, "://") {
+		return fmt.Errorf("invalid data source name for target %q, expecting a URL", dt.Name)
+	}
+	for name := range dt.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q for target %q", name, dt.Name)
+		}
+		if name == "job" || name == "instance" {
+			return fmt.Errorf("reserved label %q defined for target %q", name, dt.Name)
+		}
+	}
+	return nil
+}
+
+// spec returns the targetSpec to create the target from.
+func (dt *DynamicTarget) spec() targetSpec {
+	return targetSpec{name: dt.Name, dsn: dt.DSN, labels: dt.Labels}
+}
+
+// AddTarget implements Exporter.
+func (e *exporter) AddTarget(dt DynamicTarget) error {
+	if err := dt.validate(); err != nil {
+		return err
+	}
+
+	e.dynamicMu.Lock()
+	defer e.dynamicMu.Unlock()
+	e.mu.RLock()
+	state := e.state
+	e.mu.RUnlock()
+	j := state.job(dt.Job)
+	if j == nil {
+		return fmt.Errorf("%w %q", ErrUnknownJob, dt.Job)
+	}
+	for _, cc := range j.config.Collectors() {
+		for _, mc := range cc.Metrics {
+			for _, l := range mc.KeyLabels {
+				if _, found := dt.Labels[l]; found {
+					return fmt.Errorf("label collision in job %q: label %q is defined both by target %q and by metric %q "+
+						"of collector %q", dt.Job, l, dt.Name, mc.Name, cc.Name)
+				}
+			}
+		}
+	}
+	if err := j.addTarget(dt.spec()); err != nil {
+		return err
+	}
+
+	if e.dynamicTargets == nil {
+		e.dynamicTargets = make(map[string]map[string]DynamicTarget)
+	}
+	if e.dynamicTargets[dt.Job] == nil {
+		e.dynamicTargets[dt.Job] = make(map[string]DynamicTarget)
+	}
+	e.dynamicTargets[dt.Job][dt.Name] = dt
+	return nil
+}
+
+// RemoveTarget implements Exporter.
+func (e *exporter) RemoveTarget(jobName, name string) error {
+	e.dynamicMu.Lock()
+	defer e.dynamicMu.Unlock()
+	if _, found := e.dynamicTargets[jobName][name]; !found {
+		return fmt.Errorf("%w: %q in job %q", ErrUnknownTarget, name, jobName)
+	}
+	delete(e.dynamicTargets[jobName], name)
+
+	e.mu.RLock()
+	state := e.state
+	e.mu.RUnlock()
+	if j := state.job(jobName); j != nil {
+		// Not found if it was ignored on reload, as it conflicted with a target defined by the new configuration.
+		if err := j.removeTarget(name); err != nil && !errors.Is(err, ErrUnknownTarget) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DynamicTargets implements Exporter.
+func (e *exporter) DynamicTargets() []DynamicTarget {
+	e.dynamicMu.Lock()
+	defer e.dynamicMu.Unlock()
+	return e.sortedDynamicTargets()
+}
+
+// sortedDynamicTargets returns all targets added at runtime, ordered by job, then name. The caller must hold dynamicMu.
+func (e *exporter) sortedDynamicTargets() []DynamicTarget {
+	targets := make([]DynamicTarget, 0, len(e.dynamicTargets))
+	for _, jobTargets := range e.dynamicTargets {
+		for _, dt := range jobTargets {
+			targets = append(targets, dt)
+		}
+	}
+	sort.Slice(targets, func(i, k int) bool {
+		if targets[i].Job != targets[k].Job {
+			return targets[i].Job < targets[k].Job
+		}
+		return targets[i].Name < targets[k].Name
+	})
+	return targets
+}
+
+// addDynamicTargets adds all targets added at runtime so far to the jobs of state, e.g. after a configuration reload.
+// Targets whose job no longer exists or that conflict with ones defined by the configuration are logged and skipped.
+// The caller must hold dynamicMu and state must not be in use yet.
+func (e *exporter) addDynamicTargets(state *exporterState) {
+	for _, dt := range e.sortedDynamicTargets() {
+		j := state.job(dt.Job)
+		if j == nil {
+			e.logger.Warn("Not adding target, job no longer exists", "job", dt.Job, "target", dt.Name)
+			continue
+		}
+		if err := j.addTarget(dt.spec()); err != nil {
+			e.logger.Warn("Not adding target", "job", dt.Job, "target", dt.Name, "err", err)
+		}
+	}
+}
+
+// job returns the named job, nil if not found.
+func (s *exporterState) job(name string) *job {
+	for i, jc := range s.config.Jobs {
+		if jc.Name == name {
+			j, _ := s.jobs[i].(*job)
+			return j
+		}
+	}
+	return nil
+}
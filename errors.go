@@ -0,0 +1,138 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/kshvakov/clickhouse"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/pkg/errors"
+)
+
+// Error classes, used to label query errors and to decide whether a failed query is worth retrying.
+const (
+	errorClassTimeout    = "timeout"    // the query or connection timed out or was canceled
+	errorClassAuth       = "auth"       // authentication failed
+	errorClassSyntax     = "syntax"     // malformed query or reference to an undefined object
+	errorClassTransient  = "transient"  // broken connection, deadlock, failover etc., a retry is likely to succeed
+	errorClassPermission = "permission" // insufficient privileges
+	errorClassOther      = "other"      // anything else, including errors processing query results
+)
+
+// classifyError maps err to one of the error classes above, based on driver specific error codes where available.
+func classifyError(err error) string {
+	err = errors.Cause(err)
+	switch err {
+	case context.DeadlineExceeded, context.Canceled:
+		return errorClassTimeout
+	case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF, mysql.ErrInvalidConn:
+		return errorClassTransient
+	}
+
+	switch e := err.(type) {
+	case *pq.Error:
+		return classifyPostgresError(e)
+	case *mysql.MySQLError:
+		return classifyMySQLError(e)
+	case mssql.Error:
+		return classifyMSSQLError(e)
+	case *clickhouse.Exception:
+		return classifyClickHouseError(e)
+	case *net.OpError:
+		if e.Timeout() {
+			return errorClassTimeout
+		}
+		if se, ok := e.Err.(*os.SyscallError); ok {
+			switch se.Err {
+			case syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE:
+				return errorClassTransient
+			}
+		}
+	}
+	if strings.Contains(err.Error(), "connection reset by peer") {
+		return errorClassTransient
+	}
+	return errorClassOther
+}
+
+// isTransientError returns true if err is the kind of error that a retry could reasonably be expected to fix. Timeouts
+// are not considered transient, as they are a symptom of an overloaded or unreachable server and retrying would only
+// make matters worse.
+func isTransientError(err error) bool {
+	return classifyError(err) == errorClassTransient
+}
+
+// classifyPostgresError classifies a PostgreSQL error based on its SQLSTATE code.
+func classifyPostgresError(e *pq.Error) string {
+	switch e.Code {
+	case "57014": // query_canceled, including statement_timeout
+		return errorClassTimeout
+	case "42501": // insufficient_privilege
+		return errorClassPermission
+	}
+	switch e.Code.Class() {
+	case "08", "40", "53", "57": // connection exception, rollback, insufficient resources, operator intervention
+		return errorClassTransient
+	case "28": // invalid authorization specification
+		return errorClassAuth
+	case "42": // syntax error or access rule violation
+		return errorClassSyntax
+	}
+	return errorClassOther
+}
+
+// classifyMySQLError classifies a MySQL error based on its server error number.
+func classifyMySQLError(e *mysql.MySQLError) string {
+	switch e.Number {
+	case 1040, 1053, 1205, 1213: // too many connections, server shutdown, lock wait timeout, deadlock
+		return errorClassTransient
+	case 1045: // access denied for user
+		return errorClassAuth
+	case 1044, 1142, 1143, 1227: // access denied to database, table, column, operation
+		return errorClassPermission
+	case 1054, 1064, 1146: // unknown column, syntax error, unknown table
+		return errorClassSyntax
+	case 3024: // max_execution_time exceeded
+		return errorClassTimeout
+	}
+	return errorClassOther
+}
+
+// classifyMSSQLError classifies a SQL Server error based on its error number.
+func classifyMSSQLError(e mssql.Error) string {
+	switch e.Number {
+	case 1205, 40197, 40501, 40613, 49918, 49919, 49920: // deadlock victim, Azure SQL failover and throttling
+		return errorClassTransient
+	case 18456: // login failed
+		return errorClassAuth
+	case 229, 230, 262, 297, 300: // permission denied
+		return errorClassPermission
+	case 102, 156, 207, 208, 2812: // syntax errors, invalid column, object or stored procedure name
+		return errorClassSyntax
+	}
+	return errorClassOther
+}
+
+// classifyClickHouseError classifies a ClickHouse exception based on its error code.
+func classifyClickHouseError(e *clickhouse.Exception) string {
+	switch e.Code {
+	case 159, 209: // timeout exceeded, socket timeout
+		return errorClassTimeout
+	case 210: // network error
+		return errorClassTransient
+	case 192, 193, 516: // unknown user, wrong password, authentication failed
+		return errorClassAuth
+	case 497: // access denied
+		return errorClassPermission
+	case 47, 60, 62: // unknown identifier, unknown table, syntax error
+		return errorClassSyntax
+	}
+	return errorClassOther
+}
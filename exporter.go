@@ -2,7 +2,9 @@ package sql_exporter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -10,51 +12,301 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrShutdown is returned by scrapes and reloads once the exporter was shut down.
+var ErrShutdown = errors.New("exporter shut down")
+
+// ErrNoConfigFile is returned by reloads of an exporter created from a configuration rather than a file.
+var ErrNoConfigFile = errors.New("exporter has no configuration file to reload")
+
 // Exporter is a prometheus.Gatherer that gathers SQL metrics from targets and merges them with the default registry.
 type Exporter interface {
 	prometheus.Gatherer
 
+	// Config returns the currently active configuration.
 	Config() *config.Config
+	// JobGatherer returns a prometheus.Gatherer that collects metrics from the named job's targets only, with the job's
+	// scrape timeout (if set), so jobs may be scraped independently. It keeps following the job across reloads and
+	// fails to gather if the job no longer exists.
+	JobGatherer(job string) prometheus.Gatherer
+	// TargetGatherer returns a prometheus.Gatherer like JobGatherer, except it only collects metrics from the named
+	// target of the job (defined by the configuration, discovered or added at runtime).
+	TargetGatherer(job, target string) prometheus.Gatherer
+	// Probe returns a prometheus.Gatherer that collects metrics from a single target, created on the fly from the
+	// configuration of the named job. target is either the name of a target defined by the job or a data source name.
+	// If collectors is non-empty, the named collectors are applied instead of the job's own. The returned Gatherer is
+	// meant to be used for exactly one Gather() call, after which the target's database handle is closed.
+	Probe(job, target string, collectors []string) (prometheus.Gatherer, error)
+	// AddTarget adds a target to one of the configured jobs at runtime, or replaces one previously added. The target
+	// is kept across configuration reloads, for as long as the job exists.
+	AddTarget(target DynamicTarget) error
+	// RemoveTarget removes a target previously added via AddTarget.
+	RemoveTarget(job, target string) error
+	// DynamicTargets returns the targets added via AddTarget, ordered by job, then target name.
+	DynamicTargets() []DynamicTarget
+	// Targets returns the status of all jobs' targets as of their latest scrape, ordered by job, then target name.
+	Targets() []TargetStatus
+	// CheckHealth pings the databases of all targets (or only those of the named job and/or the named target) in
+	// parallel, within ctx, and returns the outcomes ordered by job, then target name. It fails with ErrUnknownJob or
+	// ErrUnknownTarget if a named job or target does not exist.
+	CheckHealth(ctx context.Context, job, target string) ([]TargetHealth, error)
+	// Reload re-reads the configuration file and atomically replaces all jobs, targets and collectors. If the new
+	// configuration fails to load or validate, an error is returned and the previous configuration remains in effect.
+	// Exporters created by NewExporterFromConfig have no configuration file and fail with ErrNoConfigFile.
+	Reload() error
+	// Shutdown stops the exporter: scrapes started afterwards fail with ErrShutdown, in-flight ones are given until
+	// ctx is done to complete (and are canceled after that), then background collection is stopped and all database
+	// handles are closed. It returns ctx's error if in-flight scrapes did not complete in time, without waiting for the
+	// database handles to be closed.
+	Shutdown(ctx context.Context) error
 }
 
 type exporter struct {
-	config          *config.Config
-	jobs            []Job
-	targets         []Target
+	logger *slog.Logger
+	// The configuration file, empty if the exporter was created from a configuration.
+	configFile      string
 	defaultGatherer prometheus.Gatherer
+
+	// mu protects state, which is swapped out as a whole on reload, and closed.
+	mu     sync.RWMutex
+	state  *exporterState
+	closed bool
+	// abort is closed when the shutdown timeout expires, canceling all in-flight scrapes.
+	abort chan struct{}
+
+	// dynamicMu protects dynamicTargets, the targets added at runtime by job and name, added to every new state.
+	dynamicMu      sync.Mutex
+	dynamicTargets map[string]map[string]DynamicTarget
+}
+
+// exporterState groups everything derived from a single configuration. It is only ever replaced as a whole, so
+// Gather() may keep using it after a reload has replaced it.
+type exporterState struct {
+	config *config.Config
+	// Checksum of the configuration file contents, when loaded.
+	configChecksum string
+	jobs           []Job
+	// Metric relabeling rules, keyed by job name.
+	relabelConfigs map[string][]*config.RelabelConfig
+
+	// inFlight tracks the Gather() calls still using this state, so its targets are only closed after they're done.
+	inFlight sync.WaitGroup
+	// stopWatching stops watching the collector files of the configuration for changes.
+	stopWatching context.CancelFunc
 }
 
-// NewExporter returns a new SQL Exporter for the provided config.
-func NewExporter(configFile string, defaultGatherer prometheus.Gatherer) (Exporter, error) {
+// NewExporter returns a new SQL Exporter for the provided config, logging to logger (the default slog logger if nil).
+func NewExporter(logger *slog.Logger, configFile string, defaultGatherer prometheus.Gatherer) (Exporter, error) {
+	logger = orDefaultLogger(logger)
+	state, err := loadExporterState(logger, configFile)
+	if err != nil {
+		return nil, err
+	}
+	return newExporter(logger, configFile, defaultGatherer, state), nil
+}
+
+// NewExporterFromConfig returns a new SQL Exporter for the provided configuration (e.g. as returned by config.Parse),
+// logging to logger (the default slog logger if nil). It is meant for applications embedding the exporter. Since
+// there is no configuration file, the exporter cannot be reloaded and does not watch its collector files for changes.
+func NewExporterFromConfig(logger *slog.Logger, c *config.Config, defaultGatherer prometheus.Gatherer) (
+	Exporter, error) {
+	logger = orDefaultLogger(logger)
+	state, err := newExporterState(logger, c, "")
+	if err != nil {
+		return nil, err
+	}
+	return newExporter(logger, "", defaultGatherer, state), nil
+}
+
+// newExporter returns a new exporter using the provided state and starts watching its collector files.
+func newExporter(logger *slog.Logger, configFile string, defaultGatherer prometheus.Gatherer,
+	state *exporterState) *exporter {
+	e := &exporter{
+		logger:          logger,
+		configFile:      configFile,
+		defaultGatherer: defaultGatherer,
+		state:           state,
+		abort:           make(chan struct{}),
+	}
+	e.watchCollectorFiles(state)
+	return e
+}
+
+// loadExporterState loads the given config file and instantiates all jobs and targets defined in it.
+func loadExporterState(logger *slog.Logger, configFile string) (*exporterState, error) {
+	checksum := fileChecksum(configFile)
 	c, err := config.Load(configFile)
 	if err != nil {
 		return nil, err
 	}
+	return newExporterState(logger, c, checksum)
+}
+
+// newExporterState instantiates all jobs and targets defined in the provided configuration, whose file contents have
+// the given checksum (empty if not loaded from a file).
+func newExporterState(logger *slog.Logger, c *config.Config, checksum string) (*exporterState, error) {
+	for _, f := range c.CollectorFiles {
+		if err := f.FetchError(); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
 
 	jobs := make([]Job, 0, len(c.Jobs))
-	targets := make([]Target, 0, len(c.Jobs)*3)
+	relabelConfigs := make(map[string][]*config.RelabelConfig)
 	for _, jc := range c.Jobs {
-		job, err := NewJob(jc)
+		if len(jc.MetricRelabelConfigs) > 0 {
+			relabelConfigs[jc.Name] = jc.MetricRelabelConfigs
+		}
+		job, err := NewJob(logger, jc)
 		if err != nil {
+			// Don't leak any DB handles or background collection goroutines of previously created jobs.
+			for _, j := range jobs {
+				j.Close()
+			}
 			return nil, err
 		}
 		jobs = append(jobs, job)
-		targets = append(targets, job.Targets()...)
 	}
 
-	return &exporter{
-		config:          c,
-		jobs:            jobs,
-		targets:         targets,
-		defaultGatherer: defaultGatherer,
+	queryLimiter.setLimit(c.Globals.MaxConcurrentQueries)
+	return &exporterState{
+		config:         c,
+		configChecksum: checksum,
+		jobs:           jobs,
+		relabelConfigs: relabelConfigs,
+		stopWatching:   func() {},
 	}, nil
 }
 
+// targets returns the current targets of all jobs.
+func (s *exporterState) targets() []Target {
+	var targets []Target
+	for _, j := range s.jobs {
+		targets = append(targets, j.Targets()...)
+	}
+	return targets
+}
+
+// close releases the resources held by the state's targets, once all Gather() calls using them have completed.
+func (s *exporterState) close() {
+	s.stopWatching()
+	s.inFlight.Wait()
+	for _, j := range s.jobs {
+		j.Close()
+	}
+}
+
+// acquireState returns the current state, marking it as in use, or ErrShutdown if the exporter was shut down. The
+// caller must call state.inFlight.Done() when done.
+func (e *exporter) acquireState() (*exporterState, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return nil, ErrShutdown
+	}
+	e.state.inFlight.Add(1)
+	return e.state, nil
+}
+
+// abortable returns a copy of ctx that is also canceled if the exporter's shutdown timeout expires.
+func (e *exporter) abortable(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-e.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // Gather implements prometheus.Gatherer.
 func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.config.Globals.ScrapeTimeout))
+	return e.gatherContext(context.Background())
+}
+
+// gatherContext implements contextGatherer.
+func (e *exporter) gatherContext(ctx context.Context) ([]*dto.MetricFamily, error) {
+	state, err := e.acquireState()
+	if err != nil {
+		return nil, err
+	}
+	defer state.inFlight.Done()
+	ctx, cancel := e.abortable(ctx)
+	defer cancel()
+
+	return gather(ctx, time.Duration(state.config.Globals.ScrapeTimeout), state.targets(), state.relabelConfigs)
+}
+
+// JobGatherer implements Exporter.
+func (e *exporter) JobGatherer(jobName string) prometheus.Gatherer {
+	return &jobGatherer{exporter: e, job: jobName}
+}
+
+// TargetGatherer implements Exporter.
+func (e *exporter) TargetGatherer(jobName, target string) prometheus.Gatherer {
+	return &jobGatherer{exporter: e, job: jobName, target: target}
+}
+
+// jobGatherer is a prometheus.Gatherer collecting metrics from the targets of a single job of an exporter, or from
+// only one of them, if target is set.
+type jobGatherer struct {
+	exporter *exporter
+	job      string
+	target   string
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *jobGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return g.gatherContext(context.Background())
+}
+
+// gatherContext implements contextGatherer.
+func (g *jobGatherer) gatherContext(ctx context.Context) ([]*dto.MetricFamily, error) {
+	state, err := g.exporter.acquireState()
+	if err != nil {
+		return nil, err
+	}
+	defer state.inFlight.Done()
+	ctx, cancel := g.exporter.abortable(ctx)
+	defer cancel()
+
+	for i, jc := range state.config.Jobs {
+		if jc.Name != g.job {
+			continue
+		}
+		targets := state.jobs[i].Targets()
+		if g.target != "" {
+			j, _ := state.jobs[i].(*job)
+			t := j.target(g.target)
+			if t == nil {
+				return nil, fmt.Errorf("unknown target %q of job %q", g.target, g.job)
+			}
+			targets = []Target{t}
+		}
+		return gather(ctx, jobScrapeTimeout(state.config, jc), targets, state.relabelConfigs)
+	}
+	return nil, fmt.Errorf("unknown job %q", g.job)
+}
+
+// jobScrapeTimeout returns the timeout for scraping the job on its own: its own scrape timeout, if set, else the global
+// one.
+func jobScrapeTimeout(c *config.Config, jc *config.JobConfig) time.Duration {
+	if jc.ScrapeTimeout > 0 {
+		return time.Duration(jc.ScrapeTimeout)
+	}
+	return time.Duration(c.Globals.ScrapeTimeout)
+}
+
+// gather collects metrics from the provided targets in parallel, with the given timeout, and groups them into metric
+// families. Metrics are relabeled according to the rules of their job (as per their `job` label), if any.
+func gather(ctx context.Context, timeout time.Duration, targets []Target,
+	relabelConfigs map[string][]*config.RelabelConfig) ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	// Make sure to cancel the context, releasing any resources associated with it.
 	defer cancel()
 
@@ -62,10 +314,12 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 		metricChan = make(chan Metric, capMetricChan)
 		errs       prometheus.MultiError
 	)
+	ctx, span := tracer.Start(ctx, "gather", trace.WithAttributes(attribute.Int("sql_exporter.targets", len(targets))))
+	defer func() { endSpan(span, errs.MaybeUnwrap()) }()
 
 	var wg sync.WaitGroup
-	wg.Add(len(e.targets))
-	for _, t := range e.targets {
+	wg.Add(len(targets))
+	for _, t := range targets {
 		go func(target Target) {
 			defer wg.Done()
 			target.Collect(ctx, metricChan)
@@ -93,21 +347,30 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 			continue
 		}
 		metricDesc := metric.Desc()
-		dtoMetricFamily, ok := dtoMetricFamilies[metricDesc.Name()]
+		name := metricDesc.Name()
+		if rules := relabelConfigs[jobLabel(dtoMetric)]; len(rules) > 0 {
+			var keep bool
+			if name, keep = relabelMetric(name, dtoMetric, rules); !keep {
+				continue
+			}
+		}
+		dtoMetricFamily, ok := dtoMetricFamilies[name]
 		if !ok {
 			dtoMetricFamily = &dto.MetricFamily{}
-			dtoMetricFamily.Name = proto.String(metricDesc.Name())
+			dtoMetricFamily.Name = proto.String(name)
 			dtoMetricFamily.Help = proto.String(metricDesc.Help())
 			switch {
 			case dtoMetric.Gauge != nil:
 				dtoMetricFamily.Type = dto.MetricType_GAUGE.Enum()
 			case dtoMetric.Counter != nil:
 				dtoMetricFamily.Type = dto.MetricType_COUNTER.Enum()
+			case dtoMetric.Histogram != nil:
+				dtoMetricFamily.Type = dto.MetricType_HISTOGRAM.Enum()
 			default:
 				errs = append(errs, fmt.Errorf("don't know how to handle metric %v", dtoMetric))
 				continue
 			}
-			dtoMetricFamilies[metricDesc.Name()] = dtoMetricFamily
+			dtoMetricFamilies[name] = dtoMetricFamily
 		}
 		dtoMetricFamily.Metric = append(dtoMetricFamily.Metric, dtoMetric)
 	}
@@ -117,10 +380,254 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 	for _, mf := range dtoMetricFamilies {
 		result = append(result, mf)
 	}
-	return result, errs
+	return result, errs.MaybeUnwrap()
+}
+
+// jobLabel returns the value of the metric's `job` label, empty if not set.
+func jobLabel(metric *dto.Metric) string {
+	for _, lp := range metric.Label {
+		if lp.GetName() == "job" {
+			return lp.GetValue()
+		}
+	}
+	return ""
 }
 
 // Config implements Exporter.
 func (e *exporter) Config() *config.Config {
-	return e.config
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.state.config
+}
+
+// Targets implements Exporter.
+func (e *exporter) Targets() []TargetStatus {
+	e.mu.RLock()
+	jobs := e.state.jobs
+	e.mu.RUnlock()
+	return targetStatuses(jobs)
+}
+
+// Probe implements Exporter.
+func (e *exporter) Probe(jobName, target string, collectorNames []string) (prometheus.Gatherer, error) {
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return nil, ErrShutdown
+	}
+	return NewProbe(e.logger, e.Config(), jobName, target, collectorNames)
+}
+
+// NewProbe returns a prometheus.Gatherer collecting metrics from a single target (either a target name or a data
+// source name) of the provided configuration, created on the fly from the named job (or the job defining the target,
+// if no job is specified). Non-empty collectorNames override the target's collectors. The target is closed after every
+// Gather call. The target logs to logger, the default slog logger if nil.
+func NewProbe(logger *slog.Logger, c *config.Config, jobName, target string, collectorNames []string) (
+	prometheus.Gatherer, error) {
+	var jc *config.JobConfig
+	for _, j := range c.Jobs {
+		if jobName != "" {
+			if j.Name == jobName {
+				jc = j
+				break
+			}
+		} else if j.HasTarget(target) {
+			jc = j
+			break
+		}
+	}
+	if jc == nil {
+		switch {
+		case jobName != "":
+			return nil, fmt.Errorf("unknown job %q", jobName)
+		case len(c.Jobs) == 1:
+			jc = c.Jobs[0]
+		default:
+			return nil, fmt.Errorf("unknown target %q and no job specified", target)
+		}
+	}
+
+	ccs := make([]*config.CollectorConfig, 0, len(collectorNames))
+	for _, name := range collectorNames {
+		cc := c.Collector(name)
+		if cc == nil {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		ccs = append(ccs, cc)
+	}
+
+	t, err := NewProbeTarget(logger, jc, target, ccs)
+	if err != nil {
+		return nil, err
+	}
+	return &probe{
+		target:         t,
+		timeout:        jobScrapeTimeout(c, jc),
+		relabelConfigs: map[string][]*config.RelabelConfig{jc.Name: jc.MetricRelabelConfigs},
+	}, nil
+}
+
+// probe is a prometheus.Gatherer collecting metrics from a single, transient target.
+type probe struct {
+	target         Target
+	timeout        time.Duration
+	relabelConfigs map[string][]*config.RelabelConfig
+}
+
+// Gather implements prometheus.Gatherer.
+func (p *probe) Gather() ([]*dto.MetricFamily, error) {
+	return p.gatherContext(context.Background())
+}
+
+// gatherContext implements contextGatherer.
+func (p *probe) gatherContext(ctx context.Context) ([]*dto.MetricFamily, error) {
+	defer p.target.Close()
+	return gather(ctx, p.timeout, []Target{p.target}, p.relabelConfigs)
+}
+
+// NewTargetsGatherer returns a prometheus.Gatherer collecting metrics from the provided targets (e.g. created via
+// NewTargetFromDB) in parallel, with the given timeout, for applications embedding the exporter. Unlike with probes,
+// the targets are not closed after gathering.
+func NewTargetsGatherer(timeout time.Duration, targets ...Target) prometheus.Gatherer {
+	return &targetsGatherer{targets: targets, timeout: timeout}
+}
+
+// targetsGatherer is a prometheus.Gatherer collecting metrics from a fixed set of targets.
+type targetsGatherer struct {
+	targets []Target
+	timeout time.Duration
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *targetsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return g.gatherContext(context.Background())
+}
+
+// gatherContext implements contextGatherer.
+func (g *targetsGatherer) gatherContext(ctx context.Context) ([]*dto.MetricFamily, error) {
+	return gather(ctx, g.timeout, g.targets, nil)
+}
+
+// Reload implements Exporter.
+func (e *exporter) Reload() error {
+	if e.configFile == "" {
+		return ErrNoConfigFile
+	}
+	state, err := loadExporterState(e.logger, e.configFile)
+	if err != nil {
+		return err
+	}
+
+	e.watchCollectorFiles(state)
+	// Hold dynamicMu until the new state is in use, so targets added meanwhile aren't added to the old state only.
+	e.dynamicMu.Lock()
+	e.addDynamicTargets(state)
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		e.dynamicMu.Unlock()
+		state.close()
+		return ErrShutdown
+	}
+	oldState := e.state
+	e.state = state
+	e.mu.Unlock()
+	e.dynamicMu.Unlock()
+
+	// Let in-flight scrapes complete on the old targets, then close their DB handles.
+	go oldState.close()
+	return nil
+}
+
+// Shutdown implements Exporter.
+func (e *exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	state := e.state
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		state.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(e.abort)
+		return ctx.Err()
+	}
+}
+
+// watchCollectorFiles watches the local collector files of state's configuration for changes and periodically checks
+// its remote collector files that have a refresh interval, reloading the configuration when any changed. It must be
+// called before state is in use and stops once state is replaced.
+func (e *exporter) watchCollectorFiles(state *exporterState) {
+	ctx, cancel := context.WithCancel(context.Background())
+	state.stopWatching = cancel
+	if e.configFile == "" {
+		// Nothing to reload the configuration from.
+		return
+	}
+	e.watchLocalCollectorFiles(ctx, state)
+	for _, f := range state.config.CollectorFiles {
+		if f.URL == "" || f.RefreshInterval <= 0 {
+			continue
+		}
+		go func(f *config.CollectorFileConfig) {
+			ticker := time.NewTicker(time.Duration(f.RefreshInterval))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				changed, err := f.Changed(ctx)
+				if err != nil {
+					e.logger.Warn("Error checking for changes, keeping previous version", "url", f.URL, "err", err)
+					continue
+				}
+				if !changed {
+					continue
+				}
+				e.logger.Info("Collector file changed, reloading configuration", "url", f.URL)
+				if err := e.Reload(); err != nil {
+					e.logger.Error("Error reloading configuration, keeping previous one", "err", err)
+					continue
+				}
+				return
+			}
+		}(f)
+	}
+}
+
+// contextGatherer is a prometheus.Gatherer that can also gather metrics in a provided context.
+type contextGatherer interface {
+	gatherContext(ctx context.Context) ([]*dto.MetricFamily, error)
+}
+
+// WithCollectors returns a prometheus.Gatherer that behaves like the provided Exporter (or Gatherer returned by
+// Exporter.Probe()), except it only runs the named collectors. Jobs collecting in the background are not affected, as
+// their metrics have already been collected. If collectors is empty or g is any other kind of Gatherer, g is returned
+// as is.
+func WithCollectors(g prometheus.Gatherer, collectors []string) prometheus.Gatherer {
+	cg, ok := g.(contextGatherer)
+	if !ok || len(collectors) == 0 {
+		return g
+	}
+
+	filter := make(map[string]bool, len(collectors))
+	for _, name := range collectors {
+		filter[name] = true
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return cg.gatherContext(withCollectorFilter(context.Background(), filter))
+	})
 }
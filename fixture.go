@@ -0,0 +1,270 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fixtureTimeout bounds the collection of metrics from fixtures.
+const fixtureTimeout = time.Minute
+
+// Fixture is the canned result of a query, returned by the mock database CollectFixtures runs collectors against.
+type Fixture struct {
+	// Result sets returned by the query, usually one.
+	ResultSets []FixtureResultSet
+	// Error returned by the query instead, if set.
+	Err error
+}
+
+// FixtureResultSet is a result set returned by a Fixture.
+type FixtureResultSet struct {
+	Columns []string
+	// Rows of column values: nil for NULL, strings, numbers, booleans or times.
+	Rows [][]interface{}
+}
+
+// CollectFixtures runs the collector defined by cc once against a mock database returning the provided fixtures
+// instead of query results, and returns the collected metrics, with labels applied. Fixtures are keyed by query name
+// (metric name, for metrics defining their own query) or query text (e.g. for `when` queries). Queries without a
+// fixture fail.
+func CollectFixtures(
+	cc *config.CollectorConfig, labels map[string]string, fixtures map[string]*Fixture) ([]*dto.MetricFamily, error) {
+	constLabelPairs := make([]*dto.LabelPair, 0, len(labels))
+	for n, v := range labels {
+		constLabelPairs = append(constLabelPairs, &dto.LabelPair{
+			Name:  &n,
+			Value: &v,
+		})
+	}
+	sort.Sort(labelPairSorter(constLabelPairs))
+
+	c, err := NewCollector(nil, "fixture", cc, constLabelPairs, "fixture", "fixture")
+	if err != nil {
+		return nil, err
+	}
+	t := &fixtureTarget{
+		collector: c,
+		conn:      sql.OpenDB(&fixtureConnector{fixtures: map[string]map[string]*Fixture{cc.Name: fixtures}}),
+	}
+	defer t.Close()
+	return gather(context.Background(), fixtureTimeout, []Target{t}, nil)
+}
+
+// fixtureTarget is a Target running a single collector against a mock database.
+type fixtureTarget struct {
+	collector Collector
+	conn      *sql.DB
+}
+
+// Collect implements Target.
+func (t *fixtureTarget) Collect(ctx context.Context, ch chan<- Metric) {
+	t.collector.Collect(ctx, t.conn, ch)
+}
+
+// Close implements Target.
+func (t *fixtureTarget) Close() error {
+	return t.conn.Close()
+}
+
+// fixtureConnector is a driver.Connector for a mock database returning fixtures as query results. Fixtures are keyed
+// by collector name, then by query name or text.
+type fixtureConnector struct {
+	fixtures map[string]map[string]*Fixture
+}
+
+// Connect implements driver.Connector.
+func (c *fixtureConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fixtureConn{fixtures: c.fixtures}, nil
+}
+
+// Driver implements driver.Connector.
+func (c *fixtureConnector) Driver() driver.Driver {
+	return fixtureDriver{}
+}
+
+// fixtureDriver is the driver.Driver of fixtureConnector. It can only be used via the connector.
+type fixtureDriver struct{}
+
+// Open implements driver.Driver.
+func (fixtureDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fixture databases can only be opened via a connector")
+}
+
+// fixtureConn is a connection to a mock database returning fixtures as query results.
+type fixtureConn struct {
+	fixtures map[string]map[string]*Fixture
+}
+
+// Prepare implements driver.Conn.
+func (c *fixtureConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext implements driver.ConnPrepareContext. The collector and name of the query being prepared are taken
+// from ctx.
+func (c *fixtureConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	collector, name := fixtureQueryName(ctx)
+	return &fixtureStmt{conn: c, collector: collector, name: name, query: query}, nil
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *fixtureConn) QueryContext(
+	ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	collector, name := fixtureQueryName(ctx)
+	return c.query(collector, name, query)
+}
+
+// Close implements driver.Conn.
+func (c *fixtureConn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn.
+func (c *fixtureConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported by fixture databases")
+}
+
+// query returns the rows of the fixture for the named query of the named collector, falling back to the fixture for
+// the query text (of any collector, if the collector is not known).
+func (c *fixtureConn) query(collector, name, query string) (driver.Rows, error) {
+	name = strings.TrimSuffix(name, ".[literal]")
+	var f *Fixture
+	for coll, fixtures := range c.fixtures {
+		if collector != "" && coll != collector {
+			continue
+		}
+		if f = fixtures[name]; f == nil {
+			f = fixtures[query]
+		}
+		if f != nil {
+			break
+		}
+	}
+	if f == nil {
+		if name == "" {
+			return nil, fmt.Errorf("no fixture for query %q", query)
+		}
+		return nil, fmt.Errorf("no fixture for query %q", name)
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return &fixtureRows{resultSets: f.ResultSets}, nil
+}
+
+// fixtureQueryName returns the collector and name of the query executing in ctx, empty if unknown.
+func fixtureQueryName(ctx context.Context) (collector, name string) {
+	if m, ok := ctx.Value(queryMetricsKey{}).(*queryMetrics); ok {
+		return m.labels["collector"], m.labels["query"]
+	}
+	return "", ""
+}
+
+// fixtureStmt is a prepared statement of a fixtureConn.
+type fixtureStmt struct {
+	conn      *fixtureConn
+	collector string
+	name      string
+	query     string
+}
+
+// Close implements driver.Stmt.
+func (s *fixtureStmt) Close() error {
+	return nil
+}
+
+// NumInput implements driver.Stmt.
+func (s *fixtureStmt) NumInput() int {
+	return -1
+}
+
+// Exec implements driver.Stmt.
+func (s *fixtureStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("statements are not supported by fixture databases")
+}
+
+// Query implements driver.Stmt.
+func (s *fixtureStmt) Query([]driver.Value) (driver.Rows, error) {
+	return s.conn.query(s.collector, s.name, s.query)
+}
+
+// fixtureRows iterates over the result sets of a Fixture.
+type fixtureRows struct {
+	resultSets []FixtureResultSet
+	resultSet  int
+	row        int
+}
+
+// Columns implements driver.Rows.
+func (r *fixtureRows) Columns() []string {
+	if r.resultSet >= len(r.resultSets) {
+		return nil
+	}
+	return r.resultSets[r.resultSet].Columns
+}
+
+// Close implements driver.Rows.
+func (r *fixtureRows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows.
+func (r *fixtureRows) Next(dest []driver.Value) error {
+	if r.resultSet >= len(r.resultSets) || r.row >= len(r.resultSets[r.resultSet].Rows) {
+		return io.EOF
+	}
+	rs := r.resultSets[r.resultSet]
+	row := rs.Rows[r.row]
+	r.row++
+	if len(row) != len(rs.Columns) {
+		return fmt.Errorf("fixture row %d has %d value(s), expecting %d", r.row, len(row), len(rs.Columns))
+	}
+	for i, value := range row {
+		dest[i] = fixtureValue(value)
+	}
+	return nil
+}
+
+// HasNextResultSet implements driver.RowsNextResultSet.
+func (r *fixtureRows) HasNextResultSet() bool {
+	return r.resultSet+1 < len(r.resultSets)
+}
+
+// NextResultSet implements driver.RowsNextResultSet.
+func (r *fixtureRows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+	r.resultSet++
+	r.row = 0
+	return nil
+}
+
+// fixtureValue converts a fixture column value to a driver.Value.
+func fixtureValue(value interface{}) driver.Value {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
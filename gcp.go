@@ -0,0 +1,58 @@
+package sql_exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// newGCPTokenSource returns a token source for the given scopes, using the service account key in credentialsFile if
+// not empty or Application Default Credentials otherwise.
+func newGCPTokenSource(ctx context.Context, credentialsFile string, scopes ...string) (oauth2.TokenSource, error) {
+	if credentialsFile == "" {
+		return google.DefaultTokenSource(ctx, scopes...)
+	}
+	buf, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, buf, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// gcpInstanceMetadata returns the identity of the GCE instance the exporter runs on, as label reference fields.
+func gcpInstanceMetadata(ctx context.Context) (map[string]string, error) {
+	timeout := labelMetadataTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	client := metadata.NewClient(&http.Client{Timeout: timeout})
+	fields := make(map[string]string, 5)
+	for name, get := range map[string]func() (string, error){
+		"instance_id":   client.InstanceID,
+		"instance_name": client.InstanceName,
+		"project_id":    client.ProjectID,
+		"zone":          client.Zone,
+	} {
+		value, err := get()
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = value
+	}
+	// Zones are named after their region, e.g. `us-central1-a`.
+	if i := strings.LastIndex(fields["zone"], "-"); i > 0 {
+		fields["region"] = fields["zone"][:i]
+	}
+	return fields, nil
+}
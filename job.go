@@ -1,56 +1,629 @@
 package sql_exporter
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/free/sql_exporter/config"
+	"github.com/go-sql-driver/mysql"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Job is a collection of targets with the same collectors applied.
 type Job interface {
+	// Targets returns the job's current targets, which may change over time if the job uses target discovery.
 	Targets() []Target
+	// Close closes all of the job's targets.
+	Close()
 }
 
-// job implements Job. It wraps the corresponding JobConfig and a set of Targets.
+// job implements Job. It wraps the corresponding JobConfig and a set of Targets, statically defined and/or discovered.
 type job struct {
-	config     *config.JobConfig
-	targets    []Target
-	logContext string
+	config      *config.JobConfig
+	logContext  string
+	logger      *slog.Logger
+	discoveries []discovery
+
+	// Protects static, targets, specs and discovered, which change as targets are discovered or secrets change.
+	mu sync.RWMutex
+	// The static targets, with secrets resolved, and their definitions, indexed like static.
+	static        []targetSpec
+	staticSources []staticSource
+	targets       map[string]Target
+	specs         map[string]targetSpec
+	// The latest targets returned by each discovery, indexed like discoveries.
+	discovered [][]targetSpec
+	// Targets added at runtime, via Exporter.AddTarget(), by name.
+	dynamic map[string]targetSpec
+	// Collector configs replacing the job's own, by name, after collector files changed.
+	replacedCollectors map[string]*config.CollectorConfig
+
+	// Stops the discovery goroutines, if any.
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// staticSource is the definition of a static target, from which its spec is rebuilt when its secrets change.
+type staticSource struct {
+	config  *config.StaticConfig
+	name    string
+	dsn     string // may contain secret references
+	secrets bool   // whether the DSN or data source config reference any secrets
 }
 
-// NewJob returns a new Job with the given configuration.
-func NewJob(jc *config.JobConfig) (Job, error) {
+// NewJob returns a new Job with the given configuration. If the job defines any target discovery, targets are
+// discovered once before returning and periodically refreshed in the background afterwards. Likewise, secrets
+// referenced by static targets are periodically fetched again and targets recreated if they changed. The job, its
+// targets and their collectors log to logger.
+func NewJob(logger *slog.Logger, jc *config.JobConfig) (Job, error) {
 	j := job{
 		config:     jc,
-		targets:    make([]Target, 0, 10),
 		logContext: fmt.Sprintf("job=%q", jc.Name),
+		logger:     orDefaultLogger(logger).With("job", jc.Name),
+		targets:    make(map[string]Target, 10),
+		specs:      make(map[string]targetSpec, 10),
 	}
 
+	hasSecrets := false
 	for _, sc := range jc.StaticConfigs {
 		for tname, dsn := range sc.Targets {
-			constLabels := prometheus.Labels{
-				"job":      jc.Name,
-				"instance": tname,
-			}
-			for name, value := range sc.Labels {
-				// Shouldn't happen as there are sanity checks in config, but check nonetheless.
-				if _, found := constLabels[name]; found {
-					return nil, fmt.Errorf("[%s] duplicate label %q", j.logContext, name)
-				}
-				constLabels[name] = value
-			}
-			t, err := NewTarget(j.logContext, tname, dsn, jc.Collectors(), constLabels)
+			spec, err := j.staticSpec(context.Background(), sc, tname, dsn)
 			if err != nil {
+				j.Close()
 				return nil, err
 			}
-			j.targets = append(j.targets, t)
+			t, err := j.newJobTarget(spec)
+			if err != nil {
+				j.Close()
+				return nil, err
+			}
+			j.static = append(j.static, spec)
+			src := staticSource{config: sc, name: tname, dsn: dsn}
+			src.secrets = hasSecretRefs(dsn) || dataSourceHasSecretRefs(sc.DataSource(tname))
+			j.staticSources = append(j.staticSources, src)
+			j.targets[tname] = t
+			j.specs[tname] = spec
+			hasSecrets = hasSecrets || src.secrets
 		}
 	}
 
+	var err error
+	if j.discoveries, err = newDiscoveries(j.logger, j.logContext, jc); err != nil {
+		j.Close()
+		return nil, err
+	}
+	if len(j.discoveries) == 0 && !hasSecrets {
+		return &j, nil
+	}
+
+	var ctx context.Context
+	ctx, j.cancel = context.WithCancel(context.Background())
+	if len(j.discoveries) > 0 {
+		j.discovered = make([][]targetSpec, len(j.discoveries))
+		for i := range j.discoveries {
+			j.refresh(ctx, i, initialDiscoveryTimeout)
+		}
+		j.update()
+		for i := range j.discoveries {
+			j.done.Add(1)
+			go j.runDiscovery(ctx, i)
+		}
+	}
+	if hasSecrets {
+		j.done.Add(1)
+		go j.runSecretRefresh(ctx)
+	}
+
 	return &j, nil
 }
 
+// newJobTarget creates a Target from the provided spec, collecting in the background if the job has an interval. The
+// caller must hold mu, unless the job is not in use yet.
+func (j *job) newJobTarget(spec targetSpec) (Target, error) {
+	ccs := spec.collectors
+	if ccs == nil {
+		ccs = j.config.Collectors()
+	}
+	if len(j.replacedCollectors) > 0 {
+		replaced := make([]*config.CollectorConfig, len(ccs))
+		for i, cc := range ccs {
+			replaced[i] = cc
+			if r, found := j.replacedCollectors[cc.Name]; found {
+				replaced[i] = r
+			}
+		}
+		ccs = replaced
+	}
+	t, err := j.newTarget(spec, ccs)
+	if err != nil {
+		return nil, err
+	}
+	if interval := time.Duration(j.config.Interval); interval > 0 {
+		var offset time.Duration
+		if j.config.IntervalSpread {
+			offset = scheduleOffset(j.config.Name, spec.name, interval)
+		}
+		t = newScheduledTarget(t, interval, time.Duration(j.config.IntervalJitter), offset)
+	}
+	return t, nil
+}
+
+// collectorReplacer is implemented by targets able to replace their collectors in place.
+type collectorReplacer interface {
+	// replaceCollectors rebuilds the target's collectors named like any of the replacement configs in ccs.
+	replaceCollectors(ccs map[string]*config.CollectorConfig) error
+}
+
+// replaceCollectors replaces the job's collectors named like any of the configs in ccs, for current and future targets,
+// without recreating the targets (and their database handles).
+func (j *job) replaceCollectors(ccs map[string]*config.CollectorConfig) error {
+	j.mu.Lock()
+	if j.replacedCollectors == nil {
+		j.replacedCollectors = make(map[string]*config.CollectorConfig, len(ccs))
+	}
+	for name, cc := range ccs {
+		j.replacedCollectors[name] = cc
+	}
+	targets := make([]Target, 0, len(j.targets))
+	for _, t := range j.targets {
+		targets = append(targets, t)
+	}
+	j.mu.Unlock()
+
+	// Replacing waits for any in-flight collection, so don't hold up scrapes or target updates meanwhile.
+	for _, t := range targets {
+		if r, ok := t.(collectorReplacer); ok {
+			if err := r.replaceCollectors(ccs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runDiscovery periodically refreshes the targets of the i-th discovery, until ctx is canceled.
+func (j *job) runDiscovery(ctx context.Context, i int) {
+	defer j.done.Done()
+
+	interval := j.discoveries[i].refreshInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if j.refresh(ctx, i, interval) {
+				j.update()
+			}
+		}
+	}
+}
+
+// refresh runs the i-th discovery with the given timeout and records its results. On failure it logs the error, keeps
+// the previously discovered targets and returns false.
+func (j *job) refresh(ctx context.Context, i int, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	specs, err := j.discoveries[i].discover(ctx)
+	if err != nil {
+		j.logger.Error("Target discovery failed", "err", err)
+		return false
+	}
+	for k := range specs {
+		// Keep the previously discovered targets rather than drop them when a secret store is unavailable.
+		if specs[k].dsn, err = resolveSecrets(ctx, specs[k].dsn); err != nil {
+			j.logger.Error("Target discovery failed", "target", specs[k].name, "err", err)
+			return false
+		}
+	}
+	j.mu.Lock()
+	j.discovered[i] = specs
+	j.mu.Unlock()
+	return true
+}
+
+// runSecretRefresh periodically rebuilds the specs of static targets referencing secrets, until ctx is canceled.
+// Targets whose secrets changed are recreated, with new database handles.
+func (j *job) runSecretRefresh(ctx context.Context) {
+	defer j.done.Done()
+
+	ticker := time.NewTicker(secretRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed := false
+		for i, src := range j.staticSources {
+			if !src.secrets {
+				continue
+			}
+			spec, err := j.staticSpec(ctx, src.config, src.name, src.dsn)
+			if err != nil {
+				j.logger.Error("Error refreshing secrets", "target", src.name, "err", err)
+				continue
+			}
+			j.mu.Lock()
+			if !spec.equal(j.static[i]) {
+				j.logger.Info("Secrets of target changed", "target", spec.name)
+				j.static[i] = spec
+				changed = true
+			}
+			j.mu.Unlock()
+		}
+		if changed {
+			j.update()
+		}
+	}
+}
+
+// update reconciles the job's targets with the static and latest discovered targets: new targets are created, changed
+// ones are replaced and targets that are no longer present are closed.
+func (j *job) update() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	desired := make(map[string]targetSpec, len(j.specs))
+	for _, spec := range j.static {
+		desired[spec.name] = spec
+	}
+	for _, spec := range j.dynamic {
+		desired[spec.name] = spec
+	}
+	for _, specs := range j.discovered {
+		for _, spec := range specs {
+			if _, found := desired[spec.name]; found {
+				j.logger.Warn("Ignoring discovered target, a target with the same name already exists",
+					"target", spec.name)
+				continue
+			}
+			desired[spec.name] = spec
+		}
+	}
+
+	for name, t := range j.targets {
+		if spec, found := desired[name]; !found || !spec.equal(j.specs[name]) {
+			j.logger.Info("Removing target", "target", name)
+			delete(j.targets, name)
+			delete(j.specs, name)
+			// Closing waits for any in-flight collection, so don't hold up the update.
+			go t.Close()
+		}
+	}
+	for name, spec := range desired {
+		if _, found := j.targets[name]; found {
+			continue
+		}
+		t, err := j.newJobTarget(spec)
+		if err != nil {
+			j.logger.Error("Error creating discovered target", "target", spec.name, "err", err)
+			continue
+		}
+		j.logger.Info("Adding target", "target", spec.name)
+		j.targets[name] = t
+		j.specs[name] = spec
+	}
+}
+
+// addTarget adds a target to the job at runtime, replacing any target previously added under the same name. Targets
+// defined by the configuration or discovered cannot be replaced.
+func (j *job) addTarget(spec targetSpec) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, found := j.dynamic[spec.name]; !found {
+		if _, found := j.targets[spec.name]; found {
+			return fmt.Errorf("%w: %q in job %q", ErrTargetExists, spec.name, j.config.Name)
+		}
+	}
+	t, err := j.newJobTarget(spec)
+	if err != nil {
+		return err
+	}
+	if old, found := j.targets[spec.name]; found {
+		j.logger.Info("Replacing target", "target", spec.name)
+		// Closing waits for any in-flight collection, so don't hold up the update.
+		go old.Close()
+	} else {
+		j.logger.Info("Adding target", "target", spec.name)
+	}
+	if j.dynamic == nil {
+		j.dynamic = make(map[string]targetSpec)
+	}
+	j.dynamic[spec.name] = spec
+	j.targets[spec.name] = t
+	j.specs[spec.name] = spec
+	return nil
+}
+
+// removeTarget removes a target previously added to the job at runtime.
+func (j *job) removeTarget(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, found := j.dynamic[name]; !found {
+		return fmt.Errorf("%w: %q in job %q", ErrUnknownTarget, name, j.config.Name)
+	}
+	j.logger.Info("Removing target", "target", name)
+	delete(j.dynamic, name)
+	if t, found := j.targets[name]; found {
+		delete(j.targets, name)
+		delete(j.specs, name)
+		go t.Close()
+	}
+	return nil
+}
+
+// NewProbeTarget returns a new Target created on the fly from the given job's configuration, for use by the `/probe`
+// endpoint. target is either the name of a target statically defined by the job or a data source name allowed by the
+// job's probe_dsns (if any). If ccs is empty, the target's collectors (if it overrides them) or else the job's
+// collectors are used.
+func NewProbeTarget(logger *slog.Logger, jc *config.JobConfig, target string, ccs []*config.CollectorConfig) (
+	Target, error) {
+	j := job{
+		config:     jc,
+		logContext: fmt.Sprintf("job=%q", jc.Name),
+		logger:     orDefaultLogger(logger).With("job", jc.Name),
+	}
+	for _, sc := range jc.StaticConfigs {
+		if dsn, found := sc.Targets[target]; found {
+			spec, err := j.staticSpec(context.Background(), sc, target, dsn)
+			if err != nil {
+				return nil, err
+			}
+			if len(ccs) == 0 {
+				ccs = spec.collectors
+			}
+			if len(ccs) == 0 {
+				ccs = jc.Collectors()
+			}
+			return j.newTarget(spec, ccs)
+		}
+	}
+	if len(ccs) == 0 {
+		ccs = jc.Collectors()
+	}
+	if !strings.Contains(target, "://") {
+		return nil, fmt.Errorf("[%s] unknown target %q", j.logContext, target)
+	}
+	// Never connect to arbitrary databases on request, unless explicitly allowed.
+	if jc.ProbeDSNs == nil {
+		return nil, fmt.Errorf("[%s] unknown target %q, probing data source names requires probe_dsns", j.logContext,
+			instanceFromDSN(target))
+	}
+	if !jc.ProbeDSNs.Allows(dsnDriver(target), dsnHost(target), dsnParams(target)) {
+		return nil, fmt.Errorf("[%s] data source name %q not allowed by probe_dsns", j.logContext,
+			instanceFromDSN(target))
+	}
+	return j.newTarget(targetSpec{name: instanceFromDSN(target), dsn: target}, ccs)
+}
+
+// staticSpec returns the spec of a target defined by the provided static config, resolving any secret references in
+// its data source name or data source config and any references in its label values.
+func (j *job) staticSpec(ctx context.Context, sc *config.StaticConfig, tname, dsn string) (targetSpec, error) {
+	var err error
+	if ds := sc.DataSource(tname); ds != nil {
+		// Resolve secrets field by field, before assembling (and escaping) the DSN.
+		dsn, err = ds.DSN(func(s string) (string, error) { return resolveSecrets(ctx, s) })
+	} else {
+		dsn, err = resolveSecrets(ctx, dsn)
+	}
+	if err != nil {
+		return targetSpec{}, fmt.Errorf("[%s, target=%q] %s", j.logContext, tname, err)
+	}
+	labels, err := resolveLabels(ctx, sc.Labels)
+	if err != nil {
+		return targetSpec{}, fmt.Errorf("[%s, target=%q] %s", j.logContext, tname, err)
+	}
+	spec := targetSpec{
+		name:       tname,
+		dsn:        dsn,
+		labels:     labels,
+		tls:        sc.TLS(tname),
+		params:     sc.Params(tname),
+		collectors: sc.Collectors(tname),
+	}
+	if st := sc.SSHTunnel(tname); st != nil {
+		tunnel, key := getSSHTunnel(st)
+		spec.dial = tunnel.dial
+		spec.dialKey = "ssh:" + key
+	}
+	if u := sc.ProxyURL(tname); u != nil {
+		if spec.dial, err = newProxyDialFunc(u); err != nil {
+			return targetSpec{}, fmt.Errorf("[%s, target=%q] %s", j.logContext, tname, err)
+		}
+		spec.dialKey = "proxy:" + u.String()
+	}
+	if auth := sc.Auth(tname); auth != nil {
+		if err := spec.setAuth(auth); err != nil {
+			return targetSpec{}, fmt.Errorf("[%s, target=%q] %s", j.logContext, tname, err)
+		}
+	}
+	return spec, nil
+}
+
+// newTarget creates a Target belonging to the job from the provided spec, with the provided collectors.
+func (j *job) newTarget(spec targetSpec, ccs []*config.CollectorConfig) (Target, error) {
+	constLabels := prometheus.Labels{
+		"job":      j.config.Name,
+		"instance": spec.name,
+	}
+	for name, value := range spec.labels {
+		// Shouldn't happen as there are sanity checks in config, but check nonetheless.
+		if _, found := constLabels[name]; found {
+			return nil, fmt.Errorf("[%s] duplicate label %q", j.logContext, name)
+		}
+		constLabels[name] = value
+	}
+	dsn := spec.dsn
+	if spec.tls != nil {
+		var err error
+		if dsn, err = withTLS(dsn, spec.tls); err != nil {
+			return nil, fmt.Errorf("[%s, target=%q] %s", j.logContext, spec.name, err)
+		}
+	}
+	if ia := j.config.IntegratedAuth; ia != nil {
+		var err error
+		if dsn, err = withIntegratedAuth(dsn, ia); err != nil {
+			return nil, fmt.Errorf("[%s, target=%q] %s", j.logContext, spec.name, err)
+		}
+	}
+	crdb := j.config.CockroachDB
+	if crdb != nil && crdb.FollowerReads && isPostgresDSN(dsn) {
+		var err error
+		if dsn, err = withFollowerReads(dsn); err != nil {
+			return nil, fmt.Errorf("[%s, target=%q] %s", j.logContext, spec.name, err)
+		}
+	}
+	t, err := newTarget(j.logger, j.logContext, spec.name, dsn, ccs, constLabels)
+	if err != nil {
+		return nil, err
+	}
+	t.hooks = connectHooks{dial: spec.dial, password: spec.password, accessToken: spec.accessToken}
+	t.vars = j.config.Vars
+	if len(j.config.Params) > 0 || len(spec.params) > 0 {
+		t.params = make(map[string]string, len(j.config.Params)+len(spec.params))
+		for name, value := range j.config.Params {
+			t.params[name] = value
+		}
+		for name, value := range spec.params {
+			t.params[name] = value
+		}
+	}
+	if crdb != nil {
+		t.serializationRetries = crdb.SerializationRetries
+	}
+	if cb := j.config.CircuitBreaker; cb != nil {
+		t.breaker = newCircuitBreaker(cb.FailureThreshold, time.Duration(cb.Cooldown))
+	}
+	if n := j.config.MaxParallelCollectors; n > 0 {
+		t.collectorSem = make(chan struct{}, n)
+	}
+	return t, nil
+}
+
+// Targets implements Job.
 func (j *job) Targets() []Target {
-	return j.targets
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	names := make([]string, 0, len(j.targets))
+	for name := range j.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	targets := make([]Target, 0, len(names))
+	for _, name := range names {
+		targets = append(targets, j.targets[name])
+	}
+	return targets
+}
+
+// target returns the job's current target with the given name, nil if not found (or j is nil).
+func (j *job) target(name string) Target {
+	if j == nil {
+		return nil
+	}
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.targets[name]
+}
+
+// Close implements Job.
+func (j *job) Close() {
+	if j.cancel != nil {
+		j.cancel()
+		j.done.Wait()
+	}
+	for _, d := range j.discoveries {
+		if c, ok := d.discoverer.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				j.logger.Warn("Error closing target discovery", "err", err)
+			}
+		}
+	}
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	for _, t := range j.targets {
+		if err := t.Close(); err != nil {
+			j.logger.Warn("Error closing target", "err", err)
+		}
+	}
+}
+
+// hostPattern matches valid host names and IP addresses.
+var hostPattern = regexp.MustCompile(`^[A-Za-z0-9.:%-]+$`)
+
+// dsnHost returns the host a data source name points to (as the driver would connect to it), or an empty string if
+// there is none (e.g. SQLite files or Unix sockets) or it cannot be determined reliably (e.g. ODBC connection strings
+// or multiple hosts).
+func dsnHost(dsn string) string {
+	var host string
+	if dsnDriver(dsn) == "mysql" {
+		cfg, err := mysql.ParseDSN(strings.TrimPrefix(dsn, "mysql://"))
+		if err != nil || cfg.Net != "tcp" {
+			return ""
+		}
+		if host, _, err = net.SplitHostPort(cfg.Addr); err != nil {
+			return ""
+		}
+	} else {
+		u, err := url.Parse(dsn)
+		if err != nil || u.Opaque != "" {
+			return ""
+		}
+		host = u.Hostname()
+	}
+	if !hostPattern.MatchString(host) {
+		return ""
+	}
+	return host
+}
+
+// dsnParams returns the names of the parameters of a data source name, i.e. the keys of its query string.
+func dsnParams(dsn string) []string {
+	idx := strings.Index(dsn, "?")
+	if idx == -1 {
+		return nil
+	}
+	params, err := url.ParseQuery(dsn[idx+1:])
+	if err != nil {
+		// Unparseable, so not allowed.
+		return []string{dsn[idx+1:]}
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	return names
+}
+
+// instanceFromDSN derives an instance name from a data source name, by stripping any credentials and parameters.
+func instanceFromDSN(dsn string) string {
+	var scheme string
+	if idx := strings.Index(dsn, "://"); idx != -1 {
+		scheme, dsn = dsn[:idx+3], dsn[idx+3:]
+	}
+	if idx := strings.LastIndex(dsn, "@"); idx != -1 {
+		dsn = dsn[idx+1:]
+	}
+	if idx := strings.Index(dsn, "?"); idx != -1 {
+		dsn = dsn[:idx]
+	}
+	return scheme + dsn
 }
@@ -0,0 +1,103 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// labelMetadataTimeout bounds the fetching of instance metadata from a cloud provider's metadata service.
+const labelMetadataTimeout = 5 * time.Second
+
+// labelRef matches references embedded in static label values, e.g. `${env:POD_NAMESPACE}`, `${hostname}` or
+// `${aws:region}`.
+var labelRef = regexp.MustCompile(`\$\{([a-z]+)(?::([^}]*))?\}`)
+
+// instanceMetadataProviders maps the cloud provider names used in label references to functions fetching the metadata
+// of the instance the exporter runs on, keyed by field name.
+var instanceMetadataProviders = map[string]func(ctx context.Context) (map[string]string, error){
+	"aws":   awsInstanceMetadata,
+	"gcp":   gcpInstanceMetadata,
+	"azure": azureInstanceMetadata,
+}
+
+// instanceMetadata caches instance metadata by cloud provider name, as it does not change over the process lifetime.
+var instanceMetadata = struct {
+	mu     sync.Mutex
+	values map[string]map[string]string
+}{values: make(map[string]map[string]string)}
+
+// resolveLabels returns a copy of labels with the references embedded in their values replaced by the referenced
+// values: `${env:<NAME>}` by the value of an environment variable, `${hostname}` by the host name and e.g.
+// `${aws:instance_id}` by a field of the instance metadata of the respective cloud provider.
+func resolveLabels(ctx context.Context, labels map[string]string) (map[string]string, error) {
+	var resolved map[string]string
+	for name, value := range labels {
+		if !labelRef.MatchString(value) {
+			continue
+		}
+		if resolved == nil {
+			resolved = make(map[string]string, len(labels))
+			for n, v := range labels {
+				resolved[n] = v
+			}
+		}
+
+		var err error
+		resolved[name] = labelRef.ReplaceAllStringFunc(value, func(match string) string {
+			if err != nil {
+				return ""
+			}
+			m := labelRef.FindStringSubmatch(match)
+			var v string
+			v, err = resolveLabelRef(ctx, m[1], m[2])
+			return v
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s in value of label %q: %s", value, name, err)
+		}
+	}
+	if resolved == nil {
+		return labels, nil
+	}
+	return resolved, nil
+}
+
+// resolveLabelRef returns the value referenced by `${<source>:<key>}`.
+func resolveLabelRef(ctx context.Context, source, key string) (string, error) {
+	switch source {
+	case "env":
+		value, found := os.LookupEnv(key)
+		if !found {
+			return "", fmt.Errorf("environment variable %q not set", key)
+		}
+		return value, nil
+	case "hostname":
+		return os.Hostname()
+	}
+
+	fetch, found := instanceMetadataProviders[source]
+	if !found {
+		return "", fmt.Errorf("unknown label value source %q, expecting env, hostname, aws, gcp or azure", source)
+	}
+	instanceMetadata.mu.Lock()
+	defer instanceMetadata.mu.Unlock()
+	fields, found := instanceMetadata.values[source]
+	if !found {
+		ctx, cancel := context.WithTimeout(ctx, labelMetadataTimeout)
+		defer cancel()
+		var err error
+		if fields, err = fetch(ctx); err != nil {
+			return "", fmt.Errorf("error fetching %s instance metadata: %s", source, err)
+		}
+		instanceMetadata.values[source] = fields
+	}
+	value, found := fields[key]
+	if !found {
+		return "", fmt.Errorf("unknown %s instance metadata field %q", source, key)
+	}
+	return value, nil
+}
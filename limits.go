@@ -0,0 +1,95 @@
+package sql_exporter
+
+import (
+	"log/slog"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var seriesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_series_dropped_total",
+	Help: "Total number of series dropped by label value filters (reason=\"filtered\") or max_series limits " +
+		"(reason=\"max_series\").",
+}, []string{"job", "target", "collector", "metric", "reason"})
+
+func init() {
+	prometheus.MustRegister(seriesDropped)
+}
+
+// seriesLimiter applies a metric family's label value filters and limits the number of series it exports per
+// collection.
+type seriesLimiter struct {
+	allow     map[string]*regexp.Regexp
+	deny      map[string]*regexp.Regexp
+	maxSeries int
+
+	filtered prometheus.Counter
+	limited  prometheus.Counter
+	logger   *slog.Logger
+
+	mu sync.Mutex
+	// Number of series admitted since the last reset.
+	count int
+}
+
+// newSeriesLimiter returns a seriesLimiter for the given label filters and limit (if positive), counting dropped
+// series under the provided labels (job, target, collector and metric).
+func newSeriesLimiter(logger *slog.Logger, allow, deny map[string]*regexp.Regexp, maxSeries int,
+	labels prometheus.Labels) *seriesLimiter {
+	filteredLabels := prometheus.Labels{"reason": "filtered"}
+	limitedLabels := prometheus.Labels{"reason": "max_series"}
+	for name, value := range labels {
+		filteredLabels[name] = value
+		limitedLabels[name] = value
+	}
+	return &seriesLimiter{
+		allow:     allow,
+		deny:      deny,
+		maxSeries: maxSeries,
+		filtered:  seriesDropped.With(filteredLabels),
+		limited:   seriesDropped.With(limitedLabels),
+		logger:    logger,
+	}
+}
+
+// reset resets the series count, at the start of a collection.
+func (l *seriesLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count = 0
+}
+
+// admit returns true if a series with the given labels is to be exported: if its label values are allowed and not
+// denied by the filters and the limit has not been reached yet.
+func (l *seriesLimiter) admit(labelPairs []*dto.LabelPair) bool {
+	for _, lp := range labelPairs {
+		if re, found := l.allow[lp.GetName()]; found && !re.MatchString(lp.GetValue()) {
+			l.filtered.Inc()
+			return false
+		}
+		if re, found := l.deny[lp.GetName()]; found && re.MatchString(lp.GetValue()) {
+			l.filtered.Inc()
+			return false
+		}
+	}
+	if l.maxSeries <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count >= l.maxSeries {
+		if l.count == l.maxSeries {
+			l.logger.Warn("More series than max_series collected, dropping the rest", "max_series", l.maxSeries)
+			// Only log once per collection.
+			l.count++
+		}
+		l.limited.Inc()
+		return false
+	}
+	l.count++
+	return true
+}
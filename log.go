@@ -0,0 +1,30 @@
+package sql_exporter
+
+import (
+	"context"
+	"log/slog"
+)
+
+// orDefaultLogger returns logger, or the default slog logger if nil.
+func orDefaultLogger(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// loggerKey is the context key under which the logger of the target being collected from is stored.
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying logger, for code without a logger of its own (e.g. drivers) to log to.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFromContext returns the logger carried by ctx, or the default slog logger if none.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -1,8 +1,16 @@
 package sql_exporter
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/golang/protobuf/proto"
@@ -30,11 +38,67 @@ type MetricFamily struct {
 	constLabels []*dto.LabelPair
 	labels      []string
 	logContext  string
+	logger      *slog.Logger
+
+	// Histogram only: bucket columns, sorted by upper bound.
+	bucketColumns []string
+	// Histogram only: the schema of the native histogram, nil unless exposed as a native histogram.
+	native *nativeSchema
+	// Counter only: tracks previous values to handle resets, nil unless enabled.
+	counters *counterTracker
+	// Label filters and series limit, nil if neither is configured.
+	limits *seriesLimiter
 }
 
 // NewMetricFamily creates a new MetricFamily with the given metric config and const labels (e.g. job and instance).
-func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair) (*MetricFamily, error) {
+func NewMetricFamily(logger *slog.Logger, logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair) (
+	*MetricFamily, error) {
 	logContext = fmt.Sprintf("%s, metric=%q", logContext, mc.Name)
+	logger = orDefaultLogger(logger).With("metric", mc.Name)
+
+	if mc.Histogram() {
+		bucketColumns := make([]string, 0, len(mc.Buckets))
+		for column := range mc.Buckets {
+			bucketColumns = append(bucketColumns, column)
+		}
+		sort.Slice(bucketColumns, func(i, j int) bool {
+			return mc.Buckets[bucketColumns[i]] < mc.Buckets[bucketColumns[j]]
+		})
+		var native *nativeSchema
+		if mc.Native() {
+			native = newNativeSchema(mc.NativeHistogramBucketFactor)
+		}
+		return &MetricFamily{
+			config:        mc,
+			constLabels:   constLabels,
+			labels:        mc.KeyLabels,
+			logContext:    logContext,
+			logger:        logger,
+			bucketColumns: bucketColumns,
+			native:        native,
+		}, nil
+	}
+
+	if mc.Stateset() {
+		labels := make([]string, 0, len(mc.KeyLabels)+1)
+		labels = append(labels, mc.KeyLabels...)
+		return &MetricFamily{
+			config:      mc,
+			constLabels: constLabels,
+			labels:      append(labels, mc.StateLabel()),
+			logContext:  logContext,
+			logger:      logger,
+		}, nil
+	}
+	if mc.Info() {
+		return &MetricFamily{
+			config:      mc,
+			constLabels: constLabels,
+			labels:      mc.KeyLabels,
+			logContext:  logContext,
+			logger:      logger,
+		}, nil
+	}
 
 	if len(mc.Values) == 0 {
 		return nil, fmt.Errorf("[%s] no value column defined", logContext)
@@ -54,22 +118,450 @@ func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*
 		constLabels: constLabels,
 		labels:      labels,
 		logContext:  logContext,
+		logger:      logger,
 	}, nil
 }
 
 // Collect is the equivalent of prometheus.Collector.Collect() but takes a Query output map to populate values from.
+// NULL values (nil in the map) are handled according to the metric's null_label and null_value policies. Histograms
+// populated from an observation column span multiple rows and are not collected.
 func (mf MetricFamily) Collect(row map[string]interface{}, ch chan<- Metric) {
+	mf.collectRow(row, nil, ch)
+}
+
+// collectRow implements Collect, accumulating observations into run (if not nil) for the duration of a query run.
+func (mf MetricFamily) collectRow(row map[string]interface{}, run *queryRun, ch chan<- Metric) {
+	var (
+		ts time.Time
+		ex *dto.Exemplar
+	)
+	emit := func(m Metric) {
+		if _, invalid := m.(invalidMetric); invalid {
+			run.markIncomplete()
+		}
+		mf.emit(m, ts, ex, ch)
+	}
+	if mf.config.JSONColumn != "" {
+		var err error
+		if row, err = mf.expandJSON(row); err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+	}
+
+	if mf.config.TimestampColumn != "" {
+		var err error
+		ts, err = mf.timestamp(row)
+		switch {
+		case err != nil:
+			mf.collectError(err, emit)
+			return
+		case ts.IsZero():
+			// NULL timestamp, leave it to the scrape time.
+		case mf.config.MaxAge > 0 && time.Since(ts) > time.Duration(mf.config.MaxAge):
+			mf.logger.Debug("Dropping row with stale timestamp", "timestamp", ts)
+			return
+		}
+	}
+	if len(mf.config.ExemplarLabels) > 0 {
+		ex = mf.exemplar(row)
+	}
+	mf.collect(row, run, emit)
+}
+
+// emit passes a collected metric on to ch, with the given timestamp (unless zero) and exemplar (unless nil), after
+// applying the metric's label filters and series limit and tracking counter resets.
+func (mf MetricFamily) emit(m Metric, ts time.Time, ex *dto.Exemplar, ch chan<- Metric) {
+	var labelPairs []*dto.LabelPair
+	switch m := m.(type) {
+	case *constMetric:
+		labelPairs = m.labelPairs
+	case *constHistogram:
+		labelPairs = m.labelPairs
+	default:
+		// Invalid metric.
+		ch <- m
+		return
+	}
+
+	if mf.limits != nil && !mf.limits.admit(labelPairs) {
+		return
+	}
+	if cm, ok := m.(*constMetric); ok && mf.counters != nil {
+		mf.counters.track(cm)
+	}
+	if ex != nil {
+		switch m := m.(type) {
+		case *constMetric:
+			// Without an exemplar value column, the exemplar value is the counter value.
+			value := ex.Value
+			if value == nil {
+				value = proto.Float64(m.val)
+			}
+			m.exemplar = &dto.Exemplar{Label: ex.Label, Value: value}
+		case *constHistogram:
+			m.setExemplar(ex)
+		}
+	}
+	if !ts.IsZero() {
+		m = NewMetricWithTimestamp(ts, m)
+	}
+	ch <- m
+}
+
+// collect populates the metric family from a row, passing the collected metrics to emit.
+func (mf MetricFamily) collect(row map[string]interface{}, run *queryRun, emit func(Metric)) {
 	labelValues := make([]string, len(mf.labels))
 	for i, label := range mf.config.KeyLabels {
-		labelValues[i] = row[label].(string)
+		value, err := mf.labelValue(row, label)
+		if err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+		labelValues[i] = value
+	}
+	if mf.config.ObservationColumn != "" {
+		value, err := mf.value(row, mf.config.ObservationColumn)
+		if err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+		if run != nil {
+			run.observations(mf.config).observe(mf.native, labelValues, value)
+		}
+		return
+	}
+	if mf.config.Histogram() {
+		buckets := make([]*dto.Bucket, 0, len(mf.bucketColumns))
+		for _, column := range mf.bucketColumns {
+			count, err := mf.value(row, column)
+			if err != nil {
+				mf.collectError(err, emit)
+				return
+			}
+			buckets = append(buckets, &dto.Bucket{
+				CumulativeCount: proto.Uint64(uint64(count)),
+				UpperBound:      proto.Float64(mf.config.Buckets[column]),
+			})
+		}
+		count, err := mf.value(row, mf.config.CountColumn)
+		if err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+		sum, err := mf.value(row, mf.config.SumColumn)
+		if err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+		h := NewHistogram(&mf, uint64(count), sum, buckets, labelValues...)
+		if mf.native != nil {
+			h.(*constHistogram).native = mf.native.fromBuckets(buckets, uint64(count))
+		}
+		emit(h)
+		return
 	}
-	for _, v := range mf.config.Values {
+	if mf.config.Stateset() {
+		state, err := mf.labelValue(row, mf.config.StateColumn)
+		if err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+		known := false
+		for _, s := range mf.config.States {
+			value := 0.0
+			if s == state {
+				value = 1
+				known = true
+			}
+			labelValues[len(labelValues)-1] = s
+			emit(NewMetric(&mf, value, labelValues...))
+		}
+		if !known {
+			mf.logger.Debug("Undeclared state", "state", state)
+		}
+		return
+	}
+	if mf.config.Info() {
+		emit(NewMetric(&mf, 1, labelValues...))
+		return
+	}
+	if mf.config.NameColumn != "" {
+		mf.collectKeyValue(row, labelValues, emit)
+		return
+	}
+
+	// Look up all values first, so that rows with dropped NULLs produce no metrics at all.
+	values := make([]float64, len(mf.config.Values))
+	for i, v := range mf.config.Values {
+		value, err := mf.value(row, v)
+		if err != nil {
+			mf.collectError(err, emit)
+			return
+		}
+		values[i] = value
+	}
+	for i, v := range mf.config.Values {
 		if mf.config.ValueLabel != "" {
 			labelValues[len(labelValues)-1] = v
 		}
-		value := row[v].(float64)
-		ch <- NewMetric(&mf, value, labelValues...)
+		emit(NewMetric(&mf, values[i], labelValues...))
+	}
+}
+
+// exemplar returns the exemplar to attach to the samples collected from a row, with no value unless the metric has an
+// exemplar value column. It returns nil if all exemplar label columns are NULL or empty, the exemplar value is NULL or
+// the exemplar labels exceed the OpenMetrics length limit.
+func (mf MetricFamily) exemplar(row map[string]interface{}) *dto.Exemplar {
+	labels := make([]*dto.LabelPair, 0, len(mf.config.ExemplarLabels))
+	runes := 0
+	for _, name := range mf.config.ExemplarLabels {
+		value, _ := row[name].(string)
+		if value == "" {
+			continue
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		mf.logger.Debug("Dropping exemplar exceeding the length limit", "runes", runes)
+		return nil
+	}
+
+	ex := &dto.Exemplar{Label: labels}
+	if mf.config.ExemplarValue != "" {
+		value, ok := row[mf.config.ExemplarValue].(float64)
+		if !ok {
+			return nil
+		}
+		ex.Value = proto.Float64(value)
+	}
+	return ex
+}
+
+// flush passes the native histograms accumulated over run from an observation column, if any, on to ch, once all rows
+// have been collected. Unless run is incomplete, it also forgets the counter series (tracked for resets) not collected
+// since the previous flush.
+func (mf MetricFamily) flush(run *queryRun, ch chan<- Metric) {
+	if mf.counters != nil && !run.incomplete {
+		mf.counters.sweep()
+	}
+	if mf.config.ObservationColumn == "" {
+		return
+	}
+	for _, m := range run.observations(mf.config).metrics(mf.native, &mf) {
+		mf.emit(m, time.Time{}, nil, ch)
+	}
+}
+
+// expandJSON returns a copy of row with the metric's JSON fields extracted from its JSON column. Fields used as labels
+// are converted to strings, all others to float64 where possible, with missing fields and JSON nulls mapped to nil.
+func (mf MetricFamily) expandJSON(row map[string]interface{}) (map[string]interface{}, error) {
+	var doc interface{}
+	if raw, ok := row[mf.config.JSONColumn].(string); ok {
+		if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+			return nil, fmt.Errorf("parsing JSON column %q: %s", mf.config.JSONColumn, err)
+		}
+	}
+
+	labels := make(map[string]bool, len(mf.config.KeyLabels)+2)
+	labelColumns := append([]string{mf.config.StateColumn, mf.config.NameColumn}, mf.config.KeyLabels...)
+	for _, l := range append(labelColumns, mf.config.ExemplarLabels...) {
+		labels[l] = true
+	}
+	expanded := make(map[string]interface{}, len(row)+len(mf.config.JSONPaths()))
+	for column, value := range row {
+		expanded[column] = value
+	}
+	for field, path := range mf.config.JSONPaths() {
+		value := lookupJSON(doc, path)
+		switch v := value.(type) {
+		case nil, string:
+			expanded[field] = v
+		case float64:
+			if labels[field] {
+				expanded[field] = strconv.FormatFloat(v, 'g', -1, 64)
+			} else {
+				expanded[field] = v
+			}
+		case bool:
+			if labels[field] {
+				expanded[field] = strconv.FormatBool(v)
+			} else if v {
+				expanded[field] = 1.0
+			} else {
+				expanded[field] = 0.0
+			}
+		default:
+			// Objects and arrays, as JSON text.
+			text, _ := json.Marshal(v)
+			expanded[field] = string(text)
+		}
+	}
+	return expanded, nil
+}
+
+// lookupJSON returns the value selected by path from a JSON document decoded into an interface{}, nil if not found.
+func lookupJSON(doc interface{}, path config.JSONPath) interface{} {
+	for _, elem := range path {
+		switch elem := elem.(type) {
+		case string:
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			doc = obj[elem]
+		case int:
+			arr, ok := doc.([]interface{})
+			if !ok || elem >= len(arr) {
+				return nil
+			}
+			doc = arr[elem]
+		}
 	}
+	return doc
+}
+
+// timestamp returns the sample timestamp from the metric's timestamp column, the zero time if NULL.
+func (mf MetricFamily) timestamp(row map[string]interface{}) (time.Time, error) {
+	var (
+		seconds float64
+		err     error
+	)
+	switch v := row[mf.config.TimestampColumn].(type) {
+	case nil:
+		return time.Time{}, nil
+	case string:
+		if seconds, err = parseTimestamp(strings.TrimSpace(v)); err != nil {
+			return time.Time{}, err
+		}
+	case float64:
+		seconds = v
+	}
+	return time.Unix(0, int64(seconds*1e9)), nil
+}
+
+// transform applies the metric's value transformation expression, if any, to a value.
+func (mf MetricFamily) transform(value float64) float64 {
+	if t := mf.config.ValueTransform(); t != nil {
+		return t(value)
+	}
+	return value
+}
+
+// errNullDropped is returned for NULL values when the metric's null_value policy is to drop the row.
+var errNullDropped = errors.New("NULL value dropped")
+
+// labelValue returns the value of the given key column, replacing NULL with the metric's null_label, if any.
+func (mf MetricFamily) labelValue(row map[string]interface{}, column string) (string, error) {
+	if value, ok := row[column].(string); ok {
+		return value, nil
+	}
+	if mf.config.NullLabel != "" {
+		return mf.config.NullLabel, nil
+	}
+	return "", fmt.Errorf("NULL value for key column %q", column)
+}
+
+// value returns the value of the given value column, converted according to the metric's value_format, handling
+// NULL according to the metric's null_value policy.
+func (mf MetricFamily) value(row map[string]interface{}, column string) (float64, error) {
+	switch value := row[column].(type) {
+	case float64:
+		return mf.transform(value), nil
+	case string:
+		// Value column with a value_format, scanned as a string.
+		v, err := parseValue(mf.config.ValueFormat, value)
+		return mf.transform(v), err
+	}
+	switch mf.config.NullValue {
+	case "":
+		return 0, fmt.Errorf("NULL value for value column %q", column)
+	case config.NullValueDrop:
+		return 0, errNullDropped
+	}
+	return mf.config.NullReplacement(), nil
+}
+
+// collectError reports an error populating the metric from a row, unless the row was dropped as per policy.
+func (mf MetricFamily) collectError(err error, emit func(Metric)) {
+	if err == errNullDropped {
+		mf.logger.Debug("Dropping row with NULL value")
+		return
+	}
+	emit(NewInvalidMetric(mf.logContext, err))
+}
+
+// collectKeyValue collects a key/value mode row as a metric named after the metric family plus the name column value,
+// skipping rows with empty names or non-numeric values.
+func (mf MetricFamily) collectKeyValue(row map[string]interface{}, labelValues []string, emit func(Metric)) {
+	rawName, err := mf.labelValue(row, mf.config.NameColumn)
+	if err != nil {
+		mf.collectError(err, emit)
+		return
+	}
+	suffix := sanitizeMetricName(rawName)
+	if suffix == "" {
+		mf.logger.Debug("Skipping row with empty metric name", "name", rawName)
+		return
+	}
+	var value float64
+	if rawValue, ok := row[mf.config.Values[0]].(string); ok {
+		if value, err = mf.parseKeyValue(rawValue); err != nil {
+			mf.logger.Debug("Skipping row with non-numeric value", "name", rawName, "value", rawValue)
+			return
+		}
+		value = mf.transform(value)
+	} else if value, err = mf.value(row, mf.config.Values[0]); err != nil {
+		mf.collectError(err, emit)
+		return
+	}
+	desc := &keyValueMetricDesc{MetricFamily: mf, name: mf.config.Name + "_" + suffix}
+	emit(NewMetric(desc, value, labelValues...))
+}
+
+// sanitizeMetricName converts a name (e.g. a server variable name) into a valid metric name fragment: lowercase, with
+// runs of characters other than letters, digits and underscores replaced by a single underscore and no leading or
+// trailing underscores.
+func sanitizeMetricName(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// parseKeyValue parses a key/value mode value: a number or a boolean (e.g. ON/OFF, YES/NO, TRUE/FALSE), unless the
+// metric defines a value_format.
+func (mf MetricFamily) parseKeyValue(s string) (float64, error) {
+	if mf.config.ValueFormat != "" {
+		return parseValue(mf.config.ValueFormat, s)
+	}
+	if v, err := parseBool(strings.TrimSpace(s)); err == nil {
+		return v, nil
+	}
+	return parseValue("", s)
+}
+
+// keyValueMetricDesc is the MetricDesc of a key/value mode metric, named after the metric family plus a suffix.
+type keyValueMetricDesc struct {
+	MetricFamily
+	name string
+}
+
+// Name implements MetricDesc.
+func (d keyValueMetricDesc) Name() string {
+	return d.name
 }
 
 // Name implements MetricDesc.
@@ -188,6 +680,8 @@ type constMetric struct {
 	desc       MetricDesc
 	val        float64
 	labelPairs []*dto.LabelPair
+	// Counter only, optional.
+	exemplar *dto.Exemplar
 }
 
 // Desc implements Metric.
@@ -200,7 +694,7 @@ func (m *constMetric) Write(out *dto.Metric) error {
 	out.Label = m.labelPairs
 	switch t := m.desc.ValueType(); t {
 	case prometheus.CounterValue:
-		out.Counter = &dto.Counter{Value: proto.Float64(m.val)}
+		out.Counter = &dto.Counter{Value: proto.Float64(m.val), Exemplar: m.exemplar}
 	case prometheus.GaugeValue:
 		out.Gauge = &dto.Gauge{Value: proto.Float64(m.val)}
 	default:
@@ -209,6 +703,73 @@ func (m *constMetric) Write(out *dto.Metric) error {
 	return nil
 }
 
+// NewHistogram returns a histogram metric with fixed count, sum and cumulative bucket counts, which must be sorted by
+// upper bound.
+//
+// NewHistogram panics if the length of labelValues is not consistent with desc.labels().
+func NewHistogram(desc MetricDesc, count uint64, sum float64, buckets []*dto.Bucket, labelValues ...string) Metric {
+	if len(desc.Labels()) != len(labelValues) {
+		panic(fmt.Sprintf("[%s] expected %d labels, got %d", desc.LogContext(), len(desc.Labels()), len(labelValues)))
+	}
+	return &constHistogram{
+		desc:       desc,
+		count:      count,
+		sum:        sum,
+		buckets:    buckets,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+}
+
+// constHistogram is a histogram metric with fixed count, sum and bucket counts.
+type constHistogram struct {
+	desc       MetricDesc
+	count      uint64
+	sum        float64
+	buckets    []*dto.Bucket
+	labelPairs []*dto.LabelPair
+	// Native histogram only: the native buckets, exposed alongside the classic buckets, if any.
+	native *nativeBuckets
+}
+
+// Desc implements Metric.
+func (h *constHistogram) Desc() MetricDesc {
+	return h.desc
+}
+
+// setExemplar attaches an exemplar (with a value) to the lowest bucket with an upper bound no less than its value,
+// adding a `+Inf` bucket if there is none.
+func (h *constHistogram) setExemplar(ex *dto.Exemplar) {
+	for _, b := range h.buckets {
+		if b.GetUpperBound() >= ex.GetValue() {
+			b.Exemplar = ex
+			return
+		}
+	}
+	h.buckets = append(h.buckets, &dto.Bucket{
+		CumulativeCount: proto.Uint64(h.count),
+		UpperBound:      proto.Float64(math.Inf(1)),
+		Exemplar:        ex,
+	})
+}
+
+// Write implements Metric.
+func (h *constHistogram) Write(out *dto.Metric) error {
+	out.Label = h.labelPairs
+	out.Histogram = &dto.Histogram{
+		SampleCount: proto.Uint64(h.count),
+		SampleSum:   proto.Float64(h.sum),
+		Bucket:      h.buckets,
+	}
+	if n := h.native; n != nil {
+		out.Histogram.Schema = proto.Int32(n.schema)
+		out.Histogram.ZeroThreshold = proto.Float64(prometheus.DefNativeHistogramZeroThreshold)
+		out.Histogram.ZeroCount = proto.Uint64(n.zeroCount)
+		out.Histogram.PositiveSpan, out.Histogram.PositiveDelta = n.positiveSpans, n.positiveDeltas
+		out.Histogram.NegativeSpan, out.Histogram.NegativeDelta = n.negativeSpans, n.negativeDeltas
+	}
+	return nil
+}
+
 func makeLabelPairs(desc MetricDesc, labelValues []string) []*dto.LabelPair {
 	labels := desc.Labels()
 	constLabels := desc.ConstLabels()
@@ -230,10 +791,43 @@ func makeLabelPairs(desc MetricDesc, labelValues []string) []*dto.LabelPair {
 		})
 	}
 	labelPairs = append(labelPairs, constLabels...)
-	sort.Sort(prometheus.LabelPairSorter(labelPairs))
+	sort.Sort(labelPairSorter(labelPairs))
 	return labelPairs
 }
 
+// labelPairSorter implements sort.Interface, sorting label pairs by name.
+type labelPairSorter []*dto.LabelPair
+
+func (s labelPairSorter) Len() int           { return len(s) }
+func (s labelPairSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s labelPairSorter) Less(i, j int) bool { return s[i].GetName() < s[j].GetName() }
+
+// NewMetricWithTimestamp returns a Metric wrapping the provided one, with an explicit timestamp.
+func NewMetricWithTimestamp(t time.Time, m Metric) Metric {
+	return &timestampedMetric{
+		Metric:      m,
+		timestampMs: t.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// timestampedMetric is a Metric with an explicit timestamp.
+type timestampedMetric struct {
+	Metric
+	timestampMs int64
+}
+
+// Write implements Metric.
+func (m *timestampedMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	// Keep any timestamp set by the wrapped metric (e.g. from a timestamp column).
+	if out.TimestampMs == nil {
+		out.TimestampMs = proto.Int64(m.timestampMs)
+	}
+	return nil
+}
+
 type invalidMetric struct {
 	err error
 }
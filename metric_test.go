@@ -0,0 +1,141 @@
+package sql_exporter
+
+import (
+	"math"
+	"testing"
+
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+// newTestMetricFamily returns a metric family defined by the given metric config (in YAML).
+func newTestMetricFamily(t *testing.T, metric string) *MetricFamily {
+	t.Helper()
+	var mc config.MetricConfig
+	if err := yaml.Unmarshal([]byte(metric), &mc); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := NewMetricFamily(nil, "test", &mc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mf
+}
+
+// collectMetrics collects row into mf, returning the metrics collected.
+func collectMetrics(t *testing.T, mf *MetricFamily, row map[string]interface{}) []*dto.Metric {
+	t.Helper()
+	ch := make(chan Metric, capMetricChan)
+	mf.Collect(row, ch)
+	close(ch)
+	var metrics []*dto.Metric
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, &out)
+	}
+	return metrics
+}
+
+// TestCounterExemplar checks that exemplars with the non-empty exemplar label columns are attached to counters, with
+// the counter value.
+func TestCounterExemplar(t *testing.T) {
+	mf := newTestMetricFamily(t, `
+metric_name: queries_total
+type: counter
+help: 'Queries.'
+values: [n]
+exemplar_labels: [trace_id, query_id]
+query: SELECT 1
+`)
+
+	metrics := collectMetrics(t, mf, map[string]interface{}{"n": 3.0, "trace_id": "abc", "query_id": ""})
+	if len(metrics) != 1 {
+		t.Fatalf("got %d metrics, want 1", len(metrics))
+	}
+	ex := metrics[0].GetCounter().GetExemplar()
+	if len(ex.GetLabel()) != 1 || ex.GetLabel()[0].GetName() != "trace_id" || ex.GetLabel()[0].GetValue() != "abc" {
+		t.Errorf("got exemplar labels %v, want trace_id=abc", ex.GetLabel())
+	}
+	if ex.GetValue() != 3 {
+		t.Errorf("got exemplar value %g, want 3", ex.GetValue())
+	}
+
+	metrics = collectMetrics(t, mf, map[string]interface{}{"n": 4.0, "trace_id": "", "query_id": ""})
+	if ex := metrics[0].GetCounter().GetExemplar(); ex != nil {
+		t.Errorf("got exemplar %v with empty exemplar labels, want none", ex)
+	}
+}
+
+// TestHistogramExemplar checks that exemplars are attached to the histogram bucket their value falls in.
+func TestHistogramExemplar(t *testing.T) {
+	mf := newTestMetricFamily(t, `
+metric_name: latency_seconds
+type: histogram
+help: 'Latency.'
+buckets: {le_1: 1, le_5: 5}
+sum_column: sum
+count_column: count
+exemplar_labels: [trace_id]
+exemplar_value: last
+query: SELECT 1
+`)
+	row := func(last interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"le_1": 2.0, "le_5": 3.0, "sum": 12.0, "count": 4.0, "trace_id": "abc", "last": last,
+		}
+	}
+
+	for _, tc := range []struct {
+		last  interface{}
+		bound float64
+	}{
+		{3.0, 5},
+		{1.0, 1},
+		// Above the highest bucket, the exemplar goes to an added +Inf bucket.
+		{10.0, math.Inf(1)},
+	} {
+		metrics := collectMetrics(t, mf, row(tc.last))
+		var found bool
+		for _, b := range metrics[0].GetHistogram().GetBucket() {
+			if ex := b.GetExemplar(); ex != nil {
+				if b.GetUpperBound() != tc.bound || ex.GetValue() != tc.last {
+					t.Errorf("got exemplar %g in bucket %g, want %g in bucket %g", ex.GetValue(), b.GetUpperBound(),
+						tc.last, tc.bound)
+				}
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no exemplar for value %g", tc.last)
+		}
+	}
+
+	// No exemplar without an exemplar value.
+	metrics := collectMetrics(t, mf, row(nil))
+	for _, b := range metrics[0].GetHistogram().GetBucket() {
+		if b.GetExemplar() != nil {
+			t.Errorf("got exemplar %v with NULL exemplar value, want none", b.GetExemplar())
+		}
+	}
+}
+
+// TestExemplarConfig checks that exemplars are only accepted for counters and histograms with an exemplar value.
+func TestExemplarConfig(t *testing.T) {
+	for _, metric := range []string{
+		"{metric_name: m, type: gauge, help: M, values: [v], exemplar_labels: [trace_id], query: SELECT 1}",
+		"{metric_name: m, type: counter, help: M, values: [v], exemplar_value: v, query: SELECT 1}",
+		"{metric_name: m, type: counter, help: M, values: [v], exemplar_labels: [a, a], query: SELECT 1}",
+		"{metric_name: m, type: counter, help: M, values: [v], exemplar_labels: ['a-b'], query: SELECT 1}",
+		"{metric_name: m, type: histogram, help: M, buckets: {le_1: 1}, sum_column: s, count_column: c, " +
+			"exemplar_labels: [trace_id], query: SELECT 1}",
+	} {
+		var mc config.MetricConfig
+		if err := yaml.Unmarshal([]byte(metric), &mc); err == nil {
+			t.Errorf("accepted metric %s, want error", metric)
+		}
+	}
+}
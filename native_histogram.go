@@ -0,0 +1,215 @@
+package sql_exporter
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// nativeSchema maps values to the buckets of native histograms of a given resolution.
+type nativeSchema struct {
+	// Resolution of the histograms, from -4 (bucket boundaries growing by a factor of 65536) to 8 (2^(1/256)).
+	schema int32
+	// Upper bounds of the buckets within each power of 2 (as fractions in [0.5, 1)), for positive schemas only.
+	bounds []float64
+}
+
+// newNativeSchema returns the nativeSchema with the highest resolution whose bucket boundaries grow by no more than
+// bucketFactor.
+func newNativeSchema(bucketFactor float64) *nativeSchema {
+	var schema int32
+	switch floor := math.Floor(math.Log2(math.Log2(bucketFactor))); {
+	case floor <= -8:
+		schema = 8
+	case floor >= 4:
+		schema = -4
+	default:
+		schema = -int32(floor)
+	}
+
+	s := &nativeSchema{schema: schema}
+	if schema > 0 {
+		n := 1 << uint(schema)
+		s.bounds = make([]float64, n)
+		for i := range s.bounds {
+			s.bounds[i] = math.Exp2(float64(i)/float64(n)) / 2
+		}
+	}
+	return s
+}
+
+// bucketIndex returns the index of the bucket a positive value falls in, i.e. the bucket with the lowest upper bound
+// no less than the value.
+func (s *nativeSchema) bucketIndex(value float64) int {
+	frac, exp := math.Frexp(value)
+	if s.schema > 0 {
+		return sort.SearchFloat64s(s.bounds, frac) + (exp-1)*len(s.bounds)
+	}
+	index := exp
+	if frac == 0.5 {
+		index--
+	}
+	offset := (1 << uint(-s.schema)) - 1
+	return (index + offset) >> uint(-s.schema)
+}
+
+// fromBuckets approximates classic histogram buckets (with cumulative counts, sorted by upper bound) and their total
+// count as native buckets: the observations in every classic bucket are counted in the native bucket its upper bound
+// falls in, those above the highest upper bound in the native bucket right above it.
+func (s *nativeSchema) fromBuckets(buckets []*dto.Bucket, count uint64) *nativeBuckets {
+	h := newNativeHistogram(nil)
+	var cumulative uint64
+	for _, b := range buckets {
+		if c := b.GetCumulativeCount(); c > cumulative {
+			h.add(s, b.GetUpperBound(), c-cumulative)
+			cumulative = c
+		}
+	}
+	if count > cumulative {
+		if highest := buckets[len(buckets)-1].GetUpperBound(); highest > prometheus.DefNativeHistogramZeroThreshold {
+			h.positive[s.bucketIndex(math.Min(highest, math.MaxFloat64))+1] += count - cumulative
+		} else {
+			h.zeroCount += count - cumulative
+		}
+	}
+	return h.buckets(s)
+}
+
+// nativeHistogram is a native histogram being built.
+type nativeHistogram struct {
+	labelValues []string
+	count       uint64
+	sum         float64
+	zeroCount   uint64
+	// Bucket counts, keyed by bucket index.
+	positive map[int]uint64
+	negative map[int]uint64
+}
+
+// newNativeHistogram returns an empty nativeHistogram with the given label values.
+func newNativeHistogram(labelValues []string) *nativeHistogram {
+	return &nativeHistogram{
+		labelValues: labelValues,
+		positive:    make(map[int]uint64),
+		negative:    make(map[int]uint64),
+	}
+}
+
+// observe adds an observation to the histogram.
+func (h *nativeHistogram) observe(s *nativeSchema, value float64) {
+	h.count++
+	h.sum += value
+	h.add(s, value, 1)
+}
+
+// add counts n observations of value in the bucket it falls in, without updating the histogram's count and sum. NaN
+// values fall in no bucket, infinite ones in the highest (or lowest) bucket.
+func (h *nativeHistogram) add(s *nativeSchema, value float64, n uint64) {
+	switch {
+	case math.IsNaN(value):
+	case math.Abs(value) <= prometheus.DefNativeHistogramZeroThreshold:
+		h.zeroCount += n
+	case value > 0:
+		h.positive[s.bucketIndex(math.Min(value, math.MaxFloat64))] += n
+	default:
+		h.negative[s.bucketIndex(math.Min(-value, math.MaxFloat64))] += n
+	}
+}
+
+// buckets returns the buckets of the histogram, in protobuf exposition format terms.
+func (h *nativeHistogram) buckets(s *nativeSchema) *nativeBuckets {
+	b := &nativeBuckets{schema: s.schema, zeroCount: h.zeroCount}
+	b.positiveSpans, b.positiveDeltas = nativeBucketSpans(h.positive)
+	b.negativeSpans, b.negativeDeltas = nativeBucketSpans(h.negative)
+	return b
+}
+
+// nativeObservations accumulates the observations of a histogram metric family populated from an observation column
+// into native histograms, one per label set, over a single run of its query.
+type nativeObservations struct {
+	// Histograms keyed by label values, in the order first observed.
+	series map[string]*nativeHistogram
+	keys   []string
+}
+
+// observe adds an observation to the histogram with the given label values.
+func (o *nativeObservations) observe(s *nativeSchema, labelValues []string, value float64) {
+	key := strings.Join(labelValues, "\xff")
+	h, found := o.series[key]
+	if !found {
+		if o.series == nil {
+			o.series = make(map[string]*nativeHistogram)
+		}
+		h = newNativeHistogram(append([]string(nil), labelValues...))
+		o.series[key] = h
+		o.keys = append(o.keys, key)
+	}
+	h.observe(s, value)
+}
+
+// metrics returns the accumulated histograms as metrics described by desc.
+func (o *nativeObservations) metrics(s *nativeSchema, desc MetricDesc) []Metric {
+	metrics := make([]Metric, 0, len(o.keys))
+	for _, key := range o.keys {
+		h := o.series[key]
+		m := NewHistogram(desc, h.count, h.sum, nil, h.labelValues...).(*constHistogram)
+		m.native = h.buckets(s)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// nativeBuckets are the sparse buckets of a native histogram, in protobuf exposition format terms.
+type nativeBuckets struct {
+	schema         int32
+	zeroCount      uint64
+	positiveSpans  []*dto.BucketSpan
+	positiveDeltas []int64
+	negativeSpans  []*dto.BucketSpan
+	negativeDeltas []int64
+}
+
+// nativeBucketSpans encodes bucket counts keyed by bucket index as spans of consecutive buckets and the deltas between
+// the counts of consecutive buckets. Gaps of up to 2 empty buckets are encoded as empty buckets rather than new spans.
+func nativeBucketSpans(counts map[int]uint64) ([]*dto.BucketSpan, []int64) {
+	if len(counts) == 0 {
+		return nil, nil
+	}
+	indexes := make([]int, 0, len(counts))
+	for i := range counts {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	var (
+		spans     []*dto.BucketSpan
+		deltas    = make([]int64, 0, len(indexes))
+		prevIndex int
+		prevCount int64
+	)
+	for i, index := range indexes {
+		gap := index - prevIndex - 1
+		if i == 0 || gap > 2 {
+			offset := gap
+			if i == 0 {
+				offset = index
+			}
+			spans = append(spans, &dto.BucketSpan{Offset: proto.Int32(int32(offset)), Length: proto.Uint32(0)})
+		} else {
+			for ; gap > 0; gap-- {
+				deltas = append(deltas, -prevCount)
+				prevCount = 0
+				*spans[len(spans)-1].Length++
+			}
+		}
+		count := int64(counts[index])
+		deltas = append(deltas, count-prevCount)
+		*spans[len(spans)-1].Length++
+		prevIndex, prevCount = index, count
+	}
+	return spans, deltas
+}
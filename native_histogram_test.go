@@ -0,0 +1,126 @@
+package sql_exporter
+
+import (
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNativeSchemaBucketIndex(t *testing.T) {
+	for _, tc := range []struct {
+		factor float64
+		value  float64
+		want   int
+	}{
+		// Schema 0: bucket i covers (2^(i-1), 2^i].
+		{2, 1, 0},
+		{2, 1.5, 1},
+		{2, 2, 1},
+		{2, 3, 2},
+		{2, 0.3, -1},
+		// Schema 3: bucket i covers (2^((i-1)/8), 2^(i/8)].
+		{1.1, 1, 0},
+		{1.1, 2, 8},
+		{1.1, 1.05, 1},
+		{1.1, 0.5, -8},
+		// Schema -1: bucket i covers (4^(i-1), 4^i].
+		{4, 4, 1},
+		{4, 5, 2},
+		{4, 16, 2},
+	} {
+		s := newNativeSchema(tc.factor)
+		if got := s.bucketIndex(tc.value); got != tc.want {
+			t.Errorf("factor %g (schema %d): bucketIndex(%g) = %d, want %d",
+				tc.factor, s.schema, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestNativeBucketSpans(t *testing.T) {
+	spans, deltas := nativeBucketSpans(map[int]uint64{-2: 1, -1: 3, 1: 2, 10: 4})
+	var gotSpans [][2]int64
+	for _, s := range spans {
+		gotSpans = append(gotSpans, [2]int64{int64(s.GetOffset()), int64(s.GetLength())})
+	}
+	// Bucket 0 is encoded as empty, bucket 10 starts a new span after a gap of 8.
+	if want := [][2]int64{{-2, 4}, {8, 1}}; !reflect.DeepEqual(gotSpans, want) {
+		t.Errorf("spans = %v, want %v", gotSpans, want)
+	}
+	if want := []int64{1, 2, -3, 2, 2}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("deltas = %v, want %v", deltas, want)
+	}
+}
+
+func TestNativeObservations(t *testing.T) {
+	mf := &MetricFamily{labels: []string{"l"}, native: newNativeSchema(2)}
+	var run, other nativeObservations
+	for _, v := range []float64{-1, 0, 1, 1, 3} {
+		run.observe(mf.native, []string{"a"}, v)
+	}
+	run.observe(mf.native, []string{"b"}, 2)
+	// Observations accumulated over a different run are kept separately.
+	other.observe(mf.native, []string{"a"}, 100)
+
+	metrics := run.metrics(mf.native, mf)
+	if len(metrics) != 2 {
+		t.Fatalf("got %d metrics, want 2", len(metrics))
+	}
+	var out dto.Metric
+	if err := metrics[0].Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	h := out.GetHistogram()
+	if h.GetSampleCount() != 5 || h.GetSampleSum() != 4 || h.GetSchema() != 0 || h.GetZeroCount() != 1 {
+		t.Errorf("count, sum, schema, zero count = %d, %g, %d, %d, want 5, 4, 0, 1",
+			h.GetSampleCount(), h.GetSampleSum(), h.GetSchema(), h.GetZeroCount())
+	}
+	if want := []int64{2, -2, 1}; !reflect.DeepEqual(h.GetPositiveDelta(), want) {
+		t.Errorf("positive deltas = %v, want %v", h.GetPositiveDelta(), want)
+	}
+	if want := []int64{1}; !reflect.DeepEqual(h.GetNegativeDelta(), want) {
+		t.Errorf("negative deltas = %v, want %v", h.GetNegativeDelta(), want)
+	}
+
+	if metrics := other.metrics(mf.native, mf); len(metrics) != 1 {
+		t.Errorf("got %d metrics from the other run, want 1", len(metrics))
+	}
+}
+
+func TestNativeHistogramFromBuckets(t *testing.T) {
+	mf := newTestMetricFamily(t, `
+metric_name: latency_seconds
+type: histogram
+help: 'Latency.'
+buckets: {le_1: 1, le_4: 4}
+count_column: count
+sum_column: sum
+native_histogram: true
+native_histogram_bucket_factor: 2
+query: SELECT 1
+`)
+
+	ch := make(chan Metric, 1)
+	mf.Collect(map[string]interface{}{"le_1": 2.0, "le_4": 5.0, "count": 6.0, "sum": 12.0}, ch)
+	var out dto.Metric
+	if err := (<-ch).Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	h := out.GetHistogram()
+	// The classic buckets are still exposed.
+	if len(h.GetBucket()) != 2 || h.GetSampleCount() != 6 || h.GetSchema() != 0 {
+		t.Errorf("classic buckets, count, schema = %d, %d, %d, want 2, 6, 0",
+			len(h.GetBucket()), h.GetSampleCount(), h.GetSchema())
+	}
+	// 2 observations in bucket 0 (le 1), 3 in bucket 2 (le 4), 1 above 4 in bucket 3.
+	var gotSpans [][2]int64
+	for _, s := range h.GetPositiveSpan() {
+		gotSpans = append(gotSpans, [2]int64{int64(s.GetOffset()), int64(s.GetLength())})
+	}
+	if want := [][2]int64{{0, 4}}; !reflect.DeepEqual(gotSpans, want) {
+		t.Errorf("positive spans = %v, want %v", gotSpans, want)
+	}
+	if want := []int64{2, -2, 3, -2}; !reflect.DeepEqual(h.GetPositiveDelta(), want) {
+		t.Errorf("positive deltas = %v, want %v", h.GetPositiveDelta(), want)
+	}
+}
@@ -0,0 +1,81 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// queryParamRE matches `${name}` query parameter references.
+var queryParamRE = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// queryParamsKey is the context key under which the query parameter values of the target being collected from are
+// stored.
+type queryParamsKey struct{}
+
+// withQueryParams returns a copy of ctx holding the values to bind `${name}` query parameters to.
+func withQueryParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, queryParamsKey{}, params)
+}
+
+// queryParamsFromContext returns the values to bind `${name}` query parameters to, nil if none.
+func queryParamsFromContext(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(queryParamsKey{}).(map[string]string)
+	return params
+}
+
+// bindQueryParams replaces the `${name}` parameter references in query with the driver's placeholders, returning the
+// rewritten query and the arguments to run it with. Queries without parameters are returned unchanged.
+func bindQueryParams(driver, query string, params map[string]string) (string, []interface{}, error) {
+	if !queryParamRE.MatchString(query) {
+		return query, nil, nil
+	}
+	switch driver {
+	case "bigquery", "athena":
+		return "", nil, fmt.Errorf("query parameters are not supported by driver %q", driver)
+	}
+
+	var (
+		args    []interface{}
+		indices = make(map[string]int) // maps parameters to their (1 based) index in args, for numbered placeholders
+		err     error
+	)
+	query = queryParamRE.ReplaceAllStringFunc(query, func(ref string) string {
+		name := queryParamRE.FindStringSubmatch(ref)[1]
+		value, found := params[name]
+		if !found {
+			if err == nil {
+				err = fmt.Errorf("no value defined for query parameter %q", name)
+			}
+			return ref
+		}
+
+		switch driver {
+		case "postgres", "postgresql":
+			if _, found := indices[name]; !found {
+				args = append(args, value)
+				indices[name] = len(args)
+			}
+			return "$" + strconv.Itoa(indices[name])
+		case "sqlserver", "mssql", "oracle":
+			if _, found := indices[name]; !found {
+				args = append(args, sql.Named(name, value))
+				indices[name] = len(args)
+			}
+			if driver == "oracle" {
+				return ":" + name
+			}
+			return "@" + name
+		default:
+			// Positional placeholders, with repeated parameters bound once per occurrence.
+			args = append(args, value)
+			return "?"
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return query, args, nil
+}
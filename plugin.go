@@ -0,0 +1,86 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"plugin"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CollectorPluginSymbol is the name of the function collector plugins must export, of type CollectorPluginFunc.
+const CollectorPluginSymbol = "NewCollector"
+
+// CollectorPluginFunc is the type of the function collector plugins must export as NewCollector. Collector plugins
+// are Go plugins (built with `go build -buildmode=plugin` from the same source tree as the exporter, which must be
+// built with cgo enabled) for collecting metrics that cannot be expressed as SQL queries. The function is called for
+// every target the collector is applied to, with the collector's logger and log context, the `params` of its plugin
+// configuration and the target's labels, which must be applied to all the metrics the Collector produces (e.g. via
+// NewAutomaticMetricDesc). The Collector reports errors by sending NewInvalidMetric() to the channel.
+type CollectorPluginFunc func(logger *slog.Logger, logContext string, params map[string]string,
+	constLabels []*dto.LabelPair) (Collector, error)
+
+// pluginCollector is a Collector implemented by a collector plugin. Unlike query collectors, its metrics are never
+// cached, regardless of min_interval or cache_ttl.
+type pluginCollector struct {
+	config    *config.CollectorConfig
+	collector Collector
+}
+
+// newPluginCollector loads the plugin of the provided collector configuration and returns a new Collector created
+// by it.
+func newPluginCollector(logger *slog.Logger, logContext string, cc *config.CollectorConfig,
+	constLabels []*dto.LabelPair) (Collector, error) {
+	newCollector, err := loadCollectorPlugin(cc.Plugin.Path)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+	c, err := newCollector(logger, logContext, cc.Plugin.Params, constLabels)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+	return &pluginCollector{config: cc, collector: c}, nil
+}
+
+// loadCollectorPlugin opens the collector plugin at path (or returns it, if already open) and looks up its
+// CollectorPluginFunc.
+func loadCollectorPlugin(path string) (CollectorPluginFunc, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading collector plugin: %s", err)
+	}
+	sym, err := p.Lookup(CollectorPluginSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("error loading collector plugin %q: %s", path, err)
+	}
+	// Exported functions are looked up with their plain (unnamed) function type.
+	switch newCollector := sym.(type) {
+	case func(*slog.Logger, string, map[string]string, []*dto.LabelPair) (Collector, error):
+		return newCollector, nil
+	case *CollectorPluginFunc:
+		return *newCollector, nil
+	default:
+		return nil, fmt.Errorf("collector plugin %q exports %s of type %T, expecting a CollectorPluginFunc", path,
+			CollectorPluginSymbol, sym)
+	}
+}
+
+// Collect implements Collector.
+func (c *pluginCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	// As with query collectors, the collector timeout only applies if tighter than the scrape deadline.
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.config.Timeout))
+		defer cancel()
+	}
+	c.collector.Collect(ctx, conn, ch)
+}
+
+// Name implements Collector.
+func (c *pluginCollector) Name() string {
+	return c.config.Name
+}
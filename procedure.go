@@ -0,0 +1,174 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// bindParameters resolves the values of the query's stored procedure input parameters, from either the configured
+// literals or the target's labels.
+func (q *Query) bindParameters(targetLabels map[string]string) error {
+	q.inputs = make([]interface{}, len(q.config.Parameters))
+	for i, p := range q.config.Parameters {
+		if p.Output {
+			continue
+		}
+		value := p.Value
+		if p.Label != "" {
+			var found bool
+			if value, found = targetLabels[p.Label]; !found {
+				return fmt.Errorf("[%s] no target label %q to populate parameter %q from", q.logContext, p.Label, p.Name)
+			}
+		}
+		v, err := p.Convert(value)
+		if err != nil {
+			return fmt.Errorf("[%s] %s", q.logContext, err)
+		}
+		q.inputs[i] = v
+	}
+	return nil
+}
+
+// callProcedure calls the query's stored procedure, with a driver specific statement. Procedures only populating
+// metrics from output parameters are executed rather than queried, as some drivers (e.g. Oracle) only support output
+// parameters for statements not returning rows.
+func (q *Query) callProcedure(ctx context.Context, conn *sql.DB) (*sql.Rows, map[string]interface{}, error) {
+	driver := driverFromContext(ctx)
+	query, args, outputs, err := procedureCall(driver, q.config.Procedure, q.config.Parameters, q.inputs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s] %s", q.logContext, err)
+	}
+	if len(q.output.metricFamilies) > 0 && outputs == nil {
+		return nil, nil, fmt.Errorf("[%s] driver %q returns output parameters as a result set, use result_set instead",
+			q.logContext, driver)
+	}
+	q.logger.Debug("Calling procedure", "sql", query)
+	q.setText(query)
+	traceStatement(ctx, query)
+
+	for _, rs := range q.resultSets {
+		if len(rs.metricFamilies) > 0 {
+			rows, err := conn.QueryContext(ctx, query, args...)
+			return rows, outputs, err
+		}
+	}
+	_, err = conn.ExecContext(ctx, query, args...)
+	return nil, outputs, err
+}
+
+// procedureCall returns the statement and arguments calling the named stored procedure with the given parameters and
+// input values (indexed like params) using the given driver, along with the destinations of output parameter values,
+// keyed by parameter name. Output destinations are nil if the driver returns output parameters as a result set.
+func procedureCall(driver, name string, params []*config.ParameterConfig, inputs []interface{}) (
+	string, []interface{}, map[string]interface{}, error) {
+	var (
+		args         = make([]interface{}, 0, len(params))
+		placeholders = make([]string, 0, len(params))
+		outputs      = make(map[string]interface{}, len(params))
+	)
+	for i, p := range params {
+		var arg interface{} = inputs[i]
+		if p.Output {
+			dest := outputDest(p.Type)
+			outputs[p.Name] = dest
+			arg = sql.Out{Dest: dest}
+		}
+
+		switch driver {
+		case "sqlserver", "mssql", "oracle":
+			args = append(args, sql.Named(p.Name, arg))
+			placeholders = append(placeholders, fmt.Sprintf("%s => :%s", p.Name, p.Name))
+		case "postgres", "postgresql":
+			// OUT parameters are returned as a result set, so they only need placeholder arguments.
+			if p.Output {
+				placeholders = append(placeholders, "NULL")
+				continue
+			}
+			args = append(args, arg)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		case "mysql":
+			// OUT parameters are stored into session variables, which are not read back.
+			if p.Output {
+				placeholders = append(placeholders, "@"+p.Name)
+				continue
+			}
+			args = append(args, arg)
+			placeholders = append(placeholders, "?")
+		default:
+			args = append(args, arg)
+			placeholders = append(placeholders, "?")
+		}
+	}
+
+	switch driver {
+	case "sqlserver", "mssql":
+		// A bare procedure name is run as a remote procedure call, with named parameters.
+		return name, args, outputs, nil
+	case "oracle":
+		return fmt.Sprintf("BEGIN %s(%s); END;", name, strings.Join(placeholders, ", ")), args, outputs, nil
+	case "hdb":
+		return fmt.Sprintf("CALL %s(%s)", name, strings.Join(placeholders, ", ")), args, outputs, nil
+	case "postgres", "postgresql", "mysql":
+		return fmt.Sprintf("CALL %s(%s)", name, strings.Join(placeholders, ", ")), args, nil, nil
+	default:
+		return "", nil, nil, fmt.Errorf("stored procedures are not supported by driver %q", driver)
+	}
+}
+
+// outputDest returns a pointer to a zero value of the Go type matching an output parameter type, for the driver to
+// infer the parameter's SQL type from and store its value into.
+func outputDest(typ string) interface{} {
+	switch typ {
+	case "int":
+		return new(int64)
+	case "float":
+		return new(float64)
+	case "bool":
+		return new(bool)
+	default:
+		return new(string)
+	}
+}
+
+// scanOutputs converts the values of output parameters, as populated by the driver, into a row: a map of column name
+// to value, with string values for key columns and float64 values for value columns.
+func (q *Query) scanOutputs(outputs map[string]interface{}) (map[string]interface{}, error) {
+	row := make(map[string]interface{}, len(q.output.columnTypes))
+	for column, ctype := range q.output.columnTypes {
+		dest, found := outputs[column]
+		if !found {
+			return nil, fmt.Errorf("[%s] output parameter %q not defined", q.logContext, column)
+		}
+		var value interface{}
+		switch dest := dest.(type) {
+		case *int64:
+			value = *dest
+		case *float64:
+			value = *dest
+		case *bool:
+			value = *dest
+		case *string:
+			value = *dest
+		}
+
+		var err error
+		switch ctype {
+		case columnTypeKey:
+			var s stringValue
+			err = s.Scan(value)
+			row[column] = string(s)
+		case columnTypeValue:
+			var f float64Value
+			err = f.Scan(value)
+			row[column] = float64(f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[%s] converting output parameter %q: %s", q.logContext, column, err)
+		}
+	}
+	return row, nil
+}
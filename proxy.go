@@ -0,0 +1,115 @@
+package sql_exporter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newProxyDialFunc returns a dialFunc connecting through the proxy at the provided URL: a SOCKS5 proxy (`socks5://` or
+// `socks5h://`, both resolving host names on the proxy) or an HTTP(S) proxy supporting the CONNECT method.
+func newProxyDialFunc(u *url.URL) (dialFunc, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("SOCKS5 dialer does not support contexts")
+		}
+		return cd.DialContext, nil
+
+	case "http", "https":
+		return (&connectProxy{url: u}).dial, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported proxy_url scheme %q", u.Scheme)
+	}
+}
+
+// connectProxy dials through an HTTP(S) proxy, using the CONNECT method.
+type connectProxy struct {
+	url *url.URL
+}
+
+// dial implements dialFunc.
+func (p *connectProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyAddr := p.url.Host
+	if p.url.Port() == "" {
+		port := "80"
+		if p.url.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(p.url.Hostname(), port)
+	}
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if p.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// Bound the CONNECT exchange by the context's deadline.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u := p.url.User; u != nil {
+		password, _ := u.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s through proxy %s: %s", address, proxyAddr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s through proxy %s: %s", address, proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to %s through proxy %s: %s", address, proxyAddr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Some databases (e.g. MySQL) speak first, so the reader may already hold data past the response.
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn reading through a bufio.Reader wrapping it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements net.Conn.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
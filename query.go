@@ -4,23 +4,142 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"math/big"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/free/sql_exporter/config"
-	log "github.com/golang/glog"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	queryLabelNames = []string{"job", "target", "collector", "query"}
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "sql_exporter_query_duration_seconds",
+		Help: "Time taken to execute a query and process its results, in seconds.",
+	}, queryLabelNames)
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_query_errors_total",
+		Help: "Total number of errors encountered executing a query or processing its results, by error class.",
+	}, append([]string{"error_class"}, queryLabelNames...))
+	queryRowsReturned = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_query_rows_returned",
+		Help: "Number of rows returned by the latest execution of a query.",
+	}, queryLabelNames)
+	queryBytesScanned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_query_bytes_scanned_total",
+		Help: "Total number of bytes scanned by a query, for drivers reporting it (e.g. Athena).",
+	}, queryLabelNames)
+	queryRowsTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_rows_truncated_total",
+		Help: "Total number of rows returned by a query beyond max_rows, discarded without being collected.",
+	}, queryLabelNames)
+)
+
+func init() {
+	prometheus.MustRegister(queryDuration, queryErrors, queryRowsReturned, queryBytesScanned, queryRowsTruncated)
+}
+
+// queryMetrics groups the internal metrics tracking the execution of a query.
+type queryMetrics struct {
+	labels        prometheus.Labels
+	duration      prometheus.Observer
+	rows          prometheus.Gauge
+	rowsTruncated prometheus.Counter
+}
+
+// newQueryMetrics returns the execution metrics for the query with the given labels.
+func newQueryMetrics(labels prometheus.Labels) queryMetrics {
+	return queryMetrics{
+		labels:        labels,
+		duration:      queryDuration.With(labels),
+		rows:          queryRowsReturned.With(labels),
+		rowsTruncated: queryRowsTruncated.With(labels),
+	}
+}
+
+// recordError increments the error counter of the query, labeled with the class of the provided error.
+func (m *queryMetrics) recordError(err error) {
+	labels := prometheus.Labels{"error_class": classifyError(err)}
+	for name, value := range m.labels {
+		labels[name] = value
+	}
+	queryErrors.With(labels).Inc()
+}
+
+// queryMetricsKey is the context key of the metrics of the query being executed, for drivers to report to.
+type queryMetricsKey struct{}
+
+// recordBytesScanned adds to the bytes scanned by the query executing in ctx, if any. Called by drivers.
+func recordBytesScanned(ctx context.Context, bytes int64) {
+	if m, ok := ctx.Value(queryMetricsKey{}).(*queryMetrics); ok {
+		queryBytesScanned.With(m.labels).Add(float64(bytes))
+	}
+}
+
+// simpleProtocolKey is the context key marking queries to be run without preparing them.
+type simpleProtocolKey struct{}
+
+// withSimpleProtocol returns a copy of ctx that makes queries run as is, using the simple query protocol rather than
+// prepared statements.
+func withSimpleProtocol(ctx context.Context) context.Context {
+	return context.WithValue(ctx, simpleProtocolKey{}, true)
+}
+
+// simpleProtocolFromContext returns true if queries should run using the simple query protocol.
+func simpleProtocolFromContext(ctx context.Context) bool {
+	simple, _ := ctx.Value(simpleProtocolKey{}).(bool)
+	return simple
+}
+
+// driverKey is the context key under which the driver of the target being collected from is stored.
+type driverKey struct{}
+
+// withDriver returns a copy of ctx recording the driver (data source name scheme, e.g. `sqlserver`) of the target
+// being collected from, for queries to adapt to.
+func withDriver(ctx context.Context, driver string) context.Context {
+	return context.WithValue(ctx, driverKey{}, driver)
+}
+
+// driverFromContext returns the driver of the target being collected from, or an empty string if not known.
+func driverFromContext(ctx context.Context) string {
+	driver, _ := ctx.Value(driverKey{}).(string)
+	return driver
+}
+
 // Query wraps a sql.Stmt and all the metrics populated from it. It helps extract keys and values from result rows.
 type Query struct {
-	config         *config.QueryConfig
+	config *config.QueryConfig
+	// The metric families populated from each result set, indexed by result set. Usually just the one.
+	resultSets []resultSet
+	// The metric families populated from stored procedure output parameters, if any.
+	output resultSet
+	// Stored procedure input parameter values, indexed like the configured parameters; nil for output parameters.
+	inputs     []interface{}
+	metrics    queryMetrics
+	logContext string
+	logger     *slog.Logger
+
+	// Protects stmts, enabled and text.
+	mu sync.Mutex
+	// Prepared statements, by database handle.
+	stmts map[*sql.DB]*sql.Stmt
+	// Result of the `when` feature detection query, nil until it first runs successfully.
+	enabled *bool
+	// The query text (or stored procedure call) last run, as sent to the database.
+	text string
+}
+
+// resultSet groups the metric families populated from one of a query's result sets.
+type resultSet struct {
 	metricFamilies []*MetricFamily
 	// columnTypes maps column names to the column type expected by metrics: key (string) or value (float64).
 	columnTypes columnTypeMap
-	logContext  string
-
-	conn *sql.DB
-	stmt *sql.Stmt
 }
 
 type columnType int
@@ -31,30 +150,119 @@ const (
 	columnTypeValue = 2
 )
 
-// NewQuery returns a new Query that will populate the given metric families.
-func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*MetricFamily) (*Query, error) {
+// NewQuery returns a new Query that will populate the given metric families. The provided job, target and collector
+// labels are applied to the query's execution metrics.
+func NewQuery(
+	logger *slog.Logger, logContext string, qc *config.QueryConfig, labels prometheus.Labels,
+	metricFamilies ...*MetricFamily) (*Query, error) {
 	logContext = fmt.Sprintf("%s, query=%q", logContext, qc.Name)
+	logger = orDefaultLogger(logger).With("query", qc.Name)
 
-	columnTypes := make(columnTypeMap)
+	queryLabels := prometheus.Labels{"query": qc.Name}
+	for name, value := range labels {
+		queryLabels[name] = value
+	}
 
+	resultSets := []resultSet{{columnTypes: make(columnTypeMap)}}
+	output := resultSet{columnTypes: make(columnTypeMap)}
 	for _, mf := range metricFamilies {
+		for len(resultSets) <= mf.config.ResultSet {
+			resultSets = append(resultSets, resultSet{columnTypes: make(columnTypeMap)})
+		}
+		rs := &resultSets[mf.config.ResultSet]
+		if mf.config.OutputParameters {
+			rs = &output
+		}
+		rs.metricFamilies = append(rs.metricFamilies, mf)
+		// Columns used by this metric family, including any fields expanded from its JSON column.
+		columnTypes := make(columnTypeMap)
+
 		for _, kcol := range mf.config.KeyLabels {
 			if err := setColumnType(logContext, kcol, columnTypeKey, columnTypes); err != nil {
 				return nil, err
 			}
 		}
-		for _, vcol := range mf.config.Values {
-			if err := setColumnType(logContext, vcol, columnTypeValue, columnTypes); err != nil {
+		if mf.config.Stateset() {
+			if err := setColumnType(logContext, mf.config.StateColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+		if mf.config.NameColumn != "" {
+			// Key/value mode values may be non-numeric for some rows, so they are scanned as strings and parsed (or
+			// skipped) by the metric family.
+			for _, kcol := range []string{mf.config.NameColumn, mf.config.Values[0]} {
+				if err := setColumnType(logContext, kcol, columnTypeKey, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			// Values with a value_format are scanned as strings and converted by the metric family.
+			ctype := columnType(columnTypeValue)
+			if mf.config.ValueFormat != "" {
+				ctype = columnTypeKey
+			}
+			for _, vcol := range mf.config.Values {
+				if err := setColumnType(logContext, vcol, ctype, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if mf.config.Histogram() {
+			vcols := []string{mf.config.SumColumn, mf.config.CountColumn}
+			if mf.config.ObservationColumn != "" {
+				vcols = []string{mf.config.ObservationColumn}
+			}
+			for vcol := range mf.config.Buckets {
+				vcols = append(vcols, vcol)
+			}
+			for _, vcol := range vcols {
+				if err := setColumnType(logContext, vcol, columnTypeValue, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, ecol := range mf.config.ExemplarLabels {
+			if err := setColumnType(logContext, ecol, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+		if mf.config.ExemplarValue != "" {
+			if err := setColumnType(logContext, mf.config.ExemplarValue, columnTypeValue, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		if mf.config.TimestampColumn != "" {
+			// Scanned as a string, to support both timestamp and numeric columns.
+			if err := setColumnType(logContext, mf.config.TimestampColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		jsonPaths := mf.config.JSONPaths()
+		if mf.config.JSONColumn != "" {
+			if err := setColumnType(logContext, mf.config.JSONColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+		for column, ctype := range columnTypes {
+			if _, found := jsonPaths[column]; found {
+				continue
+			}
+			if err := setColumnType(logContext, column, ctype, rs.columnTypes); err != nil {
 				return nil, err
 			}
 		}
 	}
 
 	q := Query{
-		config:         qc,
-		metricFamilies: metricFamilies,
-		columnTypes:    columnTypes,
-		logContext:     logContext,
+		config:     qc,
+		resultSets: resultSets,
+		output:     output,
+		metrics:    newQueryMetrics(queryLabels),
+		logContext: logContext,
+		logger:     logger,
 	}
 	return &q, nil
 }
@@ -74,49 +282,230 @@ func setColumnType(logContext, columnName string, ctype columnType, columnTypes
 
 // Run executes the query on the provided database, in the provided context.
 func (q *Query) Run(ctx context.Context, conn *sql.DB) (*sql.Rows, error) {
-	if q.conn != nil && q.conn != conn {
-		panic(fmt.Sprintf("[%s] Expecting to always run on the same database handle", q.logContext))
+	rows, _, err := q.run(ctx, conn)
+	return rows, err
+}
+
+// run is the implementation of Run, also returning the destinations of any stored procedure output parameters, keyed
+// by parameter name and only populated once rows is closed. Rows is nil for stored procedures only populating metrics
+// from output parameters.
+func (q *Query) run(ctx context.Context, conn *sql.DB) (*sql.Rows, map[string]interface{}, error) {
+	ctx = context.WithValue(ctx, queryMetricsKey{}, &q.metrics)
+	if q.config.Procedure != "" {
+		return q.callProcedure(ctx, conn)
+	}
+	query := q.config.Query
+	if tmpl := q.config.Template(); tmpl != nil {
+		var err error
+		if query, err = renderQuery(tmpl, queryTemplateDataFromContext(ctx)); err != nil {
+			return nil, nil, errors.Wrapf(err, "[%s] rendering query template failed", q.logContext)
+		}
+	}
+	query, args, err := bindQueryParams(driverFromContext(ctx), query, queryParamsFromContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s] %s", q.logContext, err)
 	}
+	q.logger.Debug("Running query", "sql", query)
+	q.setText(query)
+	traceStatement(ctx, query)
+	// Multiple statements (returning multiple result sets) can't be prepared by all drivers (e.g. MySQL).
+	if simpleProtocolFromContext(ctx) || len(q.resultSets) > 1 {
+		// Without arguments (i.e. query parameters), the driver sends the query text as is.
+		rows, err := conn.QueryContext(ctx, query, args...)
+		return rows, nil, err
+	}
+	stmt, err := q.prepare(ctx, conn, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	return rows, nil, err
+}
 
-	if q.stmt == nil {
-		stmt, err := conn.PrepareContext(ctx, q.config.Query)
+// prepare returns the query prepared on the provided database handle, preparing it on the first run on that handle.
+// The query text only depends on the target's driver, parameters and template data, which never change.
+func (q *Query) prepare(ctx context.Context, conn *sql.DB, query string) (*sql.Stmt, error) {
+	q.mu.Lock()
+	stmt := q.stmts[conn]
+	q.mu.Unlock()
+	if stmt != nil {
+		return stmt, nil
+	}
+
+	// Don't hold mu while preparing, it may take a while.
+	stmt, err := conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[%s] prepare query failed", q.logContext)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if prepared := q.stmts[conn]; prepared != nil {
+		// A concurrent run got there first, use its statement.
+		stmt.Close()
+		return prepared, nil
+	}
+	if q.stmts == nil {
+		q.stmts = make(map[*sql.DB]*sql.Stmt)
+	}
+	q.stmts[conn] = stmt
+	return stmt, nil
+}
+
+// setText records the query text last run.
+func (q *Query) setText(text string) {
+	q.mu.Lock()
+	q.text = text
+	q.mu.Unlock()
+}
+
+// Enabled returns true if the query should run on the provided database: if it defines no `when` feature detection
+// query or if the detection query returns a row with a true (or non-zero) first column. The detection query only runs
+// until it first succeeds, its result is cached afterwards.
+func (q *Query) Enabled(ctx context.Context, conn *sql.DB) (bool, error) {
+	if q.config.When == "" {
+		return true, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.enabled != nil {
+		return *q.enabled, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, q.config.When)
+	if err != nil {
+		return false, errors.Wrapf(err, "[%s] feature detection query failed", q.logContext)
+	}
+	defer rows.Close()
+	enabled := false
+	if rows.Next() {
+		columns, err := rows.Columns()
 		if err != nil {
-			return nil, errors.Wrapf(err, "[%s] prepare query failed", q.logContext)
+			return false, err
+		}
+		dest := make([]interface{}, len(columns))
+		for i := range dest {
+			dest[i] = new(interface{})
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return false, errors.Wrapf(err, "[%s] scanning of feature detection query result failed", q.logContext)
+		}
+		var v float64Value
+		// NULL or non-numeric values count as false.
+		enabled = len(dest) > 0 && v.Scan(*dest[0].(*interface{})) == nil && v != 0
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, errors.Wrapf(err, "[%s] feature detection query failed", q.logContext)
+	}
+
+	if !enabled {
+		q.logger.Info("Feature detection query returned false, not running query")
+	}
+	if rq := queryRecorderFromContext(ctx).query(q.metrics.labels["collector"], q.config.When); rq != nil {
+		// Only the outcome is recorded, as a single 0 or 1 value.
+		value := 0.0
+		if enabled {
+			value = 1
+		}
+		rq.resultSet()
+		rq.row(map[string]interface{}{"enabled": value})
+		rq.done()
+	}
+	q.enabled = &enabled
+	return enabled, nil
+}
+
+// resetSeriesLimits resets the series counts of the query's metric families, at the start of a collection.
+func (q *Query) resetSeriesLimits() {
+	for _, rs := range append([]resultSet{q.output}, q.resultSets...) {
+		for _, mf := range rs.metricFamilies {
+			if mf.limits != nil {
+				mf.limits.reset()
+			}
 		}
-		q.conn = conn
-		q.stmt = stmt
 	}
-	return q.stmt.QueryContext(ctx)
 }
 
-// ScanRow scans the current row into a map of column name to value, with string values for key columns and float64
-// values for value columns.
-func (q *Query) ScanRow(rows *sql.Rows) (map[string]interface{}, error) {
+// flush passes the metrics accumulated by the query's metric families over run (i.e. native histograms) on to ch and,
+// unless run is incomplete, drops the state of series not collected, once all rows have been collected.
+func (q *Query) flush(run *queryRun, ch chan<- Metric) {
+	for _, rs := range append([]resultSet{q.output}, q.resultSets...) {
+		for _, mf := range rs.metricFamilies {
+			mf.flush(run, ch)
+		}
+	}
+}
+
+// queryRun holds the state accumulated over the rows of a single run of a query. Concurrent runs of the same query
+// each have their own.
+type queryRun struct {
+	// Native histograms populated from observation columns, by metric.
+	native map[*config.MetricConfig]*nativeObservations
+	// Whether any rows were discarded or failed to be collected, i.e. series not collected may still exist.
+	incomplete bool
+}
+
+// markIncomplete records that some rows of the run were discarded or failed to be collected. It is safe to call on a
+// nil queryRun.
+func (r *queryRun) markIncomplete() {
+	if r != nil {
+		r.incomplete = true
+	}
+}
+
+// observations returns the native histograms accumulated for the given metric, creating them if necessary.
+func (r *queryRun) observations(mc *config.MetricConfig) *nativeObservations {
+	o, found := r.native[mc]
+	if !found {
+		if r.native == nil {
+			r.native = make(map[*config.MetricConfig]*nativeObservations)
+		}
+		o = &nativeObservations{}
+		r.native[mc] = o
+	}
+	return o
+}
+
+// ResultSets returns the number of result sets the query is expected to return, i.e. one more than the highest result
+// set any of its metrics is populated from.
+func (q *Query) ResultSets() int {
+	return len(q.resultSets)
+}
+
+// MetricFamilies returns the metric families populated from the given result set, possibly none.
+func (q *Query) MetricFamilies(resultSet int) []*MetricFamily {
+	return q.resultSets[resultSet].metricFamilies
+}
+
+// ScanRow scans the current row of the given result set into a map of column name to value, with string values for
+// key columns, float64 values for value columns and nil values for NULLs.
+func (q *Query) ScanRow(rows *sql.Rows, resultSet int) (map[string]interface{}, error) {
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, err
 	}
+	columnTypes := q.resultSets[resultSet].columnTypes
 
 	// Create the slice to scan the row into, with strings for keys and float64s for values.
 	dest := make([]interface{}, 0, len(columns))
-	have := make(map[string]bool, len(q.columnTypes))
+	have := make(map[string]bool, len(columnTypes))
 	for _, column := range columns {
-		switch q.columnTypes[column] {
+		switch columnTypes[column] {
 		case columnTypeKey:
-			dest = append(dest, new(string))
+			dest = append(dest, &nullable{Scanner: new(stringValue)})
 			have[column] = true
 		case columnTypeValue:
-			dest = append(dest, new(float64))
+			dest = append(dest, &nullable{Scanner: new(float64Value)})
 			have[column] = true
 		default:
-			log.V(1).Infof("[%s] Extra column %q returned by query %q", q.logContext, column)
+			q.logger.Debug("Extra column returned by query", "column", column)
 			dest = append(dest, new(interface{}))
 		}
 	}
 	// Not all requested columns could be mapped, fail.
-	if len(have) != len(q.columnTypes) {
-		missing := make([]string, len(q.columnTypes)-len(have))
-		for c := range q.columnTypes {
+	if len(have) != len(columnTypes) {
+		missing := make([]string, len(columnTypes)-len(have))
+		for c := range columnTypes {
 			if !have[c] {
 				missing = append(missing, c)
 			}
@@ -131,14 +520,129 @@ func (q *Query) ScanRow(rows *sql.Rows) (map[string]interface{}, error) {
 	}
 
 	// Pick all values we're interested in into a map.
-	result := make(map[string]interface{}, len(q.columnTypes))
+	result := make(map[string]interface{}, len(columnTypes))
 	for i, column := range columns {
-		switch q.columnTypes[column] {
+		if n, ok := dest[i].(*nullable); ok && n.null {
+			result[column] = nil
+			continue
+		}
+		switch columnTypes[column] {
 		case columnTypeKey:
-			result[column] = *dest[i].(*string)
+			result[column] = string(*dest[i].(*nullable).Scanner.(*stringValue))
 		case columnTypeValue:
-			result[column] = *dest[i].(*float64)
+			result[column] = float64(*dest[i].(*nullable).Scanner.(*float64Value))
 		}
 	}
 	return result, nil
 }
+
+// nullable is a sql.Scanner wrapping another one, recording NULL values rather than passing them through.
+type nullable struct {
+	sql.Scanner
+	null bool
+}
+
+// Scan implements sql.Scanner.
+func (n *nullable) Scan(src interface{}) error {
+	n.null = src == nil
+	if n.null {
+		return nil
+	}
+	return n.Scanner.Scan(src)
+}
+
+// stringValue is a sql.Scanner for key columns. In addition to the values accepted by database/sql when scanning into
+// a string, it accepts arbitrary precision decimals (SAP HANA returns DECIMAL columns as *big.Rat), formatted exactly.
+type stringValue string
+
+// Scan implements sql.Scanner.
+func (v *stringValue) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		*v = stringValue(src)
+	case []byte:
+		*v = stringValue(src)
+	case int64:
+		*v = stringValue(strconv.FormatInt(src, 10))
+	case float64:
+		*v = stringValue(strconv.FormatFloat(src, 'g', -1, 64))
+	case float32:
+		*v = stringValue(strconv.FormatFloat(float64(src), 'g', -1, 32))
+	case bool:
+		*v = stringValue(strconv.FormatBool(src))
+	case time.Time:
+		*v = stringValue(src.Format(time.RFC3339Nano))
+	case *big.Rat:
+		*v = stringValue(ratString(src))
+	case nil:
+		return fmt.Errorf("converting NULL to string is unsupported")
+	default:
+		*v = stringValue(fmt.Sprint(src))
+	}
+	return nil
+}
+
+// ratString formats a rational number as a decimal, exactly if it has a finite decimal representation (as all
+// DECIMAL values do).
+func ratString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	ten := big.NewInt(10)
+	pow := big.NewInt(10)
+	for digits := 1; digits <= 128; digits++ {
+		if new(big.Int).Mod(pow, r.Denom()).Sign() == 0 {
+			return r.FloatString(digits)
+		}
+		pow.Mul(pow, ten)
+	}
+	f, _ := r.Float64()
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// float64Value is a sql.Scanner for value columns. In addition to the numeric and numeric string values accepted by
+// database/sql when scanning into a float64 (Oracle returns NUMBER columns as strings), it accepts boolean values, as
+// 0 or 1, arbitrary precision decimals (SAP HANA returns DECIMAL columns as *big.Rat) and date/time values (e.g.
+// Oracle DATE columns), as seconds since the Unix epoch.
+type float64Value float64
+
+// Scan implements sql.Scanner.
+func (v *float64Value) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case float64:
+		*v = float64Value(src)
+	case float32:
+		*v = float64Value(src)
+	case int64:
+		*v = float64Value(src)
+	case bool:
+		*v = 0
+		if src {
+			*v = 1
+		}
+	case time.Time:
+		*v = float64Value(float64(src.UnixNano()) / 1e9)
+	case *big.Rat:
+		f, _ := src.Float64()
+		*v = float64Value(f)
+	case []byte:
+		return v.parse(string(src))
+	case string:
+		return v.parse(src)
+	case nil:
+		return fmt.Errorf("converting NULL to float64 is unsupported")
+	default:
+		return fmt.Errorf("unsupported Scan, storing driver.Value type %T into type float64", src)
+	}
+	return nil
+}
+
+// parse parses a numeric string into v.
+func (v *float64Value) parse(s string) error {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return fmt.Errorf("converting %q to float64: %s", s, err)
+	}
+	*v = float64Value(f)
+	return nil
+}
@@ -0,0 +1,99 @@
+package sql_exporter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queriesQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sql_exporter_queries_queued",
+	Help: "Number of queries waiting to run because max_concurrent_queries are already running.",
+})
+
+func init() {
+	prometheus.MustRegister(queriesQueued)
+}
+
+// queryLimiter bounds the number of queries running simultaneously across all targets and collectors, as per the
+// `max_concurrent_queries` global setting of the latest configuration loaded.
+var queryLimiter = &concurrencyLimiter{}
+
+// concurrencyLimiter is a semaphore with an adjustable limit, granting slots in the order they were requested.
+type concurrencyLimiter struct {
+	mu sync.Mutex
+	// Maximum number of slots held at any one time, unlimited if not positive.
+	limit int
+	// Number of slots currently held.
+	running int
+	// Callers waiting for a slot, in order. A slot is granted by closing the channel.
+	waiting []chan struct{}
+}
+
+// setLimit changes the maximum number of slots held at any one time (unlimited if not positive), granting slots to
+// waiting callers if the limit was raised. If it was lowered, slots already held are not affected.
+func (l *concurrencyLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	for len(l.waiting) > 0 && (l.limit <= 0 || l.running < l.limit) {
+		l.grant()
+	}
+}
+
+// acquire waits for a slot, until ctx is done. If it returns nil, the caller must call release() when done.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if len(l.waiting) == 0 && (l.limit <= 0 || l.running < l.limit) {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{})
+	l.waiting = append(l.waiting, granted)
+	queriesQueued.Inc()
+	l.mu.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiting {
+		if w == granted {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			queriesQueued.Dec()
+			return ctx.Err()
+		}
+	}
+	// The slot was granted meanwhile, pass it on.
+	l.releaseLocked()
+	return ctx.Err()
+}
+
+// release frees a slot, granting it to the first waiting caller, if any.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked is the implementation of release, with l.mu held.
+func (l *concurrencyLimiter) releaseLocked() {
+	l.running--
+	if len(l.waiting) > 0 && (l.limit <= 0 || l.running < l.limit) {
+		l.grant()
+	}
+}
+
+// grant hands a slot to the first waiting caller, with l.mu held.
+func (l *concurrencyLimiter) grant() {
+	l.running++
+	close(l.waiting[0])
+	l.waiting = l.waiting[1:]
+	queriesQueued.Dec()
+}
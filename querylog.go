@@ -0,0 +1,53 @@
+package sql_exporter
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+var (
+	// queryLogger is the logger to log executed queries to, if set.
+	queryLogger *slog.Logger
+	// logAllQueries is true if all executed queries are logged, rather than only slow ones.
+	logAllQueries bool
+	// slowQueryThreshold is the duration above which queries are logged as slow, if positive.
+	slowQueryThreshold time.Duration
+)
+
+// LogQueries makes collectors log the queries they execute to logger, with the job, target, collector and query name,
+// the query text as sent to the database, its duration, the number of rows returned and the error it failed with, if
+// any: all queries if all is true, plus (or else only) queries taking longer than slowThreshold, if positive, logged as
+// warnings. Feature detection queries are not logged. It must be called before creating an Exporter.
+func LogQueries(logger *slog.Logger, all bool, slowThreshold time.Duration) {
+	queryLogger, logAllQueries, slowQueryThreshold = logger, all, slowThreshold
+}
+
+// logQuery logs an execution of q that took duration and returned rows (or failed with err), if queries are logged.
+func logQuery(q *Query, duration time.Duration, rows int, err error) {
+	slow := slowQueryThreshold > 0 && duration > slowQueryThreshold
+	if queryLogger == nil || !(logAllQueries || slow) {
+		return
+	}
+
+	q.mu.Lock()
+	text := q.text
+	q.mu.Unlock()
+	level, msg := slog.LevelInfo, "Query executed"
+	if slow {
+		level, msg = slog.LevelWarn, "Slow query"
+	}
+	attrs := []slog.Attr{
+		slog.String("job", q.metrics.labels["job"]),
+		slog.String("target", q.metrics.labels["target"]),
+		slog.String("collector", q.metrics.labels["collector"]),
+		slog.String("query", q.metrics.labels["query"]),
+		slog.String("sql", text),
+		slog.Float64("duration_seconds", duration.Seconds()),
+		slog.Int("rows", rows),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	queryLogger.LogAttrs(context.Background(), level, msg, attrs...)
+}
@@ -0,0 +1,210 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	// Unlike v2, v3 marshals float64 values with full precision.
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// queryRecordDir is the directory to record query results to, if set.
+	queryRecordDir string
+	// queryReplayDir is the directory to replay recorded query results from instead of querying databases, if set.
+	queryReplayDir string
+)
+
+// RecordQueries makes targets record the results of all queries they run to a file per target in dir, rewritten after
+// every scrape, for ReplayQueries to replay later. Output parameters of stored procedures are not recorded. It must be
+// called before creating an Exporter.
+func RecordQueries(dir string) {
+	queryRecordDir = dir
+}
+
+// ReplayQueries makes targets replay the query results previously recorded (via RecordQueries) to dir, rather than
+// connecting to their databases. It must be called before creating an Exporter.
+func ReplayQueries(dir string) {
+	queryReplayDir = dir
+}
+
+// recordingFile returns the file the query results of the named target of the named job are recorded to in dir.
+func recordingFile(dir, jobName, targetName string) string {
+	return filepath.Join(dir, url.PathEscape(jobName), url.PathEscape(targetName)+".yml")
+}
+
+// queryRecording is the file format of recorded query results: the latest results of every query run, keyed by
+// collector name, then query name (metric name, for metrics defining their own query) or query text (for `when`
+// feature detection queries), same as the fixtures replaying them.
+type queryRecording struct {
+	Collectors map[string]map[string]*recordedQuery `yaml:"collectors"`
+}
+
+// recordedQuery holds the result sets returned by a query, or the error it failed with.
+type recordedQuery struct {
+	ResultSets []*recordedResultSet `yaml:"result_sets,omitempty"`
+	Error      string               `yaml:"error,omitempty"`
+
+	recorder  *queryRecorder
+	collector string
+	name      string
+}
+
+// recordedResultSet is a result set returned by a query, with only the columns used by metrics. Key column values are
+// recorded as strings and value column values as numbers, exactly as scanned.
+type recordedResultSet struct {
+	Columns []string        `yaml:"columns"`
+	Rows    [][]interface{} `yaml:"rows"`
+}
+
+// queryRecorder records the results of the queries run against a target.
+type queryRecorder struct {
+	file string
+
+	mu        sync.Mutex
+	recording queryRecording
+}
+
+// newQueryRecorder returns a queryRecorder writing to file.
+func newQueryRecorder(file string) *queryRecorder {
+	return &queryRecorder{
+		file:      file,
+		recording: queryRecording{Collectors: make(map[string]map[string]*recordedQuery)},
+	}
+}
+
+// query starts recording the results of the named query of the named collector. Nil-safe.
+func (r *queryRecorder) query(collector, name string) *recordedQuery {
+	if r == nil {
+		return nil
+	}
+	return &recordedQuery{recorder: r, collector: collector, name: strings.TrimSuffix(name, ".[literal]")}
+}
+
+// write writes the latest results of all queries to the recorder's file. Nil-safe.
+func (r *queryRecorder) write() error {
+	if r == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	r.mu.Lock()
+	err := enc.Encode(&r.recording)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.file), 0755); err != nil {
+		return err
+	}
+	tmp := r.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.file)
+}
+
+// resultSet starts recording a new result set. Nil-safe.
+func (rq *recordedQuery) resultSet() {
+	if rq == nil {
+		return
+	}
+	rq.ResultSets = append(rq.ResultSets, &recordedResultSet{})
+}
+
+// row records a row of the current result set, as scanned. Nil-safe.
+func (rq *recordedQuery) row(row map[string]interface{}) {
+	if rq == nil || len(rq.ResultSets) == 0 {
+		return
+	}
+	rs := rq.ResultSets[len(rq.ResultSets)-1]
+	if rs.Columns == nil {
+		rs.Columns = make([]string, 0, len(row))
+		for column := range row {
+			rs.Columns = append(rs.Columns, column)
+		}
+		sort.Strings(rs.Columns)
+	}
+	values := make([]interface{}, len(rs.Columns))
+	for i, column := range rs.Columns {
+		values[i] = row[column]
+	}
+	rs.Rows = append(rs.Rows, values)
+}
+
+// fail records the error the query failed with. Nil-safe.
+func (rq *recordedQuery) fail(err error) {
+	if rq == nil {
+		return
+	}
+	rq.ResultSets = nil
+	rq.Error = err.Error()
+}
+
+// done replaces the previously recorded results of the query with the ones just recorded. Nil-safe.
+func (rq *recordedQuery) done() {
+	if rq == nil {
+		return
+	}
+	rq.recorder.mu.Lock()
+	defer rq.recorder.mu.Unlock()
+	queries, found := rq.recorder.recording.Collectors[rq.collector]
+	if !found {
+		queries = make(map[string]*recordedQuery)
+		rq.recorder.recording.Collectors[rq.collector] = queries
+	}
+	queries[rq.name] = rq
+}
+
+// queryRecorderKey is the context key under which the recorder of the target being collected from is stored.
+type queryRecorderKey struct{}
+
+// withQueryRecorder returns a copy of ctx recording query results to r.
+func withQueryRecorder(ctx context.Context, r *queryRecorder) context.Context {
+	return context.WithValue(ctx, queryRecorderKey{}, r)
+}
+
+// queryRecorderFromContext returns the recorder to record query results to, nil if not recording.
+func queryRecorderFromContext(ctx context.Context) *queryRecorder {
+	r, _ := ctx.Value(queryRecorderKey{}).(*queryRecorder)
+	return r
+}
+
+// openReplayDB returns a database handle replaying the query results recorded to file.
+func openReplayDB(file string) (*sql.DB, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recorded query results: %s", err)
+	}
+	var recording queryRecording
+	if err := yaml.Unmarshal(buf, &recording); err != nil {
+		return nil, fmt.Errorf("error parsing recorded query results %s: %s", file, err)
+	}
+
+	fixtures := make(map[string]map[string]*Fixture, len(recording.Collectors))
+	for collector, queries := range recording.Collectors {
+		fixtures[collector] = make(map[string]*Fixture, len(queries))
+		for name, rq := range queries {
+			f := &Fixture{}
+			if rq.Error != "" {
+				f.Err = fmt.Errorf("%s", rq.Error)
+			}
+			for _, rs := range rq.ResultSets {
+				f.ResultSets = append(f.ResultSets, FixtureResultSet{Columns: rs.Columns, Rows: rs.Rows})
+			}
+			fixtures[collector][name] = f
+		}
+	}
+	return sql.OpenDB(&fixtureConnector{fixtures: fixtures}), nil
+}
@@ -0,0 +1,100 @@
+package sql_exporter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// nameLabel is the pseudo-label holding the metric name during relabeling.
+const nameLabel = "__name__"
+
+// relabelMetric applies the relabeling rules to the name and labels of metric, replacing its labels. It returns the
+// new metric name, or false if the metric is to be dropped.
+func relabelMetric(name string, metric *dto.Metric, rules []*config.RelabelConfig) (string, bool) {
+	labels := make(map[string]string, len(metric.Label)+1)
+	for _, lp := range metric.Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	labels[nameLabel] = name
+
+	if !relabel(labels, rules) {
+		return "", false
+	}
+	name = labels[nameLabel]
+	if name == "" {
+		return "", false
+	}
+	delete(labels, nameLabel)
+
+	labelPairs := make([]*dto.LabelPair, 0, len(labels))
+	for n, v := range labels {
+		// As with Prometheus, labels with empty values are dropped.
+		if v != "" {
+			labelPairs = append(labelPairs, &dto.LabelPair{Name: proto.String(n), Value: proto.String(v)})
+		}
+	}
+	sort.Slice(labelPairs, func(i, j int) bool { return labelPairs[i].GetName() < labelPairs[j].GetName() })
+	metric.Label = labelPairs
+	return name, true
+}
+
+// relabel applies the relabeling rules to labels, in place. It returns false if the labels are to be dropped.
+func relabel(labels map[string]string, rules []*config.RelabelConfig) bool {
+	for _, r := range rules {
+		values := make([]string, 0, len(r.SourceLabels))
+		for _, l := range r.SourceLabels {
+			values = append(values, labels[l])
+		}
+		value := strings.Join(values, r.Separator)
+		regex := r.Regexp()
+
+		switch r.Action {
+		case config.RelabelKeep:
+			if !regex.MatchString(value) {
+				return false
+			}
+		case config.RelabelDrop:
+			if regex.MatchString(value) {
+				return false
+			}
+		case config.RelabelReplace:
+			indexes := regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(regex.ExpandString(nil, r.TargetLabel, value, indexes))
+			replacement := string(regex.ExpandString(nil, r.Replacement, value, indexes))
+			if target == "" {
+				continue
+			}
+			labels[target] = replacement
+		case config.RelabelLabelMap:
+			mapped := make(map[string]string)
+			for n, v := range labels {
+				if regex.MatchString(n) {
+					mapped[regex.ReplaceAllString(n, r.Replacement)] = v
+				}
+			}
+			for n, v := range mapped {
+				labels[n] = v
+			}
+		case config.RelabelLabelDrop:
+			for n := range labels {
+				if n != nameLabel && regex.MatchString(n) {
+					delete(labels, n)
+				}
+			}
+		case config.RelabelLabelKeep:
+			for n := range labels {
+				if n != nameLabel && !regex.MatchString(n) {
+					delete(labels, n)
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+)
+
+const (
+	// secretRefPrefix prefixes references to secrets held in external secret stores, e.g. `secret://aws-sm/prod-db`.
+	secretRefPrefix = "secret://"
+	// secretTimeout bounds the resolution of all secret references in a data source name.
+	secretTimeout = 10 * time.Second
+	// secretCacheTTL is how long fetched secrets are reused for: long enough to avoid fetching the same secret for
+	// every target (or job) on reload, much shorter than refresh intervals, so every refresh fetches current secrets.
+	secretCacheTTL = 30 * time.Second
+	// secretRefreshInterval is how often secrets referenced by static targets are fetched again, to pick up new
+	// secret versions. Discovered targets' secrets are fetched on every discovery refresh.
+	secretRefreshInterval = 5 * time.Minute
+)
+
+// embeddedSecretRef matches secret references embedded in a data source name, e.g.
+// `postgres://${secret://aws-sm/prod-db#username}:${secret://aws-sm/prod-db#password}@dbhost/postgres`.
+var embeddedSecretRef = regexp.MustCompile(`\$\{(` + regexp.QuoteMeta(secretRefPrefix) + `[^}]+)\}`)
+
+// secretProvider fetches secret values from an external secret store.
+type secretProvider interface {
+	// getSecret returns the current value of the secret at path.
+	getSecret(ctx context.Context, path string) (string, error)
+}
+
+// secretProviders maps the provider names used in secret references to functions creating the providers.
+var secretProviders = map[string]func() (secretProvider, error){
+	"aws-sm":  newAWSSecretsManagerProvider,
+	"aws-ssm": newAWSSSMProvider,
+	"gcp-sm":  newGCPSecretManagerProvider,
+}
+
+// secrets is the process wide secret resolver.
+var secrets = secretResolver{
+	providers: make(map[string]secretProvider),
+	cache:     make(map[string]cachedSecret),
+}
+
+// secretResolver resolves secret references, creating providers on first use and briefly caching secret values.
+type secretResolver struct {
+	mu        sync.Mutex
+	providers map[string]secretProvider
+	cache     map[string]cachedSecret
+}
+
+// cachedSecret is a secret value along with the time it was fetched.
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// hasSecretRefs returns true if dsn is or contains a secret reference.
+func hasSecretRefs(dsn string) bool {
+	return strings.HasPrefix(dsn, secretRefPrefix) || embeddedSecretRef.MatchString(dsn)
+}
+
+// dataSourceHasSecretRefs returns true if any field of ds (which may be nil) is or contains a secret reference.
+func dataSourceHasSecretRefs(ds *config.DataSourceConfig) bool {
+	if ds == nil {
+		return false
+	}
+	for _, f := range []string{ds.Host, ds.Database, ds.User, string(ds.Password)} {
+		if hasSecretRefs(f) {
+			return true
+		}
+	}
+	for _, v := range ds.Options {
+		if hasSecretRefs(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecrets replaces the secret references in dsn with the values of the referenced secrets. dsn may either be a
+// secret reference in its entirety or embed any number of secret references as `${secret://...}`. Secret references
+// have the form `secret://<provider>/<path>[#<key>]`, with the optional key selecting a field of a JSON secret.
+func resolveSecrets(ctx context.Context, dsn string) (string, error) {
+	if !hasSecretRefs(dsn) {
+		return dsn, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, secretTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(dsn, secretRefPrefix) {
+		return secrets.resolve(ctx, dsn)
+	}
+	var err error
+	resolved := embeddedSecretRef.ReplaceAllStringFunc(dsn, func(match string) string {
+		if err != nil {
+			return ""
+		}
+		var value string
+		value, err = secrets.resolve(ctx, embeddedSecretRef.FindStringSubmatch(match)[1])
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// resolve returns the value referenced by ref.
+func (r *secretResolver) resolve(ctx context.Context, ref string) (string, error) {
+	rest := strings.TrimPrefix(ref, secretRefPrefix)
+	var key string
+	if idx := strings.LastIndex(rest, "#"); idx != -1 {
+		rest, key = rest[:idx], rest[idx+1:]
+	}
+	idx := strings.Index(rest, "/")
+	if idx <= 0 || idx == len(rest)-1 {
+		return "", fmt.Errorf("invalid secret reference %q, expecting `secret://<provider>/<path>[#<key>]`", ref)
+	}
+	name, path := rest[:idx], rest[idx+1:]
+
+	value, err := r.get(ctx, name, path)
+	if err != nil {
+		return "", fmt.Errorf("error fetching secret %s%s/%s: %s", secretRefPrefix, name, path, err)
+	}
+	if key == "" {
+		return value, nil
+	}
+	return secretField(value, key)
+}
+
+// get returns the value of the secret at path from the named provider, fetching it unless recently fetched.
+func (r *secretResolver) get(ctx context.Context, name, path string) (string, error) {
+	cacheKey := name + "/" + path
+
+	r.mu.Lock()
+	if cs, found := r.cache[cacheKey]; found && time.Since(cs.fetched) < secretCacheTTL {
+		r.mu.Unlock()
+		return cs.value, nil
+	}
+	provider, found := r.providers[name]
+	if !found {
+		newProvider, known := secretProviders[name]
+		if !known {
+			r.mu.Unlock()
+			return "", fmt.Errorf("unknown secret provider %q", name)
+		}
+		var err error
+		if provider, err = newProvider(); err != nil {
+			r.mu.Unlock()
+			return "", err
+		}
+		r.providers[name] = provider
+	}
+	r.mu.Unlock()
+
+	value, err := provider.getSecret(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.cache[cacheKey] = cachedSecret{value: value, fetched: time.Now()}
+	r.mu.Unlock()
+	return value, nil
+}
+
+// secretField extracts the named top level field from a JSON object secret, e.g. the `password` of an RDS secret.
+func secretField(value, key string) (string, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot extract %q", key)
+	}
+	field, found := fields[key]
+	if !found {
+		return "", fmt.Errorf("key %q not found in secret", key)
+	}
+	if s, ok := field.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(field), nil
+}
@@ -0,0 +1,107 @@
+package sql_exporter
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/free/sql_exporter/config"
+)
+
+// awsRegionalSessions hands out AWS sessions for the region of ARNs, defaulting to the region from the environment.
+// Credentials come from the usual AWS SDK credential chain.
+type awsRegionalSessions struct {
+	base *session.Session
+
+	mu       sync.Mutex
+	sessions map[string]*session.Session
+}
+
+// newAWSRegionalSessions returns a new awsRegionalSessions, with the default credentials and region.
+func newAWSRegionalSessions() (*awsRegionalSessions, error) {
+	base, err := newAWSSession(&config.AWSConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return &awsRegionalSessions{base: base, sessions: make(map[string]*session.Session)}, nil
+}
+
+// forID returns a session for the region of id, if it is an ARN, or the default session otherwise.
+func (s *awsRegionalSessions) forID(id string) *session.Session {
+	a, err := arn.Parse(id)
+	if err != nil || a.Region == "" || a.Region == aws.StringValue(s.base.Config.Region) {
+		return s.base
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, found := s.sessions[a.Region]
+	if !found {
+		sess = s.base.Copy(&aws.Config{Region: aws.String(a.Region)})
+		s.sessions[a.Region] = sess
+	}
+	return sess
+}
+
+// awsSecretsManagerProvider fetches secrets from AWS Secrets Manager, by name or ARN.
+type awsSecretsManagerProvider struct {
+	sessions *awsRegionalSessions
+}
+
+// newAWSSecretsManagerProvider returns a secretProvider for `secret://aws-sm/<name or ARN>` references.
+func newAWSSecretsManagerProvider() (secretProvider, error) {
+	sessions, err := newAWSRegionalSessions()
+	if err != nil {
+		return nil, err
+	}
+	return &awsSecretsManagerProvider{sessions: sessions}, nil
+}
+
+// getSecret implements secretProvider, returning the current version of the secret.
+func (p *awsSecretsManagerProvider) getSecret(ctx context.Context, id string) (string, error) {
+	client := secretsmanager.New(p.sessions.forID(id))
+	out, err := client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	if out.SecretString != nil {
+		return aws.StringValue(out.SecretString), nil
+	}
+	return string(out.SecretBinary), nil
+}
+
+// awsSSMProvider fetches (and decrypts, where needed) parameters from AWS SSM Parameter Store, by name or ARN.
+type awsSSMProvider struct {
+	sessions *awsRegionalSessions
+}
+
+// newAWSSSMProvider returns a secretProvider for `secret://aws-ssm/<name or ARN>` references.
+func newAWSSSMProvider() (secretProvider, error) {
+	sessions, err := newAWSRegionalSessions()
+	if err != nil {
+		return nil, err
+	}
+	return &awsSSMProvider{sessions: sessions}, nil
+}
+
+// getSecret implements secretProvider. Hierarchical parameter names may be given without their leading slash, e.g.
+// `secret://aws-ssm/prod/db/dsn` for parameter `/prod/db/dsn`.
+func (p *awsSSMProvider) getSecret(ctx context.Context, name string) (string, error) {
+	if !arn.IsARN(name) && strings.Contains(name, "/") && !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	client := ssm.New(p.sessions.forID(name))
+	out, err := client.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
@@ -0,0 +1,63 @@
+package sql_exporter
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	gcpSecretManagerURL   = "https://secretmanager.googleapis.com/v1/"
+	gcpSecretManagerScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// gcpSecretName matches GCP Secret Manager secret names, with an optional version.
+var gcpSecretName = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+
+// gcpSecretManagerProvider fetches secrets from GCP Secret Manager, using Application Default Credentials.
+type gcpSecretManagerProvider struct {
+	client *http.Client
+}
+
+// newGCPSecretManagerProvider returns a secretProvider for `secret://gcp-sm/projects/<p>/secrets/<s>` references.
+func newGCPSecretManagerProvider() (secretProvider, error) {
+	ctx := context.Background()
+	tokens, err := newGCPTokenSource(ctx, "", gcpSecretManagerScope)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpSecretManagerProvider{client: oauth2.NewClient(ctx, tokens)}, nil
+}
+
+// getSecret implements secretProvider, returning the latest version of the secret, unless name specifies a version
+// (`projects/<p>/secrets/<s>/versions/<v>`).
+func (p *gcpSecretManagerProvider) getSecret(ctx context.Context, name string) (string, error) {
+	if !gcpSecretName.MatchString(name) {
+		return "", fmt.Errorf("invalid secret name %q, expecting `projects/<project>/secrets/<secret>[/versions/<v>]`",
+			name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	var response struct {
+		Payload struct {
+			Data string `json:"data"` // base64 encoded
+		} `json:"payload"`
+	}
+	u := gcpSecretManagerURL + (&url.URL{Path: name}).EscapedPath() + ":access"
+	if err := callJSONAPI(ctx, p.client, http.MethodGet, u, nil, &response); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(response.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("error decoding secret payload: %s", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,146 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTunnels holds the SSH tunnels shared by all targets, keyed by sshTunnelKey.
+var (
+	sshTunnelsMu sync.Mutex
+	sshTunnels   = make(map[string]*sshTunnel)
+)
+
+// sshTunnel dials database connections through an SSH server. The SSH connection is established on first use, shared
+// by all connections going through the same server and reestablished as needed.
+type sshTunnel struct {
+	config *config.SSHTunnelConfig
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// sshTunnelKey returns a key uniquely identifying the SSH connection described by the config.
+func sshTunnelKey(c *config.SSHTunnelConfig) string {
+	return fmt.Sprintf("%s@%s?key_file=%s&known_hosts=%s", c.User, c.Host, c.KeyFile, c.KnownHosts)
+}
+
+// getSSHTunnel returns the SSH tunnel for the provided config and its key, creating it if necessary. An existing
+// tunnel's config is replaced, to pick up e.g. a changed password on the next connect.
+func getSSHTunnel(c *config.SSHTunnelConfig) (*sshTunnel, string) {
+	key := sshTunnelKey(c)
+	sshTunnelsMu.Lock()
+	defer sshTunnelsMu.Unlock()
+	t, found := sshTunnels[key]
+	if !found {
+		t = &sshTunnel{config: c}
+		sshTunnels[key] = t
+	} else {
+		t.mu.Lock()
+		t.config = c
+		t.mu.Unlock()
+	}
+	return t, key
+}
+
+// dial implements dialFunc, connecting to address from the SSH server.
+func (t *sshTunnel) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, address)
+	if err == nil {
+		return conn, nil
+	}
+	if _, ok := err.(*ssh.OpenChannelError); ok || ctx.Err() != nil {
+		// The SSH server is fine, it couldn't connect to the database.
+		return nil, err
+	}
+
+	// The SSH connection may have silently gone away, reconnect and retry once.
+	t.reset(client)
+	if client, err = t.connect(ctx); err != nil {
+		return nil, err
+	}
+	return client.DialContext(ctx, network, address)
+}
+
+// connect returns the current SSH client, connecting to the SSH server if not already connected.
+func (t *sshTunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	c := t.config
+	hostKeyCallback, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ssh_tunnel known_hosts: %s", err)
+	}
+	var auth ssh.AuthMethod
+	if c.KeyFile != "" {
+		// Read on every connect, so a rotated key is picked up.
+		buf, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ssh_tunnel key_file: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ssh_tunnel key_file %q: %s", c.KeyFile, err)
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		auth = ssh.Password(string(c.Password))
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            c.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", c.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SSH server %s: %s", c.Host, err)
+	}
+	// Bound the SSH handshake by the context, which the SSH package doesn't support directly.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.Host, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to SSH server %s: %s", c.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	t.client = client
+	logger := loggerFromContext(ctx)
+	logger.Debug("Connected to SSH server", "host", c.Host, "user", c.User)
+	go func() {
+		err := client.Wait()
+		logger.Debug("Disconnected from SSH server", "host", c.Host, "err", err)
+		t.reset(client)
+	}()
+	return client, nil
+}
+
+// reset closes the provided client and clears it, if it's still the current one.
+func (t *sshTunnel) reset(client *ssh.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client == client {
+		t.client = nil
+	}
+	client.Close()
+}
@@ -0,0 +1,142 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TargetStatus is the state of a target as of its latest scrape (or background collection).
+type TargetStatus struct {
+	Job    string            `json:"job"`
+	Name   string            `json:"target"`
+	Labels map[string]string `json:"labels"`
+
+	// Whether the latest scrape could connect to the database. False if not scraped yet.
+	Up bool `json:"up"`
+	// Start time and duration of the latest scrape, nil and zero if not scraped yet.
+	LastScrape         *time.Time `json:"last_scrape,omitempty"`
+	LastScrapeDuration float64    `json:"last_scrape_duration_seconds"`
+	// Error connecting to the database during the latest scrape, if any. Collector errors are reported per collector.
+	LastError string `json:"last_error,omitempty"`
+
+	// Statistics of the target's connection pool as of the end of the latest scrape, nil if it had no database handle.
+	ConnectionPool *ConnectionPoolStatus `json:"connection_pool,omitempty"`
+	Collectors     []CollectorStatus     `json:"collectors"`
+}
+
+// ConnectionPoolStatus holds the statistics of a target's connection pool.
+type ConnectionPoolStatus struct {
+	MaxOpen             int     `json:"max_open"` // 0 if unlimited
+	Open                int     `json:"open"`
+	InUse               int     `json:"in_use"`
+	Idle                int     `json:"idle"`
+	WaitCount           int64   `json:"wait_count"`
+	WaitDurationSeconds float64 `json:"wait_duration_seconds"`
+}
+
+// CollectorStatus is the state of one of a target's collectors, as of the latest scrape that ran it.
+type CollectorStatus struct {
+	Name string `json:"name"`
+	// Whether all of the collector's queries succeeded. False if not run yet.
+	Up                 bool    `json:"up"`
+	LastScrapeDuration float64 `json:"last_scrape_duration_seconds"`
+	// The error of the collector's latest failure (of possibly many) and its time, if it ever failed.
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// statusReporter is implemented by targets able to report their status.
+type statusReporter interface {
+	// status returns the target's status as of its latest scrape.
+	status() TargetStatus
+}
+
+// targetStatuses returns the status of all of the jobs' targets able to report it, ordered by job, then target name.
+func targetStatuses(jobs []Job) []TargetStatus {
+	var statuses []TargetStatus
+	for _, j := range jobs {
+		for _, t := range j.Targets() {
+			if r, ok := t.(statusReporter); ok {
+				statuses = append(statuses, r.status())
+			}
+		}
+	}
+	return statuses
+}
+
+// TargetHealth is the outcome of a health check pinging a target's database.
+type TargetHealth struct {
+	Job  string `json:"job"`
+	Name string `json:"target"`
+	// Whether the target's database could be pinged. Not attempted if the target's circuit breaker is open.
+	Up       bool    `json:"up"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// healthChecker is implemented by targets able to ping their database outside of scrapes.
+type healthChecker interface {
+	// healthCheck connects to the target's database, if not connected already, and pings it.
+	healthCheck(ctx context.Context) error
+}
+
+// CheckHealth implements Exporter.
+func (e *exporter) CheckHealth(ctx context.Context, jobName, targetName string) ([]TargetHealth, error) {
+	state, err := e.acquireState()
+	if err != nil {
+		return nil, err
+	}
+	defer state.inFlight.Done()
+
+	var health []TargetHealth
+	var checkers []healthChecker
+	for i, jc := range state.config.Jobs {
+		if jobName != "" && jc.Name != jobName {
+			continue
+		}
+		j, _ := state.jobs[i].(*job)
+		if j == nil {
+			continue
+		}
+		j.mu.RLock()
+		names := make([]string, 0, len(j.targets))
+		for name := range j.targets {
+			if targetName == "" || name == targetName {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if c, ok := j.targets[name].(healthChecker); ok {
+				health = append(health, TargetHealth{Job: jc.Name, Name: name})
+				checkers = append(checkers, c)
+			}
+		}
+		j.mu.RUnlock()
+	}
+	switch {
+	case jobName != "" && state.job(jobName) == nil:
+		return nil, fmt.Errorf("%w %q", ErrUnknownJob, jobName)
+	case targetName != "" && len(health) == 0:
+		return nil, fmt.Errorf("%w %q", ErrUnknownTarget, targetName)
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(h *TargetHealth, c healthChecker) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.healthCheck(ctx)
+			h.Up, h.Duration = err == nil, time.Since(start).Seconds()
+			if err != nil {
+				h.Error = err.Error()
+			}
+		}(&health[i], c)
+	}
+	wg.Wait()
+	return health, nil
+}
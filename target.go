@@ -2,51 +2,189 @@ package sql_exporter
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
 	"fmt"
+	"log/slog"
+	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	// Capacity for the channel to collect metrics.
-	capMetricChan = 1000
+// Capacity for the channels to collect metrics, see SetMetricChannelCapacity.
+var capMetricChan = 1000
+
+// SetMetricChannelCapacity sets the capacity of the channels metrics are passed through from queries to the exporter
+// (1000 by default). Larger buffers allow queries to progress while metrics are being processed, at the cost of
+// memory. It must be called before creating an Exporter.
+func SetMetricChannelCapacity(capacity int) {
+	capMetricChan = capacity
+}
 
+const (
 	upMetricName       = "up"
 	upMetricHelp       = "1 if the target is reachable, or 0 if the scrape failed"
 	scrapeDurationName = "scrape_duration_seconds"
 	scrapeDurationHelp = "How long it took to scrape the target in seconds"
+
+	collectorUpName        = "sql_exporter_collector_up"
+	collectorUpHelp        = "1 if the collector ran successfully, or 0 if any of its queries failed"
+	collectorDurationName  = "sql_exporter_collector_duration_seconds"
+	collectorDurationHelp  = "How long it took the collector to run, in seconds"
+	collectorLastErrorName = "sql_exporter_collector_last_error_timestamp_seconds"
+	collectorLastErrorHelp = "Unix timestamp of the collector's last failure, or 0 if it has not failed yet"
+	collectorCacheAgeName  = "sql_exporter_collector_cache_age_seconds"
+	collectorCacheAgeHelp  = "Age of the cached metrics served by the collector, for collectors with a cache_ttl"
+
+	connectionsOpenName         = "sql_exporter_connections_open"
+	connectionsOpenHelp         = "The number of established connections to the target database, both in use and idle"
+	connectionsInUseName        = "sql_exporter_connections_in_use"
+	connectionsInUseHelp        = "The number of connections to the target database currently in use"
+	connectionsIdleName         = "sql_exporter_connections_idle"
+	connectionsIdleHelp         = "The number of idle connections to the target database"
+	connectionsWaitCountName    = "sql_exporter_connections_wait_count"
+	connectionsWaitCountHelp    = "The total number of times a connection to the target database had to be waited for"
+	connectionsWaitDurationName = "sql_exporter_connections_wait_duration_seconds"
+	connectionsWaitDurationHelp = "The total time spent waiting for connections to the target database, in seconds"
 )
 
+var scrapeOverlaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_scrape_overlaps_total",
+	Help: "Total number of scrapes of a target started while a previous one was still running, which were served the " +
+		"metrics of the latest complete scrape instead.",
+}, []string{"job", "target"})
+
+func init() {
+	prometheus.MustRegister(scrapeOverlaps)
+}
+
 // Target collects SQL metrics from a single sql.DB instance. It aggregates one or more Collectors and it looks much
 // like a prometheus.Collector, except its Collect() method takes a Context to run in.
 type Target interface {
 	// Collect is the equivalent of prometheus.Collector.Collect(), but takes a context to run in.
 	Collect(ctx context.Context, ch chan<- Metric)
+	// Close releases the database handle, if any (closing it, unless shared with other targets). The target should not be
+	// used afterwards.
+	Close() error
 }
 
 // target implements Target. It wraps a sql.DB, which is initially nil but never changes once instantianted.
 type target struct {
 	name               string
 	dsn                string
+	driver             string
 	collectors         []Collector
+	collectorConfigs   []*config.CollectorConfig // indexed like collectors
 	constLabels        prometheus.Labels
+	constLabelPairs    []*dto.LabelPair
 	upDesc             MetricDesc
 	scrapeDurationDesc MetricDesc
+	dbStatsDescs       dbStatsDescs
 	logContext         string
+	logger             *slog.Logger
+
+	// Per-collector status metric descriptors, with a `collector` label.
+	collectorUpDesc        MetricDesc
+	collectorDurationDesc  MetricDesc
+	collectorLastErrorDesc MetricDesc
+
+	// Held by the scrape in progress, if any. Scrapes started meanwhile don't wait for it, they are served lastMetrics.
+	scrapeMu sync.Mutex
+
+	// Protects the scrape status fields, lastMetrics and cockroachDB.
+	mu sync.Mutex
+	// Status as of the latest scrape: start time, duration, whether the target was up and the error if it was not.
+	lastScrape         time.Time
+	lastScrapeDuration time.Duration
+	lastUp             bool
+	lastError          string
+	// Connection pool statistics as of the end of the latest scrape, nil if there was no database handle.
+	lastPoolStats *sql.DBStats
+	// Status of each collector as of the latest scrape that ran it, indexed like collectors.
+	collectorStatuses []CollectorStatus
+	// Metrics of the latest complete scrape running all collectors (errors excepted) and its start time, which they are
+	// timestamped with when served to overlapping scrapes.
+	lastMetrics     []Metric
+	lastMetricsTime time.Time
+	// Whether the target is CockroachDB, nil until detected. Only PostgreSQL driver targets are checked.
+	cockroachDB *bool
 
-	conn *sql.DB
+	// How many times to retry queries failing with serialization errors, on CockroachDB targets.
+	serializationRetries int
+	// Whether to run queries using the simple query protocol, without preparing them (e.g. for PgBouncer).
+	simpleProtocol bool
+	// Values of the `${name}` query parameters.
+	params map[string]string
+	// The job's query template variables.
+	vars map[string]string
+
+	// Optional, skips connecting to the database after repeated failures.
+	breaker *circuitBreaker
+	// Optional, limits the number of collectors running simultaneously (across concurrent scrapes too).
+	collectorSem chan struct{}
+	// Optional, customize how the target connects to the database.
+	hooks connectHooks
+
+	// Optional, records the results of all queries run against the target.
+	recorder *queryRecorder
+	// Optional, the file to replay recorded query results from instead of connecting to the database.
+	replayFile string
+
+	// Held for reading by Collect() and for writing by Close(), so closing waits for in-flight collections.
+	closeMu sync.RWMutex
+	closed  bool
+
+	// Protects conn, which may be set up concurrently by a collection and a health check.
+	connMu sync.Mutex
+	conn   *sql.DB
+	// Whether conn was provided by the caller, who remains responsible for closing it.
+	injectedConn bool
+}
+
+// NewTarget returns a new Target with the given instance name, data source name, collectors and constant labels,
+// logging to logger.
+func NewTarget(logger *slog.Logger, logContext, name, dsn string, ccs []*config.CollectorConfig,
+	constLabels prometheus.Labels) (Target, error) {
+	t, err := newTarget(orDefaultLogger(logger), logContext, name, dsn, ccs, constLabels)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewTargetFromDB returns a new Target like NewTarget, except it collects metrics from the provided database handle
+// rather than connecting to a data source name, e.g. for applications embedding the exporter. driver is the name of
+// the database driver (as in data source name schemes, e.g. "postgres" or "mysql"), used for driver specific query
+// handling. The handle is never closed by the Target, that is up to the caller once done with the Target.
+func NewTargetFromDB(logger *slog.Logger, logContext, name, driver string, db *sql.DB,
+	ccs []*config.CollectorConfig, constLabels prometheus.Labels) (Target, error) {
+	t, err := newTarget(orDefaultLogger(logger), logContext, name, "", ccs, constLabels)
+	if err != nil {
+		return nil, err
+	}
+	t.driver = driver
+	t.conn = db
+	t.injectedConn = true
+	t.replayFile = ""
+	return t, nil
 }
 
-// NewTarget returns a new Target with the given instance name, data source name, collectors and constant labels.
-func NewTarget(logContext, name, dsn string, ccs []*config.CollectorConfig, constLabels prometheus.Labels) (Target, error) {
+// newTarget is the implementation of NewTarget, returning the concrete type for further configuration.
+func newTarget(logger *slog.Logger, logContext, name, dsn string, ccs []*config.CollectorConfig,
+	constLabels prometheus.Labels) (*target, error) {
 	logContext = fmt.Sprintf("%s, target=%q", logContext, name)
+	logger = logger.With("target", name)
 
 	constLabelPairs := make([]*dto.LabelPair, 0, len(constLabels))
 	for n, v := range constLabels {
@@ -55,41 +193,145 @@ func NewTarget(logContext, name, dsn string, ccs []*config.CollectorConfig, cons
 			Value: proto.String(v),
 		})
 	}
-	sort.Sort(prometheus.LabelPairSorter(constLabelPairs))
+	sort.Sort(labelPairSorter(constLabelPairs))
 
+	jobName := constLabels["job"]
 	collectors := make([]Collector, 0, len(ccs))
 	for _, cc := range ccs {
-		c, err := NewCollector(logContext, cc, constLabelPairs)
+		c, err := NewCollector(logger, logContext, cc, constLabelPairs, jobName, name)
 		if err != nil {
 			return nil, err
 		}
 		collectors = append(collectors, c)
 	}
 
+	simpleProtocol, err := isSimpleProtocolDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", logContext, err)
+	}
+
 	upDesc := NewAutomaticMetricDesc(logContext, upMetricName, upMetricHelp, prometheus.GaugeValue, constLabelPairs)
 	scrapeDurationDesc :=
 		NewAutomaticMetricDesc(logContext, scrapeDurationName, scrapeDurationHelp, prometheus.GaugeValue, constLabelPairs)
 	t := target{
 		name:               name,
 		dsn:                dsn,
+		driver:             dsnDriver(dsn),
 		collectors:         collectors,
+		collectorConfigs:   ccs,
 		constLabels:        constLabels,
+		constLabelPairs:    constLabelPairs,
 		upDesc:             upDesc,
 		scrapeDurationDesc: scrapeDurationDesc,
+		dbStatsDescs:       newDBStatsDescs(logContext, constLabelPairs),
 		logContext:         logContext,
+		logger:             logger,
+		collectorUpDesc: NewAutomaticMetricDesc(
+			logContext, collectorUpName, collectorUpHelp, prometheus.GaugeValue, constLabelPairs, "collector"),
+		collectorDurationDesc: NewAutomaticMetricDesc(
+			logContext, collectorDurationName, collectorDurationHelp, prometheus.GaugeValue, constLabelPairs, "collector"),
+		collectorLastErrorDesc: NewAutomaticMetricDesc(
+			logContext, collectorLastErrorName, collectorLastErrorHelp, prometheus.GaugeValue, constLabelPairs, "collector"),
+		collectorStatuses:    make([]CollectorStatus, len(collectors)),
+		serializationRetries: config.DefaultSerializationRetries,
+		simpleProtocol:       simpleProtocol,
+	}
+	if queryReplayDir != "" {
+		t.replayFile = recordingFile(queryReplayDir, jobName, name)
+	} else if queryRecordDir != "" {
+		t.recorder = newQueryRecorder(recordingFile(queryRecordDir, jobName, name))
 	}
 	return &t, nil
 }
 
-// Collect implements Target.
+// Collect implements Target. Rather than run the same queries concurrently, scrapes overlapping a scrape still in
+// progress are served the metrics of the latest complete one, or an error if there is none. Scrapes only running some
+// of the collectors are served an error when overlapping, and don't replace the metrics served to overlapping scrapes.
 func (t *target) Collect(ctx context.Context, ch chan<- Metric) {
+	filtered := collectorFilterFromContext(ctx) != nil
+	if !t.scrapeMu.TryLock() {
+		t.collectOverlapping(filtered, ch)
+		return
+	}
+	defer t.scrapeMu.Unlock()
+	if filtered {
+		t.collect(ctx, ch)
+		return
+	}
+
+	collTime := time.Now()
+	collCh := make(chan Metric, capMetricChan)
+	go func() {
+		t.collect(ctx, collCh)
+		close(collCh)
+	}()
+	metrics := make([]Metric, 0, len(t.lastMetrics))
+	for metric := range collCh {
+		if _, invalid := metric.(invalidMetric); !invalid {
+			metrics = append(metrics, metric)
+		}
+		ch <- metric
+	}
+	t.mu.Lock()
+	t.lastMetrics, t.lastMetricsTime = metrics, collTime
+	t.mu.Unlock()
+}
+
+// collectOverlapping serves a scrape overlapping the one in progress the metrics of the latest complete scrape, unless
+// it only runs some of the collectors (i.e. is filtered).
+func (t *target) collectOverlapping(filtered bool, ch chan<- Metric) {
+	scrapeOverlaps.WithLabelValues(t.constLabels["job"], t.name).Inc()
+	if filtered {
+		ch <- NewInvalidMetric(t.logContext, fmt.Errorf("previous scrape still running"))
+		return
+	}
+	t.mu.Lock()
+	metrics, collTime := t.lastMetrics, t.lastMetricsTime
+	t.mu.Unlock()
+	if metrics == nil {
+		ch <- NewInvalidMetric(t.logContext, fmt.Errorf("previous scrape still running, no complete scrape to serve"))
+		return
+	}
+	t.logger.Debug("Previous scrape still running, serving the latest complete one")
+	for _, metric := range metrics {
+		ch <- NewMetricWithTimestamp(collTime, metric)
+	}
+}
+
+// collect collects metrics from the target, as per Collect.
+func (t *target) collect(ctx context.Context, ch chan<- Metric) {
+	t.closeMu.RLock()
+	defer t.closeMu.RUnlock()
+	if t.closed {
+		return
+	}
+	ctx = withLogger(ctx, t.logger)
+	ctx, span := tracer.Start(ctx, "collect target", trace.WithAttributes(
+		attribute.String("sql_exporter.job", t.constLabels["job"]),
+		attribute.String("sql_exporter.target", t.name),
+		semconv.DBSystemKey.String(t.driver),
+	))
+
 	var (
 		scrapeStart = time.Now()
 		targetUp    = true
 	)
 
-	err := t.ping(ctx)
+	var err error
+	defer func() { endSpan(span, err) }()
+	// The collection fails (as far as the circuit breaker is concerned) if the target is down or all collectors fail.
+	var (
+		allowed          = t.breaker.allow()
+		collectorsRun    int
+		collectorsFailed atomic.Int32
+	)
+	if allowed == nil {
+		err = t.ping(ctx)
+	} else {
+		err = allowed
+	}
 	if err != nil {
+		err = redactError(err, t.dsn)
 		ch <- NewInvalidMetric(t.logContext, err)
 		targetUp = false
 	}
@@ -99,41 +341,258 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric) {
 	var wg sync.WaitGroup
 	// Don't bother with the collectors if target is down.
 	if targetUp {
-		wg.Add(len(t.collectors))
-		for _, c := range t.collectors {
+		ctx = withDriver(ctx, t.driver)
+		if t.params != nil {
+			ctx = withQueryParams(ctx, t.params)
+		}
+		ctx = withQueryTemplateData(ctx, &queryTemplateData{
+			Target: t.name,
+			Job:    t.constLabels["job"],
+			Labels: t.constLabels,
+			Vars:   t.vars,
+		})
+		if t.simpleProtocol {
+			ctx = withSimpleProtocol(ctx)
+		} else if t.isCockroachDB(ctx) {
+			ctx = withSerializationRetries(ctx, t.serializationRetries)
+		}
+		if t.recorder != nil {
+			ctx = withQueryRecorder(ctx, t.recorder)
+		}
+		filter := collectorFilterFromContext(ctx)
+		for i, c := range t.collectors {
+			if filter != nil && !filter[c.Name()] {
+				continue
+			}
+			wg.Add(1)
+			collectorsRun++
 			// If using a single DB connection, collectors will likely run sequentially anyway. But we might have more than 1/
-			go func(collector Collector) {
+			go func(i int, collector Collector) {
 				defer wg.Done()
-				collector.Collect(ctx, t.conn, ch)
-			}(c)
+				if t.collectorSem != nil {
+					select {
+					case t.collectorSem <- struct{}{}:
+						defer func() { <-t.collectorSem }()
+					case <-ctx.Done():
+						// Run the collector regardless, so it fails and reports the error.
+					}
+				}
+				if !t.runCollector(ctx, i, collector, ch) {
+					collectorsFailed.Add(1)
+				}
+			}(i, c)
 		}
 	}
 	// Wait for all collectors (if any) to complete.
 	wg.Wait()
+	if allowed == nil {
+		t.breaker.record(targetUp && (collectorsRun == 0 || int(collectorsFailed.Load()) < collectorsRun))
+	}
+	if err := t.recorder.write(); err != nil {
+		t.logger.Error("Error recording query results", "err", err)
+	}
+
+	// Sample the connection pool statistics, if we have a DB handle.
+	var poolStats *sql.DBStats
+	if conn := t.db(); conn != nil {
+		stats := conn.Stats()
+		poolStats = &stats
+		t.dbStatsDescs.collect(stats, ch)
+	}
 
 	// And export a `scrape duration` metric once we're done scraping.
-	ch <- NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9)
+	scrapeDuration := time.Since(scrapeStart)
+	ch <- NewMetric(t.scrapeDurationDesc, float64(scrapeDuration)*1e-9)
+
+	t.mu.Lock()
+	t.lastScrape, t.lastScrapeDuration, t.lastUp, t.lastError = scrapeStart, scrapeDuration, targetUp, ""
+	t.lastPoolStats = poolStats
+	if err != nil {
+		t.lastError = err.Error()
+	}
+	t.mu.Unlock()
 }
 
-func (t *target) ping(ctx context.Context) error {
-	// Create the DB handle, if necessary. It won't usually open an actual connection, so we'll need to ping afterwards.
-	// We cannot do this only once at creation time because the sql.Open() documentation says it "may" open an actual
-	// connection, so it "may" actually fail to open a handle to a DB that's initially down.
-	if t.conn == nil {
-		conn, err := OpenConnection(ctx, t.logContext, t.dsn)
-		if err != nil {
-			if err != ctx.Err() {
+// runCollector runs the i-th collector, passing its metrics through to ch, then exports the collector's status metrics.
+// The collector is considered to have failed if it produced any invalid metrics. It returns whether the collector
+// succeeded.
+func (t *target) runCollector(ctx context.Context, i int, collector Collector, ch chan<- Metric) bool {
+	var (
+		collectorStart = time.Now()
+		collectorErr   error
+		collectorChan  = make(chan Metric, capMetricChan)
+	)
+	ctx, span := tracer.Start(ctx, "collect collector",
+		trace.WithAttributes(attribute.String("sql_exporter.collector", collector.Name())))
+	go func() {
+		collector.Collect(ctx, t.db(), collectorChan)
+		close(collectorChan)
+	}()
+	for metric := range collectorChan {
+		if m, ok := metric.(invalidMetric); ok && collectorErr == nil {
+			collectorErr = m.err
+		}
+		ch <- metric
+	}
+	endSpan(span, collectorErr)
+	collectorUp := collectorErr == nil
+	duration := time.Since(collectorStart).Seconds()
+
+	name := collector.Name()
+	t.mu.Lock()
+	status := &t.collectorStatuses[i]
+	status.Name, status.Up, status.LastScrapeDuration = name, collectorUp, duration
+	if !collectorUp {
+		now := time.Now()
+		status.LastError, status.LastErrorTime = redactError(collectorErr, t.dsn).Error(), &now
+	}
+	lastError := status.LastErrorTime
+	t.mu.Unlock()
+
+	var lastErrorTimestamp float64
+	if lastError != nil {
+		lastErrorTimestamp = float64(lastError.UnixNano()) * 1e-9
+	}
+	ch <- NewMetric(t.collectorUpDesc, boolToFloat64(collectorUp), name)
+	ch <- NewMetric(t.collectorDurationDesc, duration, name)
+	ch <- NewMetric(t.collectorLastErrorDesc, lastErrorTimestamp, name)
+	return collectorUp
+}
+
+// status implements statusReporter.
+func (t *target) status() TargetStatus {
+	t.closeMu.RLock()
+	collectors := t.collectors
+	t.closeMu.RUnlock()
+
+	labels := make(map[string]string, len(t.constLabels))
+	for name, value := range t.constLabels {
+		labels[name] = value
+	}
+	status := TargetStatus{
+		Job:        t.constLabels["job"],
+		Name:       t.name,
+		Labels:     labels,
+		Collectors: make([]CollectorStatus, len(collectors)),
+	}
+
+	t.mu.Lock()
+	status.Up, status.LastError = t.lastUp, t.lastError
+	if !t.lastScrape.IsZero() {
+		lastScrape := t.lastScrape
+		status.LastScrape = &lastScrape
+	}
+	status.LastScrapeDuration = t.lastScrapeDuration.Seconds()
+	copy(status.Collectors, t.collectorStatuses)
+	poolStats := t.lastPoolStats
+	t.mu.Unlock()
+	// Collectors that haven't run yet only have a name.
+	for i, c := range collectors {
+		status.Collectors[i].Name = c.Name()
+	}
+
+	if poolStats != nil {
+		status.ConnectionPool = &ConnectionPoolStatus{
+			MaxOpen:             poolStats.MaxOpenConnections,
+			Open:                poolStats.OpenConnections,
+			InUse:               poolStats.InUse,
+			Idle:                poolStats.Idle,
+			WaitCount:           poolStats.WaitCount,
+			WaitDurationSeconds: poolStats.WaitDuration.Seconds(),
+		}
+	}
+	return status
+}
+
+// replaceCollectors rebuilds the target's collectors with a replacement config in ccs (keyed by collector name), once
+// any in-flight collection completes. The target's other collectors and its database handle are left untouched.
+func (t *target) replaceCollectors(ccs map[string]*config.CollectorConfig) error {
+	collectors := make([]Collector, len(t.collectors))
+	configs := make([]*config.CollectorConfig, len(t.collectorConfigs))
+	replaced := false
+	for i, cc := range t.collectorConfigs {
+		collectors[i], configs[i] = t.collectors[i], cc
+		if replacement, found := ccs[cc.Name]; found {
+			c, err := NewCollector(t.logger, t.logContext, replacement, t.constLabelPairs, t.constLabels["job"], t.name)
+			if err != nil {
 				return err
 			}
-			// if err == ctx.Err() fall through
-		} else {
-			t.conn = conn
+			collectors[i], configs[i] = c, replacement
+			replaced = true
+		}
+	}
+	if !replaced {
+		return nil
+	}
+
+	t.closeMu.Lock()
+	previous := t.collectors
+	t.collectors = collectors
+	t.collectorConfigs = configs
+	t.closeMu.Unlock()
+
+	for i, c := range previous {
+		if c != collectors[i] {
+			stopCollector(c)
+		}
+	}
+	return nil
+}
+
+// Close implements Target.
+func (t *target) Close() error {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	t.closed = true
+	// Background collections must complete before the database handle is released.
+	for _, c := range t.collectors {
+		stopCollector(c)
+	}
+	t.connMu.Lock()
+	conn := t.conn
+	t.conn = nil
+	t.connMu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if t.injectedConn {
+		return nil
+	}
+	return connections.release(conn)
+}
+
+// healthCheck implements healthChecker.
+func (t *target) healthCheck(ctx context.Context) error {
+	t.closeMu.RLock()
+	defer t.closeMu.RUnlock()
+	if t.closed {
+		return fmt.Errorf("target closed")
+	}
+	if err := t.breaker.open(); err != nil {
+		return err
+	}
+	if err := t.ping(withLogger(ctx, t.logger)); err != nil {
+		return redactError(err, t.dsn)
+	}
+	return nil
+}
+
+func (t *target) ping(ctx context.Context) error {
+	conn, err := t.connect(ctx)
+	if err != nil {
+		if err != ctx.Err() {
+			return err
 		}
+		// if err == ctx.Err() fall through
 	}
 
 	// If we have a handle and the context is not closed, check whether the connection is up.
-	if t.conn != nil && ctx.Err() == nil {
-		if err := PingDB(ctx, t.conn); err != nil {
+	if conn != nil && ctx.Err() == nil {
+		ping := PingDB
+		if t.simpleProtocol {
+			ping = connectDB
+		}
+		if err := ping(ctx, conn); err != nil {
 			if err != ctx.Err() {
 				return err
 			}
@@ -147,6 +606,279 @@ func (t *target) ping(ctx context.Context) error {
 	return nil
 }
 
+// connect returns the target's DB handle, creating it if necessary. It won't usually open an actual connection, so
+// we'll need to ping afterwards. We cannot do this only once at creation time because the sql.Open() documentation
+// says it "may" open an actual connection, so it "may" actually fail to open a handle to a DB that's initially down.
+func (t *target) connect(ctx context.Context) (*sql.DB, error) {
+	if conn := t.db(); conn != nil {
+		return conn, nil
+	}
+
+	// Don't hold connMu while connecting, it may take a while.
+	var (
+		conn *sql.DB
+		err  error
+	)
+	if t.replayFile != "" {
+		conn, err = openReplayDB(t.replayFile)
+	} else {
+		conn, err = connections.acquire(ctx, t.logger, t.dsn, t.hooks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	if t.conn != nil {
+		// A concurrent health check or collection got there first, use its handle.
+		if err := connections.release(conn); err != nil {
+			t.logger.Warn("Error releasing database handle", "err", redactError(err, t.dsn))
+		}
+		return t.conn, nil
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+// db returns the target's DB handle, nil if not created yet.
+func (t *target) db() *sql.DB {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	return t.conn
+}
+
+// isCockroachDB returns true if the target is CockroachDB. Detection happens on the first successful call, after
+// which the result is cached; a detection failure is logged and retried on the next scrape.
+func (t *target) isCockroachDB(ctx context.Context) bool {
+	conn := t.db()
+	if (t.driver != "postgres" && t.driver != "postgresql") || conn == nil || t.replayFile != "" {
+		return false
+	}
+	t.mu.Lock()
+	detected := t.cockroachDB
+	t.mu.Unlock()
+	if detected != nil {
+		return *detected
+	}
+
+	isCockroach, err := isCockroachDB(ctx, conn)
+	if err != nil {
+		t.logger.Warn("Failed to check whether target is CockroachDB", "err", redactError(err, t.dsn))
+		return false
+	}
+	if isCockroach {
+		t.logger.Debug("Target is CockroachDB, retrying serialization failures")
+	}
+	t.mu.Lock()
+	t.cockroachDB = &isCockroach
+	t.mu.Unlock()
+	return isCockroach
+}
+
+// dbStatsDescs groups the descriptors of the metrics exported from a target's sql.DBStats.
+type dbStatsDescs struct {
+	open         MetricDesc
+	inUse        MetricDesc
+	idle         MetricDesc
+	waitCount    MetricDesc
+	waitDuration MetricDesc
+}
+
+// newDBStatsDescs creates the descriptors of the connection pool metrics, with the given const labels.
+func newDBStatsDescs(logContext string, constLabels []*dto.LabelPair) dbStatsDescs {
+	return dbStatsDescs{
+		open: NewAutomaticMetricDesc(
+			logContext, connectionsOpenName, connectionsOpenHelp, prometheus.GaugeValue, constLabels),
+		inUse: NewAutomaticMetricDesc(
+			logContext, connectionsInUseName, connectionsInUseHelp, prometheus.GaugeValue, constLabels),
+		idle: NewAutomaticMetricDesc(
+			logContext, connectionsIdleName, connectionsIdleHelp, prometheus.GaugeValue, constLabels),
+		waitCount: NewAutomaticMetricDesc(
+			logContext, connectionsWaitCountName, connectionsWaitCountHelp, prometheus.CounterValue, constLabels),
+		waitDuration: NewAutomaticMetricDesc(
+			logContext, connectionsWaitDurationName, connectionsWaitDurationHelp, prometheus.CounterValue, constLabels),
+	}
+}
+
+// collect exports the provided connection pool statistics as metrics.
+func (d *dbStatsDescs) collect(stats sql.DBStats, ch chan<- Metric) {
+	ch <- NewMetric(d.open, float64(stats.OpenConnections))
+	ch <- NewMetric(d.inUse, float64(stats.InUse))
+	ch <- NewMetric(d.idle, float64(stats.Idle))
+	ch <- NewMetric(d.waitCount, float64(stats.WaitCount))
+	ch <- NewMetric(d.waitDuration, stats.WaitDuration.Seconds())
+}
+
+// scheduledTarget is a Target that collects metrics from the wrapped Target in the background, at a fixed interval,
+// decoupled from scrapes. Its Collect() method returns the metrics from the latest collection, timestamped with the
+// time that collection started.
+type scheduledTarget struct {
+	target   Target
+	interval time.Duration
+	// Maximum random delay applied to every collection.
+	jitter time.Duration
+	// Delay before the first collection.
+	offset time.Duration
+
+	// Protects metrics.
+	mu sync.Mutex
+	// Metrics produced by the latest background collection.
+	metrics []Metric
+
+	// Stops the background collection.
+	cancel context.CancelFunc
+	// Closed once the background collection goroutine has exited.
+	done chan struct{}
+}
+
+// newScheduledTarget returns a new Target wrapping the provided one and starts collecting from it in the background,
+// every interval, after an initial offset and with a random delay of up to jitter before every collection.
+func newScheduledTarget(t Target, interval, jitter, offset time.Duration) Target {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &scheduledTarget{
+		target:   t,
+		interval: interval,
+		jitter:   jitter,
+		offset:   offset,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go st.run(ctx)
+	return st
+}
+
+// scheduleOffset returns the offset of the first background collection from the target named targetName of the job
+// named jobName, spreading the collections of all targets evenly over the interval. Every target is assigned a fixed
+// phase (derived from the job and target names) relative to multiples of the interval since the Unix epoch, so its
+// collections happen at the same point of the interval regardless of when the exporter was started or reloaded.
+func scheduleOffset(jobName, targetName string, interval time.Duration) time.Duration {
+	// A cryptographic hash, so that similarly named targets (e.g. `db1`, `db2`) don't end up with similar phases.
+	h := sha256.Sum256([]byte(jobName + "\x00" + targetName))
+	phase := time.Duration(binary.BigEndian.Uint64(h[:8]) % uint64(interval))
+	now := time.Duration(time.Now().UnixNano() % int64(interval))
+	return (phase - now + interval) % interval
+}
+
+// run collects metrics from the wrapped target after the offset and then on every tick, each time after a random
+// delay of up to jitter, until ctx is cancelled.
+func (st *scheduledTarget) run(ctx context.Context) {
+	defer close(st.done)
+
+	if !sleepContext(ctx, st.offset) {
+		return
+	}
+	ticker := time.NewTicker(st.interval)
+	defer ticker.Stop()
+	for {
+		if st.jitter > 0 && !sleepContext(ctx, time.Duration(rand.Int63n(int64(st.jitter)))) {
+			return
+		}
+		st.collect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sleepContext waits for d to elapse, returning true; or for ctx to be cancelled, returning false.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// collect performs one collection from the wrapped target, using the interval as timeout, and replaces the previously
+// collected metrics with the fresh ones.
+func (st *scheduledTarget) collect(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, st.interval)
+	defer cancel()
+
+	collTime := time.Now()
+	ch := make(chan Metric, capMetricChan)
+	go func() {
+		st.target.Collect(ctx, ch)
+		close(ch)
+	}()
+
+	// No need to lock for reading st.metrics, it is only ever updated by this goroutine.
+	metrics := make([]Metric, 0, len(st.metrics))
+	for metric := range ch {
+		metrics = append(metrics, NewMetricWithTimestamp(collTime, metric))
+	}
+
+	st.mu.Lock()
+	st.metrics = metrics
+	st.mu.Unlock()
+}
+
+// Collect implements Target.
+func (st *scheduledTarget) Collect(ctx context.Context, ch chan<- Metric) {
+	st.mu.Lock()
+	metrics := st.metrics
+	st.mu.Unlock()
+
+	for _, metric := range metrics {
+		ch <- metric
+	}
+}
+
+// replaceCollectors rebuilds the wrapped target's collectors with a replacement config in ccs, if any.
+func (st *scheduledTarget) replaceCollectors(ccs map[string]*config.CollectorConfig) error {
+	if r, ok := st.target.(collectorReplacer); ok {
+		return r.replaceCollectors(ccs)
+	}
+	return nil
+}
+
+// status implements statusReporter, reporting the status of the wrapped target as of its latest background collection.
+func (st *scheduledTarget) status() TargetStatus {
+	if r, ok := st.target.(statusReporter); ok {
+		return r.status()
+	}
+	return TargetStatus{}
+}
+
+// healthCheck implements healthChecker, pinging the wrapped target's database.
+func (st *scheduledTarget) healthCheck(ctx context.Context) error {
+	if c, ok := st.target.(healthChecker); ok {
+		return c.healthCheck(ctx)
+	}
+	return nil
+}
+
+// Close implements Target.
+func (st *scheduledTarget) Close() error {
+	st.cancel()
+	<-st.done
+	return st.target.Close()
+}
+
+// collectorFilterKey is the context key under which the set of collectors to run is stored.
+type collectorFilterKey struct{}
+
+// withCollectorFilter returns a copy of ctx that restricts Target.Collect() to the given set of collectors.
+func withCollectorFilter(ctx context.Context, collectors map[string]bool) context.Context {
+	return context.WithValue(ctx, collectorFilterKey{}, collectors)
+}
+
+// collectorFilterFromContext returns the set of collectors to run, or nil if all collectors should run.
+func collectorFilterFromContext(ctx context.Context) map[string]bool {
+	filter, _ := ctx.Value(collectorFilterKey{}).(map[string]bool)
+	return filter
+}
+
 // boolToFloat64 converts a boolean flag to a float64 value (0.0 or 1.0).
 func boolToFloat64(value bool) float64 {
 	if value {
@@ -0,0 +1,206 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/free/sql_exporter/config"
+	"gopkg.in/yaml.v2"
+)
+
+// newTestTarget returns a target collecting from a SQLite database in a temporary directory, with the given job
+// settings (in YAML, e.g. `max_parallel_collectors: 1`) and a single collector running query (`SELECT 1 AS v` if
+// empty).
+func newTestTarget(t *testing.T, jobSettings, query string) *target {
+	t.Helper()
+	if query == "" {
+		query = "SELECT 1 AS v"
+	}
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "test.db") + "?mode=rwc"
+	var c config.Config
+	if err := yaml.Unmarshal([]byte(fmt.Sprintf(`
+jobs:
+  - job_name: test
+    collectors: [test]
+    %s
+    static_configs:
+      - targets:
+          db: '%s'
+collectors:
+  - collector_name: test
+    metrics:
+      - metric_name: one
+        type: gauge
+        help: 'One.'
+        values: [v]
+        query: %s
+`, jobSettings, dsn, query)), &c); err != nil {
+		t.Fatal(err)
+	}
+	tt, err := NewProbeTarget(nil, c.Jobs[0], "db", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tt.(*target)
+}
+
+// collectAll runs a collection of t, returning the metrics collected.
+func collectAll(ctx context.Context, t Target) []Metric {
+	ch := make(chan Metric, capMetricChan)
+	go func() {
+		t.Collect(ctx, ch)
+		close(ch)
+	}()
+	var metrics []Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// TestTargetConcurrentHealthCheckAndCollect checks that health checks and collections racing to set up the database
+// handle end up sharing a single one, with a single reference to it. Meant to be run with -race.
+func TestTargetConcurrentHealthCheckAndCollect(t *testing.T) {
+	tt := newTestTarget(t, "", "")
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			collectAll(ctx, tt)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tt.healthCheck(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	conn := tt.db()
+	if conn == nil {
+		t.Fatal("no database handle after collecting")
+	}
+	connections.mu.Lock()
+	refs := 0
+	for _, sc := range connections.conns {
+		if sc.conn == conn {
+			refs = sc.refs
+		}
+	}
+	connections.mu.Unlock()
+	if refs != 1 {
+		t.Errorf("database handle has %d references, want 1", refs)
+	}
+
+	if err := tt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	for _, sc := range connections.conns {
+		if sc.conn == conn {
+			t.Errorf("database handle still registered after closing the target")
+		}
+	}
+}
+
+// metricNames returns the names of metrics, in order.
+func metricNames(metrics []Metric) []string {
+	names := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		names = append(names, m.Desc().Name())
+	}
+	return names
+}
+
+// TestTargetOverlappingScrapes checks that scrapes overlapping one in progress are served the latest complete scrape,
+// timestamped with its start time, or an error if they only run some of the collectors.
+func TestTargetOverlappingScrapes(t *testing.T) {
+	tt := newTestTarget(t, "", "")
+	defer tt.Close()
+	ctx := context.Background()
+	complete := collectAll(ctx, tt)
+
+	// Pretend a scrape is in progress.
+	tt.scrapeMu.Lock()
+	defer tt.scrapeMu.Unlock()
+
+	served := collectAll(ctx, tt)
+	if got, want := fmt.Sprint(metricNames(served)), fmt.Sprint(metricNames(complete)); got != want {
+		t.Errorf("overlapping scrape served %s, want %s", got, want)
+	}
+	for _, m := range served {
+		if _, ok := m.(*timestampedMetric); !ok {
+			t.Errorf("overlapping scrape served %s without a timestamp", m.Desc().Name())
+		}
+	}
+
+	served = collectAll(withCollectorFilter(ctx, map[string]bool{"test": true}), tt)
+	if len(served) != 1 {
+		t.Fatalf("overlapping filtered scrape served %d metrics, want a single error", len(served))
+	}
+	if _, ok := served[0].(invalidMetric); !ok {
+		t.Errorf("overlapping filtered scrape served %s, want an error", served[0].Desc().Name())
+	}
+}
+
+// TestTargetConcurrentFilteredAndFullScrapes checks that filtered and full scrapes don't run the same queries
+// concurrently and that filtered scrapes don't replace the latest complete scrape. Meant to be run with -race.
+func TestTargetConcurrentFilteredAndFullScrapes(t *testing.T) {
+	tt := newTestTarget(t, "", "")
+	defer tt.Close()
+	ctx := context.Background()
+	filtered := withCollectorFilter(ctx, map[string]bool{"test": true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			collectAll(ctx, tt)
+		}()
+		go func() {
+			defer wg.Done()
+			collectAll(filtered, tt)
+		}()
+	}
+	wg.Wait()
+
+	collectAll(ctx, tt)
+	tt.mu.Lock()
+	complete := tt.lastMetricsTime
+	tt.mu.Unlock()
+	collectAll(filtered, tt)
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if !tt.lastMetricsTime.Equal(complete) {
+		t.Errorf("filtered scrape replaced the latest complete scrape")
+	}
+}
+
+// TestTargetCircuitBreaker checks that collections failing altogether open the circuit breaker, even if the target can
+// be pinged.
+func TestTargetCircuitBreaker(t *testing.T) {
+	tt := newTestTarget(t, "circuit_breaker: {failure_threshold: 2, cooldown: 1h}", "SELECT v FROM missing")
+	defer tt.Close()
+	ctx := context.Background()
+
+	collectAll(ctx, tt)
+	if err := tt.breaker.open(); err != nil {
+		t.Fatalf("circuit breaker open after a single failed collection: %s", err)
+	}
+	collectAll(ctx, tt)
+	if tt.breaker.open() == nil {
+		t.Fatal("circuit breaker closed after 2 failed collections")
+	}
+}
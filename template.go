@@ -0,0 +1,40 @@
+package sql_exporter
+
+import (
+	"context"
+	"strings"
+	"text/template"
+)
+
+// queryTemplateData is the data query templates are rendered with.
+type queryTemplateData struct {
+	Target string            // the target name
+	Job    string            // the job name
+	Labels map[string]string // the target's labels, including `job` and `instance`
+	Vars   map[string]string // the job's template variables
+}
+
+// queryTemplateDataKey is the context key under which the data to render query templates with is stored.
+type queryTemplateDataKey struct{}
+
+// withQueryTemplateData returns a copy of ctx holding the data to render query templates with.
+func withQueryTemplateData(ctx context.Context, data *queryTemplateData) context.Context {
+	return context.WithValue(ctx, queryTemplateDataKey{}, data)
+}
+
+// queryTemplateDataFromContext returns the data to render query templates with, empty if not set.
+func queryTemplateDataFromContext(ctx context.Context) *queryTemplateData {
+	if data, ok := ctx.Value(queryTemplateDataKey{}).(*queryTemplateData); ok {
+		return data
+	}
+	return &queryTemplateData{}
+}
+
+// renderQuery renders a query template with the provided data.
+func renderQuery(tmpl *template.Template, data *queryTemplateData) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
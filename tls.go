@@ -0,0 +1,123 @@
+package sql_exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlTLSSeq generates unique names for registering MySQL TLS configs.
+var mysqlTLSSeq uint64
+
+// withTLS returns dsn with the driver specific settings equivalent to the provided TLS config. Returns an error if
+// the driver doesn't support some of the settings.
+func withTLS(dsn string, c *config.TLSConfig) (string, error) {
+	idx := strings.Index(dsn, "://")
+	if idx == -1 {
+		return "", fmt.Errorf("missing driver in data source name")
+	}
+	driver := dsn[:idx]
+
+	if driver == "mysql" {
+		cfg, err := mysql.ParseDSN(dsn[idx+3:])
+		if err != nil {
+			return "", err
+		}
+		tlsConfig, err := newTLSConfig(c)
+		if err != nil {
+			return "", err
+		}
+		// As with dial functions, TLS configs are looked up by name. Deregistering them is not worth the bother.
+		name := fmt.Sprintf("sql_exporter_%d", atomic.AddUint64(&mysqlTLSSeq, 1))
+		if err = mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+			return "", err
+		}
+		cfg.TLSConfig = name
+		return "mysql://" + cfg.FormatDSN(), nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	switch driver {
+	case "postgres", "postgresql":
+		if c.ServerName != "" {
+			return "", fmt.Errorf("tls server_name is not supported by the %s driver", driver)
+		}
+		if c.InsecureSkipVerify {
+			params.Set("sslmode", "require")
+		} else {
+			params.Set("sslmode", "verify-full")
+		}
+		setParam(params, "sslrootcert", c.CAFile)
+		setParam(params, "sslcert", c.CertFile)
+		setParam(params, "sslkey", c.KeyFile)
+
+	case "sqlserver", "mssql":
+		if c.CertFile != "" {
+			return "", fmt.Errorf("tls client certificates are not supported by the %s driver", driver)
+		}
+		params.Set("encrypt", "true")
+		if c.InsecureSkipVerify {
+			params.Set("TrustServerCertificate", "true")
+		}
+		setParam(params, "certificate", c.CAFile)
+		setParam(params, "hostNameInCertificate", c.ServerName)
+
+	case "clickhouse":
+		if c.CAFile != "" || c.CertFile != "" || c.ServerName != "" {
+			return "", fmt.Errorf("only tls insecure_skip_verify is supported by the %s driver", driver)
+		}
+		params.Set("secure", "true")
+		if c.InsecureSkipVerify {
+			params.Set("skip_verify", "true")
+		}
+
+	default:
+		return "", fmt.Errorf("tls config is not supported for driver %q", driver)
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// setParam sets the named parameter to value, if value is not empty.
+func setParam(params url.Values, name, value string) {
+	if value != "" {
+		params.Set(name, value)
+	}
+}
+
+// newTLSConfig returns a crypto/tls config equivalent to c, loading the CA and client certificates.
+func newTLSConfig(c *config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		buf, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tls ca_file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in tls ca_file %q", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,44 @@
+package sql_exporter
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of scrapes, targets, collectors and queries. Unless the application sets a global tracer
+// provider, spans are not recorded.
+var tracer = otel.Tracer("github.com/free/sql_exporter")
+
+// maxTracedStatementLength is the length query texts are truncated to in query spans, if positive.
+var maxTracedStatementLength int
+
+// TruncateTracedStatements makes query spans truncate the query text (the `db.statement` attribute) to maxLength bytes,
+// if positive. It must be called before creating an Exporter.
+func TruncateTracedStatements(maxLength int) {
+	maxTracedStatementLength = maxLength
+}
+
+// traceStatement adds the query text run to the query span of ctx, if any, truncated as configured.
+func traceStatement(ctx context.Context, text string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	if maxTracedStatementLength > 0 && len(text) > maxTracedStatementLength {
+		text = text[:maxTracedStatementLength]
+	}
+	span.SetAttributes(semconv.DBStatement(text))
+}
+
+// endSpan sets the status of span to error if err is not nil, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,155 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// parseValue converts a value column, scanned as a string, to a float64 according to the metric's value_format:
+// booleans to 0/1, durations to seconds, sizes to bytes and timestamps to seconds since the epoch.
+func parseValue(format, s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	switch format {
+	case config.ValueFormatBool:
+		return parseBool(s)
+	case config.ValueFormatDuration:
+		return parseDuration(s)
+	case config.ValueFormatSize:
+		return parseSize(s)
+	case config.ValueFormatTimestamp:
+		return parseTimestamp(s)
+	default:
+		var v float64Value
+		if err := v.parse(s); err != nil {
+			return 0, err
+		}
+		return float64(v), nil
+	}
+}
+
+// parseBool parses a boolean (as accepted by strconv.ParseBool, plus ON/OFF and YES/NO) as 1 or 0.
+func parseBool(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "on", "yes":
+		return 1, nil
+	case "off", "no":
+		return 0, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return 0, fmt.Errorf("converting %q to bool: %s", s, err)
+	}
+	if b {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+var (
+	// E.g. MySQL TIME ("838:59:59") or PostgreSQL interval ("1 day 02:03:04.5", "-3 days -00:00:01").
+	clockDurationRE = regexp.MustCompile(`^(?:([+-]?\d+) days? ?)?([+-])?(\d+):(\d{2}):(\d{2}(?:\.\d+)?)$`)
+	// ISO 8601 durations, without years or months (which have no fixed length), e.g. "P1DT2H30M", "PT0.5S".
+	isoDurationRE = regexp.MustCompile(`^([+-])?P(?:(\d+(?:\.\d+)?)W)?(?:(\d+(?:\.\d+)?)D)?` +
+		`(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+)
+
+// parseDuration parses a Go ("1h30m"), clock ("[N days ]HH:MM:SS[.fff]") or ISO 8601 ("PT1H30M") duration, or a plain
+// number of seconds, as seconds.
+func parseDuration(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Seconds(), nil
+	}
+	if m := clockDurationRE.FindStringSubmatch(s); m != nil {
+		hours, _ := strconv.ParseFloat(m[3], 64)
+		minutes, _ := strconv.ParseFloat(m[4], 64)
+		seconds, _ := strconv.ParseFloat(m[5], 64)
+		v := hours*3600 + minutes*60 + seconds
+		if m[2] == "-" {
+			v = -v
+		}
+		if m[1] != "" {
+			days, _ := strconv.ParseFloat(m[1], 64)
+			v += days * 86400
+		}
+		return v, nil
+	}
+	if m := isoDurationRE.FindStringSubmatch(s); m != nil && s != "P" && !strings.HasSuffix(s, "T") {
+		v := 0.0
+		for i, unit := range []float64{7 * 86400, 86400, 3600, 60, 1} {
+			if m[i+2] != "" {
+				f, _ := strconv.ParseFloat(m[i+2], 64)
+				v += f * unit
+			}
+		}
+		if m[1] == "-" {
+			v = -v
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("converting %q to duration: unsupported format", s)
+}
+
+// sizeRE matches a number followed by an optional size unit, e.g. "10 MB", "8kB", "1.5GiB".
+var sizeRE = regexp.MustCompile(`^([+-]?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?)\s*([a-zA-Z]*)$`)
+
+// sizeUnits maps lowercase size units to their multipliers. As with database settings (e.g. PostgreSQL's and MySQL's),
+// kB, MB etc. are powers of 1024, same as KiB, MiB etc.
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1, "byte": 1, "bytes": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+	"p": 1 << 50, "pb": 1 << 50, "pib": 1 << 50,
+}
+
+// parseSize parses a human readable size ("10 MB", "8kB", "1.5 GiB") or a plain number of bytes, as bytes.
+func parseSize(s string) (float64, error) {
+	m := sizeRE.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("converting %q to size: unsupported format", s)
+	}
+	unit, found := sizeUnits[strings.ToLower(m[2])]
+	if !found {
+		return 0, fmt.Errorf("converting %q to size: unknown unit %q", s, m[2])
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("converting %q to size: %s", s, err)
+	}
+	return f * unit, nil
+}
+
+// timestampLayouts are the timestamp formats accepted by parseTimestamp, in the order they are tried. Timestamps
+// without a time zone are assumed to be UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// parseTimestamp parses a timestamp (RFC 3339 or SQL style, e.g. "2006-01-02 15:04:05+07") or a plain number of
+// seconds since the epoch, as seconds since the epoch.
+func parseTimestamp(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return float64(t.UnixNano()) / 1e9, nil
+		}
+	}
+	return 0, fmt.Errorf("converting %q to timestamp: unsupported format", s)
+}
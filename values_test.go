@@ -0,0 +1,68 @@
+package sql_exporter
+
+import (
+	"testing"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// TestParseValue checks the conversion of values in each value_format.
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		format, s string
+		want      float64
+	}{
+		{"", "1.5", 1.5},
+
+		{config.ValueFormatBool, "true", 1},
+		{config.ValueFormatBool, "f", 0},
+		{config.ValueFormatBool, "ON", 1},
+		{config.ValueFormatBool, " no ", 0},
+
+		{config.ValueFormatDuration, "90", 90},
+		{config.ValueFormatDuration, "1h30m", 5400},
+		{config.ValueFormatDuration, "838:59:59", 838*3600 + 59*60 + 59},
+		{config.ValueFormatDuration, "1 day 02:03:04.5", 86400 + 2*3600 + 3*60 + 4.5},
+		{config.ValueFormatDuration, "-00:00:01", -1},
+		{config.ValueFormatDuration, "P1DT2H30M", 86400 + 2*3600 + 30*60},
+		{config.ValueFormatDuration, "PT0.5S", 0.5},
+
+		{config.ValueFormatSize, "512", 512},
+		{config.ValueFormatSize, "8kB", 8 << 10},
+		{config.ValueFormatSize, "10 MB", 10 << 20},
+		{config.ValueFormatSize, "1.5GiB", 1.5 * (1 << 30)},
+
+		{config.ValueFormatTimestamp, "1500000000", 1500000000},
+		{config.ValueFormatTimestamp, "2017-07-14T02:40:00Z", 1500000000},
+		{config.ValueFormatTimestamp, "2017-07-14 04:40:00+02", 1500000000},
+		{config.ValueFormatTimestamp, "2017-07-14 02:40:00.5", 1500000000.5},
+		{config.ValueFormatTimestamp, "2017-07-14", 1499990400},
+	}
+	for _, test := range tests {
+		got, err := parseValue(test.format, test.s)
+		if err != nil {
+			t.Errorf("parseValue(%q, %q): %s", test.format, test.s, err)
+		} else if got != test.want {
+			t.Errorf("parseValue(%q, %q) = %g, want %g", test.format, test.s, got, test.want)
+		}
+	}
+}
+
+// TestParseValueErrors checks that values not in the expected value_format are rejected.
+func TestParseValueErrors(t *testing.T) {
+	tests := []struct {
+		format, s string
+	}{
+		{"", "abc"},
+		{config.ValueFormatBool, "maybe"},
+		{config.ValueFormatDuration, "1 fortnight"},
+		{config.ValueFormatDuration, "P"},
+		{config.ValueFormatSize, "10 parsecs"},
+		{config.ValueFormatTimestamp, "yesterday"},
+	}
+	for _, test := range tests {
+		if got, err := parseValue(test.format, test.s); err == nil {
+			t.Errorf("parseValue(%q, %q) = %g, want error", test.format, test.s, got)
+		}
+	}
+}